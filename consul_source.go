@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// consulRouteSource loads backends and routes from the Consul KV store. Each
+// backend is stored as a JSON document under <prefix>/backends/, and each
+// route as a JSON document under <prefix>/routes/, using the same field names
+// as the mongo collections.
+type consulRouteSource struct {
+	url      string
+	prefix   string
+	debounce time.Duration
+	wait     time.Duration
+	client   *http.Client
+}
+
+// consulWatchWait is how long a blocking query waits for changes before
+// returning with an unchanged index.
+const consulWatchWait = 5 * time.Minute
+
+// NewConsulRouteSource returns a RouteSource which reads from the Consul agent
+// at consulUrl. Changes seen by Watch are debounced by the given period.
+func NewConsulRouteSource(consulUrl, prefix string, debounce time.Duration) *consulRouteSource {
+	return &consulRouteSource{
+		url:      strings.TrimRight(consulUrl, "/"),
+		prefix:   strings.Trim(prefix, "/"),
+		debounce: debounce,
+		wait:     consulWatchWait,
+		client:   &http.Client{Timeout: consulWatchWait + time.Minute},
+	}
+}
+
+func (s *consulRouteSource) Load() (backends []Backend, routes []Route, err error) {
+	pairs, _, err := s.get(context.Background(), 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	backends, routes, err = routesFromKV(s.prefix, pairs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("consul: %w", err)
+	}
+	return backends, routes, nil
+}
+
+// Watch uses consul blocking queries to wait for changes to the keys under
+// the prefix, calling reload once they have settled for the debounce period.
+func (s *consulRouteSource) Watch(ctx context.Context, reload func()) {
+	changes := make(chan struct{}, 1)
+	go debounceChanges(ctx, changes, s.debounce, reload)
+
+	var index uint64
+	for ctx.Err() == nil {
+		_, newIndex, err := s.get(ctx, index)
+		if err != nil {
+			if ctx.Err() == nil {
+				logWarn("router: error watching consul for route changes:", err)
+				sleepContext(ctx, time.Second)
+			}
+			continue
+		}
+
+		if index != 0 && newIndex != index {
+			notifyChange(changes)
+		}
+		if newIndex < index {
+			// The index went backwards (e.g. the consul state was reset), so
+			// start again from the current index.
+			newIndex = 0
+		}
+		index = newIndex
+	}
+}
+
+// get fetches all the keys under the prefix. If index is non-zero, this is a
+// blocking query which returns when the keys have changed since that index,
+// or after the source's wait time has elapsed.
+func (s *consulRouteSource) get(ctx context.Context, index uint64) (pairs []kvPair, newIndex uint64, err error) {
+	params := url.Values{"recurse": {""}}
+	if index > 0 {
+		params.Set("index", strconv.FormatUint(index, 10))
+		params.Set("wait", fmt.Sprintf("%dms", s.wait/time.Millisecond))
+	}
+	// The trailing slash stops "router" also matching e.g. "router-staging".
+	req, err := http.NewRequestWithContext(ctx, "GET", s.url+"/v1/kv/"+s.prefix+"/?"+params.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("consul: %w", err)
+	}
+	defer resp.Body.Close()
+
+	newIndex, err = strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil || newIndex == 0 {
+		return nil, 0, fmt.Errorf("consul: response has no valid X-Consul-Index header")
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(&pairs); err != nil {
+			return nil, 0, fmt.Errorf("consul: couldn't parse response: %v", err)
+		}
+		return pairs, newIndex, nil
+	case http.StatusNotFound:
+		// No keys under the prefix.
+		return nil, newIndex, nil
+	default:
+		return nil, 0, fmt.Errorf("consul: unexpected response status %s", resp.Status)
+	}
+}
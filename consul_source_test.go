@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul implements just enough of the consul KV HTTP API, including
+// blocking queries, to exercise consulRouteSource.
+type fakeConsul struct {
+	mu       sync.Mutex
+	index    uint64
+	kv       map[string]string
+	modified map[string]uint64
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{index: 1, kv: make(map[string]string), modified: make(map[string]uint64)}
+}
+
+func (fc *fakeConsul) put(key, value string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.index++
+	fc.kv[key] = value
+	fc.modified[key] = fc.index
+}
+
+// keys returns the keys matching prefix, and the index at which any of them
+// was last modified. Like consul, the prefix is a plain string prefix.
+func (fc *fakeConsul) keys(prefix string) (keys []string, index uint64) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	index = 1
+	for k := range fc.kv {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+			if fc.modified[k] > index {
+				index = fc.modified[k]
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, index
+}
+
+func (fc *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	if index, err := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); err == nil {
+		wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+		timeout := time.After(wait)
+	wait:
+		for {
+			if _, current := fc.keys(prefix); current != index {
+				break
+			}
+			select {
+			case <-r.Context().Done():
+				return
+			case <-timeout:
+				break wait
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}
+
+	keys, index := fc.keys(prefix)
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	if len(keys) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	pairs := make([]kvPair, 0)
+	for _, k := range keys {
+		pairs = append(pairs, kvPair{k, []byte(fc.kv[k])})
+	}
+	json.NewEncoder(w).Encode(pairs)
+}
+
+func TestConsulRouteSourceLoad(t *testing.T) {
+	fc := newFakeConsul()
+	fc.put("router/backends/foo", `{"backend_id": "foo", "backend_url": "http://foo.example.com/"}`)
+	fc.put("router/routes/b", `{"incoming_path": "/foo", "route_type": "prefix", "handler": "backend", "backend_id": "foo"}`)
+	fc.put("router/routes/a", `{"incoming_path": "/foo", "route_type": "exact", "handler": "gone"}`)
+	fc.put("router/routes/c", `{"incoming_path": "/bar", "route_type": "exact", "handler": "redirect", "redirect_to": "/baz"}`)
+	fc.put("router-staging/routes/d", `{"incoming_path": "/staging", "route_type": "exact", "handler": "gone"}`)
+	fc.put("other/routes/e", `{"incoming_path": "/other", "route_type": "exact", "handler": "gone"}`)
+	server := httptest.NewServer(fc)
+	defer server.Close()
+
+	backends, routes, err := NewConsulRouteSource(server.URL, "/router/", time.Second).Load()
+	if err != nil {
+		t.Fatalf("Unexpected error loading routes: %v", err)
+	}
+	checkLoadedRoutes(t, backends, routes)
+}
+
+// checkLoadedRoutes checks the routes set up by the consul and etcd load
+// tests, and that they have been sorted like the mongo query sorts them.
+func checkLoadedRoutes(t *testing.T, backends []Backend, routes []Route) {
+	if len(backends) != 1 || !reflect.DeepEqual(backends[0], Backend{BackendId: "foo", BackendURL: "http://foo.example.com/"}) {
+		t.Errorf("Unexpected backends loaded: %+v", backends)
+	}
+
+	expected := []struct{ path, routeType string }{
+		{"/bar", "exact"},
+		{"/foo", "exact"},
+		{"/foo", "prefix"},
+	}
+	if len(routes) != len(expected) {
+		t.Fatalf("Expected %d routes, got %+v", len(expected), routes)
+	}
+	for i, e := range expected {
+		if routes[i].IncomingPath != e.path || routes[i].RouteType != e.routeType {
+			t.Errorf("Expected route %d to be %s (%s), got %+v", i, e.path, e.routeType, routes[i])
+		}
+	}
+	if routes[0].RedirectTo != "/baz" {
+		t.Errorf("Expected redirect_to to be loaded, got %+v", routes[0])
+	}
+}
+
+func TestConsulRouteSourceLoadEmpty(t *testing.T) {
+	server := httptest.NewServer(newFakeConsul())
+	defer server.Close()
+
+	backends, routes, err := NewConsulRouteSource(server.URL, "router", time.Second).Load()
+	if err != nil || len(backends) != 0 || len(routes) != 0 {
+		t.Errorf("Expected no backends, routes or error, got %v, %v, %v", backends, routes, err)
+	}
+}
+
+// expectReloads checks that exactly n reloads arrive within the timeout.
+func expectReloads(t *testing.T, reloads <-chan struct{}, n int, timeout time.Duration) {
+	deadline := time.After(timeout)
+	count := 0
+	for {
+		select {
+		case <-reloads:
+			count++
+		case <-deadline:
+			if count != n {
+				t.Errorf("Expected %d reloads, got %d", n, count)
+			}
+			return
+		}
+	}
+}
+
+func TestConsulRouteSourceWatch(t *testing.T) {
+	fc := newFakeConsul()
+	fc.put("router/routes/a", `{"incoming_path": "/foo", "route_type": "exact", "handler": "gone"}`)
+	server := httptest.NewServer(fc)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reloads := make(chan struct{}, 10)
+	source := NewConsulRouteSource(server.URL, "router", 100*time.Millisecond)
+	source.wait = 50 * time.Millisecond
+	go source.Watch(ctx, func() { reloads <- struct{}{} })
+
+	expectReloads(t, reloads, 0, 200*time.Millisecond)
+
+	// Keys which merely share the prefix string shouldn't trigger reloads.
+	fc.put("router-staging/routes/b", `{"incoming_path": "/bar", "route_type": "exact", "handler": "gone"}`)
+	expectReloads(t, reloads, 0, 300*time.Millisecond)
+
+	// A burst of changes should be debounced into a single reload.
+	for i := 0; i < 3; i++ {
+		fc.put("router/routes/b", `{"incoming_path": "/bar", "route_type": "exact", "handler": "gone"}`)
+		time.Sleep(30 * time.Millisecond)
+	}
+	expectReloads(t, reloads, 1, 500*time.Millisecond)
+}
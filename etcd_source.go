@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// etcdRouteSource loads backends and routes from etcd (v3), using the JSON
+// gateway which etcd serves alongside its gRPC API. Keys are laid out in the
+// same way as for consulRouteSource.
+type etcdRouteSource struct {
+	url      string
+	prefix   string
+	debounce time.Duration
+	client   *http.Client
+}
+
+type etcdKeyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type etcdRangeResponse struct {
+	Kvs []etcdKeyValue `json:"kvs"`
+}
+
+type etcdWatchResponse struct {
+	Result struct {
+		Created bool          `json:"created"`
+		Events  []interface{} `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// NewEtcdRouteSource returns a RouteSource which reads from the etcd cluster
+// at etcdUrl. Changes seen by Watch are debounced by the given period.
+func NewEtcdRouteSource(etcdUrl, prefix string, debounce time.Duration) *etcdRouteSource {
+	return &etcdRouteSource{
+		url:      strings.TrimRight(etcdUrl, "/"),
+		prefix:   strings.Trim(prefix, "/"),
+		debounce: debounce,
+		client:   &http.Client{},
+	}
+}
+
+// keyRange returns the (base64 encoded, by encoding/json) key range covering
+// everything under the prefix.
+func (s *etcdRouteSource) keyRange() map[string][]byte {
+	key := []byte(s.prefix + "/")
+	rangeEnd := append([]byte(s.prefix), '/'+1)
+	return map[string][]byte{"key": key, "range_end": rangeEnd}
+}
+
+func (s *etcdRouteSource) post(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("etcd: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("etcd: unexpected response status %s", resp.Status)
+	}
+	return resp, nil
+}
+
+func (s *etcdRouteSource) Load() (backends []Backend, routes []Route, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	resp, err := s.post(ctx, "/v3/kv/range", s.keyRange())
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	var result etcdRangeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, nil, fmt.Errorf("etcd: couldn't parse response: %v", err)
+	}
+	pairs := make([]kvPair, len(result.Kvs))
+	for i, kv := range result.Kvs {
+		pairs[i] = kvPair{string(kv.Key), kv.Value}
+	}
+
+	backends, routes, err = routesFromKV(s.prefix, pairs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("etcd: %w", err)
+	}
+	return backends, routes, nil
+}
+
+// Watch opens an etcd watch on the prefix, calling reload once changes have
+// settled for the debounce period. If the watch is interrupted it is
+// re-established, and a reload is triggered in case changes were missed.
+func (s *etcdRouteSource) Watch(ctx context.Context, reload func()) {
+	changes := make(chan struct{}, 1)
+	go debounceChanges(ctx, changes, s.debounce, reload)
+
+	reconnecting := false
+	for ctx.Err() == nil {
+		err := s.watch(ctx, changes, reconnecting)
+		if ctx.Err() != nil {
+			return
+		}
+		logWarn("router: error watching etcd for route changes:", err)
+		reconnecting = true
+		sleepContext(ctx, time.Second)
+	}
+}
+
+func (s *etcdRouteSource) watch(ctx context.Context, changes chan<- struct{}, reconnecting bool) error {
+	resp, err := s.post(ctx, "/v3/watch", map[string]interface{}{"create_request": s.keyRange()})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg etcdWatchResponse
+		if err := decoder.Decode(&msg); err != nil {
+			return fmt.Errorf("etcd: watch stream ended: %v", err)
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("etcd: %s", msg.Error.Message)
+		}
+		if (msg.Result.Created && reconnecting) || len(msg.Result.Events) > 0 {
+			notifyChange(changes)
+		}
+	}
+}
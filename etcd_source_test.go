@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd implements just enough of the etcd v3 JSON gateway (range
+// requests and watches) to exercise etcdRouteSource.
+type fakeEtcd struct {
+	mu       sync.Mutex
+	kv       map[string]string
+	watchers []chan string
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{kv: make(map[string]string)}
+}
+
+func (fe *fakeEtcd) put(key, value string) {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	fe.kv[key] = value
+	for _, w := range fe.watchers {
+		w <- key
+	}
+}
+
+func (fe *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body map[string]map[string][]byte
+	var keyRange map[string][]byte
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		json.NewDecoder(r.Body).Decode(&keyRange)
+	case "/v3/watch":
+		json.NewDecoder(r.Body).Decode(&body)
+		keyRange = body["create_request"]
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	start, end := string(keyRange["key"]), string(keyRange["range_end"])
+	inRange := func(k string) bool { return k >= start && k < end }
+
+	if r.URL.Path == "/v3/kv/range" {
+		fe.mu.Lock()
+		defer fe.mu.Unlock()
+		kvs := make([]etcdKeyValue, 0)
+		for k, v := range fe.kv {
+			if inRange(k) {
+				kvs = append(kvs, etcdKeyValue{[]byte(k), []byte(v)})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"kvs": kvs})
+		return
+	}
+
+	changes := make(chan string, 10)
+	fe.mu.Lock()
+	fe.watchers = append(fe.watchers, changes)
+	fe.mu.Unlock()
+
+	enc := json.NewEncoder(w)
+	enc.Encode(map[string]interface{}{"result": map[string]interface{}{"created": true}})
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case key := <-changes:
+			if inRange(key) {
+				enc.Encode(map[string]interface{}{"result": map[string]interface{}{
+					"events": []interface{}{map[string]interface{}{"kv": map[string][]byte{"key": []byte(key)}}},
+				}})
+				w.(http.Flusher).Flush()
+			}
+		}
+	}
+}
+
+func TestEtcdRouteSourceLoad(t *testing.T) {
+	fe := newFakeEtcd()
+	fe.put("router/backends/foo", `{"backend_id": "foo", "backend_url": "http://foo.example.com/"}`)
+	fe.put("router/routes/b", `{"incoming_path": "/foo", "route_type": "prefix", "handler": "backend", "backend_id": "foo"}`)
+	fe.put("router/routes/a", `{"incoming_path": "/foo", "route_type": "exact", "handler": "gone"}`)
+	fe.put("router/routes/c", `{"incoming_path": "/bar", "route_type": "exact", "handler": "redirect", "redirect_to": "/baz"}`)
+	fe.put("router-staging/routes/d", `{"incoming_path": "/staging", "route_type": "exact", "handler": "gone"}`)
+	server := httptest.NewServer(fe)
+	defer server.Close()
+
+	backends, routes, err := NewEtcdRouteSource(server.URL, "router", time.Second).Load()
+	if err != nil {
+		t.Fatalf("Unexpected error loading routes: %v", err)
+	}
+	checkLoadedRoutes(t, backends, routes)
+}
+
+func TestEtcdRouteSourceWatch(t *testing.T) {
+	fe := newFakeEtcd()
+	server := httptest.NewServer(fe)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reloads := make(chan struct{}, 10)
+	go NewEtcdRouteSource(server.URL, "router", 100*time.Millisecond).Watch(ctx, func() { reloads <- struct{}{} })
+
+	expectReloads(t, reloads, 0, 200*time.Millisecond)
+
+	fe.put("router-staging/routes/b", `{"incoming_path": "/bar", "route_type": "exact", "handler": "gone"}`)
+	expectReloads(t, reloads, 0, 300*time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		fe.put("router/routes/b", `{"incoming_path": "/bar", "route_type": "exact", "handler": "gone"}`)
+		time.Sleep(30 * time.Millisecond)
+	}
+	expectReloads(t, reloads, 1, 500*time.Millisecond)
+}
+
+func TestEtcdKeyRange(t *testing.T) {
+	r := NewEtcdRouteSource("http://localhost:2379", "/router/", time.Second).keyRange()
+	if string(r["key"]) != "router/" || string(r["range_end"]) != "router0" {
+		t.Errorf("Unexpected key range %q - %q", r["key"], r["range_end"])
+	}
+	if !strings.HasPrefix("router/routes/a", string(r["key"])) {
+		t.Error("Expected routes to fall within the key range")
+	}
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"context"
+	"github.com/alphagov/router/logger"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// AccessLogSample says which of the requests that complete normally are
+// written to the access log. Every > 1 logs every Nth request (starting with
+// the first), and Percent > 0 logs that percentage of requests at random.
+// The zero value logs every request.
+type AccessLogSample struct {
+	Every   int
+	Percent float64
+}
+
+// AccessLogExclude lists the paths whose requests aren't written to the
+// access log, such as health checks and metrics scrapes. Paths must match
+// exactly, while Prefixes exclude every path starting with one of them.
+// Responses with a 5xx status are still logged unless DropErrors is set.
+type AccessLogExclude struct {
+	Paths      map[string]bool
+	Prefixes   []string
+	DropErrors bool
+}
+
+// excludes reports whether requests for path aren't logged.
+func (e *AccessLogExclude) excludes(path string) bool {
+	if e.Paths[path] {
+		return true
+	}
+	for _, prefix := range e.Prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewAccessLogHandler wraps a handler so that its requests are logged to the
+// passed logger once they have been served, subject to sample. Responses
+// with a 5xx status, and requests taking at least slow to serve (if slow is
+// positive), are always logged, except for requests to paths which exclude
+// (if not nil) says aren't.
+func NewAccessLogHandler(handler http.Handler, logger logger.Logger, sample AccessLogSample, slow time.Duration, exclude *AccessLogExclude) http.Handler {
+	return &accessLogHandler{handler: handler, logger: logger, sample: sample, slow: slow, exclude: exclude}
+}
+
+type accessLogHandler struct {
+	handler http.Handler
+	logger  logger.Logger
+	sample  AccessLogSample
+	slow    time.Duration
+	exclude *AccessLogExclude
+	count   atomic.Uint64
+}
+
+// accessLogFieldsKey is the context key under which the fields added with
+// AddAccessLogField are kept.
+type accessLogFieldsKey struct{}
+
+// AddAccessLogField adds a field to the access log entry for a request, if
+// it is being served through an access-logging handler.
+func AddAccessLogField(r *http.Request, key string, value interface{}) {
+	if fields, ok := r.Context().Value(accessLogFieldsKey{}).(map[string]interface{}); ok {
+		fields[key] = value
+	}
+}
+
+func (h *accessLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The path is checked before the request is served, as the handler may
+	// change it.
+	excluded := h.exclude != nil && h.exclude.excludes(r.URL.Path)
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	fields := make(map[string]interface{})
+	h.handler.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), accessLogFieldsKey{}, fields)))
+	elapsed := time.Since(start)
+
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	if excluded && (sw.status < 500 || h.exclude.DropErrors) {
+		return
+	}
+	if sw.status < 500 && (h.slow <= 0 || elapsed < h.slow) && !h.sampled() {
+		return
+	}
+	fields["status"] = sw.status
+	fields["bytes_sent"] = sw.bytes
+	fields["request_time"] = elapsed.Seconds()
+	fields["remote_addr"] = r.RemoteAddr
+	h.logger.LogFromClientRequest(fields, r)
+}
+
+// sampled decides whether a request which completed normally is logged.
+func (h *accessLogHandler) sampled() bool {
+	switch {
+	case h.sample.Percent > 0:
+		return rand.Float64()*100 < h.sample.Percent
+	case h.sample.Every > 1:
+		return (h.count.Add(1)-1)%uint64(h.sample.Every) == 0
+	default:
+		return true
+	}
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"bytes"
+	"github.com/alphagov/router/logger"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countAccessLogs serves requests through an access-logging handler and
+// returns the number of entries logged.
+func countAccessLogs(handler http.Handler, sample AccessLogSample, slow time.Duration, requests int) int {
+	var buf bytes.Buffer
+	l, _ := logger.New(&buf)
+	logged := NewAccessLogHandler(handler, l, sample, slow, nil)
+	for i := 0; i < requests; i++ {
+		logged.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil))
+	}
+	l.Flush()
+	return strings.Count(buf.String(), "\n")
+}
+
+func TestAccessLogEntry(t *testing.T) {
+	var buf bytes.Buffer
+	l, _ := logger.New(&buf)
+	handler := NewAccessLogHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("not here"))
+	}), l, AccessLogSample{}, 0, nil)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo?bar=baz", nil))
+	l.Flush()
+
+	for _, field := range []string{`"status":404`, `"bytes_sent":8`, `"request":"GET /foo HTTP/1.1"`, `"request_time":`} {
+		if !strings.Contains(buf.String(), field) {
+			t.Errorf("Expected the access log entry to contain %s, got %q", field, buf.String())
+		}
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	failing := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(2 * time.Millisecond)
+	})
+
+	examples := []struct {
+		name     string
+		handler  http.Handler
+		sample   AccessLogSample
+		slow     time.Duration
+		requests int
+		min, max int
+	}{
+		{"unsampled", ok, AccessLogSample{}, 0, 100, 100, 100},
+		{"every 10th", ok, AccessLogSample{Every: 10}, 0, 100, 10, 10},
+		{"every 10th, not a multiple", ok, AccessLogSample{Every: 10}, 0, 95, 10, 10},
+		{"10 percent", ok, AccessLogSample{Percent: 10}, 0, 10000, 800, 1200},
+		{"100 percent", ok, AccessLogSample{Percent: 100}, 0, 100, 100, 100},
+		{"errors", failing, AccessLogSample{Every: 1000}, 0, 100, 100, 100},
+		{"errors by percentage", failing, AccessLogSample{Percent: 0.1}, 0, 100, 100, 100},
+		{"slow", slow, AccessLogSample{Every: 1000}, time.Millisecond, 20, 20, 20},
+		{"not slow", ok, AccessLogSample{Every: 1000}, time.Second, 100, 1, 1},
+	}
+	for _, ex := range examples {
+		if n := countAccessLogs(ex.handler, ex.sample, ex.slow, ex.requests); n < ex.min || n > ex.max {
+			t.Errorf("%s: expected between %d and %d of %d requests to be logged, got %d", ex.name, ex.min, ex.max, ex.requests, n)
+		}
+	}
+}
+
+func TestAccessLogExclude(t *testing.T) {
+	var buf bytes.Buffer
+	l, _ := logger.New(&buf)
+	status := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	exclude := &AccessLogExclude{Paths: map[string]bool{"/healthcheck": true}, Prefixes: []string{"/metrics"}}
+
+	examples := []struct {
+		path       string
+		dropErrors bool
+		logged     bool
+	}{
+		{"/healthcheck", false, false},
+		{"/healthcheck/deep", false, true},
+		{"/metrics", false, false},
+		{"/metrics/router", false, false},
+		{"/foo", false, true},
+		{"/foo/healthcheck", false, true},
+		{"/healthcheck?fail=1", false, true},
+		{"/metrics?fail=1", false, true},
+		{"/healthcheck?fail=1", true, false},
+		{"/foo?fail=1", true, true},
+	}
+	for _, ex := range examples {
+		buf.Reset()
+		exclude.DropErrors = ex.dropErrors
+		NewAccessLogHandler(status, l, AccessLogSample{}, 0, exclude).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", ex.path, nil))
+		l.Flush()
+		if logged := buf.Len() > 0; logged != ex.logged {
+			t.Errorf("%s (dropping errors: %v): expected logged to be %v, got %q", ex.path, ex.dropErrors, ex.logged, buf.String())
+		}
+	}
+}
@@ -1,29 +1,72 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/alphagov/router/logger"
+	"github.com/alphagov/router/tracing"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
-func NewBackendHandler(backendUrl *url.URL, connectTimeout, headerTimeout time.Duration, logger logger.Logger) http.Handler {
+// NewBackendHandler returns a handler which proxies requests to the backend at
+// backendUrl. If dnsCache is not nil, it is used to resolve the backend's
+// hostname. New connections wait up to connectTimeout for the TCP connection
+// to open and then, for https backends, up to tlsHandshakeTimeout (or no
+// limit, if it's zero) for the TLS handshake. Requests wait up to
+// headerTimeout (or no limit, if it's zero) for the backend's response
+// headers, unless they have been passed through WithHeaderTimeout. Responses
+// are flushed to the client every flushInterval as they're copied, or after
+// every write if it's negative; if it's zero, only streaming responses
+// (server-sent events, and those without a Content-Length) are flushed as
+// they arrive. If h2c is set, requests are made with HTTP/2 (without an
+// upgrade from HTTP/1.1 for plain http backends), so that they can share a
+// single connection to the backend.
+func NewBackendHandler(backendUrl *url.URL, connectTimeout, tlsHandshakeTimeout, headerTimeout, flushInterval time.Duration, dnsCache *DNSCache, h2c bool, logger logger.Logger) http.Handler {
 	proxy := httputil.NewSingleHostReverseProxy(backendUrl)
-	proxy.Transport = newBackendTransport(connectTimeout, headerTimeout, logger)
+	proxy.FlushInterval = flushInterval
+	transport := newBackendTransport(connectTimeout, tlsHandshakeTimeout, headerTimeout, dnsCache, h2c, logger)
+	proxy.Transport = transport
 
 	defaultDirector := proxy.Director
 	proxy.Director = func(req *http.Request) {
 		defaultDirector(req)
 
-		// Set the Host header to match the backend hostname instead of the one from the incoming request.
+		// At the edge, the forwarding headers describe the client's own
+		// connection, and are set before the Host is changed.
+		if edge, _ := req.Context().Value(edgeKey{}).(bool); edge {
+			resetForwardedHeaders(req)
+		}
+
+		// Set the Host header to match the backend hostname instead of the
+		// one from the incoming request, unless the handler has been wrapped
+		// with WithHost or WithClientHost.
 		req.Host = backendUrl.Host
+		if host, ok := req.Context().Value(hostKey{}).(string); ok && host != "" {
+			req.Host = host
+		}
+
+		// Replace or extend the client's User-Agent if the handler has been
+		// wrapped with WithUserAgent or WithUserAgentSuffix.
+		if ua, ok := req.Context().Value(userAgentKey{}).(userAgentOverride); ok {
+			if client := req.Header.Get("User-Agent"); ua.suffix && client != "" {
+				req.Header.Set("User-Agent", client+" "+ua.value)
+			} else {
+				req.Header.Set("User-Agent", ua.value)
+			}
+		}
 
 		// Setting a blank User-Agent causes the http lib not to output one, whereas if there
 		// is no header, it will output a default one.
@@ -33,9 +76,46 @@ func NewBackendHandler(backendUrl *url.URL, connectTimeout, headerTimeout time.D
 		}
 
 		populateViaHeader(req.Header, fmt.Sprintf("%d.%d", req.ProtoMajor, req.ProtoMinor))
+
+		// Pass on the trace context (if tracing is enabled) so that the
+		// backend's spans are children of the router's.
+		tracing.Inject(req)
 	}
 
-	return proxy
+	return &backendHandler{proxy, transport, backendUrl, logger}
+}
+
+// backendHandler proxies requests to a backend, opening tunnels to it for
+// CONNECT requests.
+type backendHandler struct {
+	proxy      *httputil.ReverseProxy
+	transport  *backendTransport
+	backendUrl *url.URL
+	logger     logger.Logger
+}
+
+func (h *backendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		h.proxy.ServeHTTP(w, r)
+		return
+	}
+	// Tunnels are only opened for routes which have asked for them.
+	if allowed, _ := r.Context().Value(connectKey{}).(bool); !allowed {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	tunnel(w, r, h.transport.wrapped.DialContext, backendAddr(h.backendUrl), h.logger)
+}
+
+// backendAddr returns the host and port to connect to for a backend URL.
+func backendAddr(backendUrl *url.URL) string {
+	if backendUrl.Port() != "" {
+		return backendUrl.Host
+	}
+	if backendUrl.Scheme == "https" {
+		return net.JoinHostPort(backendUrl.Hostname(), "443")
+	}
+	return net.JoinHostPort(backendUrl.Hostname(), "80")
 }
 
 func populateViaHeader(header http.Header, httpVersion string) {
@@ -46,39 +126,393 @@ func populateViaHeader(header http.Header, httpVersion string) {
 	header.Set("Via", via)
 }
 
+type headerTimeoutKey struct{}
+
+// WithHeaderTimeout wraps a backend handler so that the requests passed
+// through it wait up to timeout for the backend's response headers, in place
+// of the header timeout the backend handler was created with. It allows one
+// backend handler (and its connection pool) to be shared by routes with
+// different timeouts.
+func WithHeaderTimeout(handler http.Handler, timeout time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), headerTimeoutKey{}, timeout)))
+	})
+}
+
+type timeoutHeaderKey struct{}
+
+// WithTimeoutHeader wraps a handler so that the backend requests made while
+// serving it carry the named header, giving the time left before the
+// request's deadline in milliseconds. Cooperative backends can use it to
+// give up on work whose response won't be waited for.
+func WithTimeoutHeader(handler http.Handler, header string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), timeoutHeaderKey{}, header)))
+	})
+}
+
+type hostKey struct{}
+
+// WithHost wraps a backend handler so that the requests passed through it
+// are sent with the passed Host header, rather than the host of the
+// backend's URL, for backends which serve several virtual hosts.
+func WithHost(handler http.Handler, host string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), hostKey{}, host)))
+	})
+}
+
+// WithClientHost wraps a backend handler so that the requests passed through
+// it keep the Host header sent by the client, rather than being given the
+// host of the backend's URL.
+func WithClientHost(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), hostKey{}, r.Host)))
+	})
+}
+
+type userAgentKey struct{}
+
+// userAgentOverride is the User-Agent to send to a backend, or if suffix is
+// set, the text to add to the end of the client's.
+type userAgentOverride struct {
+	value  string
+	suffix bool
+}
+
+// WithUserAgent wraps a backend handler so that the requests passed through
+// it are sent with the passed User-Agent, rather than the client's, for
+// backends which behave differently for different clients.
+func WithUserAgent(handler http.Handler, userAgent string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userAgentKey{}, userAgentOverride{userAgent, false})))
+	})
+}
+
+// WithUserAgentSuffix wraps a backend handler so that the requests passed
+// through it have suffix (such as "via router") added to the end of the
+// client's User-Agent, separated by a space. Requests without a User-Agent
+// are sent with the suffix alone.
+func WithUserAgentSuffix(handler http.Handler, suffix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userAgentKey{}, userAgentOverride{suffix, true})))
+	})
+}
+
+type edgeKey struct{}
+
+// AtEdge wraps a backend handler for a router which clients connect to
+// directly, with no proxy in front of it, so that the X-Forwarded-For,
+// X-Forwarded-Proto and X-Forwarded-Host headers the client sent can't be
+// trusted. They are replaced with the client's address, the scheme of its
+// connection and the Host it asked for, rather than being appended to or
+// passed on.
+func AtEdge(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), edgeKey{}, true)))
+	})
+}
+
+// resetForwardedHeaders replaces the forwarding headers of a request to a
+// backend with ones describing the client's own connection. The proxy adds
+// the client's address to X-Forwarded-For once the header is removed.
+func resetForwardedHeaders(req *http.Request) {
+	req.Header.Del("X-Forwarded-For")
+	req.Header.Set("X-Forwarded-Proto", RequestScheme(req, nil))
+	req.Header.Set("X-Forwarded-Host", req.Host)
+}
+
+type maxResponseBytesKey struct{}
+
+// WithMaxResponseBytes wraps a backend handler so that the response bodies
+// it proxies are limited to maxBytes. A response whose Content-Length is
+// over the limit is answered with a 502 instead. Otherwise, as the status
+// has already been sent, a body which turns out to be longer is cut off at
+// the limit and the connection to the client aborted. Either way it's
+// logged.
+func WithMaxResponseBytes(handler http.Handler, maxBytes int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), maxResponseBytesKey{}, maxBytes)))
+	})
+}
+
+// errResponseTooLarge is returned when reading the body of a backend's
+// response which has gone over its limit.
+var errResponseTooLarge = errors.New("response body too large")
+
+// limitedBody passes on a response body until it goes over maxBytes.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	maxBytes  int64
+	req       *http.Request
+	status    int
+	logger    logger.Logger
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errResponseTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		b.logger.LogFromBackendRequest(map[string]interface{}{
+			"error":              fmt.Sprintf("response body is larger than the limit of %d bytes, so it was cut off", b.maxBytes),
+			"status":             b.status,
+			"max_response_bytes": b.maxBytes,
+		}, b.req)
+		return n + int(b.remaining), errResponseTooLarge
+	}
+	return n, err
+}
+
+type connectKey struct{}
+
+// WithConnect wraps a backend handler so that CONNECT requests passed
+// through it are tunnelled to the backend: once a connection to the backend
+// is open, the client is sent "200 Connection Established" and bytes are
+// copied blindly in both directions until either side closes, or the
+// request's context ends. Without this, backend handlers refuse CONNECT
+// requests with a 405.
+func WithConnect(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), connectKey{}, true)))
+	})
+}
+
+// tunnel connects the client of a CONNECT request to addr, as described for
+// WithConnect.
+func tunnel(w http.ResponseWriter, r *http.Request, dial func(ctx context.Context, network, addr string) (net.Conn, error), addr string, logger logger.Logger) {
+	backendConn, err := dial(r.Context(), "tcp", addr)
+	if err != nil {
+		logger.LogFromClientRequest(map[string]interface{}{"error": fmt.Sprintf("couldn't open tunnel to %s: %v", addr, err), "status": http.StatusBadGateway}, r)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer backendConn.Close()
+
+	clientConn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		logger.LogFromClientRequest(map[string]interface{}{"error": fmt.Sprintf("couldn't open tunnel to %s: %v", addr, err), "status": http.StatusInternalServerError}, r)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer clientConn.Close()
+	if _, err := io.WriteString(clientConn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	copyAndClose := func(dst net.Conn, src io.Reader) {
+		io.Copy(dst, src)
+		// Pass on the end of the stream, while letting the other
+		// direction finish.
+		if c, ok := dst.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	// The client's reader may already hold the first bytes it sent.
+	go copyAndClose(backendConn, buf)
+	go copyAndClose(clientConn, backendConn)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+type hopByHopHeadersKey struct{}
+
+// WithHopByHopHeaders wraps a backend handler so that the named request
+// headers are passed on to the backend, even though the proxy would remove
+// them as hop-by-hop headers (either because they're in the standard list,
+// or because they're named in the Connection header). Headers which aren't
+// named are removed as usual.
+func WithHopByHopHeaders(handler http.Handler, names []string) http.Handler {
+	canonical := make([]string, len(names))
+	for i, name := range names {
+		canonical[i] = http.CanonicalHeaderKey(name)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kept := make(http.Header)
+		for _, name := range canonical {
+			if vs, ok := r.Header[name]; ok {
+				kept[name] = vs
+			}
+		}
+		if len(kept) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), hopByHopHeadersKey{}, kept))
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// CloseIdleConnections closes the connections which a handler returned by
+// NewBackendHandler is keeping open to its backend for reuse. Requests in
+// progress are unaffected, and their connections are kept for reuse once
+// they finish, so it should only be called once the handler is no longer
+// serving requests. Other handlers are ignored.
+func CloseIdleConnections(handler http.Handler) {
+	if h, ok := handler.(*backendHandler); ok {
+		h.transport.wrapped.CloseIdleConnections()
+	}
+}
+
+var errHeaderTimeout = errors.New("net/http: timeout awaiting response headers")
+
 type backendTransport struct {
-	wrapped *http.Transport
-	logger  logger.Logger
+	wrapped       *http.Transport
+	headerTimeout time.Duration
+	logger        logger.Logger
 }
 
 // Construct a backendTransport that wraps an http.Transport and implements http.RoundTripper.
 // This allows us to intercept the response from the backend and modify it before it's copied
 // back to the client.
-func newBackendTransport(connectTimeout, headerTimeout time.Duration, logger logger.Logger) (transport *backendTransport) {
-	transport = &backendTransport{&http.Transport{}, logger}
+func newBackendTransport(connectTimeout, tlsHandshakeTimeout, headerTimeout time.Duration, dnsCache *DNSCache, h2c bool, logger logger.Logger) (transport *backendTransport) {
+	transport = &backendTransport{&http.Transport{TLSHandshakeTimeout: tlsHandshakeTimeout}, headerTimeout, logger}
 
-	transport.wrapped.Dial = func(network, address string) (net.Conn, error) {
-		return net.DialTimeout(network, address, connectTimeout)
+	dialer := &net.Dialer{Timeout: connectTimeout}
+	transport.wrapped.DialContext = dialer.DialContext
+	if dnsCache != nil {
+		transport.wrapped.DialContext = dnsCache.DialContext(dialer)
 	}
 	// Allow the proxy to keep more than the default (2) keepalive connections
 	// per upstream.
 	transport.wrapped.MaxIdleConnsPerHost = 20
-	transport.wrapped.ResponseHeaderTimeout = headerTimeout
+	if h2c {
+		// Only HTTP/2 is enabled, so plain http backends are spoken to with
+		// prior knowledge, and https ones must negotiate it.
+		transport.wrapped.Protocols = new(http.Protocols)
+		transport.wrapped.Protocols.SetUnencryptedHTTP2(true)
+		transport.wrapped.Protocols.SetHTTP2(true)
+	}
 	return
 }
 
+// roundTripWithHeaderTimeout makes the request, cancelling it if the response
+// headers haven't arrived within timeout of the request being written. This
+// mirrors http.Transport's ResponseHeaderTimeout, but can vary per request.
+func (bt *backendTransport) roundTripWithHeaderTimeout(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+
+	var mu sync.Mutex
+	var timer *time.Timer
+	var done, timedOut bool
+	trace := &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.AfterFunc(timeout, func() {
+				mu.Lock()
+				defer mu.Unlock()
+				if !done {
+					timedOut = true
+					cancel()
+				}
+			})
+		},
+	}
+
+	resp, err := bt.wrapped.RoundTrip(req.WithContext(httptrace.WithClientTrace(ctx, trace)))
+
+	mu.Lock()
+	done = true
+	if timer != nil {
+		timer.Stop()
+	}
+	if timedOut {
+		if resp != nil {
+			// The timer fired just as the response arrived.
+			resp.Body.Close()
+			resp = nil
+		}
+		err = errHeaderTimeout
+	}
+	mu.Unlock()
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases a request's context once its response body has been
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
 var invalidContentLengthRegexp = regexp.MustCompile(`http: Request.ContentLength=\d+ with Body length \d+`)
 
 func (bt *backendTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
-	resp, err = bt.wrapped.RoundTrip(req)
+	// The proxy has removed the hop-by-hop headers from its copy of the
+	// request by now, so put back any which should be kept.
+	if kept, ok := req.Context().Value(hopByHopHeadersKey{}).(http.Header); ok {
+		for k, vs := range kept {
+			req.Header[k] = vs
+		}
+	}
+
+	if header, ok := req.Context().Value(timeoutHeaderKey{}).(string); ok {
+		if deadline, ok := req.Context().Deadline(); ok {
+			req.Header.Set(header, strconv.FormatInt(max(time.Until(deadline).Milliseconds(), 0), 10))
+		}
+	}
+
+	headerTimeout := bt.headerTimeout
+	if timeout, ok := req.Context().Value(headerTimeoutKey{}).(time.Duration); ok {
+		headerTimeout = timeout
+	}
+	if headerTimeout > 0 {
+		resp, err = bt.roundTripWithHeaderTimeout(req, headerTimeout)
+	} else {
+		resp, err = bt.wrapped.RoundTrip(req)
+	}
 	if err == nil {
 		populateViaHeader(resp.Header, fmt.Sprintf("%d.%d", resp.ProtoMajor, resp.ProtoMinor))
+		if maxBytes, ok := req.Context().Value(maxResponseBytesKey{}).(int64); ok && maxBytes > 0 && req.Method != http.MethodHead && resp.StatusCode != http.StatusSwitchingProtocols {
+			if resp.ContentLength > maxBytes {
+				resp.Body.Close()
+				bt.logger.LogFromBackendRequest(map[string]interface{}{
+					"error":              fmt.Sprintf("response body of %d bytes is larger than the limit of %d bytes", resp.ContentLength, maxBytes),
+					"status":             502,
+					"max_response_bytes": maxBytes,
+				}, req)
+				return newErrorResponse(502), nil
+			}
+			resp.Body = &limitedBody{resp.Body, maxBytes, maxBytes, req, resp.StatusCode, bt.logger}
+		}
 	} else {
 		// Log the error (deferred to allow special case error handling to add/change details)
 		logDetails := map[string]interface{}{"error": err.Error(), "status": 500}
 		defer bt.logger.LogFromBackendRequest(logDetails, req)
 
 		// Intercept some specific errors and generate an appropriate HTTP error response
+		if req.Context().Err() == context.DeadlineExceeded {
+			// The router's overall request timeout has passed.
+			logDetails["status"] = 504
+			return newErrorResponse(504), nil
+		}
 		if opErr, ok := err.(*net.OpError); ok {
 			if opErr.Timeout() {
 				logDetails["status"] = 504
@@ -88,7 +522,7 @@ func (bt *backendTransport) RoundTrip(req *http.Request) (resp *http.Response, e
 				return newErrorResponse(502), nil
 			}
 		}
-		if err.Error() == "net/http: timeout awaiting response headers" {
+		if err == errHeaderTimeout {
 			logDetails["status"] = 504
 			return newErrorResponse(504), nil
 		} else if invalidContentLengthRegexp.MatchString(err.Error()) {
@@ -0,0 +1,340 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"github.com/alphagov/router/logger"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHopByHopHeaders(t *testing.T) {
+	var seen http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	l, _ := logger.New(io.Discard)
+
+	examples := []struct {
+		kept     []string
+		expected map[string]string
+	}{
+		{nil, map[string]string{"X-Coordination": "", "Keep-Alive": "", "Proxy-Authorization": "", "X-Other": "other"}},
+		{[]string{"x-coordination"}, map[string]string{"X-Coordination": "token", "Keep-Alive": "", "Proxy-Authorization": "", "X-Other": "other"}},
+		{[]string{"X-Coordination", "Proxy-Authorization"}, map[string]string{"X-Coordination": "token", "Keep-Alive": "", "Proxy-Authorization": "Basic Zm9v", "X-Other": "other"}},
+	}
+	for _, ex := range examples {
+		var handler http.Handler = NewBackendHandler(backendURL, time.Second, 0, time.Second, 0, nil, false, l)
+		if ex.kept != nil {
+			handler = WithHopByHopHeaders(handler, ex.kept)
+		}
+
+		req := httptest.NewRequest("GET", "/foo", nil)
+		req.Header.Set("Connection", "X-Coordination")
+		req.Header.Set("X-Coordination", "token")
+		req.Header.Set("Keep-Alive", "timeout=5")
+		req.Header.Set("Proxy-Authorization", "Basic Zm9v")
+		req.Header.Set("X-Other", "other")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		for name, value := range ex.expected {
+			if got := seen.Get(name); got != value {
+				t.Errorf("Keeping %v, expected the backend to see %s %q, got %q", ex.kept, name, value, got)
+			}
+		}
+	}
+}
+
+func TestH2CBackends(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	backend.Config.Protocols = new(http.Protocols)
+	backend.Config.Protocols.SetHTTP1(true)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	l, _ := logger.New(io.Discard)
+
+	for _, h2c := range []bool{false, true} {
+		handler := NewBackendHandler(backendURL, time.Second, 0, time.Second, 0, nil, h2c, l)
+		expected := "HTTP/1.1"
+		if h2c {
+			expected = "HTTP/2.0"
+		}
+		for i := 0; i < 3; i++ {
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, httptest.NewRequest("GET", "/foo", nil))
+			if rw.Code != http.StatusOK || rw.Body.String() != expected {
+				t.Errorf("With h2c=%v, expected a 200 from an %s backend, got %d %q", h2c, expected, rw.Code, rw.Body.String())
+			}
+		}
+	}
+}
+
+func TestBackendTransportTimeouts(t *testing.T) {
+	l, _ := logger.New(io.Discard)
+	transport := newBackendTransport(2*time.Second, 3*time.Second, 4*time.Second, nil, false, l)
+	if transport.wrapped.TLSHandshakeTimeout != 3*time.Second || transport.headerTimeout != 4*time.Second {
+		t.Errorf("Expected a TLS handshake timeout of 3s and header timeout of 4s, got %v and %v",
+			transport.wrapped.TLSHandshakeTimeout, transport.headerTimeout)
+	}
+
+	// A backend which accepts connections but never completes a handshake
+	// is only abandoned once the TLS handshake timeout has passed.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	backendURL, _ := url.Parse("https://" + listener.Addr().String())
+
+	for _, timeout := range []time.Duration{50 * time.Millisecond, 300 * time.Millisecond} {
+		handler := NewBackendHandler(backendURL, time.Second, timeout, 0, 0, nil, false, l)
+		start := time.Now()
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+		elapsed := time.Since(start)
+		if rw.Code < 500 || elapsed < timeout || elapsed > timeout+500*time.Millisecond {
+			t.Errorf("With a TLS handshake timeout of %v, expected an error after about that long, got %d after %v", timeout, rw.Code, elapsed)
+		}
+	}
+}
+
+func TestBackendHost(t *testing.T) {
+	var seen string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Host
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	l, _ := logger.New(io.Discard)
+	handler := NewBackendHandler(backendURL, time.Second, 0, time.Second, 0, nil, false, l)
+
+	examples := []struct {
+		name     string
+		handler  http.Handler
+		expected string
+	}{
+		{"default", handler, backendURL.Host},
+		{"override", WithHost(handler, "app.internal"), "app.internal"},
+		{"client", WithClientHost(handler), "www.example.com"},
+	}
+	for _, ex := range examples {
+		seen = ""
+		rw := httptest.NewRecorder()
+		ex.handler.ServeHTTP(rw, httptest.NewRequest("GET", "http://www.example.com/foo", nil))
+		if seen != ex.expected {
+			t.Errorf("With the %s host, expected the backend to see Host %q, got %q", ex.name, ex.expected, seen)
+		}
+	}
+}
+
+func TestBackendUserAgent(t *testing.T) {
+	var seen []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Values("User-Agent")
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	l, _ := logger.New(io.Discard)
+	handler := NewBackendHandler(backendURL, time.Second, 0, time.Second, 0, nil, false, l)
+
+	examples := []struct {
+		name      string
+		handler   http.Handler
+		userAgent string
+		expected  []string
+	}{
+		{"default", handler, "Mozilla/5.0", []string{"Mozilla/5.0"}},
+		{"default without a User-Agent", handler, "", nil},
+		{"override", WithUserAgent(handler, "router"), "Mozilla/5.0", []string{"router"}},
+		{"override without a User-Agent", WithUserAgent(handler, "router"), "", []string{"router"}},
+		{"suffix", WithUserAgentSuffix(handler, "via router"), "Mozilla/5.0", []string{"Mozilla/5.0 via router"}},
+		{"suffix without a User-Agent", WithUserAgentSuffix(handler, "via router"), "", []string{"via router"}},
+	}
+	for _, ex := range examples {
+		seen = nil
+		req := httptest.NewRequest("GET", "http://www.example.com/foo", nil)
+		if ex.userAgent != "" {
+			req.Header.Set("User-Agent", ex.userAgent)
+		}
+		ex.handler.ServeHTTP(httptest.NewRecorder(), req)
+		if !reflect.DeepEqual(seen, ex.expected) {
+			t.Errorf("With the %s User-Agent, expected the backend to see %q, got %q", ex.name, ex.expected, seen)
+		}
+		if ex.userAgent != "" && req.Header.Get("User-Agent") != ex.userAgent {
+			t.Errorf("With the %s User-Agent, expected the client's request to be left alone, got %q", ex.name, req.Header.Get("User-Agent"))
+		}
+	}
+}
+
+func TestBackendForwardedHeaders(t *testing.T) {
+	var seen http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	l, _ := logger.New(io.Discard)
+	handler := NewBackendHandler(backendURL, time.Second, 0, time.Second, 0, nil, false, l)
+
+	examples := []struct {
+		name          string
+		handler       http.Handler
+		tls           bool
+		xff, xfp, xfh string
+	}{
+		{"behind a proxy", handler, false, "192.0.2.1, 203.0.113.7", "https", "spoofed.example.com"},
+		{"at the edge", AtEdge(handler), false, "203.0.113.7", "http", "www.example.com"},
+		{"at the edge over TLS", AtEdge(handler), true, "203.0.113.7", "https", "www.example.com"},
+	}
+	for _, ex := range examples {
+		seen = nil
+		req := httptest.NewRequest("GET", "http://www.example.com/foo", nil)
+		req.RemoteAddr = "203.0.113.7:1234"
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "spoofed.example.com")
+		if ex.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		ex.handler.ServeHTTP(httptest.NewRecorder(), req)
+		if xff := seen.Values("X-Forwarded-For"); len(xff) != 1 || xff[0] != ex.xff {
+			t.Errorf("%s: expected X-Forwarded-For %q, got %q", ex.name, ex.xff, xff)
+		}
+		if xfp := seen.Values("X-Forwarded-Proto"); len(xfp) != 1 || xfp[0] != ex.xfp {
+			t.Errorf("%s: expected X-Forwarded-Proto %q, got %q", ex.name, ex.xfp, xfp)
+		}
+		if xfh := seen.Values("X-Forwarded-Host"); len(xfh) != 1 || xfh[0] != ex.xfh {
+			t.Errorf("%s: expected X-Forwarded-Host %q, got %q", ex.name, ex.xfh, xfh)
+		}
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		body := strings.Repeat("x", size)
+		if r.URL.Query().Get("stream") != "" {
+			// Flushing before the body is written leaves out the
+			// Content-Length.
+			w.(http.Flusher).Flush()
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(size))
+		}
+		io.WriteString(w, body)
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	var buf bytes.Buffer
+	l, _ := logger.New(&buf)
+	handler := WithMaxResponseBytes(NewBackendHandler(backendURL, time.Second, 0, time.Second, 0, nil, false, l), 50)
+
+	examples := []struct {
+		query  string
+		status int
+		size   int
+		logged bool
+	}{
+		{"size=30", 200, 30, false},
+		{"size=50", 200, 50, false},
+		{"size=30&stream=1", 200, 30, false},
+		{"size=50&stream=1", 200, 50, false},
+		{"size=100", 502, 0, true},
+		{"size=100&stream=1", 200, 50, true},
+	}
+	for _, ex := range examples {
+		buf.Reset()
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest("GET", "/?"+ex.query, nil))
+		l.Flush()
+		if rw.Code != ex.status || rw.Body.Len() != ex.size {
+			t.Errorf("%s: expected %d with %d bytes, got %d with %d bytes", ex.query, ex.status, ex.size, rw.Code, rw.Body.Len())
+		}
+		if logged := strings.Contains(buf.String(), `"max_response_bytes":50`); logged != ex.logged {
+			t.Errorf("%s: expected logged to be %v, got %q", ex.query, ex.logged, buf.String())
+		}
+	}
+
+	// A real client sees the response cut short, rather than complete.
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/?size=100000&stream=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, err := io.ReadAll(resp.Body); err == nil {
+		t.Errorf("Expected the response to be aborted, got %d bytes", len(body))
+	}
+}
+
+func TestTimeoutHeader(t *testing.T) {
+	remaining := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remaining <- r.Header.Get("X-Timeout-Ms")
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	l, _ := logger.New(io.Discard)
+	proxy := NewBackendHandler(backendURL, time.Second, 0, time.Second, 0, nil, false, l)
+
+	serve := func(handler http.Handler, budget time.Duration) int {
+		ctx, cancel := context.WithTimeout(context.Background(), budget)
+		defer cancel()
+		handler = WithTimeoutHeader(handler, "X-Timeout-Ms")
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+		select {
+		case v := <-remaining:
+			ms, err := strconv.Atoi(v)
+			if err != nil {
+				t.Fatalf("Expected the remaining time in milliseconds, got %q", v)
+			}
+			return ms
+		default:
+			t.Fatal("Expected the request to reach the backend")
+		}
+		return 0
+	}
+	delayed := func(delay time.Duration) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(delay)
+			proxy.ServeHTTP(w, r)
+		})
+	}
+
+	if ms := serve(proxy, time.Second); ms > 1000 || ms < 800 {
+		t.Errorf("Expected about 1000ms to be left, got %d", ms)
+	}
+	if ms := serve(delayed(300*time.Millisecond), time.Second); ms > 700 || ms < 500 {
+		t.Errorf("Expected about 700ms to be left after a 300ms delay, got %d", ms)
+	}
+
+	// Without a deadline, there's nothing to send.
+	WithTimeoutHeader(proxy, "X-Timeout-Ms").ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if v := <-remaining; v != "" {
+		t.Errorf("Expected no header without a deadline, got %q", v)
+	}
+}
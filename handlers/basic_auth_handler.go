@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// NewBasicAuthHandler wraps a handler so that requests are only passed on
+// when they carry HTTP basic auth credentials for user. passHash is the
+// hex-encoded SHA-256 digest of the password, so that the password itself
+// needn't be stored with the routes. Requests with missing or wrong
+// credentials are answered with a 401 challenge for realm.
+func NewBasicAuthHandler(realm, user, passHash string, next http.Handler) http.Handler {
+	wantUser := sha256.Sum256([]byte(user))
+	wantPass, err := hex.DecodeString(strings.TrimSpace(passHash))
+	if err != nil || len(wantPass) != sha256.Size {
+		// No password can match, so every request is challenged.
+		wantPass = nil
+	}
+	challenge := "Basic realm=" + strconv.Quote(realm)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if ok && wantPass != nil {
+			gotUser := sha256.Sum256([]byte(u))
+			gotPass := sha256.Sum256([]byte(p))
+			userOK := subtle.ConstantTimeCompare(gotUser[:], wantUser[:])
+			passOK := subtle.ConstantTimeCompare(gotPass[:], wantPass)
+			if userOK&passOK == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+		http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+	})
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBasicAuthHandler(t *testing.T) {
+	sum := sha256.Sum256([]byte("s3cret"))
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("protected"))
+	})
+	handler := NewBasicAuthHandler("Internal tools", "admin", hex.EncodeToString(sum[:]), backend)
+
+	examples := []struct {
+		name       string
+		user, pass string
+		withAuth   bool
+		status     int
+	}{
+		{"missing credentials", "", "", false, http.StatusUnauthorized},
+		{"wrong password", "admin", "guess", true, http.StatusUnauthorized},
+		{"wrong user", "root", "s3cret", true, http.StatusUnauthorized},
+		{"correct credentials", "admin", "s3cret", true, http.StatusOK},
+	}
+	for _, ex := range examples {
+		r := httptest.NewRequest("GET", "/tools/foo", nil)
+		if ex.withAuth {
+			r.SetBasicAuth(ex.user, ex.pass)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != ex.status {
+			t.Errorf("%s: expected status %d, got %d", ex.name, ex.status, w.Code)
+		}
+		challenge := w.Header().Get("WWW-Authenticate")
+		if ex.status == http.StatusUnauthorized && challenge != `Basic realm="Internal tools"` {
+			t.Errorf("%s: expected a challenge for the realm, got %q", ex.name, challenge)
+		}
+		if ex.status == http.StatusOK && (challenge != "" || w.Body.String() != "protected") {
+			t.Errorf("%s: expected the request to be passed on, got %q (challenge %q)", ex.name, w.Body.String(), challenge)
+		}
+	}
+}
+
+func TestBasicAuthHandlerWithInvalidHash(t *testing.T) {
+	handler := NewBasicAuthHandler("Internal tools", "admin", "not-a-hash", http.NotFoundHandler())
+	r := httptest.NewRequest("GET", "/tools/foo", nil)
+	r.SetBasicAuth("admin", "")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected every request to be refused, got status %d", w.Code)
+	}
+}
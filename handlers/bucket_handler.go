@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strconv"
+)
+
+// NewCookieBucketHandler returns a handler which chooses between several
+// handlers (usually backends) by the value of the named cookie, for A/B
+// testing. The cookie's value is looked up in buckets directly, unless
+// hashBuckets is positive, in which case the value is hashed into one of
+// that many buckets, named "0" to hashBuckets-1. Requests without the
+// cookie, or with a value which isn't in buckets, are passed to fallback.
+func NewCookieBucketHandler(cookie string, buckets map[string]http.Handler, hashBuckets int, fallback http.Handler) http.Handler {
+	return &cookieBucketHandler{cookie, buckets, hashBuckets, fallback}
+}
+
+type cookieBucketHandler struct {
+	cookie      string
+	buckets     map[string]http.Handler
+	hashBuckets int
+	fallback    http.Handler
+}
+
+func (h *cookieBucketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if handler, ok := h.buckets[h.bucket(r)]; ok {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	h.fallback.ServeHTTP(w, r)
+}
+
+// bucket returns the name of the bucket the request belongs in, or an empty
+// string if it has no cookie.
+func (h *cookieBucketHandler) bucket(r *http.Request) string {
+	c, err := r.Cookie(h.cookie)
+	if err != nil || c.Value == "" {
+		return ""
+	}
+	if h.hashBuckets <= 0 {
+		return c.Value
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(c.Value))
+	return strconv.Itoa(int(hash.Sum32() % uint32(h.hashBuckets)))
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// namedHandler responds with its name, so tests can see which was chosen.
+func namedHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	})
+}
+
+func TestCookieBucketHandler(t *testing.T) {
+	handler := NewCookieBucketHandler("ab_bucket", map[string]http.Handler{
+		"A": namedHandler("backend-a"),
+		"B": namedHandler("backend-b"),
+	}, 0, namedHandler("default"))
+
+	examples := []struct {
+		cookie, expected string
+	}{
+		{"A", "backend-a"},
+		{"B", "backend-b"},
+		{"C", "default"},
+		{"a", "default"},
+		{"", "default"},
+	}
+	for _, ex := range examples {
+		r := httptest.NewRequest("GET", "/", nil)
+		if ex.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "ab_bucket", Value: ex.cookie})
+		}
+		r.AddCookie(&http.Cookie{Name: "other", Value: "A"})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Body.String() != ex.expected {
+			t.Errorf("Expected bucket cookie %q to be served by %s, got %s", ex.cookie, ex.expected, w.Body.String())
+		}
+	}
+}
+
+func TestCookieBucketHandlerHashing(t *testing.T) {
+	handler := NewCookieBucketHandler("user_id", map[string]http.Handler{
+		"0": namedHandler("backend-a"),
+		"1": namedHandler("backend-b"),
+	}, 2, namedHandler("default"))
+
+	serve := func(value string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		if value != "" {
+			r.AddCookie(&http.Cookie{Name: "user_id", Value: value})
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	if got := serve(""); got != "default" {
+		t.Errorf("Expected a request without the cookie to be served by default, got %s", got)
+	}
+	seen := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		value := "user-" + string(rune('a'+i%26)) + string(rune('a'+i/26))
+		first := serve(value)
+		if again := serve(value); again != first {
+			t.Errorf("Expected %s to stay in one bucket, got %s then %s", value, first, again)
+		}
+		seen[first]++
+	}
+	if seen["backend-a"] == 0 || seen["backend-b"] == 0 || seen["default"] != 0 {
+		t.Errorf("Expected hashed values to be spread over both buckets, got %v", seen)
+	}
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// NewBufferingHandler wraps a handler so that responses of up to maxBytes
+// are held back until they are complete, and then sent with an explicit
+// Content-Length rather than chunked. Once a response grows past maxBytes,
+// what has been held back is sent on and the rest is streamed as usual.
+//
+// Responses which already have a Content-Length, server-sent events, and
+// responses to HEAD requests are never held back.
+func NewBufferingHandler(handler http.Handler, maxBytes int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		bw := &bufferingWriter{ResponseWriter: w, limit: maxBytes}
+		handler.ServeHTTP(bw, r)
+		bw.finish()
+	})
+}
+
+// bufferingWriter holds back a response until it's complete, or has grown
+// past limit bytes, or turns out not to need buffering.
+type bufferingWriter struct {
+	http.ResponseWriter
+	limit     int
+	status    int
+	buf       []byte
+	streaming bool
+}
+
+func (bw *bufferingWriter) WriteHeader(code int) {
+	if code >= 100 && code <= 199 && code != http.StatusSwitchingProtocols {
+		// Informational responses are sent on ahead of the real one.
+		bw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if bw.status != 0 {
+		return
+	}
+	bw.status = code
+	header := bw.Header()
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if header.Get("Content-Length") != "" || mediaType == "text/event-stream" || !bodyAllowedForStatus(code) {
+		bw.stream()
+	}
+}
+
+func (bw *bufferingWriter) Write(b []byte) (int, error) {
+	if bw.status == 0 {
+		bw.WriteHeader(http.StatusOK)
+	}
+	if !bw.streaming && len(bw.buf)+len(b) > bw.limit {
+		if err := bw.stream(); err != nil {
+			return 0, err
+		}
+	}
+	if bw.streaming {
+		return bw.ResponseWriter.Write(b)
+	}
+	bw.buf = append(bw.buf, b...)
+	return len(b), nil
+}
+
+// Flush passes flushes on once the response is being streamed. Until then
+// they're ignored, as the point is to send the response in one piece.
+func (bw *bufferingWriter) Flush() {
+	if !bw.streaming {
+		return
+	}
+	if f, ok := bw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// stream sends the status and anything held back, and passes everything
+// after that straight through.
+func (bw *bufferingWriter) stream() error {
+	bw.streaming = true
+	bw.ResponseWriter.WriteHeader(bw.status)
+	if len(bw.buf) == 0 {
+		return nil
+	}
+	_, err := bw.ResponseWriter.Write(bw.buf)
+	bw.buf = nil
+	return err
+}
+
+// finish sends a response which was held back in full, with its length.
+func (bw *bufferingWriter) finish() {
+	if bw.streaming {
+		return
+	}
+	if bw.status == 0 {
+		bw.status = http.StatusOK
+	}
+	bw.Header().Del("Transfer-Encoding")
+	bw.Header().Set("Content-Length", strconv.Itoa(len(bw.buf)))
+	bw.stream()
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chunkedHandler writes each of the chunks, flushing after each one.
+func chunkedHandler(contentType string, chunks ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		for _, chunk := range chunks {
+			w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+		}
+	})
+}
+
+func TestBufferingHandlerSetsContentLength(t *testing.T) {
+	server := httptest.NewServer(NewBufferingHandler(chunkedHandler("text/plain", "Hello, ", "world"), 16))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.ContentLength != 12 || len(resp.TransferEncoding) != 0 {
+		t.Errorf("Expected a Content-Length of 12 and no chunking, got %d and %v", resp.ContentLength, resp.TransferEncoding)
+	}
+	if string(body) != "Hello, world" {
+		t.Errorf("Expected the full body, got %q", body)
+	}
+}
+
+func TestBufferingHandlerStreamsLargeResponses(t *testing.T) {
+	release := make(chan struct{})
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 20) + "\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("done\n"))
+	})
+	server := httptest.NewServer(NewBufferingHandler(backend, 16))
+	defer server.Close()
+	defer close(release)
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.ContentLength != -1 {
+		t.Errorf("Expected a large response to be sent without a Content-Length, got %d", resp.ContentLength)
+	}
+
+	line := make(chan string)
+	go func() {
+		l, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- l
+	}()
+	select {
+	case l := <-line:
+		if l != strings.Repeat("x", 20)+"\n" {
+			t.Errorf("Expected the first part of the body, got %q", l)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the first part of a large response before it was complete")
+	}
+}
+
+func TestBufferingHandlerPassesThrough(t *testing.T) {
+	examples := []struct {
+		name    string
+		method  string
+		handler http.Handler
+	}{
+		{"server-sent events", "GET", chunkedHandler("text/event-stream; charset=utf-8", "data: 1\n\n")},
+		{"a HEAD request", "HEAD", chunkedHandler("text/plain", "Hello")},
+		{"an existing Content-Length", "GET", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "5")
+			w.Write([]byte("Hello"))
+			w.(http.Flusher).Flush()
+		})},
+	}
+	for _, ex := range examples {
+		w := httptest.NewRecorder()
+		NewBufferingHandler(ex.handler, 1024).ServeHTTP(w, httptest.NewRequest(ex.method, "/", nil))
+		if !w.Flushed {
+			t.Errorf("Expected the response for %s to be streamed", ex.name)
+		}
+		if ex.name != "an existing Content-Length" && w.Header().Get("Content-Length") != "" {
+			t.Errorf("Expected no Content-Length to be added for %s, got %s", ex.name, w.Header().Get("Content-Length"))
+		}
+	}
+}
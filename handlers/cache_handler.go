@@ -0,0 +1,325 @@
+package handlers
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResponseCache is an in-memory LRU cache of backend responses, shared by
+// all the caching handlers created with it. The total size of the cached
+// responses (headers and bodies) is bounded by maxBytes.
+type ResponseCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	lru      *list.List
+	entries  map[string]*list.Element
+	varies   map[string][]string
+	variants map[string]int
+	hits     int64
+	misses   int64
+}
+
+type cachedResponse struct {
+	primaryKey string
+	key        string
+	header     http.Header
+	body       []byte
+	stored     time.Time
+	expires    time.Time
+	size       int64
+}
+
+// NewResponseCache creates an empty ResponseCache which will hold at most
+// maxBytes of responses.
+func NewResponseCache(maxBytes int64) *ResponseCache {
+	return &ResponseCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		varies:   make(map[string][]string),
+		variants: make(map[string]int),
+	}
+}
+
+// maxEntryBytes is the largest single response the cache will accept, so
+// that one large response can't evict everything else.
+func (c *ResponseCache) maxEntryBytes() int64 {
+	return c.maxBytes / 8
+}
+
+// Purge removes all entries from the cache. The hit and miss counts are
+// preserved.
+func (c *ResponseCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.size = 0
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.varies = make(map[string][]string)
+	c.variants = make(map[string]int)
+}
+
+// ResetStats sets the hit and miss counts back to zero, leaving the cached
+// responses in place.
+func (c *ResponseCache) ResetStats() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.hits, c.misses = 0, 0
+}
+
+// Stats returns the hit and miss counts for the cache, along with the number
+// and total size of the responses currently held.
+func (c *ResponseCache) Stats() (stats map[string]interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats = make(map[string]interface{})
+	stats["hits"] = c.hits
+	stats["misses"] = c.misses
+	stats["entries"] = c.lru.Len()
+	stats["bytes"] = c.size
+	return
+}
+
+// variantKey builds the full cache key for a request, taking into account
+// the request headers named in the Vary header of the cached response.
+func variantKey(primaryKey string, vary []string, r *http.Request) string {
+	key := primaryKey
+	for _, name := range vary {
+		key += "\n" + name + ":" + strings.Join(r.Header[name], ",")
+	}
+	return key
+}
+
+func (c *ResponseCache) get(primaryKey string, r *http.Request) (entry *cachedResponse, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[variantKey(primaryKey, c.varies[primaryKey], r)]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	entry = el.Value.(*cachedResponse)
+	if time.Now().After(entry.expires) {
+		c.remove(el)
+		c.misses++
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	c.hits++
+	return entry, true
+}
+
+func (c *ResponseCache) miss() {
+	c.mu.Lock()
+	c.misses++
+	c.mu.Unlock()
+}
+
+func (c *ResponseCache) set(primaryKey string, vary []string, r *http.Request, header http.Header, body []byte, maxAge time.Duration) {
+	size := int64(len(primaryKey) + len(body))
+	for k, vs := range header {
+		for _, v := range vs {
+			size += int64(len(k) + len(v))
+		}
+	}
+	if size > c.maxEntryBytes() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.varies[primaryKey] = vary
+	entry := &cachedResponse{
+		primaryKey: primaryKey,
+		key:        variantKey(primaryKey, vary, r),
+		header:     header,
+		body:       body,
+		stored:     now,
+		expires:    now.Add(maxAge),
+		size:       size,
+	}
+	if el, ok := c.entries[entry.key]; ok {
+		c.remove(el)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.variants[primaryKey]++
+	c.size += size
+
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *ResponseCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*cachedResponse)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+	c.variants[entry.primaryKey]--
+	if c.variants[entry.primaryKey] <= 0 {
+		delete(c.variants, entry.primaryKey)
+		delete(c.varies, entry.primaryKey)
+	}
+}
+
+// NewCachingHandler wraps a handler so that cacheable responses to GET and
+// HEAD requests are stored in, and served from, the passed ResponseCache.
+//
+// Only 200 responses with an explicit max-age (or s-maxage), and without
+// no-store, no-cache, private or Set-Cookie, are cached. Requests with
+// "Cache-Control: no-cache" bypass the cache, although the fresh response
+// they receive may still be stored.
+func NewCachingHandler(handler http.Handler, cache *ResponseCache) http.Handler {
+	return &cachingHandler{handler, cache}
+}
+
+type cachingHandler struct {
+	handler http.Handler
+	cache   *ResponseCache
+}
+
+func (h *cachingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if (r.Method != "GET" && r.Method != "HEAD") || r.Header.Get("Authorization") != "" {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	primaryKey := r.Method + " " + r.URL.RequestURI()
+	reqDirectives := parseCacheControl(r.Header)
+	_, noCache := reqDirectives["no-cache"]
+	if noCache || r.Header.Get("Pragma") == "no-cache" {
+		h.cache.miss()
+	} else if entry, ok := h.cache.get(primaryKey, r); ok {
+		for k, vs := range entry.header {
+			w.Header()[k] = vs
+		}
+		w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.stored)/time.Second)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(entry.body)
+		return
+	}
+
+	rec := &responseRecorder{ResponseWriter: w, limit: h.cache.maxEntryBytes()}
+	h.handler.ServeHTTP(rec, r)
+
+	if _, noStore := reqDirectives["no-store"]; noStore || rec.overflow {
+		return
+	}
+	if maxAge, vary, ok := cacheableResponse(rec.status, rec.header); ok {
+		h.cache.set(primaryKey, vary, r, rec.header, rec.body.Bytes(), maxAge)
+	}
+}
+
+// cacheableResponse decides whether a response may be stored, and if so for
+// how long and which request headers it varies on.
+func cacheableResponse(status int, header http.Header) (maxAge time.Duration, vary []string, ok bool) {
+	if status != http.StatusOK || header == nil || len(header["Set-Cookie"]) > 0 {
+		return 0, nil, false
+	}
+
+	directives := parseCacheControl(header)
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, present := directives[d]; present {
+			return 0, nil, false
+		}
+	}
+	age, present := directives["s-maxage"]
+	if !present {
+		age, present = directives["max-age"]
+	}
+	seconds, err := strconv.Atoi(age)
+	if !present || err != nil || seconds <= 0 {
+		return 0, nil, false
+	}
+
+	for _, line := range header["Vary"] {
+		for _, name := range strings.Split(line, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return 0, nil, false
+			}
+			if name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	return time.Duration(seconds) * time.Second, vary, true
+}
+
+// parseCacheControl returns the directives in a Cache-Control header, mapped
+// to their (possibly empty) values.
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, line := range header["Cache-Control"] {
+		for _, part := range strings.Split(line, ",") {
+			name, value := strings.TrimSpace(part), ""
+			if i := strings.Index(name, "="); i >= 0 {
+				name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+			}
+			if name != "" {
+				directives[strings.ToLower(name)] = value
+			}
+		}
+	}
+	return directives
+}
+
+// responseRecorder passes a response through to the client while keeping a
+// copy of the status, headers and (up to limit bytes of) body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	limit    int64
+	overflow bool
+}
+
+func (rr *responseRecorder) WriteHeader(code int) {
+	if rr.status == 0 {
+		rr.status = code
+		rr.header = rr.ResponseWriter.Header().Clone()
+	}
+	rr.ResponseWriter.WriteHeader(code)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.WriteHeader(http.StatusOK)
+	}
+	if !rr.overflow {
+		if int64(rr.body.Len()+len(b)) > rr.limit {
+			rr.overflow = true
+			rr.body.Reset()
+		} else {
+			rr.body.Write(b)
+		}
+	}
+	return rr.ResponseWriter.Write(b)
+}
+
+func (rr *responseRecorder) Flush() {
+	if rr.status == 0 {
+		rr.WriteHeader(http.StatusOK)
+	}
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getRequest(path string) *http.Request {
+	return httptest.NewRequest("GET", path, nil)
+}
+
+// store adds a response with an empty header and a body of bodyBytes bytes
+// to the cache, returning the size that should be accounted for it.
+func store(c *ResponseCache, primaryKey string, bodyBytes int) int64 {
+	c.set(primaryKey, nil, getRequest("/"), http.Header{}, make([]byte, bodyBytes), time.Minute)
+	return int64(len(primaryKey) + bodyBytes)
+}
+
+func cached(c *ResponseCache, primaryKey string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[primaryKey]
+	return ok
+}
+
+func TestResponseCacheSizeAccounting(t *testing.T) {
+	c := NewResponseCache(8000)
+
+	expected := store(c, "GET /a", 100) + store(c, "GET /b", 200)
+	if c.size != expected {
+		t.Errorf("Expected size %d after storing two entries, got %d", expected, c.size)
+	}
+
+	// Replacing an entry mustn't count it twice.
+	expected = expected - 106 + store(c, "GET /a", 50)
+	if c.size != expected {
+		t.Errorf("Expected size %d after replacing an entry, got %d", expected, c.size)
+	}
+
+	header := http.Header{"Content-Type": []string{"text/plain"}}
+	c.set("GET /c", nil, getRequest("/c"), header, []byte("hello"), time.Minute)
+	expected += int64(len("GET /c") + len("hello") + len("Content-Type") + len("text/plain"))
+	if c.size != expected {
+		t.Errorf("Expected size %d to include headers, got %d", expected, c.size)
+	}
+
+	c.mu.Lock()
+	c.remove(c.entries["GET /b"])
+	c.mu.Unlock()
+	expected -= 206
+	if c.size != expected {
+		t.Errorf("Expected size %d after removing an entry, got %d", expected, c.size)
+	}
+	if _, ok := c.variants["GET /b"]; ok {
+		t.Error("Expected the variant count to be removed along with the last variant")
+	}
+
+	c.Purge()
+	if c.size != 0 || c.lru.Len() != 0 {
+		t.Errorf("Expected an empty cache after Purge, got %d entries of %d bytes", c.lru.Len(), c.size)
+	}
+}
+
+func TestResponseCacheLRUEviction(t *testing.T) {
+	// Room for exactly eight of the 1000 byte entries below.
+	c := NewResponseCache(8000)
+	for i := 1; i <= 8; i++ {
+		store(c, fmt.Sprintf("GET /%d", i), 994)
+	}
+
+	// Using /1 makes /2 the least recently used entry.
+	if _, ok := c.get("GET /1", getRequest("/1")); !ok {
+		t.Fatal("Expected GET /1 to be cached")
+	}
+	store(c, "GET /9", 994)
+
+	for i := 1; i <= 9; i++ {
+		key := fmt.Sprintf("GET /%d", i)
+		if expected := i != 2; cached(c, key) != expected {
+			t.Errorf("Expected cached(%q) to be %v", key, expected)
+		}
+	}
+	if c.size != c.maxBytes {
+		t.Errorf("Expected size to be %d, got %d", c.maxBytes, c.size)
+	}
+}
+
+func TestResponseCacheMaxEntryBytes(t *testing.T) {
+	c := NewResponseCache(8000)
+
+	store(c, "GET /small", 1000-len("GET /small"))
+	store(c, "GET /large", 1001-len("GET /large"))
+
+	if !cached(c, "GET /small") {
+		t.Error("Expected an entry of exactly maxEntryBytes to be cached")
+	}
+	if cached(c, "GET /large") {
+		t.Error("Expected an entry larger than maxEntryBytes not to be cached")
+	}
+}
+
+// serveBody returns a handler which responds with a cacheable response with
+// the passed body, and counts how many times it has been called.
+func serveBody(body string, calls *int, header http.Header) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		for k, vs := range header {
+			w.Header()[k] = vs
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(body + r.Header.Get("Accept-Language")))
+	})
+}
+
+func TestCachingHandlerOverflow(t *testing.T) {
+	c := NewResponseCache(8000)
+	calls := 0
+	body := strings.Repeat("x", 600)
+	handler := NewCachingHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		// Written in two parts, the second of which takes the body over
+		// maxEntryBytes.
+		w.Write([]byte(body))
+		w.Write([]byte(body))
+	}), c)
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, getRequest("/big"))
+		if w.Body.Len() != 1200 {
+			t.Errorf("Expected the full 1200 byte body to be passed through, got %d bytes", w.Body.Len())
+		}
+	}
+	if calls != 2 {
+		t.Errorf("Expected an oversized response not to be cached, but the handler was called %d times", calls)
+	}
+	if c.lru.Len() != 0 || c.size != 0 {
+		t.Errorf("Expected an empty cache, got %d entries of %d bytes", c.lru.Len(), c.size)
+	}
+}
+
+func TestCachingHandlerVary(t *testing.T) {
+	c := NewResponseCache(8000)
+	calls := 0
+	handler := NewCachingHandler(serveBody("hello ", &calls, http.Header{"Vary": []string{"accept-language"}}), c)
+
+	request := func(lang string) string {
+		r := getRequest("/greeting")
+		if lang != "" {
+			r.Header.Set("Accept-Language", lang)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	for _, ex := range []struct {
+		lang, body string
+		calls      int
+	}{
+		{"en", "hello en", 1},
+		{"fr", "hello fr", 2},
+		{"en", "hello en", 2},
+		{"", "hello ", 3},
+		{"fr", "hello fr", 3},
+	} {
+		if body := request(ex.lang); body != ex.body {
+			t.Errorf("Expected body %q for Accept-Language %q, got %q", ex.body, ex.lang, body)
+		}
+		if calls != ex.calls {
+			t.Errorf("Expected %d calls to the handler after a request with Accept-Language %q, got %d", ex.calls, ex.lang, calls)
+		}
+	}
+	if variants := c.variants["GET /greeting"]; variants != 3 {
+		t.Errorf("Expected 3 variants of GET /greeting to be cached, got %d", variants)
+	}
+}
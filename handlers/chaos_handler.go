@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// NewChaosHandler wraps a handler so that, for testing failure handling,
+// requests are delayed by delay with probability delayProbability, and
+// answered with a 500 (without reaching the wrapped handler) with
+// probability errorProbability. The two are decided independently, so a
+// request may be delayed and then fail. Responses to requests which were
+// interfered with have an X-Router-Chaos header saying how.
+func NewChaosHandler(handler http.Handler, delay time.Duration, delayProbability, errorProbability float64) http.Handler {
+	return &chaosHandler{handler, delay, delayProbability, errorProbability}
+}
+
+type chaosHandler struct {
+	handler          http.Handler
+	delay            time.Duration
+	delayProbability float64
+	errorProbability float64
+}
+
+func (h *chaosHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.delay > 0 && rand.Float64() < h.delayProbability {
+		w.Header().Add("X-Router-Chaos", "delay")
+		timer := time.NewTimer(h.delay)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			// The request has been abandoned, e.g. by the request timeout.
+			timer.Stop()
+			return
+		}
+	}
+	if rand.Float64() < h.errorProbability {
+		w.Header().Add("X-Router-Chaos", "error")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	h.handler.ServeHTTP(w, r)
+}
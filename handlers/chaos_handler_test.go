@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestChaosHandlerProbabilities(t *testing.T) {
+	const requests = 10000
+	examples := []struct {
+		delayProbability, errorProbability float64
+	}{
+		{0, 0},
+		{0.25, 0},
+		{0, 0.1},
+		{0.5, 0.5},
+		{1, 1},
+	}
+	for _, ex := range examples {
+		handler := NewChaosHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		}), time.Nanosecond, ex.delayProbability, ex.errorProbability)
+
+		delayed, failed := 0, 0
+		for i := 0; i < requests; i++ {
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+			for _, v := range rw.Header()["X-Router-Chaos"] {
+				if v == "delay" {
+					delayed++
+				}
+			}
+			switch rw.Code {
+			case http.StatusInternalServerError:
+				failed++
+			case http.StatusTeapot:
+			default:
+				t.Fatalf("Unexpected status %d", rw.Code)
+			}
+		}
+
+		// Allow for a deviation of well over 5 standard deviations, so
+		// that the test isn't flaky.
+		for _, c := range []struct {
+			name     string
+			count    int
+			expected float64
+		}{{"delayed", delayed, ex.delayProbability}, {"failed", failed, ex.errorProbability}} {
+			rate := float64(c.count) / requests
+			if math.Abs(rate-c.expected) > 0.03 {
+				t.Errorf("With probabilities %v/%v, expected %.2f of requests to be %s, got %.3f",
+					ex.delayProbability, ex.errorProbability, c.expected, c.name, rate)
+			}
+		}
+	}
+}
+
+func TestChaosDelayEndsWithRequest(t *testing.T) {
+	handler := NewChaosHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected an abandoned request not to reach the wrapped handler")
+	}), time.Minute, 1, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the delay to end with the request, took %v", elapsed)
+	}
+}
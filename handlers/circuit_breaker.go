@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// CircuitBreaker keeps track of the failures of a backend. Once the backend
+// has failed threshold times in a row, with no more than window between the
+// first and last failures, the circuit opens and requests are refused
+// without being sent to the backend. After cooldown a single request is let
+// through to test whether the backend has recovered: if it succeeds the
+// circuit closes again, and if not it stays open for another cooldown.
+type CircuitBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	mu           sync.Mutex
+	state        circuitState
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+	trialPending bool
+	trips        int64
+	rejected     int64
+}
+
+// NewCircuitBreaker returns a closed CircuitBreaker with the passed limits.
+func NewCircuitBreaker(threshold int, window, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{threshold: threshold, window: window, cooldown: cooldown}
+}
+
+// Stats returns the state of the circuit, along with the number of times it
+// has opened and the number of requests it has refused.
+func (cb *CircuitBreaker) Stats() map[string]interface{} {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return map[string]interface{}{
+		"state":    cb.state.String(),
+		"trips":    cb.trips,
+		"rejected": cb.rejected,
+	}
+}
+
+// ResetStats sets the counts of trips and refused requests back to zero,
+// without changing the state of the circuit.
+func (cb *CircuitBreaker) ResetStats() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.trips, cb.rejected = 0, 0
+}
+
+// RecordHealthCheck updates the circuit with the outcome of an out-of-band
+// check of the backend's health. A healthy backend's circuit is closed
+// straight away, without waiting for the cool-down, while an unhealthy
+// backend's circuit is opened (or kept open for another cool-down).
+func (cb *CircuitBreaker) RecordHealthCheck(healthy bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failures = 0
+	cb.trialPending = false
+	if healthy {
+		cb.state = circuitClosed
+		return
+	}
+	if cb.state != circuitOpen {
+		cb.trips++
+	}
+	cb.state = circuitOpen
+	cb.openedAt = time.Now()
+}
+
+// Open reports whether the circuit is open and still cooling down, so that
+// requests sent to the backend would be refused. Unlike allow, it doesn't
+// change the state of the circuit.
+func (cb *CircuitBreaker) Open() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.state == circuitOpen && time.Since(cb.openedAt) < cb.cooldown
+}
+
+// allow reports whether a request may be sent to the backend, and if not,
+// how long it is until the backend will next be tried.
+func (cb *CircuitBreaker) allow() (bool, time.Duration) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case circuitOpen:
+		if wait := cb.cooldown - time.Since(cb.openedAt); wait > 0 {
+			cb.rejected++
+			return false, wait
+		}
+		cb.state = circuitHalfOpen
+		cb.trialPending = true
+		return true, 0
+	case circuitHalfOpen:
+		if cb.trialPending {
+			cb.rejected++
+			return false, cb.cooldown
+		}
+		cb.trialPending = true
+		return true, 0
+	}
+	return true, 0
+}
+
+// record updates the circuit with the outcome of a request to the backend.
+func (cb *CircuitBreaker) record(failed bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := time.Now()
+	switch {
+	case cb.state == circuitOpen:
+		// A request from before the circuit opened; it tells us nothing new.
+	case !failed:
+		cb.state = circuitClosed
+		cb.failures = 0
+		cb.trialPending = false
+	case cb.state == circuitHalfOpen:
+		cb.state = circuitOpen
+		cb.openedAt = now
+		cb.trialPending = false
+		cb.trips++
+	default:
+		if cb.failures == 0 || now.Sub(cb.firstFailure) > cb.window {
+			cb.failures = 0
+			cb.firstFailure = now
+		}
+		cb.failures++
+		if cb.failures >= cb.threshold {
+			cb.state = circuitOpen
+			cb.openedAt = now
+			cb.failures = 0
+			cb.trips++
+		}
+	}
+}
+
+// circuitBypassKey is the context key marking requests which are sent to the
+// backend whatever the state of its circuit.
+type circuitBypassKey struct{}
+
+// BypassCircuitBreaker returns a copy of r which circuit-breaking handlers
+// pass straight to the backend, without recording the outcome. It's for
+// health probes, whose outcome is recorded with RecordHealthCheck.
+func BypassCircuitBreaker(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), circuitBypassKey{}, true))
+}
+
+// NewCircuitBreakingHandler wraps a backend handler so that its responses
+// are recorded by breaker, and requests are answered with a 503 while the
+// circuit is open. Responses with a 5xx status (including those generated
+// when the backend can't be reached) count as failures, except where the
+// client has gone away.
+func NewCircuitBreakingHandler(handler http.Handler, breaker *CircuitBreaker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(circuitBypassKey{}) != nil {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if ok, wait := breaker.allow(); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		failed := true
+		defer func() {
+			breaker.record(failed)
+		}()
+		handler.ServeHTTP(sw, r)
+		failed = sw.status >= 500 && r.Context().Err() != context.Canceled
+	})
+}
+
+// statusWriter passes a response through, keeping a note of its status and
+// the size of its body.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 && code >= 200 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+func (sw *statusWriter) Flush() {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
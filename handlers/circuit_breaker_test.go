@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyBackend answers with the status stored in status, counting the
+// requests it receives.
+type flakyBackend struct {
+	status   atomic.Int32
+	requests atomic.Int32
+}
+
+func (b *flakyBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.requests.Add(1)
+	w.WriteHeader(int(b.status.Load()))
+}
+
+func serveStatus(handler http.Handler) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/foo", nil))
+	return w
+}
+
+func TestCircuitBreakerTripsAndRecovers(t *testing.T) {
+	backend := &flakyBackend{}
+	backend.status.Store(http.StatusBadGateway)
+	breaker := NewCircuitBreaker(3, time.Second, 50*time.Millisecond)
+	handler := NewCircuitBreakingHandler(backend, breaker)
+
+	for i := 0; i < 3; i++ {
+		if w := serveStatus(handler); w.Code != http.StatusBadGateway {
+			t.Fatalf("Expected failure %d to be passed through, got %d", i, w.Code)
+		}
+	}
+	if state := breaker.Stats()["state"]; state != "open" {
+		t.Fatalf("Expected the circuit to open after 3 failures, got %v", state)
+	}
+
+	w := serveStatus(handler)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected a fast 503 with Retry-After while open, got %d %v", w.Code, w.Header())
+	}
+	if n := backend.requests.Load(); n != 3 {
+		t.Errorf("Expected the backend not to be called while open, got %d requests", n)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	backend.status.Store(http.StatusOK)
+	for i := 0; i < 3; i++ {
+		if w := serveStatus(handler); w.Code != http.StatusOK {
+			t.Errorf("Expected request %d after the cool-down to succeed, got %d", i, w.Code)
+		}
+	}
+	stats := breaker.Stats()
+	if stats["state"] != "closed" || stats["trips"] != int64(1) || stats["rejected"] != int64(1) {
+		t.Errorf("Expected the circuit to close again after recovery, got %v", stats)
+	}
+}
+
+func TestCircuitBreakerReopensOnFailedTrial(t *testing.T) {
+	backend := &flakyBackend{}
+	backend.status.Store(http.StatusInternalServerError)
+	breaker := NewCircuitBreaker(1, time.Second, 50*time.Millisecond)
+	handler := NewCircuitBreakingHandler(backend, breaker)
+
+	serveStatus(handler)
+	time.Sleep(60 * time.Millisecond)
+	if w := serveStatus(handler); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected the trial request to reach the backend, got %d", w.Code)
+	}
+	if w := serveStatus(handler); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the circuit to reopen after a failed trial, got %d", w.Code)
+	}
+	if n := backend.requests.Load(); n != 2 {
+		t.Errorf("Expected 2 requests to reach the backend, got %d", n)
+	}
+}
+
+func TestCircuitBreakerOnlyCountsFailuresWithinWindow(t *testing.T) {
+	backend := &flakyBackend{}
+	backend.status.Store(http.StatusServiceUnavailable)
+	breaker := NewCircuitBreaker(2, 20*time.Millisecond, time.Minute)
+	handler := NewCircuitBreakingHandler(backend, breaker)
+
+	serveStatus(handler)
+	time.Sleep(30 * time.Millisecond)
+	serveStatus(handler)
+	if state := breaker.Stats()["state"]; state != "closed" {
+		t.Errorf("Expected failures further apart than the window not to open the circuit, got %v", state)
+	}
+
+	backend.status.Store(http.StatusOK)
+	serveStatus(handler)
+	backend.status.Store(http.StatusServiceUnavailable)
+	serveStatus(handler)
+	if state := breaker.Stats()["state"]; state != "closed" {
+		t.Errorf("Expected a success to reset the count of failures, got %v", state)
+	}
+}
+
+func TestCircuitBreakerHealthCheck(t *testing.T) {
+	backend := &flakyBackend{}
+	backend.status.Store(http.StatusBadGateway)
+	breaker := NewCircuitBreaker(1, time.Second, time.Minute)
+	handler := NewCircuitBreakingHandler(backend, breaker)
+	serveStatus(handler)
+
+	if status := Probe(handler, "/health", time.Second); status != http.StatusBadGateway {
+		t.Errorf("Expected a probe to reach the backend while the circuit is open, got %d", status)
+	}
+	breaker.RecordHealthCheck(false)
+	if w := serveStatus(handler); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the circuit to stay open after a failed health check, got %d", w.Code)
+	}
+
+	backend.status.Store(http.StatusOK)
+	breaker.RecordHealthCheck(true)
+	if w := serveStatus(handler); w.Code != http.StatusOK {
+		t.Errorf("Expected the circuit to close after a passed health check, got %d", w.Code)
+	}
+	breaker.RecordHealthCheck(false)
+	stats := breaker.Stats()
+	if stats["state"] != "open" || stats["trips"] != int64(2) {
+		t.Errorf("Expected a failed health check to open the circuit, got %v", stats)
+	}
+}
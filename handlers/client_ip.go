@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseTrustedProxies parses a comma-separated list of IP addresses and CIDR
+// ranges (e.g. "10.0.0.0/8, 127.0.0.1") for use with ClientIP.
+func ParseTrustedProxies(list string) (proxies []*net.IPNet, err error) {
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy address %q", entry)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy range %q", entry)
+		}
+		proxies = append(proxies, ipNet)
+	}
+	return proxies, nil
+}
+
+// ClientIP works out the address of the client which made a request. The
+// request's X-Forwarded-For chain is only believed as far as it was added to
+// by trusted proxies: starting with the peer that connected to us, and then
+// walking the chain from right to left, the first address which isn't a
+// trusted proxy is the client. Anything further left could have been made up
+// by that client.
+func ClientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	if !isTrusted(client, trustedProxies) {
+		return client
+	}
+
+	hops := make([]string, 0)
+	for _, line := range r.Header["X-Forwarded-For"] {
+		for _, hop := range strings.Split(line, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			// A hop we can't make sense of: the last address which we
+			// could is the best we can do.
+			break
+		}
+		client = hops[i]
+		if !isTrusted(client, trustedProxies) {
+			break
+		}
+	}
+	return client
+}
+
+// RequestScheme returns "https" if a request reached the router over TLS, or
+// came from a trusted proxy (which terminated TLS for it) with an
+// X-Forwarded-Proto header of https, and "http" otherwise. Where proxies have
+// appended to the header, the last value (from the proxy nearest the router)
+// is used.
+func RequestScheme(r *http.Request, trustedProxies []*net.IPNet) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	values := r.Header.Values("X-Forwarded-Proto")
+	if len(values) == 0 || !isTrusted(peer, trustedProxies) {
+		return "http"
+	}
+	protos := strings.Split(values[len(values)-1], ",")
+	if proto := strings.ToLower(strings.TrimSpace(protos[len(protos)-1])); proto == "https" {
+		return proto
+	}
+	return "http"
+}
+
+func isTrusted(addr string, trustedProxies []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range trustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies(" 10.0.0.0/8, 127.0.0.1,::1 ,")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []string{"10.0.0.0/8", "127.0.0.1/32", "::1/128"}
+	if len(proxies) != len(expected) {
+		t.Fatalf("Expected %d proxies, got %d", len(expected), len(proxies))
+	}
+	for i, p := range proxies {
+		if p.String() != expected[i] {
+			t.Errorf("Expected proxy %d to be %s, got %s", i, expected[i], p)
+		}
+	}
+
+	for _, list := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0.1/8/8"} {
+		if _, err := ParseTrustedProxies(list); err == nil {
+			t.Errorf("Expected an error parsing %q", list)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, _ := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+
+	testCases := []struct {
+		description string
+		remoteAddr  string
+		xff         []string
+		expected    string
+	}{
+		{"direct connection", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"spoofed header from an untrusted client", "203.0.113.7:1234", []string{"1.2.3.4"}, "203.0.113.7"},
+		{"single trusted proxy", "10.0.0.1:1234", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"chain of trusted proxies", "10.0.0.1:1234", []string{"203.0.113.7, 192.168.1.1, 10.1.2.3"}, "203.0.113.7"},
+		{"chain split over several headers", "10.0.0.1:1234", []string{"203.0.113.7", "192.168.1.1"}, "203.0.113.7"},
+		{"spoofed hops left of the client", "10.0.0.1:1234", []string{"1.2.3.4, 10.9.9.9, 203.0.113.7, 10.1.2.3"}, "203.0.113.7"},
+		{"trusted proxy without a header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"only trusted proxies", "10.0.0.1:1234", []string{"10.0.0.2, 10.0.0.3"}, "10.0.0.2"},
+		{"garbage in the chain", "10.0.0.1:1234", []string{"203.0.113.7, garbage, 10.0.0.2"}, "10.0.0.2"},
+		{"IPv6 client", "[::1]:1234", []string{"203.0.113.7"}, "::1"},
+	}
+
+	for _, tc := range testCases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		r.Header["X-Forwarded-For"] = tc.xff
+		if ip := ClientIP(r, trusted); ip != tc.expected {
+			t.Errorf("%s: expected client IP %s, got %s", tc.description, tc.expected, ip)
+		}
+	}
+}
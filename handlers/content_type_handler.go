@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// NewContentTypeHandler returns a handler which chooses between several
+// handlers (usually backends) by the media type of the request's
+// Content-Type, ignoring any parameters such as charset. Media types are
+// compared case-insensitively. Requests without a Content-Type, or with one
+// which isn't in handlers or can't be parsed, are passed to fallback.
+func NewContentTypeHandler(handlers map[string]http.Handler, fallback http.Handler) http.Handler {
+	byType := make(map[string]http.Handler, len(handlers))
+	for mediaType, handler := range handlers {
+		byType[strings.ToLower(mediaType)] = handler
+	}
+	return &contentTypeHandler{byType, fallback}
+}
+
+type contentTypeHandler struct {
+	handlers map[string]http.Handler
+	fallback http.Handler
+}
+
+func (h *contentTypeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		// ParseMediaType lower-cases the media type.
+		if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+			if handler, ok := h.handlers[mediaType]; ok {
+				handler.ServeHTTP(w, r)
+				return
+			}
+		}
+	}
+	h.fallback.ServeHTTP(w, r)
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestContentTypeHandler(t *testing.T) {
+	handler := NewContentTypeHandler(map[string]http.Handler{
+		"application/json":    namedHandler("api"),
+		"Multipart/Form-Data": namedHandler("uploads"),
+	}, namedHandler("default"))
+
+	examples := []struct {
+		contentType, expected string
+	}{
+		{"application/json", "api"},
+		{"application/json; charset=utf-8", "api"},
+		{"APPLICATION/JSON", "api"},
+		{"multipart/form-data; boundary=xyz", "uploads"},
+		{"text/html", "default"},
+		{"application/json-patch+json", "default"},
+		{"not a media type;;", "default"},
+		{"", "default"},
+	}
+	for _, ex := range examples {
+		r := httptest.NewRequest("POST", "/", nil)
+		if ex.contentType != "" {
+			r.Header.Set("Content-Type", ex.contentType)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Body.String() != ex.expected {
+			t.Errorf("Expected Content-Type %q to be served by %s, got %s", ex.contentType, ex.expected, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// NewDecompressingHandler wraps a handler so that request bodies sent with a
+// Content-Encoding of gzip or deflate are decompressed on their way through,
+// for backends which can't decode them themselves. The body is decompressed
+// as it is read, rather than buffered, so its decoded length isn't known in
+// advance: the Content-Encoding and Content-Length headers are removed.
+// Requests with any other Content-Encoding are passed through untouched.
+func NewDecompressingHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var newReader func(io.Reader) (io.ReadCloser, error)
+		switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+		case "gzip", "x-gzip":
+			newReader = func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }
+		case "deflate":
+			newReader = zlib.NewReader
+		default:
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := newReader(r.Body)
+		if err != nil {
+			http.Error(w, "Malformed request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		r2 := r.Clone(r.Context())
+		r2.Body = &decompressedBody{body, r.Body}
+		r2.ContentLength = -1
+		r2.Header.Del("Content-Encoding")
+		r2.Header.Del("Content-Length")
+		handler.ServeHTTP(w, r2)
+	})
+}
+
+// decompressedBody reads from a decompressor, and closes both it and the
+// original request body.
+type decompressedBody struct {
+	io.ReadCloser
+	original io.ReadCloser
+}
+
+func (b *decompressedBody) Close() error {
+	b.ReadCloser.Close()
+	return b.original.Close()
+}
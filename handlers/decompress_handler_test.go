@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"github.com/alphagov/router/logger"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// echoBody responds with the headers and body of the request it receives.
+var echoBody = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Content-Encoding", r.Header.Get("Content-Encoding"))
+	w.Header().Set("X-Content-Length", r.Header.Get("Content-Length"))
+	io.Copy(w, r.Body)
+})
+
+func TestDecompressingHandler(t *testing.T) {
+	payload := bytes.Repeat([]byte(`{"hello": "world"}`), 100)
+
+	var gzipped, deflated bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(payload)
+	gw.Close()
+	zw := zlib.NewWriter(&deflated)
+	zw.Write(payload)
+	zw.Close()
+
+	testCases := []struct {
+		encoding string
+		body     []byte
+		status   int
+		expected []byte
+		encoded  string
+	}{
+		{"gzip", gzipped.Bytes(), 200, payload, ""},
+		{"GZIP", gzipped.Bytes(), 200, payload, ""},
+		{"deflate", deflated.Bytes(), 200, payload, ""},
+		{"", payload, 200, payload, ""},
+		{"br", []byte("brotli"), 200, []byte("brotli"), "br"},
+		{"gzip", []byte("not gzip"), 400, nil, ""},
+	}
+
+	handler := NewDecompressingHandler(echoBody)
+	for _, tc := range testCases {
+		r := httptest.NewRequest("POST", "/", bytes.NewReader(tc.body))
+		if tc.encoding != "" {
+			r.Header.Set("Content-Encoding", tc.encoding)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.encoding, tc.status, w.Code)
+			continue
+		}
+		if tc.status != 200 {
+			continue
+		}
+		if !bytes.Equal(w.Body.Bytes(), tc.expected) {
+			t.Errorf("%s: expected the handler to receive %d decoded bytes, got %q", tc.encoding, len(tc.expected), w.Body.String())
+		}
+		if got := w.Header().Get("X-Content-Encoding"); got != tc.encoded {
+			t.Errorf("%s: expected the handler to see Content-Encoding %q, got %q", tc.encoding, tc.encoded, got)
+		}
+	}
+}
+
+func TestDecompressingHandlerProxiesDecodedBody(t *testing.T) {
+	backend := httptest.NewServer(echoBody)
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	l, _ := logger.New(io.Discard)
+
+	router := httptest.NewServer(NewDecompressingHandler(NewBackendHandler(backendURL, time.Second, 0, time.Second, 0, nil, false, l)))
+	defer router.Close()
+
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write([]byte("Hello, backend"))
+	gw.Close()
+
+	req, _ := http.NewRequest("POST", router.URL, &gzipped)
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if string(body) != "Hello, backend" {
+		t.Errorf("Expected the backend to receive the decoded body, got %q", body)
+	}
+	if enc := resp.Header.Get("X-Content-Encoding"); enc != "" {
+		t.Errorf("Expected the backend not to see a Content-Encoding, got %q", enc)
+	}
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// hostResolver is the part of net.Resolver used by DNSCache.
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+// DNSCache caches the addresses of backend hosts for a fixed TTL, so that
+// requests to a backend don't each have to resolve its hostname.
+type DNSCache struct {
+	resolver hostResolver
+	ttl      time.Duration
+	now      func() time.Time
+	mu       sync.Mutex
+	entries  map[string]dnsCacheEntry
+	hits     int64
+	misses   int64
+}
+
+type dnsCacheEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// NewDNSCache creates a DNSCache which holds on to each host's addresses for
+// ttl after looking them up.
+func NewDNSCache(ttl time.Duration) *DNSCache {
+	return &DNSCache{
+		resolver: net.DefaultResolver,
+		ttl:      ttl,
+		now:      time.Now,
+		entries:  make(map[string]dnsCacheEntry),
+	}
+}
+
+// ResetStats sets the hit and miss counts back to zero, leaving the cached
+// lookups in place.
+func (c *DNSCache) ResetStats() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.hits, c.misses = 0, 0
+}
+
+// Stats returns the hit and miss counts for the cache, and the number of
+// hosts it currently holds addresses for.
+func (c *DNSCache) Stats() (stats map[string]interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats = make(map[string]interface{})
+	stats["hits"] = c.hits
+	stats["misses"] = c.misses
+	stats["hosts"] = len(c.entries)
+	return
+}
+
+// LookupHost returns the addresses of host, from the cache if they were
+// looked up less than the TTL ago.
+func (c *DNSCache) LookupHost(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	if ok && c.now().Before(entry.expires) {
+		c.hits++
+		c.mu.Unlock()
+		return entry.addrs, nil
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[host] = dnsCacheEntry{addrs, c.now().Add(c.ttl)}
+	c.mu.Unlock()
+	return addrs, nil
+}
+
+// DialContext returns a dial function for an http.Transport which resolves
+// hostnames through the cache, and then dials the addresses in turn with
+// dialer until one succeeds. Addresses which are already IPs are dialled
+// directly.
+func (c *DNSCache) DialContext(dialer *net.Dialer) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, address)
+		}
+
+		addrs, err := c.LookupHost(ctx, host)
+		if err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		for _, addr := range addrs {
+			var conn net.Conn
+			conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type fakeResolver struct {
+	lookups map[string]int
+	addrs   map[string][]string
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.lookups[host]++
+	addrs, ok := r.addrs[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func newTestDNSCache(ttl time.Duration) (*DNSCache, *fakeResolver, *time.Time) {
+	resolver := &fakeResolver{
+		lookups: make(map[string]int),
+		addrs:   map[string][]string{"backend.example": {"127.0.0.1"}},
+	}
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewDNSCache(ttl)
+	c.resolver = resolver
+	c.now = func() time.Time { return now }
+	return c, resolver, &now
+}
+
+func TestDNSCacheRespectsTTL(t *testing.T) {
+	c, resolver, now := newTestDNSCache(10 * time.Second)
+
+	for i := 0; i < 3; i++ {
+		addrs, err := c.LookupHost(context.Background(), "backend.example")
+		if err != nil || len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+			t.Fatalf("Unexpected lookup result %v, %v", addrs, err)
+		}
+	}
+	if n := resolver.lookups["backend.example"]; n != 1 {
+		t.Errorf("Expected 1 lookup within the TTL, got %d", n)
+	}
+
+	*now = now.Add(9 * time.Second)
+	c.LookupHost(context.Background(), "backend.example")
+	if n := resolver.lookups["backend.example"]; n != 1 {
+		t.Errorf("Expected no further lookup just before the TTL expires, got %d lookups", n)
+	}
+
+	*now = now.Add(time.Second)
+	c.LookupHost(context.Background(), "backend.example")
+	if n := resolver.lookups["backend.example"]; n != 2 {
+		t.Errorf("Expected another lookup once the TTL expired, got %d lookups", n)
+	}
+
+	stats := c.Stats()
+	if stats["hits"] != int64(3) || stats["misses"] != int64(2) || stats["hosts"] != 1 {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+}
+
+func TestDNSCacheDoesNotCacheFailures(t *testing.T) {
+	c, resolver, _ := newTestDNSCache(time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.LookupHost(context.Background(), "missing.example"); err == nil {
+			t.Error("Expected an error looking up a missing host")
+		}
+	}
+	if n := resolver.lookups["missing.example"]; n != 2 {
+		t.Errorf("Expected failed lookups to be retried, got %d lookups", n)
+	}
+}
+
+func TestDNSCacheDialContext(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	c, resolver, _ := newTestDNSCache(time.Minute)
+	dial := c.DialContext(&net.Dialer{Timeout: time.Second})
+
+	for _, address := range []string{"backend.example:" + port, "backend.example:" + port, "127.0.0.1:" + port} {
+		conn, err := dial(context.Background(), "tcp", address)
+		if err != nil {
+			t.Fatalf("Unexpected error dialling %s: %v", address, err)
+		}
+		conn.Close()
+	}
+	if n := resolver.lookups["backend.example"]; n != 1 {
+		t.Errorf("Expected the hostname to be resolved once, got %d lookups", n)
+	}
+	if len(resolver.lookups) != 1 {
+		t.Errorf("Expected IP addresses to be dialled without a lookup, got %v", resolver.lookups)
+	}
+
+	_, err = dial(context.Background(), "tcp", "missing.example:"+port)
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		t.Errorf("Expected lookup failures to be returned as a *net.OpError, got %#v", err)
+	}
+}
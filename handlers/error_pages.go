@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/alphagov/router/logger"
+	"io"
+	"net/http"
+	"time"
+)
+
+// errorPageHeader marks the router's requests for error pages, so that an
+// error page which is itself served by the router can't trigger another
+// fetch.
+const errorPageHeader = "X-Router-Error-Page"
+
+// maxErrorPageSize is the largest error page which will be served. The page
+// is read in full before any of it is sent, so that a failed fetch can fall
+// back to the usual response.
+const maxErrorPageSize = 1 << 20
+
+// ErrorPages serves error responses using pages fetched from backends,
+// configured by status code.
+type ErrorPages struct {
+	urls   map[int]string
+	client *http.Client
+	logger logger.Logger
+}
+
+// NewErrorPages returns ErrorPages serving the page at urls[status] for
+// responses with that status. Pages taking longer than timeout to fetch
+// aren't used.
+func NewErrorPages(urls map[int]string, timeout time.Duration, logger logger.Logger) *ErrorPages {
+	return &ErrorPages{urls, &http.Client{Timeout: timeout}, logger}
+}
+
+// Wrap wraps a handler so that responses with a configured status and an
+// empty body, such as those generated when a backend can't be reached, are
+// replaced by the error page. The status is kept. If the page can't be
+// fetched, the original empty response is sent.
+func (p *ErrorPages) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(errorPageHeader) != "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		ew := &errorPageWriter{ResponseWriter: w, pages: p}
+		handler.ServeHTTP(ew, r)
+		if ew.held != 0 {
+			p.Serve(w, r, ew.held, nil)
+		}
+	})
+}
+
+// PageHandler returns a handler which answers every request with the error
+// page for status, or passes it to fallback if there's no page for status
+// or it can't be fetched.
+func (p *ErrorPages) PageHandler(status int, fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.Serve(w, r, status, fallback)
+	})
+}
+
+// Serve responds with the error page for status. If there isn't one, or it
+// can't be fetched, the request is passed to fallback, or if that's nil
+// answered with status and an empty body.
+func (p *ErrorPages) Serve(w http.ResponseWriter, r *http.Request, status int, fallback http.Handler) {
+	contentType, body, err := p.fetch(r, status)
+	if err != nil {
+		if err != errNoErrorPage {
+			p.logger.LogFromClientRequest(map[string]interface{}{"error": err.Error(), "status": status}, r)
+		}
+		if fallback != nil {
+			fallback.ServeHTTP(w, r)
+		} else {
+			w.WriteHeader(status)
+		}
+		return
+	}
+	w.Header().Del("Content-Encoding")
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// has reports whether there's an error page for status.
+func (p *ErrorPages) has(status int) bool {
+	_, ok := p.urls[status]
+	return ok
+}
+
+var errNoErrorPage = errors.New("no error page")
+
+// fetch gets the error page for status, which must be returned with a 200.
+func (p *ErrorPages) fetch(r *http.Request, status int) (contentType string, body []byte, err error) {
+	url, ok := p.urls[status]
+	if !ok || r.Header.Get(errorPageHeader) != "" {
+		return "", nil, errNoErrorPage
+	}
+
+	// The page is still wanted if the request has timed out, which is one of
+	// the responses it may be replacing.
+	req, err := http.NewRequestWithContext(context.WithoutCancel(r.Context()), "GET", url, nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("couldn't fetch error page %s: %v", url, err)
+	}
+	req.Header.Set(errorPageHeader, fmt.Sprint(status))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", nil, fmt.Errorf("couldn't fetch error page %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("couldn't fetch error page %s: got status %d", url, resp.StatusCode)
+	}
+	body, err = io.ReadAll(io.LimitReader(resp.Body, maxErrorPageSize+1))
+	if err == nil && len(body) > maxErrorPageSize {
+		err = fmt.Errorf("larger than %d bytes", maxErrorPageSize)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("couldn't fetch error page %s: %v", url, err)
+	}
+	return resp.Header.Get("Content-Type"), body, nil
+}
+
+// errorPageWriter holds back a response with a status which has an error
+// page until its body starts. If the body turns out to be empty, held is
+// left set so that the error page can be sent instead.
+type errorPageWriter struct {
+	http.ResponseWriter
+	pages   *ErrorPages
+	held    int
+	started bool
+}
+
+func (ew *errorPageWriter) WriteHeader(code int) {
+	if !ew.started && code >= 200 && ew.pages.has(code) {
+		ew.held = code
+		ew.started = true
+		return
+	}
+	if code >= 200 {
+		ew.started = true
+	}
+	ew.ResponseWriter.WriteHeader(code)
+}
+
+// release sends a held status, as the response has a body of its own.
+func (ew *errorPageWriter) release() {
+	if ew.held != 0 {
+		ew.ResponseWriter.WriteHeader(ew.held)
+		ew.held = 0
+	}
+	ew.started = true
+}
+
+func (ew *errorPageWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	ew.release()
+	return ew.ResponseWriter.Write(b)
+}
+
+func (ew *errorPageWriter) Flush() {
+	ew.release()
+	if f, ok := ew.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (ew *errorPageWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"bytes"
+	"github.com/alphagov/router/logger"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorPages(t *testing.T) {
+	pageServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Router-Error-Page") == "" {
+			t.Error("Expected the error page request to be marked as one")
+		}
+		switch r.URL.Path {
+		case "/404":
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, "<h1>Not found</h1>")
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer pageServer.Close()
+
+	var buf bytes.Buffer
+	l, _ := logger.New(&buf)
+	pages := NewErrorPages(map[int]string{
+		404: pageServer.URL + "/404",
+		503: pageServer.URL + "/broken",
+	}, time.Second, l)
+
+	respond := func(status int, body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			io.WriteString(w, body)
+		})
+	}
+
+	examples := []struct {
+		name        string
+		handler     http.Handler
+		status      int
+		body        string
+		contentType string
+	}{
+		{"configured page", respond(404, ""), 404, "<h1>Not found</h1>", "text/html"},
+		{"backend body", respond(404, "the backend's own page"), 404, "the backend's own page", ""},
+		{"page can't be fetched", respond(503, ""), 503, "", ""},
+		{"no page configured", respond(502, ""), 502, "", ""},
+		{"success", respond(200, ""), 200, "", ""},
+	}
+	for _, ex := range examples {
+		rw := httptest.NewRecorder()
+		pages.Wrap(ex.handler).ServeHTTP(rw, httptest.NewRequest("GET", "/foo", nil))
+		if rw.Code != ex.status || rw.Body.String() != ex.body || rw.Header().Get("Content-Type") != ex.contentType {
+			t.Errorf("%s: expected %d %q (%q), got %d %q (%q)", ex.name, ex.status, ex.body, ex.contentType,
+				rw.Code, rw.Body.String(), rw.Header().Get("Content-Type"))
+		}
+	}
+
+	l.Flush()
+	if !strings.Contains(buf.String(), "couldn't fetch error page") {
+		t.Errorf("Expected the failed fetch to be logged, got %q", buf.String())
+	}
+}
+
+func TestErrorPagesFallBack(t *testing.T) {
+	var buf bytes.Buffer
+	l, _ := logger.New(&buf)
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	pages := NewErrorPages(map[int]string{404: unreachable.URL + "/404"}, time.Second, l)
+	handler := pages.PageHandler(404, NewNotFoundHandler(404, "text/plain", "static body\n"))
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/foo", nil))
+	if rw.Code != 404 || rw.Body.String() != "static body\n" {
+		t.Errorf("Expected the static body when the page can't be fetched, got %d %q", rw.Code, rw.Body.String())
+	}
+
+	// A request for an error page never fetches another, even if it would
+	// be served by the router.
+	rw = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/404", nil)
+	req.Header.Set("X-Router-Error-Page", "404")
+	handler.ServeHTTP(rw, req)
+	l.Flush()
+	if rw.Body.String() != "static body\n" {
+		t.Errorf("Expected an error page request to get the static body, got %q", rw.Body.String())
+	}
+	if strings.Count(buf.String(), "couldn't fetch error page") != 1 {
+		t.Errorf("Expected only the first request to fetch the error page, got %q", buf.String())
+	}
+}
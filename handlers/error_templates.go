@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/alphagov/router/logger"
+	"html/template"
+	"net/http"
+	"os"
+)
+
+// ErrorTemplates replaces the bodies of backends' 5xx responses with the
+// router's own, rendered from templates configured by status code, so that
+// clients see the same error pages whichever backend failed.
+type ErrorTemplates struct {
+	templates map[int]*template.Template
+	logger    logger.Logger
+}
+
+// ErrorTemplateData is what error templates are rendered with.
+type ErrorTemplateData struct {
+	Status     int
+	StatusText string
+	Path       string
+}
+
+// NewErrorTemplates parses the HTML template in files[status] for each
+// status, which must be a 5xx. Each template is rendered once with example
+// data, so that one which can't be rendered is an error here rather than
+// when a backend fails.
+func NewErrorTemplates(files map[int]string, logger logger.Logger) (*ErrorTemplates, error) {
+	templates := make(map[int]*template.Template, len(files))
+	for status, file := range files {
+		if status < 500 || status > 599 {
+			return nil, fmt.Errorf("error template %s is for status %d, which isn't a 5xx", file, status)
+		}
+		text, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read error template: %v", err)
+		}
+		tmpl, err := template.New(file).Parse(string(text))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse error template: %v", err)
+		}
+		example := ErrorTemplateData{status, http.StatusText(status), "/"}
+		if err := tmpl.Execute(&bytes.Buffer{}, example); err != nil {
+			return nil, fmt.Errorf("couldn't render error template: %v", err)
+		}
+		templates[status] = tmpl
+	}
+	return &ErrorTemplates{templates, logger}, nil
+}
+
+// Wrap wraps a handler so that its responses with a status which has a
+// template are sent with the rendered template in place of their body. The
+// status is kept, along with the headers other than those describing the
+// body. Other responses are passed on untouched.
+func (t *ErrorTemplates) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(&errorTemplateWriter{ResponseWriter: w, templates: t, req: r}, r)
+	})
+}
+
+// render renders the template for status, if there is one.
+func (t *ErrorTemplates) render(status int, r *http.Request) ([]byte, bool) {
+	tmpl, ok := t.templates[status]
+	if !ok {
+		return nil, false
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, ErrorTemplateData{status, http.StatusText(status), r.URL.Path}); err != nil {
+		// The backend's body is sent instead.
+		t.logger.LogFromClientRequest(map[string]interface{}{"error": fmt.Sprintf("couldn't render error template: %v", err), "status": status}, r)
+		return nil, false
+	}
+	return body.Bytes(), true
+}
+
+// errorTemplateWriter sends the rendered template as soon as a status with
+// one is written, and then discards the backend's body.
+type errorTemplateWriter struct {
+	http.ResponseWriter
+	templates *ErrorTemplates
+	req       *http.Request
+	started   bool
+	replaced  bool
+}
+
+func (ew *errorTemplateWriter) WriteHeader(code int) {
+	if ew.started || code < 200 {
+		ew.ResponseWriter.WriteHeader(code)
+		return
+	}
+	ew.started = true
+	body, ok := ew.templates.render(code, ew.req)
+	if !ok {
+		ew.ResponseWriter.WriteHeader(code)
+		return
+	}
+	ew.replaced = true
+	h := ew.Header()
+	h.Del("Content-Encoding")
+	h.Del("Content-Range")
+	h.Del("ETag")
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Length", fmt.Sprint(len(body)))
+	ew.ResponseWriter.WriteHeader(code)
+	ew.ResponseWriter.Write(body)
+}
+
+func (ew *errorTemplateWriter) Write(b []byte) (int, error) {
+	ew.started = true
+	if ew.replaced {
+		return len(b), nil
+	}
+	return ew.ResponseWriter.Write(b)
+}
+
+func (ew *errorTemplateWriter) Flush() {
+	if ew.replaced {
+		return
+	}
+	if f, ok := ew.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (ew *errorTemplateWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"github.com/alphagov/router/logger"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestErrorTemplates(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "500.html")
+	os.WriteFile(file, []byte("<h1>{{.Status}} {{.StatusText}}</h1><p>{{.Path}}</p>"), 0644)
+	l, _ := logger.New(io.Discard)
+	templates, err := NewErrorTemplates(map[int]string{500: file}, l)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing templates: %v", err)
+	}
+
+	respond := func(status int, body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("X-Backend", "yes")
+			w.WriteHeader(status)
+			io.WriteString(w, body)
+		})
+	}
+
+	examples := []struct {
+		name        string
+		handler     http.Handler
+		status      int
+		body        string
+		contentType string
+	}{
+		{"backend 500", respond(500, "stack trace"), 500, "<h1>500 Internal Server Error</h1><p>/foo&lt;b&gt;</p>", "text/html; charset=utf-8"},
+		{"no template", respond(502, "bad gateway"), 502, "bad gateway", "text/plain"},
+		{"backend 404", respond(404, "not here"), 404, "not here", "text/plain"},
+		{"success", respond(200, "ok"), 200, "ok", "text/plain"},
+	}
+	for _, ex := range examples {
+		rw := httptest.NewRecorder()
+		templates.Wrap(ex.handler).ServeHTTP(rw, httptest.NewRequest("GET", "/foo<b>", nil))
+		if rw.Code != ex.status || rw.Body.String() != ex.body || rw.Header().Get("Content-Type") != ex.contentType {
+			t.Errorf("%s: expected %d %q (%q), got %d %q (%q)", ex.name, ex.status, ex.body, ex.contentType,
+				rw.Code, rw.Body.String(), rw.Header().Get("Content-Type"))
+		}
+		if rw.Header().Get("X-Backend") != "yes" {
+			t.Errorf("%s: expected the backend's other headers to be kept", ex.name)
+		}
+	}
+}
+
+func TestErrorTemplatesInvalid(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.html")
+	os.WriteFile(valid, []byte("<h1>{{.Status}}</h1>"), 0644)
+	unparsable := filepath.Join(dir, "unparsable.html")
+	os.WriteFile(unparsable, []byte("<h1>{{.Status</h1>"), 0644)
+	unrenderable := filepath.Join(dir, "unrenderable.html")
+	os.WriteFile(unrenderable, []byte("<h1>{{.Missing}}</h1>"), 0644)
+	l, _ := logger.New(io.Discard)
+
+	for name, files := range map[string]map[int]string{
+		"not a 5xx":    {404: valid},
+		"missing file": {500: filepath.Join(dir, "missing.html")},
+		"unparsable":   {500: unparsable},
+		"unrenderable": {500: unrenderable},
+	} {
+		if _, err := NewErrorTemplates(files, l); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
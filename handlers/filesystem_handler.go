@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"net/http"
+	"os"
+	"path"
+)
+
+// NewFileSystemHandler returns a handler which serves files from the
+// directory root, looking them up by the request path with stripPrefix
+// removed. Directory listings are never served: a request for a directory is
+// answered with its index.html, or a 404 if it doesn't have one.
+func NewFileSystemHandler(root, stripPrefix string) http.Handler {
+	fileServer := http.FileServer(noListingFileSystem{http.Dir(root)})
+	if stripPrefix == "" {
+		return fileServer
+	}
+	return http.StripPrefix(stripPrefix, fileServer)
+}
+
+// noListingFileSystem wraps an http.FileSystem, hiding any directories which
+// http.FileServer would otherwise list.
+type noListingFileSystem struct {
+	fs http.FileSystem
+}
+
+func (nfs noListingFileSystem) Open(name string) (http.File, error) {
+	f, err := nfs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if stat.IsDir() {
+		index, err := nfs.fs.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
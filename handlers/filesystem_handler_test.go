@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, name, content string) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileSystemHandler(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "hello.txt"), "Hello, world")
+	writeFile(t, filepath.Join(root, "listed", "file.txt"), "unlisted")
+	writeFile(t, filepath.Join(root, "indexed", "index.html"), "<p>Index</p>")
+
+	handler := NewFileSystemHandler(root, "/assets")
+
+	testCases := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/assets/hello.txt", http.StatusOK, "Hello, world"},
+		{"/assets/listed/file.txt", http.StatusOK, "unlisted"},
+		{"/assets/missing.txt", http.StatusNotFound, ""},
+		{"/assets/listed/", http.StatusNotFound, ""},
+		{"/assets/", http.StatusNotFound, ""},
+		{"/assets/indexed/", http.StatusOK, "<p>Index</p>"},
+		{"/assets/../../hello.txt", http.StatusOK, "Hello, world"}, // stays within root
+		{"/assets/../../../etc/passwd", http.StatusNotFound, ""},
+		{"/other/hello.txt", http.StatusNotFound, ""},
+	}
+
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+		if w.Code != tc.status {
+			t.Errorf("Expected GET %s to return status %d, got %d", tc.path, tc.status, w.Code)
+		}
+		if tc.body != "" && w.Body.String() != tc.body {
+			t.Errorf("Expected GET %s to return body %q, got %q", tc.path, tc.body, w.Body.String())
+		}
+	}
+}
+
+func TestFileSystemHandlerWithoutStripPrefix(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "assets", "hello.txt"), "Hello, world")
+
+	w := httptest.NewRecorder()
+	NewFileSystemHandler(root, "").ServeHTTP(w, httptest.NewRequest("GET", "/assets/hello.txt", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "Hello, world" {
+		t.Errorf("Expected the file to be served from its full path, got %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// hashRingReplicas is the number of points each node has on a HashRing.
+// More points spread the keys more evenly between the nodes.
+const hashRingReplicas = 100
+
+// HashRing assigns keys to nodes by consistent hashing, so that when a node
+// is added or removed only the keys it takes or held move between nodes.
+type HashRing struct {
+	points []uint64
+	nodes  map[uint64]string
+}
+
+// NewHashRing returns a ring holding the passed nodes.
+func NewHashRing(nodes []string) *HashRing {
+	ring := &HashRing{nodes: make(map[uint64]string, len(nodes)*hashRingReplicas)}
+	for _, node := range nodes {
+		for i := 0; i < hashRingReplicas; i++ {
+			point := hashKey(node + "#" + strconv.Itoa(i))
+			if _, taken := ring.nodes[point]; taken {
+				continue
+			}
+			ring.nodes[point] = node
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// Get returns the node which key is assigned to: the first node on the ring
+// at or after the key's hash, passing over any for which skip returns true.
+// If every node is skipped (or the ring is empty), ok is false.
+func (ring *HashRing) Get(key string, skip func(node string) bool) (node string, ok bool) {
+	if len(ring.points) == 0 {
+		return "", false
+	}
+	hash := hashKey(key)
+	start := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= hash })
+	tried := make(map[string]bool)
+	for i := 0; i < len(ring.points); i++ {
+		node := ring.nodes[ring.points[(start+i)%len(ring.points)]]
+		if tried[node] {
+			continue
+		}
+		if skip == nil || !skip(node) {
+			return node, true
+		}
+		tried[node] = true
+	}
+	return "", false
+}
+
+// hashKey hashes a key or ring point. FNV alone leaves similar strings (such
+// as a node's points) close together on the ring, so its result is mixed
+// with MurmurHash3's finaliser to spread them out.
+func hashKey(key string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	h := hash.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// ParseHashKey parses the request attribute to hash requests by: "path" (the
+// default, if spec is empty), "header:<name>", "cookie:<name>" or
+// "query:<name>". It returns a function which gets the attribute from a
+// request, returning an empty string if the request doesn't have it.
+func ParseHashKey(spec string) (func(r *http.Request) string, error) {
+	if spec == "" || spec == "path" {
+		return func(r *http.Request) string { return r.URL.Path }, nil
+	}
+	kind, name, _ := strings.Cut(spec, ":")
+	if name == "" {
+		return nil, fmt.Errorf("invalid hash key %q", spec)
+	}
+	switch kind {
+	case "header":
+		return func(r *http.Request) string { return r.Header.Get(name) }, nil
+	case "cookie":
+		return func(r *http.Request) string {
+			if c, err := r.Cookie(name); err == nil {
+				return c.Value
+			}
+			return ""
+		}, nil
+	case "query":
+		return func(r *http.Request) string { return r.URL.Query().Get(name) }, nil
+	}
+	return nil, fmt.Errorf("invalid hash key %q, must be path, header:<name>, cookie:<name> or query:<name>", spec)
+}
+
+// NewConsistentHashHandler returns a handler which chooses between several
+// handlers (usually backends) by consistent hashing of the key returned for
+// each request, so that requests with the same key go to the same handler
+// as long as it's healthy, for backends which cache by key. Handlers whose
+// circuit breaker (if they have one in breakers) is open are passed over for
+// the next on the ring. Requests with an empty key are passed to fallback,
+// as are those where every handler is unhealthy.
+func NewConsistentHashHandler(key func(r *http.Request) string, handlers map[string]http.Handler, breakers map[string]*CircuitBreaker, fallback http.Handler) http.Handler {
+	nodes := make([]string, 0, len(handlers))
+	for node := range handlers {
+		nodes = append(nodes, node)
+	}
+	return &consistentHashHandler{key, NewHashRing(nodes), handlers, breakers, fallback}
+}
+
+type consistentHashHandler struct {
+	key      func(r *http.Request) string
+	ring     *HashRing
+	handlers map[string]http.Handler
+	breakers map[string]*CircuitBreaker
+	fallback http.Handler
+}
+
+func (h *consistentHashHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if key := h.key(r); key != "" {
+		if node, ok := h.ring.Get(key, h.unhealthy); ok {
+			h.handlers[node].ServeHTTP(w, r)
+			return
+		}
+	}
+	h.fallback.ServeHTTP(w, r)
+}
+
+func (h *consistentHashHandler) unhealthy(node string) bool {
+	breaker := h.breakers[node]
+	return breaker != nil && breaker.Open()
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHashRing(t *testing.T) {
+	ring := NewHashRing([]string{"a", "b", "c", "d"})
+
+	assigned := make(map[string]string)
+	shares := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		key := "/page/" + strconv.Itoa(i)
+		node, ok := ring.Get(key, nil)
+		if !ok {
+			t.Fatalf("Expected %s to be assigned a node", key)
+		}
+		if again, _ := ring.Get(key, nil); again != node {
+			t.Errorf("Expected %s to stay on %s, got %s", key, node, again)
+		}
+		assigned[key] = node
+		shares[node]++
+	}
+	for _, node := range []string{"a", "b", "c", "d"} {
+		if shares[node] < 100 {
+			t.Errorf("Expected the keys to be spread between the nodes, got %v", shares)
+			break
+		}
+	}
+
+	// Skipping a node, or removing it from the ring, only moves its keys.
+	skipC := func(node string) bool { return node == "c" }
+	withoutC := NewHashRing([]string{"a", "b", "d"})
+	for key, node := range assigned {
+		skipped, _ := ring.Get(key, skipC)
+		removed, _ := withoutC.Get(key, nil)
+		if skipped != removed {
+			t.Errorf("Expected skipping c to assign %s as removing it does (%s), got %s", key, removed, skipped)
+		}
+		if node != "c" && skipped != node {
+			t.Errorf("Expected %s to stay on %s when c is skipped, got %s", key, node, skipped)
+		}
+		if node == "c" && skipped == "c" {
+			t.Errorf("Expected %s to move off c when it's skipped", key)
+		}
+	}
+
+	if _, ok := ring.Get("/foo", func(string) bool { return true }); ok {
+		t.Error("Expected no node when every node is skipped")
+	}
+	if _, ok := NewHashRing(nil).Get("/foo", nil); ok {
+		t.Error("Expected no node from an empty ring")
+	}
+}
+
+func TestConsistentHashHandler(t *testing.T) {
+	key, err := ParseHashKey("header:X-Cache-Key")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing hash key: %v", err)
+	}
+	breakers := map[string]*CircuitBreaker{"b": NewCircuitBreaker(1, time.Minute, time.Minute)}
+	handler := NewConsistentHashHandler(key, map[string]http.Handler{
+		"a": namedHandler("a"),
+		"b": namedHandler("b"),
+		"c": namedHandler("c"),
+	}, breakers, namedHandler("fallback"))
+
+	serve := func(value string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		if value != "" {
+			r.Header.Set("X-Cache-Key", value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+
+	if got := serve(""); got != "fallback" {
+		t.Errorf("Expected a request without a key to be served by the fallback, got %s", got)
+	}
+	before := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		value := "key-" + strconv.Itoa(i)
+		before[value] = serve(value)
+		if again := serve(value); again != before[value] {
+			t.Errorf("Expected %s to be served by %s again, got %s", value, before[value], again)
+		}
+	}
+
+	breakers["b"].RecordHealthCheck(false)
+	for value, node := range before {
+		got := serve(value)
+		if got == "b" || (node != "b" && got != node) {
+			t.Errorf("Expected %s (served by %s) to avoid b while it's unhealthy, got %s", value, node, got)
+		}
+	}
+}
+
+func TestParseHashKey(t *testing.T) {
+	r := httptest.NewRequest("GET", "/foo/bar?user=123", nil)
+	r.Header.Set("X-Region", "eu")
+	r.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+
+	examples := []struct {
+		spec, expected string
+	}{
+		{"", "/foo/bar"},
+		{"path", "/foo/bar"},
+		{"header:X-Region", "eu"},
+		{"cookie:session", "abc"},
+		{"query:user", "123"},
+		{"query:missing", ""},
+	}
+	for _, ex := range examples {
+		key, err := ParseHashKey(ex.spec)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %v", ex.spec, err)
+			continue
+		}
+		if got := key(r); got != ex.expected {
+			t.Errorf("Expected %q to give %q, got %q", ex.spec, ex.expected, got)
+		}
+	}
+	for _, spec := range []string{"host", "header:", "body:foo"} {
+		if _, err := ParseHashKey(spec); err == nil {
+			t.Errorf("Expected an error parsing %q", spec)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// NewHeadHandler wraps a handler which generates its own responses so that
+// HEAD requests are answered with exactly the status and headers that a GET
+// would receive (including Content-Length), but without a body. The wrapped
+// handler is run as if for a GET, and the body it writes is discarded.
+//
+// It isn't needed for handlers which already treat HEAD properly, such as
+// those built on http.ServeContent, or for proxies to backends.
+func NewHeadHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		get := r.Clone(r.Context())
+		get.Method = "GET"
+		hw := &headResponseWriter{ResponseWriter: w}
+		handler.ServeHTTP(hw, get)
+		hw.finish()
+	})
+}
+
+// headResponseWriter holds back the status of a response until the handler
+// has finished, counting (and discarding) the body it writes in the meantime.
+type headResponseWriter struct {
+	http.ResponseWriter
+	status int
+	length int
+}
+
+func (hw *headResponseWriter) WriteHeader(code int) {
+	if hw.status == 0 {
+		hw.status = code
+	}
+}
+
+func (hw *headResponseWriter) Write(b []byte) (int, error) {
+	if hw.status == 0 {
+		hw.status = http.StatusOK
+	}
+	hw.length += len(b)
+	return len(b), nil
+}
+
+func (hw *headResponseWriter) finish() {
+	if hw.status == 0 {
+		hw.status = http.StatusOK
+	}
+	header := hw.Header()
+	if header.Get("Content-Length") == "" && header.Get("Transfer-Encoding") == "" && bodyAllowedForStatus(hw.status) {
+		header.Set("Content-Length", strconv.Itoa(hw.length))
+	}
+	hw.ResponseWriter.WriteHeader(hw.status)
+}
+
+func bodyAllowedForStatus(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
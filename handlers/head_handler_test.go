@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/alphagov/router/logger"
+)
+
+func TestHeadMatchesGet(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "hello.txt"), "Hello, world")
+	l, _ := logger.New(io.Discard)
+	redirect, _ := NewRedirectHandler("/redirect", "/target", false, false, 0, l)
+
+	mux := http.NewServeMux()
+	mux.Handle("/redirect", NewHeadHandler(redirect))
+	mux.Handle("/gone", NewHeadHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	})))
+	mux.Handle("/static", NewHeadHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("Static body"))
+	})))
+	mux.Handle("/files/", NewFileSystemHandler(root, "/files"))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	do := func(method, path string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	for _, path := range []string{"/redirect", "/gone", "/static", "/files/hello.txt"} {
+		get, _ := do("GET", path)
+		head, body := do("HEAD", path)
+
+		if head.StatusCode != get.StatusCode {
+			t.Errorf("%s: expected HEAD status %d to match GET, got %d", path, get.StatusCode, head.StatusCode)
+		}
+		for _, name := range []string{"Content-Length", "Content-Type", "Location", "Cache-Control"} {
+			if head.Header.Get(name) != get.Header.Get(name) {
+				t.Errorf("%s: expected HEAD %s header %q to match GET, got %q", path, name, get.Header.Get(name), head.Header.Get(name))
+			}
+		}
+		if body != "" {
+			t.Errorf("%s: expected an empty body for HEAD, got %q", path, body)
+		}
+	}
+}
+
+func TestHeadHandlerPassesOtherMethodsThrough(t *testing.T) {
+	handler := NewHeadHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method))
+	}))
+	for _, method := range []string{"GET", "POST"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/", nil))
+		if w.Body.String() != method {
+			t.Errorf("Expected %s to be passed through, got %q", method, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+)
+
+// NewHTTPSRedirectHandler wraps a handler so that requests made over plain
+// HTTP (as RequestScheme tells) are redirected to the same URL with https,
+// keeping the host, path and query. GET and HEAD requests get a 301, and
+// others a 308 so that clients repeat the method and body. Requests made
+// over HTTPS, and those without a Host to redirect to, are passed on.
+func NewHTTPSRedirectHandler(handler http.Handler, trustedProxies []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "" || RequestScheme(r, trustedProxies) != "http" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		status := http.StatusPermanentRedirect
+		if r.Method == "GET" || r.Method == "HEAD" {
+			status = http.StatusMovedPermanently
+		}
+		w.Header().Set("Location", "https://"+r.Host+r.URL.RequestURI())
+		w.WriteHeader(status)
+	})
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPSRedirectHandler(t *testing.T) {
+	trusted, _ := ParseTrustedProxies("10.0.0.0/8")
+	handler := NewHTTPSRedirectHandler(namedHandler("backend"), trusted)
+
+	examples := []struct {
+		name, method, remoteAddr, proto string
+		tls                             bool
+		status                          int
+		location                        string
+	}{
+		{"plain HTTP", "GET", "203.0.113.7:1234", "", false, 301, "https://www.example.com/foo%20bar?q=1"},
+		{"plain HTTP POST", "POST", "203.0.113.7:1234", "", false, 308, "https://www.example.com/foo%20bar?q=1"},
+		{"direct TLS", "GET", "203.0.113.7:1234", "", true, 200, ""},
+		{"forwarded https", "GET", "10.0.0.1:1234", "https", false, 200, ""},
+		{"forwarded https, upper case", "GET", "10.0.0.1:1234", "HTTPS", false, 200, ""},
+		{"forwarded http", "GET", "10.0.0.1:1234", "http", false, 301, "https://www.example.com/foo%20bar?q=1"},
+		{"forwarded through several proxies", "GET", "10.0.0.1:1234", "http, https", false, 200, ""},
+		{"spoofed https from an untrusted client", "GET", "203.0.113.7:1234", "https", false, 301, "https://www.example.com/foo%20bar?q=1"},
+	}
+	for _, ex := range examples {
+		req := httptest.NewRequest(ex.method, "http://www.example.com/foo%20bar?q=1", nil)
+		req.RemoteAddr = ex.remoteAddr
+		if ex.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", ex.proto)
+		}
+		if ex.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		if rw.Code != ex.status || rw.Header().Get("Location") != ex.location {
+			t.Errorf("%s: expected %d to %q, got %d to %q", ex.name, ex.status, ex.location, rw.Code, rw.Header().Get("Location"))
+		}
+		if ex.status == http.StatusOK && rw.Body.String() != "backend" {
+			t.Errorf("%s: expected the request to be passed on, got %q", ex.name, rw.Body.String())
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// LazyHandler is a handler which isn't built until it first serves a
+// request, for handlers (such as backends, with their connection pools)
+// which are costly to keep around and may never be used.
+type LazyHandler struct {
+	build   func() http.Handler
+	once    sync.Once
+	handler http.Handler
+	built   atomic.Bool
+}
+
+// NewLazyHandler returns a handler which calls build when it first serves a
+// request, and passes that and every later request to the handler build
+// returned. build is called at most once, however many requests arrive at
+// once.
+func NewLazyHandler(build func() http.Handler) *LazyHandler {
+	return &LazyHandler{build: build}
+}
+
+func (h *LazyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.once.Do(func() {
+		h.handler = h.build()
+		h.build = nil
+		h.built.Store(true)
+	})
+	h.handler.ServeHTTP(w, r)
+}
+
+// Built reports whether the handler has been built.
+func (h *LazyHandler) Built() bool {
+	return h.built.Load()
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLazyHandler(t *testing.T) {
+	var builds atomic.Int32
+	handler := NewLazyHandler(func() http.Handler {
+		builds.Add(1)
+		return namedHandler("built")
+	})
+	unused := NewLazyHandler(func() http.Handler {
+		t.Error("Expected a handler which serves no requests never to be built")
+		return nil
+	})
+
+	if handler.Built() || unused.Built() {
+		t.Fatal("Expected the handlers not to be built before serving a request")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+			if rw.Body.String() != "built" {
+				t.Errorf("Expected the request to be served by the built handler, got %q", rw.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := builds.Load(); n != 1 {
+		t.Errorf("Expected the handler to be built exactly once, got %d builds", n)
+	}
+	if !handler.Built() || unused.Built() {
+		t.Errorf("Expected only the handler which served requests to be built, got %v and %v", handler.Built(), unused.Built())
+	}
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxMirrorsInFlight limits the number of mirrored requests a handler will
+// have outstanding at once, so that a slow shadow can't pile up goroutines.
+// Requests arriving while the limit is reached aren't mirrored.
+const maxMirrorsInFlight = 64
+
+// NewMirroringHandler wraps a handler so that a copy of each request is also
+// sent to shadow, in the background, and its response thrown away. The
+// client's response always comes from handler and doesn't wait for shadow.
+//
+// Request bodies of up to maxBodyBytes are read in full before the request
+// is served, so that the copy can be sent; larger bodies are streamed to
+// handler as usual and the request isn't mirrored. Mirrored requests are
+// abandoned after timeout. CONNECT and upgrade requests are never mirrored.
+func NewMirroringHandler(handler, shadow http.Handler, maxBodyBytes int, timeout time.Duration) http.Handler {
+	return &mirroringHandler{handler, shadow, maxBodyBytes, timeout, make(chan struct{}, maxMirrorsInFlight)}
+}
+
+type mirroringHandler struct {
+	handler      http.Handler
+	shadow       http.Handler
+	maxBodyBytes int
+	timeout      time.Duration
+	inFlight     chan struct{}
+}
+
+func (h *mirroringHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "CONNECT" || r.Header.Get("Upgrade") != "" {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, int64(h.maxBodyBytes)+1))
+		// Whatever was read is put back in front of the rest of the body, so
+		// the primary sees the request as it arrived.
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		if err != nil || len(body) > h.maxBodyBytes {
+			h.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	select {
+	case h.inFlight <- struct{}{}:
+		// The copy is taken before the primary can change the request.
+		mirror := h.mirrorRequest(r, body)
+		go func() {
+			defer func() { <-h.inFlight }()
+			h.sendMirror(mirror)
+		}()
+	default:
+	}
+
+	h.handler.ServeHTTP(w, r)
+}
+
+// mirrorRequest copies r, with body, for sending to the shadow. It isn't
+// cancelled when the client's request finishes, only after the timeout.
+func (h *mirroringHandler) mirrorRequest(r *http.Request, body []byte) *http.Request {
+	mirror := r.Clone(context.WithoutCancel(r.Context()))
+	mirror.Body = http.NoBody
+	mirror.ContentLength = 0
+	if len(body) > 0 {
+		mirror.Body = io.NopCloser(bytes.NewReader(body))
+		mirror.ContentLength = int64(len(body))
+		mirror.TransferEncoding = nil
+	}
+	return mirror
+}
+
+// sendMirror serves a mirrored request with the shadow handler, discarding
+// the response. Errors reaching the shadow are logged by it as usual.
+func (h *mirroringHandler) sendMirror(mirror *http.Request) {
+	ctx, cancel := context.WithTimeout(mirror.Context(), h.timeout)
+	defer cancel()
+	defer func() {
+		// Nothing the shadow does may affect the router, including a panic
+		// from a proxy which couldn't finish copying the response.
+		recover()
+	}()
+	h.shadow.ServeHTTP(&discardWriter{header: make(http.Header)}, mirror.WithContext(ctx))
+}
+
+// readCloser reads from one reader but closes another.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// discardWriter is a ResponseWriter which throws the response away.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header         { return d.header }
+func (d *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardWriter) WriteHeader(int)             {}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mirroredRequest is what the shadow saw of a mirrored request.
+type mirroredRequest struct {
+	method, path, header, body string
+}
+
+func TestMirroringHandler(t *testing.T) {
+	mirrored := make(chan mirroredRequest, 10)
+	release := make(chan struct{})
+	shadow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirrored <- mirroredRequest{r.Method, r.URL.Path, r.Header.Get("X-Test"), string(body)}
+		// A slow shadow mustn't hold up the client's response.
+		<-release
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "shadow response")
+	})
+	primary := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Primary", "yes")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "primary saw "+string(body))
+	})
+	handler := NewMirroringHandler(primary, shadow, 10, time.Second)
+	defer close(release)
+
+	examples := []struct {
+		name, method, body string
+		mirrored           bool
+	}{
+		{"no body", "GET", "", true},
+		{"small body", "POST", "hello", true},
+		{"body at the limit", "POST", "0123456789", true},
+		{"body over the limit", "POST", "0123456789!", false},
+	}
+	for _, ex := range examples {
+		req := httptest.NewRequest(ex.method, "/foo", strings.NewReader(ex.body))
+		req.Header.Set("X-Test", ex.name)
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusCreated || rw.Header().Get("X-Primary") != "yes" || rw.Body.String() != "primary saw "+ex.body {
+			t.Errorf("%s: expected the primary's response, got %d %q", ex.name, rw.Code, rw.Body.String())
+		}
+		select {
+		case m := <-mirrored:
+			if !ex.mirrored {
+				t.Errorf("%s: expected the request not to be mirrored, got %+v", ex.name, m)
+			} else if m != (mirroredRequest{ex.method, "/foo", ex.name, ex.body}) {
+				t.Errorf("%s: expected the shadow to get a copy of the request, got %+v", ex.name, m)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if ex.mirrored {
+				t.Errorf("%s: expected the request to be mirrored", ex.name)
+			}
+		}
+	}
+}
+
+func TestMirroringHandlerShadowFailure(t *testing.T) {
+	done := make(chan struct{})
+	shadow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		panic(http.ErrAbortHandler)
+	})
+	handler := NewMirroringHandler(namedHandler("primary"), shadow, 10, time.Second)
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/foo", nil))
+	<-done
+	if rw.Code != http.StatusOK || rw.Body.String() != "primary" {
+		t.Errorf("Expected a failing shadow not to affect the response, got %d %q", rw.Code, rw.Body.String())
+	}
+}
@@ -0,0 +1,17 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+)
+
+// NewNotFoundHandler returns a handler which answers every request with the
+// passed status, content type and body, for use when no route matches.
+func NewNotFoundHandler(status int, contentType, body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	})
+}
@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNotFoundHandler(t *testing.T) {
+	handler := NewNotFoundHandler(http.StatusNotFound, "application/json", `{"error":"not_found"}`)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/missing", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected Content-Type application/json, got %q", ct)
+	}
+	if body := w.Body.String(); body != `{"error":"not_found"}` {
+		t.Errorf("Expected the configured body, got %q", body)
+	}
+}
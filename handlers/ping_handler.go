@@ -0,0 +1,19 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+)
+
+// NewPingHandler returns a handler which answers every request with a 200
+// and the passed body, for health probes which shouldn't depend on a
+// backend being up. The response is marked as uncacheable, so that probes
+// always reach the router.
+func NewPingHandler(body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, body)
+	})
+}
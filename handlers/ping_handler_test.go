@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPingHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewPingHandler("app OK").ServeHTTP(w, httptest.NewRequest("GET", "/app/healthcheck", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", w.Code)
+	}
+	if body := w.Body.String(); body != "app OK" {
+		t.Errorf("Expected body %q, got %q", "app OK", body)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("Expected the response to be uncacheable, got Cache-Control %q", cc)
+	}
+}
@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+)
+
+// DefaultReadOnlyBody is the body of the response to writes refused by a
+// read-only handler, if no other is given.
+const DefaultReadOnlyBody = "This page can't be changed at the moment. Please try again later.\n"
+
+// NewReadOnlyHandler wraps a handler so that requests with safe methods (GET,
+// HEAD, OPTIONS and TRACE) are passed through, and any others, which may
+// write, are answered with a 503 and body, such as while a backend's database
+// is being migrated.
+func NewReadOnlyHandler(handler http.Handler, body string) http.Handler {
+	if body == "" {
+		body = DefaultReadOnlyBody
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS", "TRACE":
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, body)
+	})
+}
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadOnlyHandler(t *testing.T) {
+	examples := []struct {
+		method, body string
+		status       int
+		expected     string
+	}{
+		{"GET", "", 200, "backend"},
+		{"OPTIONS", "", 200, "backend"},
+		{"POST", "", 503, DefaultReadOnlyBody},
+		{"PUT", "", 503, DefaultReadOnlyBody},
+		{"PATCH", "", 503, DefaultReadOnlyBody},
+		{"DELETE", "", 503, DefaultReadOnlyBody},
+		{"POST", "Migrating, back soon\n", 503, "Migrating, back soon\n"},
+	}
+	for _, ex := range examples {
+		handler := NewReadOnlyHandler(namedHandler("backend"), ex.body)
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(ex.method, "/foo", nil))
+		if rw.Code != ex.status || rw.Body.String() != ex.expected {
+			t.Errorf("%s: expected %d %q, got %d %q", ex.method, ex.status, ex.expected, rw.Code, rw.Body.String())
+		}
+	}
+}
@@ -1,44 +1,138 @@
 package handlers
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
+
+	"github.com/alphagov/router/logger"
 )
 
 const cacheDuration = 24 * time.Hour
 
-func NewRedirectHandler(sourcePath, targetPath string, prefix, temporary bool) http.Handler {
+// NewRedirectHandler returns a handler which redirects requests to
+// targetPath. The target may be a path on the same host, or an absolute
+// (or protocol-relative) URL on another host, in which case it is emitted in
+// the Location header verbatim. An error is returned if the target is not a
+// usable URL.
+//
+// A request whose redirect would point back at the URL requested is answered
+// with a 508 (Loop Detected) instead, and logged to the passed logger. So is
+// one whose Location would be longer than maxLocationLength bytes (unless
+// that's zero), as can happen when a prefix redirect appends a long path and
+// query string, with a 500.
+func NewRedirectHandler(sourcePath, targetPath string, prefix, temporary bool, maxLocationLength int, logger logger.Logger) (http.Handler, error) {
+	if err := validateRedirectTarget(targetPath); err != nil {
+		return nil, err
+	}
+
 	statusMoved := http.StatusMovedPermanently
 	if temporary {
 		statusMoved = http.StatusFound
 	}
 	if prefix {
-		return &pathPreservingRedirectHandler{sourcePath, targetPath, statusMoved}
+		return &pathPreservingRedirectHandler{sourcePath, targetPath, statusMoved, maxLocationLength, logger}, nil
+	}
+	return &redirectHandler{targetPath, statusMoved, maxLocationLength, logger}, nil
+}
+
+func validateRedirectTarget(target string) error {
+	if target == "" {
+		return errors.New("redirect target is empty")
 	}
-	return &redirectHandler{targetPath, statusMoved}
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "" && !strings.EqualFold(u.Scheme, "http") && !strings.EqualFold(u.Scheme, "https") {
+		return fmt.Errorf("redirect target %s has unsupported scheme %s", target, u.Scheme)
+	}
+	if (u.Scheme != "" || strings.HasPrefix(target, "//")) && u.Host == "" {
+		return fmt.Errorf("redirect target %s has no host", target)
+	}
+	return nil
+}
+
+// isAbsoluteTarget reports whether target refers to a (possibly) different
+// host, i.e. it has a scheme or is protocol-relative ("//host/path").
+func isAbsoluteTarget(target string) bool {
+	u, err := url.Parse(target)
+	return err == nil && (u.Scheme != "" || u.Host != "")
 }
 
 func addCacheHeaders(w http.ResponseWriter) {
 	w.Header().Set("Expires", time.Now().Add(cacheDuration).Format(time.RFC1123))
-	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, public", cacheDuration / time.Second))
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, public", cacheDuration/time.Second))
+}
+
+// isRedirectLoop reports whether redirecting the request to target would
+// send the client straight back to the URL it requested.
+func isRedirectLoop(r *http.Request, target string) bool {
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	if u.Host != "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		if !strings.EqualFold(u.Host, r.Host) || (u.Scheme != "" && !strings.EqualFold(u.Scheme, scheme)) {
+			return false
+		}
+	}
+	resolved := r.URL.ResolveReference(u)
+	return resolved.EscapedPath() == r.URL.EscapedPath() && resolved.RawQuery == r.URL.RawQuery
+}
+
+// redirect behaves like http.Redirect, except that absolute targets are
+// always passed through to the Location header untouched, redirects which
+// would loop are refused with an (uncached) 508, and those with targets
+// longer than maxLength (if it's positive) with a 500.
+func redirect(w http.ResponseWriter, r *http.Request, target string, code, maxLength int, l logger.Logger) {
+	if maxLength > 0 && len(target) > maxLength {
+		l.LogFromClientRequest(map[string]interface{}{
+			"error":  fmt.Sprintf("redirect Location of %d bytes is longer than the limit of %d", len(target), maxLength),
+			"status": http.StatusInternalServerError,
+		}, r)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if isRedirectLoop(r, target) {
+		l.LogFromClientRequest(map[string]interface{}{"error": "redirect to " + target + " redirects to itself", "status": http.StatusLoopDetected}, r)
+		w.WriteHeader(http.StatusLoopDetected)
+		return
+	}
+
+	addCacheHeaders(w)
+	if !isAbsoluteTarget(target) {
+		http.Redirect(w, r, target, code)
+		return
+	}
+	w.Header().Set("Location", target)
+	w.WriteHeader(code)
 }
 
 type redirectHandler struct {
-	url  string
-	code int
+	url       string
+	code      int
+	maxLength int
+	logger    logger.Logger
 }
 
 func (rh *redirectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	addCacheHeaders(w)
-	http.Redirect(w, r, rh.url, rh.code)
+	redirect(w, r, rh.url, rh.code, rh.maxLength, rh.logger)
 }
 
 type pathPreservingRedirectHandler struct {
 	sourcePrefix string
 	targetPrefix string
 	code         int
+	maxLength    int
+	logger       logger.Logger
 }
 
 func (rh *pathPreservingRedirectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -47,6 +141,5 @@ func (rh *pathPreservingRedirectHandler) ServeHTTP(w http.ResponseWriter, r *htt
 		target = target + "?" + r.URL.RawQuery
 	}
 
-	addCacheHeaders(w)
-	http.Redirect(w, r, target, rh.code)
+	redirect(w, r, target, rh.code, rh.maxLength, rh.logger)
 }
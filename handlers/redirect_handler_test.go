@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alphagov/router/logger"
+)
+
+func TestValidateRedirectTarget(t *testing.T) {
+	testCases := []struct {
+		target string
+		valid  bool
+	}{
+		{"/bar", true},
+		{"/bar?baz=qux", true},
+		{"http://other.example.org/path", true},
+		{"https://other.example.org/path", true},
+		{"HTTPS://other.example.org/path", true},
+		{"//other.example.org/path", true},
+		{"", false},
+		{"http:///path", false},
+		{"http:/foo", false},
+		{"///path", false},
+		{"javascript://alert(1)", false},
+		{"javascript:alert(1)", false},
+		{"JavaScript:alert(1)", false},
+		{"data:text/html,hi", false},
+		{"mailto:x@y", false},
+	}
+
+	for _, tc := range testCases {
+		err := validateRedirectTarget(tc.target)
+		if tc.valid && err != nil {
+			t.Errorf("Expected %q to be valid, got error: %v", tc.target, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("Expected %q to be invalid", tc.target)
+		}
+	}
+}
+
+func TestRedirectLoops(t *testing.T) {
+	testCases := []struct {
+		source, target string
+		prefix         bool
+		request        string
+		status         int
+	}{
+		{"/foo", "/foo", false, "http://www.example.com/foo", http.StatusLoopDetected},
+		{"/foo", "/foo?a=b", false, "http://www.example.com/foo?a=b", http.StatusLoopDetected},
+		{"/foo", "/foo?a=b", false, "http://www.example.com/foo", http.StatusMovedPermanently},
+		{"/foo", "http://www.example.com/foo", false, "http://www.example.com/foo", http.StatusLoopDetected},
+		{"/foo", "HTTP://WWW.EXAMPLE.COM/foo", false, "http://www.example.com/foo", http.StatusLoopDetected},
+		{"/foo", "//www.example.com/foo", false, "http://www.example.com/foo", http.StatusLoopDetected},
+		{"/foo", "https://www.example.com/foo", false, "http://www.example.com/foo", http.StatusMovedPermanently},
+		{"/foo", "http://other.example.com/foo", false, "http://www.example.com/foo", http.StatusMovedPermanently},
+		{"/foo", "/bar", false, "http://www.example.com/foo", http.StatusMovedPermanently},
+		{"/foo", "/foo", true, "http://www.example.com/foo/bar?x=y", http.StatusLoopDetected},
+		{"/foo", "/foo/new", true, "http://www.example.com/foo/bar", http.StatusMovedPermanently},
+	}
+
+	for _, tc := range testCases {
+		var buf bytes.Buffer
+		l, _ := logger.New(&buf)
+		handler, err := NewRedirectHandler(tc.source, tc.target, tc.prefix, false, 0, l)
+		if err != nil {
+			t.Fatalf("Unexpected error creating redirect to %s: %v", tc.target, err)
+		}
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest("GET", tc.request, nil))
+		l.Flush()
+
+		if rw.Code != tc.status {
+			t.Errorf("%s -> %s: expected status %d for %s, got %d", tc.source, tc.target, tc.status, tc.request, rw.Code)
+		}
+		loopLogged := strings.Contains(buf.String(), "redirects to itself")
+		if loopLogged != (tc.status == http.StatusLoopDetected) {
+			t.Errorf("%s -> %s: unexpected log output for %s: %q", tc.source, tc.target, tc.request, buf.String())
+		}
+		if tc.status == http.StatusLoopDetected && (rw.Header().Get("Location") != "" || rw.Header().Get("Cache-Control") != "") {
+			t.Errorf("%s -> %s: expected no Location or Cache-Control header, got %v", tc.source, tc.target, rw.Header())
+		}
+	}
+}
+
+func TestRedirectLocationLength(t *testing.T) {
+	var buf bytes.Buffer
+	l, _ := logger.New(&buf)
+	handler, err := NewRedirectHandler("/foo", "/bar", true, false, 100, l)
+	if err != nil {
+		t.Fatalf("Unexpected error creating redirect: %v", err)
+	}
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/foo/"+strings.Repeat("a", 80)+"?q=1", nil))
+	if rw.Code != http.StatusMovedPermanently {
+		t.Errorf("Expected a Location within the limit to be sent, got %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", "/foo/"+strings.Repeat("a", 80)+"?q="+strings.Repeat("b", 20), nil))
+	l.Flush()
+	if rw.Code != http.StatusInternalServerError || rw.Header().Get("Location") != "" {
+		t.Errorf("Expected a 500 without a Location for a Location over the limit, got %d %v", rw.Code, rw.Header())
+	}
+	if !strings.Contains(buf.String(), "longer than the limit of 100") {
+		t.Errorf("Expected the oversized Location to be logged, got %q", buf.String())
+	}
+}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+)
+
+// NewRegionHandler returns a handler which chooses between several handlers
+// (usually backends) by the value of the named request header, such as the
+// viewer's country added by a CDN, so that requests can be served from a
+// region-local backend. Values are compared case-insensitively, ignoring
+// surrounding whitespace. Requests without the header, or with a value which
+// isn't in regions, are passed to fallback.
+func NewRegionHandler(header string, regions map[string]http.Handler, fallback http.Handler) http.Handler {
+	byRegion := make(map[string]http.Handler, len(regions))
+	for region, handler := range regions {
+		byRegion[strings.ToLower(strings.TrimSpace(region))] = handler
+	}
+	return &regionHandler{header, byRegion, fallback}
+}
+
+type regionHandler struct {
+	header   string
+	regions  map[string]http.Handler
+	fallback http.Handler
+}
+
+func (h *regionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	region := strings.ToLower(strings.TrimSpace(r.Header.Get(h.header)))
+	if handler, ok := h.regions[region]; ok && region != "" {
+		handler.ServeHTTP(w, r)
+		return
+	}
+	h.fallback.ServeHTTP(w, r)
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegionHandler(t *testing.T) {
+	handler := NewRegionHandler("CloudFront-Viewer-Country", map[string]http.Handler{
+		"GB": namedHandler("backend-eu"),
+		"FR": namedHandler("backend-eu"),
+		"us": namedHandler("backend-us"),
+	}, namedHandler("default"))
+
+	examples := []struct {
+		region, expected string
+	}{
+		{"GB", "backend-eu"},
+		{"FR", "backend-eu"},
+		{"US", "backend-us"},
+		{" gb ", "backend-eu"},
+		{"JP", "default"},
+		{"", "default"},
+	}
+	for _, ex := range examples {
+		r := httptest.NewRequest("GET", "/", nil)
+		if ex.region != "" {
+			r.Header.Set("CloudFront-Viewer-Country", ex.region)
+		}
+		r.Header.Set("X-Other-Country", "US")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Body.String() != ex.expected {
+			t.Errorf("Expected region %q to be served by %s, got %s", ex.region, ex.expected, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+// NewResponseHeaderHandler wraps a handler so that extra headers are added
+// to every response it sends, whether from a backend or generated by the
+// router itself. The headers in defaults are only added when the response
+// doesn't already have them, while those in overrides replace whatever the
+// wrapped handler set.
+func NewResponseHeaderHandler(handler http.Handler, defaults, overrides http.Header) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(&headerInjectingWriter{ResponseWriter: w, defaults: defaults, overrides: overrides}, r)
+	})
+}
+
+// headerInjectingWriter adds its headers just before the response headers
+// are sent, once the wrapped handler has set its own.
+type headerInjectingWriter struct {
+	http.ResponseWriter
+	defaults    http.Header
+	overrides   http.Header
+	wroteHeader bool
+}
+
+func (hw *headerInjectingWriter) injectHeaders() {
+	header := hw.ResponseWriter.Header()
+	for k, vs := range hw.defaults {
+		if _, present := header[k]; !present {
+			header[k] = append([]string(nil), vs...)
+		}
+	}
+	for k, vs := range hw.overrides {
+		header[k] = append([]string(nil), vs...)
+	}
+}
+
+func (hw *headerInjectingWriter) WriteHeader(code int) {
+	// Informational responses are sent with the headers set so far, so they
+	// get the extra headers too, but don't count as the final response.
+	hw.injectHeaders()
+	if code >= 200 {
+		hw.wroteHeader = true
+	}
+	hw.ResponseWriter.WriteHeader(code)
+}
+
+func (hw *headerInjectingWriter) Write(b []byte) (int, error) {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(b)
+}
+
+func (hw *headerInjectingWriter) Flush() {
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := hw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (hw *headerInjectingWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
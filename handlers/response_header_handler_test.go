@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResponseHeaderHandler(t *testing.T) {
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+		w.Header().Set("Server", "backend")
+		w.Write([]byte("body"))
+	})
+	defaults := http.Header{"X-Frame-Options": {"DENY"}, "X-Content-Type-Options": {"nosniff"}}
+	overrides := http.Header{"Server": {"router"}}
+	handler := NewResponseHeaderHandler(backend, defaults, overrides)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/foo", nil))
+
+	expected := map[string]string{
+		"X-Frame-Options":        "SAMEORIGIN", // a default doesn't replace the backend's value
+		"X-Content-Type-Options": "nosniff",    // but is added when the backend has none
+		"Server":                 "router",     // overrides always win
+	}
+	for name, value := range expected {
+		if got := w.Header().Get(name); got != value {
+			t.Errorf("Expected %s to be %q, got %q", name, value, got)
+		}
+	}
+	if w.Body.String() != "body" {
+		t.Errorf("Expected the body to be passed through, got %q", w.Body.String())
+	}
+	if _, changed := defaults["Server"]; changed || len(defaults["X-Frame-Options"]) != 1 {
+		t.Errorf("Expected the configured headers not to be modified, got %v", defaults)
+	}
+}
+
+func TestResponseHeaderHandlerWithoutBody(t *testing.T) {
+	handler := NewResponseHeaderHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	}), http.Header{"X-Content-Type-Options": {"nosniff"}}, nil)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/foo", nil))
+	if w.Code != http.StatusGone || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("Expected a 410 with the injected header, got %d %v", w.Code, w.Header())
+	}
+}
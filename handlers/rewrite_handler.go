@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// NewRewritingHandler wraps a handler so that the part of the request path
+// which matches pattern is replaced with replacement before the request is
+// passed on. The replacement may refer to the pattern's capture groups as $1
+// or ${name}, as in regexp.Regexp.Expand. Paths which don't match are passed
+// on unchanged. The request's RequestURI isn't altered, so errors are still
+// logged against the path the client asked for.
+func NewRewritingHandler(handler http.Handler, pattern, replacement string) (http.Handler, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !re.MatchString(r.URL.Path) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		path := re.ReplaceAllString(r.URL.Path, replacement)
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = path
+		r2.URL.RawPath = ""
+		handler.ServeHTTP(w, r2)
+	}), nil
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRewritingHandler(t *testing.T) {
+	var seen *http.Request
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+	})
+	handler, err := NewRewritingHandler(backend, `^/old/(.*)$`, "/v2/$1")
+	if err != nil {
+		t.Fatalf("Unexpected error creating handler: %v", err)
+	}
+
+	examples := []struct {
+		requestURI string
+		path       string
+		rawQuery   string
+	}{
+		{"/old/foo/bar?baz=qux", "/v2/foo/bar", "baz=qux"}, // capture groups are substituted
+		{"/old/", "/v2/", ""},
+		{"/new/foo", "/new/foo", ""}, // non-matching paths pass through unchanged
+		{"/older/foo", "/older/foo", ""},
+	}
+	for _, ex := range examples {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", ex.requestURI, nil))
+		if seen.URL.Path != ex.path || seen.URL.RawQuery != ex.rawQuery {
+			t.Errorf("Expected %s to be passed on as %s?%s, got %s?%s",
+				ex.requestURI, ex.path, ex.rawQuery, seen.URL.Path, seen.URL.RawQuery)
+		}
+		if seen.RequestURI != ex.requestURI {
+			t.Errorf("Expected the original RequestURI %s to be kept, got %s", ex.requestURI, seen.RequestURI)
+		}
+	}
+}
+
+func TestRewritingHandlerRejectsInvalidPatterns(t *testing.T) {
+	if _, err := NewRewritingHandler(http.NotFoundHandler(), `/old/(`, "/v2/$1"); err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+}
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"github.com/alphagov/router/logger"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxScanClients limits the number of clients a ScanDetector keeps track of
+// at once. Each holds at most threshold path hashes, so this bounds the
+// detector's memory use.
+const maxScanClients = 10000
+
+// ScanDetector spots clients which request many distinct paths that aren't
+// found, as scanners looking for vulnerable software do.
+type ScanDetector struct {
+	threshold      int
+	window         time.Duration
+	block          bool
+	notFoundStatus int
+	trustedProxies []*net.IPNet
+	logger         logger.Logger
+
+	mu       sync.RWMutex
+	clients  map[string]*scanClient
+	detected int64
+	blocked  atomic.Int64
+}
+
+// scanClient records the distinct paths (by hash) which weren't found for a
+// client since start.
+type scanClient struct {
+	start        time.Time
+	paths        map[uint64]bool
+	flaggedUntil time.Time
+}
+
+// NewScanDetector returns a detector which flags a client once it has
+// received a 404 (or notFoundStatus) response for threshold distinct paths
+// within window of the first. Each flagged client is logged, and if block is
+// set, answered with a 429 until the window after it was flagged has passed.
+// Clients are identified by their address, taking X-Forwarded-For from
+// trustedProxies into account.
+func NewScanDetector(threshold int, window time.Duration, block bool, notFoundStatus int, trustedProxies []*net.IPNet, logger logger.Logger) *ScanDetector {
+	return &ScanDetector{
+		threshold:      threshold,
+		window:         window,
+		block:          block,
+		notFoundStatus: notFoundStatus,
+		trustedProxies: trustedProxies,
+		logger:         logger,
+		clients:        make(map[string]*scanClient),
+	}
+}
+
+// Wrap wraps a handler so that its not-found responses are counted towards
+// the client's total, and blocked clients are turned away.
+func (d *ScanDetector) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := ClientIP(r, d.trustedProxies)
+		if wait := d.blockedFor(client); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		handler.ServeHTTP(sw, r)
+		if sw.status == http.StatusNotFound || sw.status == d.notFoundStatus {
+			d.record(client, r.URL.Path)
+		}
+	})
+}
+
+// blockedFor returns how much longer the client is blocked for, if at all.
+func (d *ScanDetector) blockedFor(client string) time.Duration {
+	if !d.block {
+		return 0
+	}
+	d.mu.RLock()
+	c, ok := d.clients[client]
+	var flaggedUntil time.Time
+	if ok {
+		flaggedUntil = c.flaggedUntil
+	}
+	d.mu.RUnlock()
+
+	wait := time.Until(flaggedUntil)
+	if wait > 0 {
+		d.blocked.Add(1)
+	}
+	return wait
+}
+
+// record notes a path which wasn't found for the client, flagging the client
+// if it has now reached the threshold.
+func (d *ScanDetector) record(client, path string) {
+	hash := fnv.New64a()
+	hash.Write([]byte(path))
+	sum := hash.Sum64()
+	now := time.Now()
+
+	d.mu.Lock()
+	c, ok := d.clients[client]
+	if !ok {
+		if len(d.clients) >= maxScanClients {
+			d.sweep(now)
+		}
+		if len(d.clients) >= maxScanClients {
+			// Too busy to keep track of another client.
+			d.mu.Unlock()
+			return
+		}
+		c = &scanClient{start: now, paths: make(map[uint64]bool)}
+		d.clients[client] = c
+	}
+	if now.Sub(c.start) > d.window {
+		c.start = now
+		c.paths = make(map[uint64]bool)
+	}
+	if len(c.paths) >= d.threshold || c.paths[sum] {
+		d.mu.Unlock()
+		return
+	}
+	c.paths[sum] = true
+	flagged := len(c.paths) == d.threshold
+	if flagged {
+		c.flaggedUntil = now.Add(d.window)
+		d.detected++
+	}
+	d.mu.Unlock()
+
+	if flagged {
+		d.logger.Log(map[string]interface{}{
+			"event":          "scanner_detected",
+			"client_ip":      client,
+			"distinct_paths": d.threshold,
+			"window_seconds": d.window.Seconds(),
+			"blocked":        d.block,
+		})
+	}
+}
+
+// sweep forgets clients whose window and any block have expired. mu must be
+// held.
+func (d *ScanDetector) sweep(now time.Time) {
+	for client, c := range d.clients {
+		if now.Sub(c.start) > d.window && now.After(c.flaggedUntil) {
+			delete(d.clients, client)
+		}
+	}
+}
+
+// Stats returns the number of clients being tracked, the number of times a
+// client has been flagged, and the number of requests turned away.
+func (d *ScanDetector) Stats() map[string]interface{} {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return map[string]interface{}{
+		"tracked_clients": len(d.clients),
+		"detected":        d.detected,
+		"blocked":         d.blocked.Load(),
+	}
+}
+
+// ResetStats sets the detected and blocked counts back to zero.
+func (d *ScanDetector) ResetStats() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.detected = 0
+	d.blocked.Store(0)
+}
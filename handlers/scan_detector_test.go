@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/alphagov/router/logger"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScanDetector(t *testing.T) {
+	var buf bytes.Buffer
+	l, _ := logger.New(&buf)
+	detector := NewScanDetector(10, time.Minute, true, http.StatusNotFound, nil, l)
+	handler := detector.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+		}
+	}))
+
+	serve := func(client, path string) int {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = client + ":1234"
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, r)
+		return rw.Code
+	}
+
+	// A normal client hits a few missing pages, some of them repeatedly.
+	for i := 0; i < 50; i++ {
+		if status := serve("10.0.0.1", fmt.Sprintf("/missing-%d", i%5)); status != http.StatusNotFound {
+			t.Fatalf("Expected a normal client to get 404s, got %d", status)
+		}
+	}
+
+	// A scanner tries many different paths.
+	for i := 0; i < 10; i++ {
+		if status := serve("10.0.0.2", fmt.Sprintf("/wp-admin/%d.php", i)); status != http.StatusNotFound {
+			t.Fatalf("Expected the scanner's first 10 requests to get 404s, got %d", status)
+		}
+	}
+	if status := serve("10.0.0.2", "/"); status != http.StatusTooManyRequests {
+		t.Errorf("Expected the scanner to be blocked, got %d", status)
+	}
+	if status := serve("10.0.0.1", "/"); status != http.StatusOK {
+		t.Errorf("Expected the normal client not to be blocked, got %d", status)
+	}
+
+	l.Flush()
+	if n := strings.Count(buf.String(), `"event":"scanner_detected"`); n != 1 || !strings.Contains(buf.String(), `"client_ip":"10.0.0.2"`) {
+		t.Errorf("Expected the scanner to be logged once, got %q", buf.String())
+	}
+	stats := detector.Stats()
+	if stats["tracked_clients"] != 2 || stats["detected"] != int64(1) || stats["blocked"] != int64(1) {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+}
+
+func TestScanDetectorWindow(t *testing.T) {
+	l, _ := logger.New(&bytes.Buffer{})
+	detector := NewScanDetector(3, 20*time.Millisecond, true, http.StatusNotFound, nil, l)
+
+	// Misses spread out over more than the window never add up to the
+	// threshold.
+	for i := 0; i < 6; i++ {
+		detector.record("10.0.0.1", fmt.Sprintf("/missing-%d", i))
+		time.Sleep(15 * time.Millisecond)
+	}
+	if wait := detector.blockedFor("10.0.0.1"); wait > 0 {
+		t.Errorf("Expected a slow client not to be blocked, got %v", wait)
+	}
+
+	for i := 0; i < 3; i++ {
+		detector.record("10.0.0.2", fmt.Sprintf("/missing-%d", i))
+	}
+	if wait := detector.blockedFor("10.0.0.2"); wait <= 0 {
+		t.Error("Expected a fast client to be blocked")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if wait := detector.blockedFor("10.0.0.2"); wait > 0 {
+		t.Errorf("Expected the block to end after the window, got %v", wait)
+	}
+}
@@ -0,0 +1,19 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// NewStaticHandler returns a handler which answers every request with a 200
+// and the passed body and content type, for site-wide resources such as
+// /robots.txt which the router serves itself.
+func NewStaticHandler(contentType, body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, body)
+	})
+}
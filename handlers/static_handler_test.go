@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStaticHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewStaticHandler("text/plain", "User-agent: *\nDisallow:\n").ServeHTTP(w, httptest.NewRequest("GET", "/robots.txt", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", w.Code)
+	}
+	if body := w.Body.String(); body != "User-agent: *\nDisallow:\n" {
+		t.Errorf("Expected the fixed body, got %q", body)
+	}
+	if ct, cl := w.Header().Get("Content-Type"), w.Header().Get("Content-Length"); ct != "text/plain" || cl != "24" {
+		t.Errorf("Expected Content-Type text/plain and Content-Length 24, got %q and %q", ct, cl)
+	}
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+)
+
+// NewPrefixStrippingHandler wraps a handler so that prefix (which must start
+// with a slash and not end with one) is removed from the start of the
+// request path before the request is passed on. A request for the prefix
+// itself is passed on as "/". Paths which aren't beneath the prefix are
+// passed on unchanged. As with NewRewritingHandler, the request's RequestURI
+// isn't altered.
+func NewPrefixStrippingHandler(handler http.Handler, prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, ok := stripPathPrefix(r.URL.Path, prefix)
+		if !ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = path
+		r2.URL.RawPath, _ = stripPathPrefix(r.URL.RawPath, prefix)
+		handler.ServeHTTP(w, r2)
+	})
+}
+
+// stripPathPrefix removes prefix from path, reporting whether path was the
+// prefix or beneath it.
+func stripPathPrefix(path, prefix string) (string, bool) {
+	if path == prefix {
+		return "/", true
+	}
+	if rest := strings.TrimPrefix(path, prefix); len(rest) < len(path) && strings.HasPrefix(rest, "/") {
+		return rest, true
+	}
+	return "", false
+}
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPrefixStrippingHandler(t *testing.T) {
+	var seen *http.Request
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r
+	})
+	handler := NewPrefixStrippingHandler(backend, "/staging")
+
+	examples := []struct {
+		requestURI, path, rawPath string
+	}{
+		{"/staging/foo/bar?baz=qux", "/foo/bar", ""},
+		{"/staging", "/", ""},
+		{"/staging/", "/", ""},
+		{"/staging/a%2Fb", "/a/b", "/a%2Fb"},
+		{"/stagingfoo", "/stagingfoo", ""}, // not beneath the prefix, so unchanged
+		{"/foo", "/foo", ""},
+	}
+	for _, ex := range examples {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", ex.requestURI, nil))
+		if seen.URL.Path != ex.path || seen.URL.RawPath != ex.rawPath {
+			t.Errorf("Expected %s to be passed on as %s (raw %q), got %s (raw %q)",
+				ex.requestURI, ex.path, ex.rawPath, seen.URL.Path, seen.URL.RawPath)
+		}
+		if seen.RequestURI != ex.requestURI {
+			t.Errorf("Expected the original RequestURI %s to be kept, got %s", ex.requestURI, seen.RequestURI)
+		}
+	}
+}
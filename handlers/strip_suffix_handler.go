@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+)
+
+// NewSuffixStrippingHandler wraps a handler so that suffix (such as ".json")
+// is removed from the end of the request path before the request is passed
+// on, so that a backend serving "/foo" can also be routed "/foo.json". A
+// path which is only the suffix is passed on as "/". Paths which don't end
+// with the suffix are passed on unchanged. As with NewRewritingHandler, the
+// request's RequestURI isn't altered.
+func NewSuffixStrippingHandler(handler http.Handler, suffix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, ok := stripPathSuffix(r.URL.Path, suffix)
+		if !ok {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = path
+		// If the suffix was encoded differently, the raw path is dropped and
+		// the path re-encoded from the decoded form.
+		r2.URL.RawPath, _ = stripPathSuffix(r.URL.RawPath, suffix)
+		handler.ServeHTTP(w, r2)
+	})
+}
+
+// stripPathSuffix removes suffix from the end of path, reporting whether
+// path ended with it.
+func stripPathSuffix(path, suffix string) (string, bool) {
+	rest, ok := strings.CutSuffix(path, suffix)
+	if !ok {
+		return "", false
+	}
+	if rest == "" {
+		rest = "/"
+	}
+	return rest, true
+}
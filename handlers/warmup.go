@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WarmUp sends connections concurrent GET requests for path through a
+// backend handler, so that the backend's connection pool holds that many
+// idle connections before clients need them. The responses are discarded,
+// and each request is abandoned after timeout. It returns once all of the
+// requests have finished.
+func WarmUp(backend http.Handler, path string, connections int, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < connections; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, "GET", path, nil)
+			if err != nil {
+				return
+			}
+			backend.ServeHTTP(&discardResponseWriter{header: make(http.Header)}, req)
+		}()
+	}
+	wg.Wait()
+}
+
+// Probe sends a single GET request for path through a backend handler,
+// bypassing any circuit breaker, and returns the status of the response, or
+// 0 if there wasn't one. The request is abandoned after timeout.
+func Probe(backend http.Handler, path string, timeout time.Duration) int {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", path, nil)
+	if err != nil {
+		return 0
+	}
+	sw := &statusWriter{ResponseWriter: &discardResponseWriter{header: make(http.Header)}}
+	backend.ServeHTTP(sw, BypassCircuitBreaker(req))
+	return sw.status
+}
+
+// discardResponseWriter throws away the response written to it.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(code int) {}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"github.com/alphagov/router/logger"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWarmUpOpensConnections(t *testing.T) {
+	var mu sync.Mutex
+	paths := make([]string, 0)
+	conns := make(map[string]bool)
+	release := make(chan struct{})
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		<-release
+	}))
+	backend.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns[c.RemoteAddr().String()] = true
+			mu.Unlock()
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	backendUrl, _ := url.Parse(backend.URL)
+	l, _ := logger.New(io.Discard)
+	handler := NewBackendHandler(backendUrl, time.Second, 0, time.Second, 0, nil, false, l)
+
+	done := make(chan struct{})
+	go func() {
+		WarmUp(handler, "/healthcheck", 3, 5*time.Second)
+		close(done)
+	}()
+	deadline := time.After(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(paths)
+		mu.Unlock()
+		if n == 3 {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("Expected 3 concurrent warmup requests, got %d", n)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	close(release)
+	<-done
+
+	for _, path := range paths {
+		if path != "/healthcheck" {
+			t.Errorf("Expected warmup requests for /healthcheck, got %s", path)
+		}
+	}
+	if len(conns) != 3 {
+		t.Errorf("Expected 3 connections to be opened, got %d", len(conns))
+	}
+}
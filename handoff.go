@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// handoffEnv is set in the environment of a router process started by
+// startSuccessor. It lists the file descriptors passed to the new process,
+// as name=fd pairs: one for each listener, one for reading the route
+// snapshot and one for reporting that it's ready.
+const handoffEnv = "ROUTER_HANDOFF_FDS"
+
+// handoffTimeout is how long a new process has to get ready to serve
+// requests before the handoff is abandoned.
+const handoffTimeout = 30 * time.Second
+
+// drainGracePeriod is how long connections accepted just before a handoff
+// have to send their requests before the old process starts shutting down.
+const drainGracePeriod = 500 * time.Millisecond
+
+// inheritedFile returns the named file passed on by the process which
+// started this one, if there is one.
+func inheritedFile(name string) (*os.File, bool) {
+	for _, pair := range strings.Split(os.Getenv(handoffEnv), ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] != name {
+			continue
+		}
+		fd, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, false
+		}
+		return os.NewFile(uintptr(fd), name), true
+	}
+	return nil, false
+}
+
+// listen returns a listener for the named address. If the router was started
+// by a handoff, the listening socket is taken over from the old process
+// instead, so that no connections are refused while it restarts.
+func listen(name, addr string) (net.Listener, error) {
+	f, ok := inheritedFile("listener:" + name)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	defer f.Close()
+	logInfo("router: taking over", name, "listener from the previous process")
+	return net.FileListener(f)
+}
+
+// inheritedSnapshot returns the route snapshot passed on by the process
+// which started this one, if there is one.
+func inheritedSnapshot() ([]byte, bool) {
+	f, ok := inheritedFile("snapshot")
+	if !ok {
+		return nil, false
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		logWarn("router: couldn't read route snapshot from the previous process:", err)
+		return nil, false
+	}
+	return data, true
+}
+
+// notifyReady tells the process which started this one, if there is one,
+// that it is serving requests and can be left to them.
+func notifyReady() {
+	if f, ok := inheritedFile("ready"); ok {
+		f.Write([]byte("ready\n"))
+		f.Close()
+	}
+}
+
+// startSuccessor starts a new router process from path and args, passing it
+// the listeners and route snapshot, and waits up to timeout for it to report
+// that it's ready. If it fails to, it is killed and an error is returned,
+// leaving this process to carry on serving.
+func startSuccessor(path string, args []string, listeners map[string]net.Listener, snapshot []byte, timeout time.Duration) (*os.Process, error) {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var fds []string
+	pass := func(name string, f *os.File) {
+		fds = append(fds, fmt.Sprintf("%s=%d", name, 3+len(files)))
+		files = append(files, f)
+	}
+
+	for name, l := range listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return nil, fmt.Errorf("can't pass on %s listener of type %T", name, l)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return nil, err
+		}
+		pass("listener:"+name, f)
+	}
+	snapshotR, snapshotW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	pass("snapshot", snapshotR)
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		snapshotW.Close()
+		return nil, err
+	}
+	defer readyR.Close()
+	pass("ready", readyW)
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, handoffEnv+"=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, handoffEnv+"="+strings.Join(fds, ","))
+	if err := cmd.Start(); err != nil {
+		snapshotW.Close()
+		return nil, err
+	}
+	// The new process has its own copies of the files now. Closing ours
+	// means the read below sees EOF if it exits without reporting that it's
+	// ready.
+	for _, f := range files {
+		f.Close()
+	}
+	files = nil
+	// Passing a socket to a new process puts it into blocking mode, which
+	// is shared with our own listener, so switch it back.
+	for _, l := range listeners {
+		if sc, ok := l.(syscall.Conn); ok {
+			if rc, err := sc.SyscallConn(); err == nil {
+				rc.Control(func(fd uintptr) { syscall.SetNonblock(int(fd), true) })
+			}
+		}
+	}
+	go func() {
+		snapshotW.Write(snapshot)
+		snapshotW.Close()
+	}()
+
+	ready := make(chan error, 1)
+	go func() {
+		line, err := io.ReadAll(readyR)
+		if err == nil && string(line) != "ready\n" {
+			err = errors.New("new process exited before it was ready")
+		}
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(timeout):
+		err = fmt.Errorf("new process wasn't ready after %v", timeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	go cmd.Wait()
+	return cmd.Process, nil
+}
+
+// drain stops servers accepting connections once a new process has taken
+// over their listeners, and waits up to timeout for the requests already in
+// progress to finish. The listeners are closed a little before the servers
+// are shut down, because requests read after that are dropped, and those on
+// connections accepted just before the handoff may not have arrived yet.
+func drain(servers []*http.Server, listeners map[string]net.Listener, timeout time.Duration) {
+	for _, l := range listeners {
+		l.Close()
+	}
+	time.Sleep(drainGracePeriod)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, server := range servers {
+		server.Shutdown(ctx)
+	}
+}
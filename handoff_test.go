@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestHandoffSuccessor isn't a test in itself. It's run in a new process by
+// TestHandoffDropsNoConnections, to take over its listener.
+func TestHandoffSuccessor(t *testing.T) {
+	if os.Getenv("ROUTER_TEST_HANDOFF_SUCCESSOR") == "" {
+		t.Skip("only run as the successor in TestHandoffDropsNoConnections")
+	}
+	snapshot, _ := inheritedSnapshot()
+	listener, err := listen("public", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error taking over the listener: %v", err)
+	}
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("successor: " + string(snapshot)))
+	}))
+	notifyReady()
+
+	// Serve until killed by the predecessor.
+	time.Sleep(time.Minute)
+}
+
+func TestHandoffDropsNoConnections(t *testing.T) {
+	listener, err := listen("public", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening: %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("predecessor"))
+	})}
+	go server.Serve(listener)
+
+	// Make requests on new connections throughout the handoff.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+	responses := make(map[string]int)
+	var errs []error
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			resp, err := client.Get("http://" + listener.Addr().String() + "/")
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			responses[string(body)]++
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	t.Setenv("ROUTER_TEST_HANDOFF_SUCCESSOR", "1")
+	listeners := map[string]net.Listener{"public": listener}
+	process, err := startSuccessor(os.Args[0], []string{"-test.run=^TestHandoffSuccessor$"}, listeners, []byte("snapshot"), 10*time.Second)
+	if err != nil {
+		close(stop)
+		<-done
+		t.Fatalf("Unexpected error starting the successor: %v", err)
+	}
+	defer process.Kill()
+	drain([]*http.Server{server}, map[string]net.Listener{"public": listener}, 5*time.Second)
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	<-done
+
+	if len(errs) > 0 {
+		t.Errorf("Expected no failed requests across the handoff, got %d, such as: %v", len(errs), errs[0])
+	}
+	if responses["predecessor"] == 0 || responses["successor: snapshot"] == 0 || len(responses) != 2 {
+		t.Errorf("Expected responses from the predecessor and then the successor, got %v", responses)
+	}
+}
+
+func TestHandoffFailsIfSuccessorExits(t *testing.T) {
+	listener, err := listen("public", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening: %v", err)
+	}
+	defer listener.Close()
+
+	listeners := map[string]net.Listener{"public": listener}
+	if _, err := startSuccessor("/bin/true", nil, listeners, nil, 10*time.Second); err == nil {
+		t.Error("Expected an error when the successor exits without becoming ready")
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,6 +16,40 @@ type Logger interface {
 	Log(fields map[string]interface{})
 	LogFromClientRequest(fields map[string]interface{}, req *http.Request)
 	LogFromBackendRequest(fields map[string]interface{}, req *http.Request)
+	// SetRequestFormat changes how much of the URL of the requests logged
+	// with LogFromClientRequest and LogFromBackendRequest is recorded.
+	SetRequestFormat(format RequestFormat)
+	// Flush waits until all the entries logged so far have been written.
+	Flush()
+}
+
+// RequestFormat says how much of a request's URL is logged in its "request"
+// field.
+type RequestFormat int32
+
+const (
+	// RequestPathOnly logs the path, without the query string, which may
+	// hold sensitive data.
+	RequestPathOnly RequestFormat = iota
+	// RequestFullURL logs the path and query string.
+	RequestFullURL
+	// RequestFullURLRedacted logs the path and the names of the query
+	// parameters, with their values replaced by "[redacted]".
+	RequestFullURLRedacted
+)
+
+// ParseRequestFormat parses the name of a request format: "path-only",
+// "full-url" or "full-url-redacted".
+func ParseRequestFormat(name string) (RequestFormat, error) {
+	switch name {
+	case "path-only":
+		return RequestPathOnly, nil
+	case "full-url":
+		return RequestFullURL, nil
+	case "full-url-redacted":
+		return RequestFullURLRedacted, nil
+	}
+	return 0, fmt.Errorf("unknown request format %q, must be path-only, full-url or full-url-redacted", name)
 }
 
 type logEntry struct {
@@ -22,8 +58,10 @@ type logEntry struct {
 }
 
 type jsonLogger struct {
-	writer io.Writer
-	lines  chan *[]byte
+	writer        io.Writer
+	lines         chan *[]byte
+	flushed       chan struct{}
+	requestFormat atomic.Int32
 }
 
 // New creates a new Logger.   The output variable sets the
@@ -37,6 +75,7 @@ func New(output interface{}) (logger Logger, err error) {
 		return nil, err
 	}
 	l.lines = make(chan *[]byte, 100)
+	l.flushed = make(chan struct{})
 	go l.writeLoop()
 	return l, nil
 }
@@ -65,6 +104,11 @@ func openWriter(output interface{}) (w io.Writer, err error) {
 func (l *jsonLogger) writeLoop() {
 	for {
 		line := <-l.lines
+		if line == nil {
+			// Everything queued before the flush has now been written.
+			l.flushed <- struct{}{}
+			continue
+		}
 		_, err := l.writer.Write(*line)
 		if err != nil {
 			log.Printf("router: Error writing to error log: %v", err)
@@ -72,6 +116,11 @@ func (l *jsonLogger) writeLoop() {
 	}
 }
 
+func (l *jsonLogger) Flush() {
+	l.lines <- nil
+	<-l.flushed
+}
+
 func (l *jsonLogger) writeLine(line []byte) {
 	line = append(line, 10) // Append a newline
 	l.lines <- &line
@@ -88,7 +137,7 @@ func (l *jsonLogger) Log(fields map[string]interface{}) {
 
 func (l *jsonLogger) LogFromClientRequest(fields map[string]interface{}, req *http.Request) {
 	fields["request_method"] = req.Method
-	fields["request"] = fmt.Sprintf("%s %s %s", req.Method, req.RequestURI, req.Proto)
+	fields["request"] = fmt.Sprintf("%s %s %s", req.Method, l.requestTarget(req), req.Proto)
 	fields["varnish_id"] = req.Header.Get("X-Varnish")
 
 	l.Log(fields)
@@ -101,3 +150,39 @@ func (l *jsonLogger) LogFromBackendRequest(fields map[string]interface{}, req *h
 
 	l.LogFromClientRequest(fields, req)
 }
+
+func (l *jsonLogger) SetRequestFormat(format RequestFormat) {
+	l.requestFormat.Store(int32(format))
+}
+
+// requestTarget returns as much of the request's URL as the request format
+// allows to be logged. The URL is logged as the client sent it, or for
+// requests to backends (which have no RequestURI), as it was sent to them.
+func (l *jsonLogger) requestTarget(req *http.Request) string {
+	target := req.RequestURI
+	if target == "" && req.URL != nil {
+		target = req.URL.RequestURI()
+	}
+	path, query, hasQuery := strings.Cut(target, "?")
+	switch RequestFormat(l.requestFormat.Load()) {
+	case RequestFullURL:
+		return target
+	case RequestFullURLRedacted:
+		if hasQuery {
+			return path + "?" + redactQuery(query)
+		}
+	}
+	return path
+}
+
+// redactQuery replaces the values of the parameters in a query string with
+// "[redacted]", keeping their names.
+func redactQuery(query string) string {
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		if name, _, hasValue := strings.Cut(param, "="); hasValue {
+			params[i] = name + "=[redacted]"
+		}
+	}
+	return strings.Join(params, "&")
+}
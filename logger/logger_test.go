@@ -0,0 +1,50 @@
+package logger
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestFormat(t *testing.T) {
+	examples := []struct {
+		format   string
+		expected string
+	}{
+		{"path-only", `"request":"GET /search HTTP/1.1"`},
+		{"full-url", `"request":"GET /search?q=my+secret\u0026page=2\u0026flag HTTP/1.1"`},
+		{"full-url-redacted", `"request":"GET /search?q=[redacted]\u0026page=[redacted]\u0026flag HTTP/1.1"`},
+	}
+	for _, ex := range examples {
+		format, err := ParseRequestFormat(ex.format)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %s: %v", ex.format, err)
+		}
+		var buf bytes.Buffer
+		l, _ := New(&buf)
+		l.SetRequestFormat(format)
+
+		l.LogFromClientRequest(map[string]interface{}{}, httptest.NewRequest("GET", "/search?q=my+secret&page=2&flag", nil))
+		backendReq := httptest.NewRequest("GET", "http://backend.example.com/search?q=my+secret&page=2&flag", nil)
+		backendReq.RequestURI = ""
+		l.LogFromBackendRequest(map[string]interface{}{}, backendReq)
+		l.Flush()
+
+		if n := strings.Count(buf.String(), ex.expected); n != 2 {
+			t.Errorf("%s: expected client and backend requests to be logged as %s, got %q", ex.format, ex.expected, buf.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	l, _ := New(&buf)
+	l.LogFromClientRequest(map[string]interface{}{}, httptest.NewRequest("GET", "/search?q=my+secret", nil))
+	l.Flush()
+	if !strings.Contains(buf.String(), `"request":"GET /search HTTP/1.1"`) {
+		t.Errorf("Expected only the path to be logged by default, got %q", buf.String())
+	}
+
+	if _, err := ParseRequestFormat("everything"); err == nil {
+		t.Error("Expected an error parsing an unknown format")
+	}
+}
@@ -1,23 +1,92 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/alphagov/router/handlers"
+	"github.com/alphagov/router/logger"
+	"github.com/alphagov/router/tracing"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var (
 	pubAddr               = getenvDefault("ROUTER_PUBADDR", ":8080")
 	apiAddr               = getenvDefault("ROUTER_APIADDR", ":8081")
+	apiPrefix             = getenvDefault("ROUTER_API_PREFIX", "")
+	apiUser               = getenvDefault("ROUTER_API_USER", "")
+	apiPasswordSHA256     = getenvDefault("ROUTER_API_PASSWORD_SHA256", "")
 	mongoUrl              = getenvDefault("ROUTER_MONGO_URL", "localhost")
 	mongoDbName           = getenvDefault("ROUTER_MONGO_DB", "router")
+	routeSources          = getenvDefault("ROUTER_ROUTE_SOURCE", "mongo")
+	routeFile             = getenvDefault("ROUTER_ROUTE_FILE", "routes.json")
+	staticFiles           = getenvDefault("ROUTER_STATIC_FILES", "")
+	consulUrl             = getenvDefault("ROUTER_CONSUL_URL", "http://localhost:8500")
+	etcdUrl               = getenvDefault("ROUTER_ETCD_URL", "http://localhost:2379")
+	kvPrefix              = getenvDefault("ROUTER_KV_PREFIX", "router")
+	watchRoutes           = getenvDefault("ROUTER_WATCH_ROUTES", "") != ""
+	watchDebounce         = getenvDefault("ROUTER_WATCH_DEBOUNCE", "1s")
+	watchMaxDropPercent   = getenvDefault("ROUTER_WATCH_MAX_DROP_PERCENT", "50")
+	pathPrefix            = getenvDefault("ROUTER_PATH_PREFIX", "")
 	errorLogFile          = getenvDefault("ROUTER_ERROR_LOG", "STDERR")
+	traceLogFile          = getenvDefault("ROUTER_TRACE_LOG", "")
 	enableDebugOutput     = getenvDefault("DEBUG", "") != ""
+	enableBoom            = getenvDefault("ROUTER_ENABLE_BOOM", "") != ""
+	enableChaos           = getenvDefault("ROUTER_ENABLE_CHAOS", "") != ""
+	requireHost           = getenvDefault("ROUTER_REQUIRE_HOST", "") != ""
+	strictPaths           = getenvDefault("ROUTER_STRICT_PATHS", "") != ""
+	strictIncomingPaths   = getenvDefault("ROUTER_STRICT_INCOMING_PATHS", "") != ""
+	integrityInterval     = getenvDefault("ROUTER_INTEGRITY_CHECK_INTERVAL", "")
+	httpsRedirect         = getenvDefault("ROUTER_HTTPS_REDIRECT", "") != ""
+	edgeMode              = getenvDefault("ROUTER_EDGE", "") != ""
+	skipRedirectLoops     = getenvDefault("ROUTER_SKIP_REDIRECT_LOOPS", "") != ""
+	maxRedirectLength     = getenvDefault("ROUTER_MAX_REDIRECT_LENGTH", "8192")
+	maxQueuedReloads      = getenvDefault("ROUTER_MAX_QUEUED_RELOADS", "1")
+	maxResponseBytes      = getenvDefault("ROUTER_MAX_RESPONSE_BYTES", "0")
 	backendConnectTimeout = getenvDefault("ROUTER_BACKEND_CONNECT_TIMEOUT", "1s")
 	backendHeaderTimeout  = getenvDefault("ROUTER_BACKEND_HEADER_TIMEOUT", "15s")
+	backendTLSTimeout     = getenvDefault("ROUTER_BACKEND_TLS_HANDSHAKE_TIMEOUT", "0s")
+	backendDNSCacheTTL    = getenvDefault("ROUTER_BACKEND_DNS_CACHE_TTL", "0s")
+	backendFlushInterval  = getenvDefault("ROUTER_BACKEND_FLUSH_INTERVAL", "0s")
+	requestTimeout        = getenvDefault("ROUTER_REQUEST_TIMEOUT", "60s")
+	backendTimeoutHeader  = getenvDefault("ROUTER_BACKEND_TIMEOUT_HEADER", "")
+	allowedMethods        = getenvDefault("ROUTER_ALLOWED_METHODS", "GET,HEAD,POST,PUT,PATCH,DELETE,OPTIONS")
+	trustedProxies        = getenvDefault("ROUTER_TRUSTED_PROXIES", "")
+	responseCacheSize     = getenvDefault("ROUTER_RESPONSE_CACHE_SIZE_MB", "64")
+	notFoundStatus        = getenvDefault("ROUTER_NOTFOUND_STATUS", "404")
+	notFoundContentType   = getenvDefault("ROUTER_NOTFOUND_CONTENT_TYPE", "text/plain; charset=utf-8")
+	notFoundBody          = getenvDefault("ROUTER_NOTFOUND_BODY", "")
+	errorPages            = getenvDefault("ROUTER_ERROR_PAGES", "")
+	errorTemplates        = getenvDefault("ROUTER_ERROR_TEMPLATES", "")
+	allowedHandlers       = getenvDefault("ROUTER_ALLOWED_HANDLERS", "backend,redirect,gone,ping,static,filesystem,boom")
+	allowedRedirectHosts  = getenvDefault("ROUTER_ALLOWED_REDIRECT_HOSTS", "")
+	backendWarmupConns    = getenvDefault("ROUTER_BACKEND_WARMUP_CONNECTIONS", "0")
+	backendWarmupPath     = getenvDefault("ROUTER_BACKEND_WARMUP_PATH", "/")
+	lazyBackends          = getenvDefault("ROUTER_LAZY_BACKENDS", "") != ""
+	responseHeaders       = getenvDefault("ROUTER_RESPONSE_HEADERS", "")
+	responseHeadersForced = getenvDefault("ROUTER_RESPONSE_HEADERS_OVERRIDE", "")
+	accessLogFile         = getenvDefault("ROUTER_ACCESS_LOG", "")
+	logRequestFormat      = getenvDefault("ROUTER_LOG_REQUEST_FORMAT", "path-only")
+	accessLogSample       = getenvDefault("ROUTER_ACCESS_LOG_SAMPLE", "")
+	accessLogSlow         = getenvDefault("ROUTER_ACCESS_LOG_SLOW", "0s")
+	accessLogExclude      = getenvDefault("ROUTER_ACCESS_LOG_EXCLUDE", "")
+	accessLogDropErrors   = getenvDefault("ROUTER_ACCESS_LOG_EXCLUDE_ERRORS", "") != ""
+	scanThreshold         = getenvDefault("ROUTER_SCAN_THRESHOLD", "0")
+	scanWindow            = getenvDefault("ROUTER_SCAN_WINDOW", "1m")
+	scanBlock             = getenvDefault("ROUTER_SCAN_BLOCK", "") != ""
 )
 
 func usage() {
@@ -27,17 +96,170 @@ The following environment variables and defaults are available:
 
 ROUTER_PUBADDR=:8080        Address on which to serve public requests
 ROUTER_APIADDR=:8081        Address on which to receive reload requests
+ROUTER_API_PREFIX=          Path prefix (e.g. '/__router__') under which to serve the
+                            API on the public address instead - the API address is
+                            then not used
+ROUTER_API_USER=            Basic auth user required for the API when it is served
+                            under ROUTER_API_PREFIX
+ROUTER_API_PASSWORD_SHA256=
+                            Hex-encoded SHA-256 digest of the basic auth password
+                            required for the API under ROUTER_API_PREFIX
 ROUTER_MONGO_URL=localhost  Address of mongo cluster (e.g. 'mongo1,mongo2,mongo3')
 ROUTER_MONGO_DB=router      Name of mongo database to use
-ROUTER_ERROR_LOG=STDERR     File to log errors to (in JSON format)
+ROUTER_ROUTE_SOURCE=mongo   Comma-separated list of sources to load routes from -
+                            'mongo', 'file', 'env', 'consul' or 'etcd'. Where
+                            sources define the same route, the last source wins.
+                            Other mongo databases and collections can be added as
+                            'mongo:<db>' or 'mongo:<db>/<backends>/<routes>'
+ROUTER_ROUTE_FILE=routes.json
+                            JSON file to load routes from for the 'file' source
+ROUTER_STATIC_FILES=        Comma-separated list of paths to serve fixed files at, as
+                            '/path=file' (e.g. '/robots.txt=/etc/router/robots.txt')
+                            - these routes take precedence over all route sources
+ROUTER_ROUTES_JSON=         JSON routes and backends, in the same form as the route
+                            file, to load for the 'env' source
+ROUTER_CONSUL_URL=http://localhost:8500
+                            Address of the consul agent to load routes from
+ROUTER_ETCD_URL=http://localhost:2379
+                            Address of the etcd cluster to load routes from
+ROUTER_KV_PREFIX=router     Key prefix under which backends and routes are stored
+                            in consul or etcd
+ROUTER_WATCH_ROUTES=        Whether to reload automatically when routes change in
+                            consul or etcd - set to anything to enable
+ROUTER_WATCH_MAX_DROP_PERCENT=50
+                            Largest percentage of the current routes which an
+                            automatic reload may remove - larger drops are refused
+ROUTER_PATH_PREFIX=         Path prefix (e.g. '/staging') under which to serve every
+                            route - it is removed from request paths before they
+                            are handled
+ROUTER_ERROR_LOG=STDERR     File to log errors and lifecycle events to (in JSON format)
+ROUTER_ACCESS_LOG=          File to log public requests to (in JSON format) - access
+                            logging is disabled if unset
+ROUTER_LOG_REQUEST_FORMAT=path-only
+                            How much of request URLs to log, in the error and access
+                            logs - 'path-only', 'full-url' (with the query string) or
+                            'full-url-redacted' (with query parameter values removed)
+ROUTER_ACCESS_LOG_SAMPLE=   Which requests to write to the access log - 'N' logs every
+                            Nth request and 'N%' a random N percent; errors (5xx) and
+                            slow requests are always logged. If unset, all are logged
+ROUTER_ACCESS_LOG_EXCLUDE=  Comma-separated paths (e.g. '/healthcheck,/metrics*') whose
+                            requests aren't logged - a trailing '*' excludes every
+                            path starting with the rest. Errors (5xx) are still logged
+ROUTER_ACCESS_LOG_EXCLUDE_ERRORS=
+                            Whether to leave errors on excluded paths out of the access
+                            log too - set to anything to enable
+ROUTER_TRACE_LOG=           File to export OpenTelemetry trace spans to (in JSON
+                            format) - tracing is disabled if unset
 DEBUG=                      Whether to enable debug output - set to anything to enable
+ROUTER_ENABLE_BOOM=         Whether to serve routes with the "boom" handler, which
+                            panics for testing - set to anything to enable
+ROUTER_ENABLE_CHAOS=        Whether to inject the delays and errors configured on
+                            routes for chaos testing - set to anything to enable
+ROUTER_REQUIRE_HOST=        Whether to reject requests without a Host header (which
+                            HTTP/1.0 allows) with a 400 - set to anything to enable
+ROUTER_STRICT_PATHS=        Whether to reject requests whose paths have malformed
+                            percent-encoding or encoded control characters (such as
+                            '%00') with a 400 - set to anything to enable
+ROUTER_STRICT_INCOMING_PATHS=
+                            Whether to fail reloads, keeping the current routes, if
+                            a route has an empty incoming_path, rather than skipping
+                            the route - set to anything to enable
+ROUTER_INTEGRITY_CHECK_INTERVAL=
+                            How often to check that the loaded route table hasn't
+                            been corrupted, logging and counting any mismatch (off
+                            if unset)
+ROUTER_HTTPS_REDIRECT=      Whether to redirect every plain HTTP request to HTTPS (as
+                            told by X-Forwarded-Proto from ROUTER_TRUSTED_PROXIES),
+                            rather than only for some routes - set to anything to enable
+ROUTER_EDGE=                Whether clients connect to the router directly, so that
+                            their X-Forwarded-* headers are replaced rather than
+                            passed on - set to anything to enable
+ROUTER_SKIP_REDIRECT_LOOPS= Whether to skip redirect routes which redirect back to
+                            themselves, rather than just warning about them - set to
+                            anything to enable
+ROUTER_MAX_REDIRECT_LENGTH=8192
+                            Longest Location header (in bytes) a redirect route may
+                            send - longer redirects get a 500. 0 disables the limit
+ROUTER_MAX_RESPONSE_BYTES=0 Largest response body (in bytes) proxied from a backend -
+                            longer responses get a 502, or are cut off if already
+                            started. 0 disables the limit
+ROUTER_MAX_QUEUED_RELOADS=1
+                            Number of reloads which may wait for the running one to
+                            finish - further reloads are dropped unless one waiting
+                            covers them
+ROUTER_ALLOWED_HANDLERS=backend,redirect,gone,ping,static,filesystem,boom
+                            Comma-separated list of the handlers which routes may
+                            use; routes using any other handler are skipped
+ROUTER_ALLOWED_REDIRECT_HOSTS=
+                            Comma-separated list of the hosts which redirect routes
+                            may send clients to - if unset, any host is allowed
+
+ROUTER_ALLOWED_METHODS=GET,HEAD,POST,PUT,PATCH,DELETE,OPTIONS
+                            Comma-separated list of request methods to serve;
+                            all other methods are rejected with a 405
+ROUTER_TRUSTED_PROXIES=     Comma-separated IP addresses and CIDR ranges of proxies
+                            whose X-Forwarded-For entries are believed when working
+                            out the client's address
+ROUTER_RESPONSE_CACHE_SIZE_MB=64
+                            Memory limit for responses cached from routes with
+                            response caching enabled
+ROUTER_BACKEND_WARMUP_CONNECTIONS=0
+                            Number of connections to open to each backend after
+                            routes are reloaded, ahead of client requests
+ROUTER_BACKEND_WARMUP_PATH=/
+                            Path requested from each backend to warm up its
+                            connections
+ROUTER_LAZY_BACKENDS=       Whether to set up each backend (and its connection pool)
+                            only when it is first used, rather than when routes are
+                            loaded - set to anything to enable
+ROUTER_BACKEND_TIMEOUT_HEADER=
+                            Request header (e.g. 'X-Timeout-Ms') in which to tell
+                            backends how many milliseconds are left before the
+                            request times out - not sent if unset
+ROUTER_NOTFOUND_STATUS=404  Status of the response to requests which match no route
+ROUTER_NOTFOUND_CONTENT_TYPE=text/plain; charset=utf-8
+                            Content type of the response to unmatched requests
+ROUTER_NOTFOUND_BODY=       Body of the response to unmatched requests - if unset,
+                            the standard text for the status is used
+ROUTER_ERROR_PAGES=         Comma-separated list of <status>=<url> pages to fetch and
+                            serve in place of the router's own error responses, and
+                            backend error responses without a body
+ROUTER_ERROR_TEMPLATES=     Comma-separated list of <status>=<file> HTML templates to
+                            serve in place of the bodies of 5xx responses from
+                            backends with intercept_errors set
+ROUTER_SCAN_THRESHOLD=0     Number of distinct paths a client may get a 404 for within
+                            ROUTER_SCAN_WINDOW before it's logged as a scanner - 0
+                            disables scanner detection
+ROUTER_SCAN_BLOCK=          Whether to answer clients detected as scanners with a 429
+                            for ROUTER_SCAN_WINDOW - set to anything to enable
+ROUTER_RESPONSE_HEADERS=    JSON object of headers to add to every response which
+                            doesn't already have them, e.g. {"X-Frame-Options": "DENY"}
+ROUTER_RESPONSE_HEADERS_OVERRIDE=
+                            JSON object of headers to add to every response, replacing
+                            any values set by backends
 
 Timeouts: (values must be parseable by http://golang.org/pkg/time/#ParseDuration)
 
-ROUTER_BACKEND_CONNECT_TIMEOUT=1s  Connect timeout when connecting to backends
+ROUTER_BACKEND_CONNECT_TIMEOUT=1s  Timeout for opening TCP connections to backends
 ROUTER_BACKEND_HEADER_TIMEOUT=15s  Timeout for backend response headers to be returned
+ROUTER_BACKEND_TLS_HANDSHAKE_TIMEOUT=0s
+                                   Timeout for the TLS handshake with https backends, once
+                                   connected - 0 means no limit
+ROUTER_BACKEND_DNS_CACHE_TTL=0s    How long to cache backend hostname lookups for - 0 disables
+                                   the cache, so each new connection resolves the hostname
+ROUTER_BACKEND_FLUSH_INTERVAL=0s   How often to flush backend responses to clients as they
+                                   are copied - 0 flushes only streaming responses, and a
+                                   negative value flushes after every write
+ROUTER_REQUEST_TIMEOUT=60s         Overall limit on the time taken to serve any request -
+                                   clients may ask for less, in milliseconds, with an
+                                   X-Request-Timeout header
+ROUTER_WATCH_DEBOUNCE=1s           Time to wait for further route changes before reloading
+ROUTER_SCAN_WINDOW=1m              Period over which each client's distinct not-found paths
+                                   are counted, and for which scanners are blocked
+ROUTER_ACCESS_LOG_SLOW=0s          Requests taking at least this long are always written to
+                                   the access log - 0 disables this
 `
-	fmt.Fprintf(os.Stderr, helpstring)
+	fmt.Fprint(os.Stderr, helpstring)
 	os.Exit(2)
 }
 
@@ -64,11 +286,149 @@ func logDebug(msg ...interface{}) {
 	}
 }
 
-func catchListenAndServe(addr string, handler http.Handler) {
-	err := http.ListenAndServe(addr, handler)
+// enableTracing sets up OpenTelemetry tracing, exporting spans to the named
+// file (or "STDOUT"/"STDERR").
+func enableTracing(fileName string) (shutdown func(), err error) {
+	var out *os.File
+	switch fileName {
+	case "STDOUT":
+		out = os.Stdout
+	case "STDERR":
+		out = os.Stderr
+	default:
+		out, err = os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(out))
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	tracing.Enable(provider)
+
+	shutdown = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			logWarn("router: error flushing trace spans:", err)
+		}
+		if out != os.Stdout && out != os.Stderr {
+			out.Close()
+		}
+	}
+	return shutdown, nil
+}
+
+// waitForShutdown waits for a signal, and then calls shutdown, logging the
+// start and end of the shutdown. SIGUSR2 asks for the router to be restarted
+// without downtime: handOff is called first to start the new process, and if
+// that fails the router carries on serving.
+func waitForShutdown(rout *Router, signals <-chan os.Signal, handOff func() error, shutdown func()) os.Signal {
+	for {
+		sig := <-signals
+		if sig == syscall.SIGUSR2 {
+			logInfo("router: received", sig, "- handing over to a new process")
+			if err := handOff(); err != nil {
+				logWarn("router: couldn't hand over to a new process:", err)
+				rout.logEvent("handoff_failed", map[string]interface{}{"error": err.Error()})
+				continue
+			}
+		}
+		logInfo("router: received", sig, "- shutting down")
+		rout.logEvent("shutdown_initiated", map[string]interface{}{"signal": sig.String()})
+		shutdown()
+		rout.logEvent("shutdown_complete", map[string]interface{}{})
+		rout.logger.Flush()
+		return sig
+	}
+}
+
+// parseAccessLogSample parses a sample rate for the access log, as used for
+// ROUTER_ACCESS_LOG_SAMPLE: either a number N, to log every Nth request, or
+// a percentage. An empty string logs every request.
+func parseAccessLogSample(value string) (sample handlers.AccessLogSample, err error) {
+	if value == "" {
+		return
+	}
+	if strings.HasSuffix(value, "%") {
+		sample.Percent, err = strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err == nil && (sample.Percent <= 0 || sample.Percent > 100) {
+			err = fmt.Errorf("percentage %s is out of range", value)
+		}
+		return
+	}
+	sample.Every, err = strconv.Atoi(value)
+	if err == nil && sample.Every < 1 {
+		err = fmt.Errorf("%s is not a positive number", value)
+	}
+	return
+}
+
+// parseAccessLogExclude parses a comma-separated list of paths to leave out
+// of the access log, as used for ROUTER_ACCESS_LOG_EXCLUDE. Paths ending in
+// '*' exclude every path starting with the rest. An empty list gives nil.
+func parseAccessLogExclude(value string) *handlers.AccessLogExclude {
+	exclude := &handlers.AccessLogExclude{Paths: make(map[string]bool)}
+	for _, path := range strings.Split(value, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		if prefix, ok := strings.CutSuffix(path, "*"); ok {
+			exclude.Prefixes = append(exclude.Prefixes, prefix)
+		} else {
+			exclude.Paths[path] = true
+		}
+	}
+	if len(exclude.Paths) == 0 && len(exclude.Prefixes) == 0 {
+		return nil
 	}
+	return exclude
+}
+
+// parseResponseHeaders parses a JSON object of header names and values, as
+// used for ROUTER_RESPONSE_HEADERS. An empty string gives no headers.
+func parseResponseHeaders(value string) (http.Header, error) {
+	header := make(http.Header)
+	if value == "" {
+		return header, nil
+	}
+	var fields map[string]string
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return nil, err
+	}
+	for k, v := range fields {
+		header.Set(k, v)
+	}
+	return header, nil
+}
+
+// publicHandler returns the handler for public requests, which adds the
+// configured headers to the router's responses.
+func publicHandler(rout *Router, defaults, overrides http.Header) http.Handler {
+	handler := tracing.Handler(rout)
+	if len(defaults) > 0 || len(overrides) > 0 {
+		handler = handlers.NewResponseHeaderHandler(handler, defaults, overrides)
+	}
+	return handler
+}
+
+// serve starts serving requests from listener with handler, in the
+// background. The name of the listener is used in the logs.
+func serve(rout *Router, name string, listener net.Listener, handler http.Handler) *http.Server {
+	server := &http.Server{Handler: handler}
+	go func() {
+		// The listener is closed without shutting down the server when
+		// handing over to a new process.
+		if err := server.Serve(listener); err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+			log.Fatal(err)
+		}
+	}()
+	logInfo("router: listening for", name, "requests on", listener.Addr())
+	rout.logEvent("listening", map[string]interface{}{"listener": name, "address": listener.Addr().String()})
+	return server
 }
 
 func main() {
@@ -81,19 +441,281 @@ func main() {
 	flag.Usage = usage
 	flag.Parse()
 
-	rout, err := NewRouter(mongoUrl, mongoDbName, backendConnectTimeout, backendHeaderTimeout, errorLogFile)
+	shutdown := func() {}
+	if traceLogFile != "" {
+		// Make sure buffered spans are written out before we exit.
+		var err error
+		shutdown, err = enableTracing(traceLogFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logInfo("router: exporting trace spans to", traceLogFile)
+	}
+
+	debounce, err := time.ParseDuration(watchDebounce)
 	if err != nil {
 		log.Fatal(err)
 	}
-	rout.ReloadRoutes()
+	defaultHeaders, err := parseResponseHeaders(responseHeaders)
+	if err != nil {
+		log.Fatal("router: invalid ROUTER_RESPONSE_HEADERS: ", err)
+	}
+	overrideHeaders, err := parseResponseHeaders(responseHeadersForced)
+	if err != nil {
+		log.Fatal("router: invalid ROUTER_RESPONSE_HEADERS_OVERRIDE: ", err)
+	}
+	rout, err := NewRouter(backendConnectTimeout, backendHeaderTimeout, errorLogFile, RouterOptions{
+		BackendTLSHandshakeTimeout: backendTLSTimeout,
+		DNSCacheTTL:                backendDNSCacheTTL,
+		RequestTimeout:             requestTimeout,
+		AllowedMethods:             allowedMethods,
+		TrustedProxies:             trustedProxies,
+		ResponseCacheSize:          responseCacheSize,
+		NotFoundStatus:             notFoundStatus,
+		NotFoundContentType:        notFoundContentType,
+		NotFoundBody:               notFoundBody,
+		AllowedHandlers:            allowedHandlers,
+		AllowedRedirectHosts:       allowedRedirectHosts,
+		BackendWarmupConnections:   backendWarmupConns,
+		BackendWarmupPath:          backendWarmupPath,
+		ErrorPages:                 errorPages,
+		EnableBoom:                 enableBoom,
+		EnableChaos:                enableChaos,
+		RequireHost:                requireHost,
+		SkipRedirectLoops:          skipRedirectLoops,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	requestFormat, err := logger.ParseRequestFormat(logRequestFormat)
+	if err != nil {
+		log.Fatal("router: invalid ROUTER_LOG_REQUEST_FORMAT: ", err)
+	}
+	rout.logger.SetRequestFormat(requestFormat)
+	if enableChaos {
+		logWarn("router: chaos testing is enabled, so routes may inject delays and errors")
+	}
 
-	go catchListenAndServe(pubAddr, rout)
-	logInfo("router: listening for requests on " + pubAddr)
+	watchable := make(map[string]WatchableRouteSource)
+	for _, name := range strings.Split(routeSources, ",") {
+		name = strings.TrimSpace(name)
+		var source RouteSource
+		switch name {
+		case "mongo":
+			source = NewMongoRouteSource(mongoUrl, mongoDbName, "backends", "routes")
+		case "file":
+			source = NewFileRouteSource(routeFile)
+		case "env":
+			source = NewEnvRouteSource("ROUTER_ROUTES_JSON")
+		case "consul":
+			source = NewConsulRouteSource(consulUrl, kvPrefix, debounce)
+		case "etcd":
+			source = NewEtcdRouteSource(etcdUrl, kvPrefix, debounce)
+		default:
+			if !strings.HasPrefix(name, "mongo:") {
+				log.Fatal("router: unknown route source ", name)
+			}
+			db, backendsCollection, routesCollection, err := parseMongoSourceName(name)
+			if err != nil {
+				log.Fatal("router: ", err)
+			}
+			source = NewMongoRouteSource(mongoUrl, db, backendsCollection, routesCollection)
+		}
+		if w, ok := source.(WatchableRouteSource); ok {
+			watchable[name] = w
+		}
+		rout.AddRouteSource(name, source)
+		logInfo("router: loading routes from", name)
+	}
+	if staticFiles != "" {
+		// Added last, so that these routes win over any from other sources.
+		source, err := NewStaticFilesRouteSource(staticFiles)
+		if err != nil {
+			log.Fatal("router: invalid ROUTER_STATIC_FILES: ", err)
+		}
+		rout.AddRouteSource("static-files", source)
+		logInfo("router: serving static files at", staticFiles)
+	}
+	if apiPrefix != "" {
+		rout.ReservePrefix(apiPrefix)
+	}
+	if n, err := strconv.Atoi(maxRedirectLength); err != nil || n < 0 {
+		log.Fatal("router: invalid ROUTER_MAX_REDIRECT_LENGTH: ", maxRedirectLength)
+	} else {
+		rout.LimitRedirectLength(n)
+	}
+	if errorTemplates != "" {
+		if err := rout.SetErrorTemplates(errorTemplates); err != nil {
+			log.Fatal("router: invalid ROUTER_ERROR_TEMPLATES: ", err)
+		}
+		logInfo("router: serving error templates:", errorTemplates)
+	}
+	if n, err := strconv.ParseInt(maxResponseBytes, 10, 64); err != nil || n < 0 {
+		log.Fatal("router: invalid ROUTER_MAX_RESPONSE_BYTES: ", maxResponseBytes)
+	} else if n > 0 {
+		rout.LimitResponseSize(n)
+		logInfo("router: limiting backend responses to", n, "bytes")
+	}
+	if n, err := strconv.Atoi(maxQueuedReloads); err != nil || n < 0 {
+		log.Fatal("router: invalid ROUTER_MAX_QUEUED_RELOADS: ", maxQueuedReloads)
+	} else {
+		rout.LimitQueuedReloads(n)
+	}
+	if interval, err := time.ParseDuration(backendFlushInterval); err != nil {
+		log.Fatal("router: invalid ROUTER_BACKEND_FLUSH_INTERVAL: ", err)
+	} else if interval != 0 {
+		rout.SetBackendFlushInterval(interval)
+	}
+	if backendTimeoutHeader != "" {
+		rout.SendTimeoutHeader(backendTimeoutHeader)
+	}
+	if lazyBackends {
+		rout.LoadBackendsLazily()
+	}
+	if strictPaths {
+		rout.RejectMalformedPaths()
+	}
+	if strictIncomingPaths {
+		rout.FailReloadOnEmptyIncomingPaths()
+	}
+	if httpsRedirect {
+		rout.RedirectToHTTPS()
+	}
+	if edgeMode {
+		if err := rout.ServeAtEdge(); err != nil {
+			log.Fatal("router: invalid ROUTER_EDGE: ", err)
+		}
+		logInfo("router: replacing clients' X-Forwarded-* headers")
+	}
+	if pathPrefix != "" {
+		if err := rout.SetPathPrefix(pathPrefix); err != nil {
+			log.Fatal("router: invalid ROUTER_PATH_PREFIX: ", err)
+		}
+		logInfo("router: serving routes under", pathPrefix)
+	}
+	if threshold, err := strconv.Atoi(scanThreshold); err != nil || threshold < 0 {
+		log.Fatal("router: invalid ROUTER_SCAN_THRESHOLD: ", scanThreshold)
+	} else if threshold > 0 {
+		window, err := time.ParseDuration(scanWindow)
+		if err != nil || window <= 0 {
+			log.Fatal("router: invalid ROUTER_SCAN_WINDOW: ", scanWindow)
+		}
+		rout.DetectScanners(threshold, window, scanBlock)
+		logInfo(fmt.Sprintf("router: detecting clients with %d not-found paths within %v as scanners", threshold, window))
+	}
+	if snapshot, ok := inheritedSnapshot(); ok {
+		if err := rout.RestoreSnapshot(snapshot); err != nil {
+			logWarn("router: couldn't restore routes from the previous process:", err)
+			rout.ReloadRoutes()
+		}
+	} else {
+		rout.ReloadRoutes()
+	}
 
-	api := newApiHandler(rout)
-	go catchListenAndServe(apiAddr, api)
-	logInfo("router: listening for refresh on " + apiAddr)
+	if integrityInterval != "" {
+		interval, err := time.ParseDuration(integrityInterval)
+		if err != nil || interval <= 0 {
+			log.Fatal("router: invalid ROUTER_INTEGRITY_CHECK_INTERVAL: ", integrityInterval)
+		}
+		go rout.CheckRouteIntegrityEvery(context.Background(), interval)
+		logInfo("router: checking the route table's integrity every", interval)
+	}
 
-	dontQuit := make(chan struct{})
-	<-dontQuit
+	if watchRoutes {
+		if len(watchable) == 0 {
+			log.Fatal("router: routes can't be watched when loading from ", routeSources)
+		}
+		maxDrop, err := strconv.Atoi(watchMaxDropPercent)
+		if err != nil {
+			log.Fatal("router: invalid ROUTER_WATCH_MAX_DROP_PERCENT: ", err)
+		}
+		for name, source := range watchable {
+			name := name
+			go source.Watch(context.Background(), func() {
+				rout.ReloadSourceWithDropProtection(name, maxDrop)
+			})
+			logInfo("router: watching", name, "for route changes")
+		}
+	}
+
+	public := publicHandler(rout, defaultHeaders, overrideHeaders)
+	var accessLogger logger.Logger
+	if accessLogFile != "" {
+		sample, err := parseAccessLogSample(accessLogSample)
+		if err != nil {
+			log.Fatal("router: invalid ROUTER_ACCESS_LOG_SAMPLE: ", err)
+		}
+		slow, err := time.ParseDuration(accessLogSlow)
+		if err != nil {
+			log.Fatal("router: invalid ROUTER_ACCESS_LOG_SLOW: ", err)
+		}
+		accessLogger, err = logger.New(accessLogFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		accessLogger.SetRequestFormat(requestFormat)
+		exclude := parseAccessLogExclude(accessLogExclude)
+		if exclude != nil {
+			exclude.DropErrors = accessLogDropErrors
+		}
+		public = handlers.NewAccessLogHandler(public, accessLogger, sample, slow, exclude)
+		logInfo("router: logging requests to", accessLogFile)
+	}
+	if apiPrefix != "" {
+		public, err = withApiPrefix(public, newApiHandler(rout), apiPrefix, apiUser, apiPasswordSHA256)
+		if err != nil {
+			log.Fatal("router: invalid ROUTER_API_PREFIX: ", err)
+		}
+	}
+	publicListener, err := listen("public", pubAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	listeners := map[string]net.Listener{"public": publicListener}
+	servers := []*http.Server{serve(rout, "public", publicListener, public)}
+	if apiPrefix == "" {
+		apiListener, err := listen("api", apiAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners["api"] = apiListener
+		servers = append(servers, serve(rout, "api", apiListener, newApiHandler(rout)))
+	} else {
+		logInfo("router: serving api requests on the public address under", apiPrefix)
+	}
+	notifyReady()
+
+	handedOff := false
+	handOff := func() error {
+		snapshot, err := rout.Snapshot()
+		if err != nil {
+			return err
+		}
+		executable, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		if _, err := startSuccessor(executable, os.Args[1:], listeners, snapshot, handoffTimeout); err != nil {
+			return err
+		}
+		handedOff = true
+		return nil
+	}
+	stop := func() {
+		if handedOff {
+			drain(servers, listeners, rout.requestTimeout)
+		}
+		if accessLogger != nil {
+			accessLogger.Flush()
+		}
+		shutdown()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+	sig := waitForShutdown(rout, signals, handOff, stop)
+	if handedOff {
+		os.Exit(0)
+	}
+	os.Exit(128 + int(sig.(syscall.Signal)))
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/alphagov/router/handlers"
+	"github.com/alphagov/router/logger"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestLifecycleEvents(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone,filesystem,boom"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	var buf bytes.Buffer
+	rt.logger, _ = logger.New(&buf)
+	rt.AddRouteSource("static", &staticRouteSource{routes: goneRoutes(2)})
+
+	rt.ReloadRoutes()
+	listeners := []struct {
+		name    string
+		handler http.Handler
+	}{{"public", rt}, {"api", http.NotFoundHandler()}}
+	for _, l := range listeners {
+		listener, err := listen(l.name, "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Unexpected error listening: %v", err)
+		}
+		defer serve(rt, l.name, listener, l.handler).Close()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signals <- syscall.SIGTERM
+	shutdownCalled := false
+	waitForShutdown(rt, signals, nil, func() { shutdownCalled = true })
+	if !shutdownCalled {
+		t.Error("Expected the shutdown function to be called")
+	}
+
+	var events []map[string]interface{}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var entry struct {
+			Fields map[string]interface{} `json:"@fields"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("Unexpected error parsing log entry %q: %v", scanner.Text(), err)
+		}
+		if _, ok := entry.Fields["event"]; ok {
+			events = append(events, entry.Fields)
+		}
+	}
+
+	expected := []string{"routes_loaded", "listening", "listening", "shutdown_initiated", "shutdown_complete"}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected events %v, got %v", expected, events)
+	}
+	for i, event := range expected {
+		if events[i]["event"] != event {
+			t.Errorf("Expected event %d to be %s, got %v", i, event, events[i])
+		}
+	}
+	if events[0]["count"] != float64(2) || events[0]["checksum"] != rt.RouteChecksum() {
+		t.Errorf("Expected the routes_loaded event to give the route count and checksum, got %v", events[0])
+	}
+	if events[1]["listener"] != "public" || events[2]["listener"] != "api" {
+		t.Errorf("Expected listening events for the public and api listeners, got %v and %v", events[1], events[2])
+	}
+	if events[3]["signal"] != "terminated" {
+		t.Errorf("Expected the shutdown_initiated event to give the signal, got %v", events[3])
+	}
+}
+
+func TestResponseHeadersAreInjected(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+		w.Header().Set("Server", "backend")
+	}))
+	defer backend.Close()
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone,filesystem,boom"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{{BackendId: "backend", BackendURL: backend.URL}},
+		routes: []Route{
+			{IncomingPath: "/backend", Handler: "backend", BackendId: "backend"},
+			{IncomingPath: "/redirect", Handler: "redirect", RedirectTo: "/target"},
+		},
+	})
+	rt.ReloadRoutes()
+
+	defaults, err := parseResponseHeaders(`{"X-Frame-Options": "DENY", "X-Content-Type-Options": "nosniff"}`)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing headers: %v", err)
+	}
+	overrides, _ := parseResponseHeaders(`{"Server": "router"}`)
+	handler := publicHandler(rt, defaults, overrides)
+
+	examples := []struct {
+		path        string
+		status      int
+		frameOption string
+	}{
+		{"/backend", http.StatusOK, "SAMEORIGIN"}, // the backend's own value is kept
+		{"/redirect", http.StatusMovedPermanently, "DENY"},
+		{"/missing", http.StatusNotFound, "DENY"},
+	}
+	for _, ex := range examples {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", ex.path, nil))
+		if w.Code != ex.status {
+			t.Errorf("Expected %s to get %d, got %d", ex.path, ex.status, w.Code)
+		}
+		if got := w.Header().Get("X-Frame-Options"); got != ex.frameOption {
+			t.Errorf("Expected %s to have X-Frame-Options %q, got %q", ex.path, ex.frameOption, got)
+		}
+		if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+			t.Errorf("Expected %s to have X-Content-Type-Options nosniff, got %q", ex.path, got)
+		}
+		if got := w.Header().Get("Server"); got != "router" {
+			t.Errorf("Expected %s to have its Server header overridden, got %q", ex.path, got)
+		}
+	}
+}
+
+func TestParseResponseHeadersRejectsInvalidJSON(t *testing.T) {
+	if _, err := parseResponseHeaders(`X-Frame-Options: DENY`); err == nil {
+		t.Error("Expected an error for headers which aren't a JSON object")
+	}
+}
+
+func TestParseAccessLogSample(t *testing.T) {
+	examples := []struct {
+		value    string
+		expected handlers.AccessLogSample
+		valid    bool
+	}{
+		{"", handlers.AccessLogSample{}, true},
+		{"1", handlers.AccessLogSample{Every: 1}, true},
+		{"100", handlers.AccessLogSample{Every: 100}, true},
+		{"12.5%", handlers.AccessLogSample{Percent: 12.5}, true},
+		{"100%", handlers.AccessLogSample{Percent: 100}, true},
+		{"0", handlers.AccessLogSample{}, false},
+		{"-2", handlers.AccessLogSample{}, false},
+		{"0%", handlers.AccessLogSample{}, false},
+		{"150%", handlers.AccessLogSample{}, false},
+		{"half", handlers.AccessLogSample{}, false},
+	}
+	for _, ex := range examples {
+		sample, err := parseAccessLogSample(ex.value)
+		if ex.valid && (err != nil || sample != ex.expected) {
+			t.Errorf("Expected %q to parse as %+v, got %+v (error: %v)", ex.value, ex.expected, sample, err)
+		}
+		if !ex.valid && err == nil {
+			t.Errorf("Expected an error parsing %q, got %+v", ex.value, sample)
+		}
+	}
+}
+
+func TestParseAccessLogExclude(t *testing.T) {
+	if exclude := parseAccessLogExclude(" , "); exclude != nil {
+		t.Errorf("Expected an empty list to exclude nothing, got %+v", exclude)
+	}
+	exclude := parseAccessLogExclude("/healthcheck, /metrics*,/assets/*")
+	expected := &handlers.AccessLogExclude{
+		Paths:    map[string]bool{"/healthcheck": true},
+		Prefixes: []string{"/metrics", "/assets/"},
+	}
+	if !reflect.DeepEqual(exclude, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, exclude)
+	}
+}
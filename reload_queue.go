@@ -0,0 +1,154 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultMaxQueuedReloads is the number of reloads which may wait for the
+// running one to finish unless LimitQueuedReloads is called.
+const defaultMaxQueuedReloads = 1
+
+// reloadQueue makes reloads run one at a time, holding a limited number
+// waiting their turn. A reload triggered while one with the same drop
+// protection is already waiting shares that one rather than being queued
+// again, so a burst of triggers loads from the route sources no more than
+// twice.
+type reloadQueue struct {
+	mu        sync.Mutex
+	maxQueued int
+	running   *queuedReload
+	queued    []*queuedReload
+	coalesced int64
+	dropped   int64
+}
+
+// queuedReload is a reload which is running or waiting to, shared by every
+// trigger coalesced into it.
+type queuedReload struct {
+	name           string
+	maxDropPercent int
+	backendsOnly   bool
+	queuedAt       time.Time
+	startedAt      time.Time
+	triggers       int
+	// start is closed when the reload may run, and done once it has, after
+	// which err holds its outcome.
+	start chan struct{}
+	done  chan struct{}
+	err   error
+}
+
+// merge makes r, which is waiting, do everything a reload of the named
+// source (or of all of them, if name is empty) would, and reports whether it
+// could. A reload of one source is widened to all of them to cover a full
+// reload. Reloads with different drop protection are never merged, as one
+// would either lose its guard or fail because of the other's. A reload of
+// just the backends is covered by a full reload without drop protection.
+func (r *queuedReload) merge(name string, maxDropPercent int, backendsOnly bool) bool {
+	if r.backendsOnly != backendsOnly {
+		return backendsOnly && r.name == "" && r.maxDropPercent < 0
+	}
+	if r.maxDropPercent != maxDropPercent {
+		return false
+	}
+	switch {
+	case r.name == "" || r.name == name:
+	case name == "":
+		r.name = ""
+	default:
+		return false
+	}
+	return true
+}
+
+// enter finds the reload which will serve a trigger for the named source.
+// If owner is true, the caller must wait for start to be closed, run the
+// reload and then call finish; otherwise it need only wait for done. If the
+// queue is full, ok is false and the trigger is dropped.
+func (q *reloadQueue) enter(name string, maxDropPercent int, backendsOnly bool) (r *queuedReload, owner, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	r = &queuedReload{
+		name:           name,
+		maxDropPercent: maxDropPercent,
+		backendsOnly:   backendsOnly,
+		queuedAt:       time.Now(),
+		triggers:       1,
+		start:          make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	if q.running == nil {
+		r.startedAt = r.queuedAt
+		close(r.start)
+		q.running = r
+		return r, true, true
+	}
+
+	for _, waiting := range q.queued {
+		if waiting.merge(name, maxDropPercent, backendsOnly) {
+			waiting.triggers++
+			q.coalesced++
+			return waiting, false, true
+		}
+	}
+	if len(q.queued) >= q.maxQueued {
+		q.dropped++
+		return nil, false, false
+	}
+	q.queued = append(q.queued, r)
+	return r, true, true
+}
+
+// finish records the outcome of the running reload, and lets the next one
+// waiting, if there is one, start.
+func (q *reloadQueue) finish(r *queuedReload, err error) {
+	r.err = err
+	close(r.done)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.running = nil
+	if len(q.queued) > 0 {
+		q.running = q.queued[0]
+		q.queued = q.queued[1:]
+		q.running.startedAt = time.Now()
+		close(q.running.start)
+	}
+}
+
+// status describes the running and queued reloads, and how many triggers
+// have been coalesced or dropped.
+func (q *reloadQueue) status() map[string]interface{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	describe := func(r *queuedReload) map[string]interface{} {
+		return map[string]interface{}{
+			"source":        r.name,
+			"backends_only": r.backendsOnly,
+			"triggers":      r.triggers,
+			"queued_at":     r.queuedAt.UTC().Format(time.RFC3339Nano),
+		}
+	}
+
+	running := map[string]interface{}(nil)
+	if q.running != nil {
+		running = describe(q.running)
+		running["started_at"] = q.running.startedAt.UTC().Format(time.RFC3339Nano)
+	}
+	queued := make([]map[string]interface{}, 0, len(q.queued))
+	for _, r := range q.queued {
+		queued = append(queued, describe(r))
+	}
+
+	return map[string]interface{}{
+		"running":    running,
+		"queued":     queued,
+		"max_queued": q.maxQueued,
+		"coalesced":  q.coalesced,
+		"dropped":    q.dropped,
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"labix.org/v2/mgo"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A RouteSource provides the backends and routes which make up a routing
+// table. Routes must be returned sorted by incoming_path and then route_type,
+// as the route checksum depends on the order in which they are registered.
+type RouteSource interface {
+	Load() (backends []Backend, routes []Route, err error)
+}
+
+// ErrInvalidRouteData is wrapped by the errors route sources return when the
+// backends or routes they hold can't be parsed.
+var ErrInvalidRouteData = errors.New("invalid route data")
+
+// A BackendSource is a RouteSource which can load its backends without its
+// routes, for Router.ReloadBackends.
+type BackendSource interface {
+	RouteSource
+	LoadBackends() (backends []Backend, err error)
+}
+
+// loadBackends loads just the backends from a route source, loading the
+// routes as well and throwing them away if it isn't a BackendSource.
+func loadBackends(source RouteSource) ([]Backend, error) {
+	if bs, ok := source.(BackendSource); ok {
+		return bs.LoadBackends()
+	}
+	backends, _, err := source.Load()
+	return backends, err
+}
+
+// A WatchableRouteSource is a RouteSource which can tell when its routes have
+// changed. Watch blocks, calling reload after each (debounced) change, until
+// the context is cancelled.
+type WatchableRouteSource interface {
+	RouteSource
+	Watch(ctx context.Context, reload func())
+}
+
+// mongoRouteSource loads backends and routes from two collections of a mongo
+// database (normally "backends" and "routes").
+type mongoRouteSource struct {
+	url                string
+	dbName             string
+	backendsCollection string
+	routesCollection   string
+}
+
+func NewMongoRouteSource(url, dbName, backendsCollection, routesCollection string) RouteSource {
+	return &mongoRouteSource{url, dbName, backendsCollection, routesCollection}
+}
+
+// parseMongoSourceName parses the name of an extra mongo route source, of
+// the form "mongo:<db>" or "mongo:<db>/<backends collection>/<routes
+// collection>", returning the database and collection names.
+func parseMongoSourceName(name string) (dbName, backendsCollection, routesCollection string, err error) {
+	spec, ok := strings.CutPrefix(name, "mongo:")
+	if !ok {
+		return "", "", "", fmt.Errorf("%s is not a mongo route source", name)
+	}
+	parts := strings.Split(spec, "/")
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		return parts[0], "backends", "routes", nil
+	case len(parts) == 3 && parts[0] != "" && parts[1] != "" && parts[2] != "":
+		return parts[0], parts[1], parts[2], nil
+	}
+	return "", "", "", fmt.Errorf("mongo route source %s should be mongo:<db> or mongo:<db>/<backends>/<routes>", name)
+}
+
+// dial opens a session with the source's database.
+func (s *mongoRouteSource) dial() (*mgo.Session, error) {
+	logDebug("mgo: connecting to", s.url)
+	sess, err := mgo.Dial(s.url)
+	if err != nil {
+		return nil, fmt.Errorf("mgo: %w", err)
+	}
+	sess.SetMode(mgo.Strong, true)
+	return sess, nil
+}
+
+func (s *mongoRouteSource) Load() (backends []Backend, routes []Route, err error) {
+	sess, err := s.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer sess.Close()
+
+	db := sess.DB(s.dbName)
+
+	if err = db.C(s.backendsCollection).Find(nil).All(&backends); err != nil {
+		return nil, nil, err
+	}
+	if err = db.C(s.routesCollection).Find(nil).Sort("incoming_path", "route_type").All(&routes); err != nil {
+		return nil, nil, err
+	}
+	return backends, routes, nil
+}
+
+// LoadBackends reads just the backends collection, leaving the (usually much
+// larger) routes collection alone.
+func (s *mongoRouteSource) LoadBackends() (backends []Backend, err error) {
+	sess, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer sess.Close()
+
+	if err = sess.DB(s.dbName).C(s.backendsCollection).Find(nil).All(&backends); err != nil {
+		return nil, err
+	}
+	return backends, nil
+}
+
+// snapshotRouteSource stands in for a route source while a snapshot taken by
+// another router process is restored. The first load returns the backends
+// and routes from the snapshot, and later loads use the wrapped source.
+type snapshotRouteSource struct {
+	RouteSource
+	backends []Backend
+	routes   []Route
+	used     bool
+}
+
+func (s *snapshotRouteSource) Load() (backends []Backend, routes []Route, err error) {
+	if s.used {
+		return s.RouteSource.Load()
+	}
+	s.used = true
+	return s.backends, s.routes, nil
+}
+
+// LoadBackends loads the wrapped source's backends. The snapshot's backends
+// are only used by the first full load.
+func (s *snapshotRouteSource) LoadBackends() (backends []Backend, err error) {
+	return loadBackends(s.RouteSource)
+}
+
+// fileRouteSource loads backends and routes from a JSON file of the form
+// {"backends": [...], "routes": [...]}, using the same field names as the
+// mongo collections.
+type fileRouteSource struct {
+	path string
+}
+
+func NewFileRouteSource(path string) RouteSource {
+	return &fileRouteSource{path}
+}
+
+func (s *fileRouteSource) Load() (backends []Backend, routes []Route, err error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	backends, routes, err = parseRoutesJSON(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: couldn't parse %s: %v", ErrInvalidRouteData, s.path, err)
+	}
+	return backends, routes, nil
+}
+
+// envRouteSource loads backends and routes from an environment variable
+// holding JSON in the same form as a fileRouteSource's file. It's intended
+// for small routing tables, where it's simpler to pass the routes to the
+// router than for it to fetch them.
+type envRouteSource struct {
+	name string
+}
+
+func NewEnvRouteSource(name string) RouteSource {
+	return &envRouteSource{name}
+}
+
+func (s *envRouteSource) Load() (backends []Backend, routes []Route, err error) {
+	data := os.Getenv(s.name)
+	if data == "" {
+		return nil, nil, fmt.Errorf("%s is not set", s.name)
+	}
+	backends, routes, err = parseRoutesJSON([]byte(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: couldn't parse %s: %v", ErrInvalidRouteData, s.name, err)
+	}
+	return backends, routes, nil
+}
+
+// staticFilesRouteSource provides an exact static route for each of a list of
+// paths, serving the contents of a file read when the routes are loaded. It
+// lets the router own site-wide resources, such as /robots.txt, without
+// them being added to another route source.
+type staticFilesRouteSource struct {
+	files map[string]string
+}
+
+// NewStaticFilesRouteSource returns a route source for the comma-separated
+// list of path=file pairs in spec, such as
+// "/robots.txt=/etc/router/robots.txt".
+func NewStaticFilesRouteSource(spec string) (RouteSource, error) {
+	files := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		path, file, ok := strings.Cut(pair, "=")
+		if !ok || !strings.HasPrefix(path, "/") || file == "" {
+			return nil, fmt.Errorf("invalid static file %q: must be of the form /path=file", pair)
+		}
+		files[path] = file
+	}
+	return &staticFilesRouteSource{files}, nil
+}
+
+func (s *staticFilesRouteSource) Load() (backends []Backend, routes []Route, err error) {
+	for path, file := range s.files {
+		body, err := os.ReadFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		contentType := mime.TypeByExtension(filepath.Ext(file))
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+		}
+		routes = append(routes, Route{
+			IncomingPath:      path,
+			RouteType:         "exact",
+			Handler:           "static",
+			StaticBody:        string(body),
+			StaticContentType: contentType,
+		})
+	}
+
+	sort.Sort(routesByPathAndType(routes))
+	return nil, routes, nil
+}
+
+// parseRoutesJSON parses the backends and routes from a document of the form
+// {"backends": [...], "routes": [...]}, and sorts the routes.
+func parseRoutesJSON(data []byte) (backends []Backend, routes []Route, err error) {
+	var doc struct {
+		Backends []Backend `json:"backends"`
+		Routes   []Route   `json:"routes"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+
+	sort.Sort(routesByPathAndType(doc.Routes))
+	return doc.Backends, doc.Routes, nil
+}
+
+// kvPair is a document read from a key-value store such as consul or etcd.
+type kvPair struct {
+	Key   string
+	Value []byte
+}
+
+// routesFromKV decodes the backends and routes stored as JSON documents under
+// <prefix>/backends/ and <prefix>/routes/ respectively, using the same field
+// names as the mongo collections. Other keys are ignored.
+func routesFromKV(prefix string, pairs []kvPair) (backends []Backend, routes []Route, err error) {
+	for _, pair := range pairs {
+		if len(pair.Value) == 0 {
+			// Keys without values are "folders".
+			continue
+		}
+		switch key := strings.TrimPrefix(pair.Key, prefix+"/"); {
+		case strings.HasPrefix(key, "backends/"):
+			var backend Backend
+			if err := json.Unmarshal(pair.Value, &backend); err != nil {
+				return nil, nil, fmt.Errorf("%w: couldn't parse backend %s: %v", ErrInvalidRouteData, pair.Key, err)
+			}
+			backends = append(backends, backend)
+		case strings.HasPrefix(key, "routes/"):
+			var route Route
+			if err := json.Unmarshal(pair.Value, &route); err != nil {
+				return nil, nil, fmt.Errorf("%w: couldn't parse route %s: %v", ErrInvalidRouteData, pair.Key, err)
+			}
+			routes = append(routes, route)
+		}
+	}
+
+	sort.Sort(routesByPathAndType(routes))
+	return backends, routes, nil
+}
+
+// routesByPathAndType sorts routes in the same order as the mongo query.
+type routesByPathAndType []Route
+
+func (r routesByPathAndType) Len() int      { return len(r) }
+func (r routesByPathAndType) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r routesByPathAndType) Less(i, j int) bool {
+	if r[i].IncomingPath != r[j].IncomingPath {
+		return r[i].IncomingPath < r[j].IncomingPath
+	}
+	return r[i].RouteType < r[j].RouteType
+}
+
+// notifyChange signals a change on a channel without blocking. Changes which
+// arrive while one is already pending are merged into it.
+func notifyChange(changes chan<- struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
+
+// debounceChanges calls reload once changes have stopped arriving on the
+// channel for the debounce period, until the context is cancelled.
+func debounceChanges(ctx context.Context, changes <-chan struct{}, debounce time.Duration, reload func()) {
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changes:
+			timer = time.After(debounce)
+		case <-timer:
+			timer = nil
+			reload()
+		}
+	}
+}
+
+// sleepContext waits for the given duration, returning early (and false) if
+// the context is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
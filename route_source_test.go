@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/alphagov/router/logger"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type staticRouteSource struct {
+	backends []Backend
+	routes   []Route
+	err      error
+	loads    int
+}
+
+func (s *staticRouteSource) Load() ([]Backend, []Route, error) {
+	s.loads++
+	if s.err != nil {
+		return nil, nil, s.err
+	}
+	return s.backends, s.routes, nil
+}
+
+type panickingRouteSource struct{}
+
+func (panickingRouteSource) Load() ([]Backend, []Route, error) {
+	panic("oops")
+}
+
+func goneRoutes(n int) (routes []Route) {
+	for i := 0; i < n; i++ {
+		routes = append(routes, Route{IncomingPath: fmt.Sprintf("/gone-%d", i), RouteType: "exact", Handler: "gone"})
+	}
+	return
+}
+
+func TestReloadRoutesWithDropProtection(t *testing.T) {
+	source := &staticRouteSource{routes: goneRoutes(10)}
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone,filesystem,boom"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", source)
+
+	testCases := []struct {
+		routes   int
+		expected int
+	}{
+		{10, 10}, // the first load is never refused
+		{5, 5},   // dropping exactly half is allowed
+		{2, 5},   // dropping more than half is refused
+		{0, 5},   // as is dropping everything
+		{20, 20}, // adding routes is always allowed
+	}
+
+	for _, tc := range testCases {
+		source.routes = goneRoutes(tc.routes)
+		rt.ReloadRoutesWithDropProtection(50)
+		if count := rt.mux.Load().RouteCount(); count != tc.expected {
+			t.Errorf("Reloading %d routes: expected %d routes loaded, got %d", tc.routes, tc.expected, count)
+		}
+	}
+
+	source.routes = nil
+	rt.ReloadRoutes()
+	if count := rt.mux.Load().RouteCount(); count != 0 {
+		t.Errorf("Expected ReloadRoutes to ignore drop protection, got %d routes", count)
+	}
+}
+
+func TestReloadErrors(t *testing.T) {
+	dir := t.TempDir()
+	invalidPath := filepath.Join(dir, "routes.json")
+	if err := os.WriteFile(invalidPath, []byte(`{"routes": [`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	examples := []struct {
+		name     string
+		source   RouteSource
+		expected error
+	}{
+		{"unavailable", &staticRouteSource{err: errors.New("connection refused")}, ErrRouteSourceUnavailable},
+		{"timeout", &staticRouteSource{err: fmt.Errorf("etcd: %w", context.DeadlineExceeded)}, ErrRouteSourceTimeout},
+		{"invalid", NewFileRouteSource(invalidPath), ErrInvalidRouteData},
+		{"drop protection", &staticRouteSource{routes: goneRoutes(1)}, ErrTooManyRoutesDropped},
+		{"panic", panickingRouteSource{}, ErrReloadPanicked},
+	}
+	kinds := []error{ErrRouteSourceUnavailable, ErrRouteSourceTimeout, ErrInvalidRouteData, ErrTooManyRoutesDropped, ErrReloadPanicked}
+	for _, ex := range examples {
+		rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone,filesystem,boom"})
+		if err != nil {
+			t.Fatalf("Unexpected error creating router: %v", err)
+		}
+		// Load 10 routes, and then switch to the failing source.
+		source := &struct{ RouteSource }{&staticRouteSource{routes: goneRoutes(10)}}
+		rt.AddRouteSource("source", source)
+		rt.ReloadRoutes()
+		source.RouteSource = ex.source
+
+		err = rt.ReloadRoutesWithDropProtection(50)
+		for _, kind := range kinds {
+			if errors.Is(err, kind) != (kind == ex.expected) {
+				t.Errorf("%s: expected an error wrapping %v, got %v", ex.name, ex.expected, err)
+			}
+		}
+		if count := rt.mux.Load().RouteCount(); count != 10 {
+			t.Errorf("%s: expected the original 10 routes to be kept, got %d", ex.name, count)
+		}
+	}
+}
+
+func TestFileRouteSourceLoad(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "routes.json")
+	os.WriteFile(file, []byte(`{
+		"backends": [{"backend_id": "foo", "backend_url": "http://foo.example.com/"}],
+		"routes": [
+			{"incoming_path": "/foo", "route_type": "prefix", "handler": "backend", "backend_id": "foo"},
+			{"incoming_path": "/foo", "route_type": "exact", "handler": "gone"},
+			{"incoming_path": "/bar", "route_type": "exact", "handler": "redirect", "redirect_to": "/baz"}
+		]
+	}`), 0644)
+
+	backends, routes, err := NewFileRouteSource(file).Load()
+	if err != nil {
+		t.Fatalf("Unexpected error loading routes: %v", err)
+	}
+	checkLoadedRoutes(t, backends, routes)
+
+	if _, _, err := NewFileRouteSource(file + ".missing").Load(); err == nil {
+		t.Error("Expected an error loading routes from a missing file")
+	}
+}
+
+func TestEnvRouteSourceLoad(t *testing.T) {
+	t.Setenv("ROUTER_TEST_ROUTES_JSON", `{
+		"backends": [{"backend_id": "foo", "backend_url": "http://foo.example.com/"}],
+		"routes": [
+			{"incoming_path": "/foo", "route_type": "prefix", "handler": "backend", "backend_id": "foo"},
+			{"incoming_path": "/foo", "route_type": "exact", "handler": "gone"},
+			{"incoming_path": "/bar", "route_type": "exact", "handler": "redirect", "redirect_to": "/baz"}
+		]
+	}`)
+	source := NewEnvRouteSource("ROUTER_TEST_ROUTES_JSON")
+
+	backends, routes, err := source.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error loading routes: %v", err)
+	}
+	checkLoadedRoutes(t, backends, routes)
+
+	// The variable is read on each load, not just the first.
+	t.Setenv("ROUTER_TEST_ROUTES_JSON", `{"routes": [{"incoming_path": "/foo",`)
+	if _, _, err := source.Load(); err == nil || !strings.Contains(err.Error(), "ROUTER_TEST_ROUTES_JSON") {
+		t.Errorf("Expected an error naming the variable for malformed JSON, got %v", err)
+	}
+	if _, _, err := NewEnvRouteSource("ROUTER_TEST_UNSET_ROUTES_JSON").Load(); err == nil {
+		t.Error("Expected an error loading routes from an unset variable")
+	}
+}
+
+func TestReloadSource(t *testing.T) {
+	first := &staticRouteSource{routes: []Route{
+		{IncomingPath: "/first", RouteType: "exact", Handler: "gone"},
+		{IncomingPath: "/both", RouteType: "exact", Handler: "gone"},
+	}}
+	second := &staticRouteSource{routes: []Route{
+		{IncomingPath: "/second", RouteType: "exact", Handler: "gone"},
+		{IncomingPath: "/both", RouteType: "exact", Handler: "redirect", RedirectTo: "/elsewhere"},
+	}}
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone,filesystem,boom"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("first", first)
+	rt.AddRouteSource("second", second)
+	rt.ReloadRoutes()
+
+	status := func(path string) int {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+	expectStatuses := func(expected map[string]int) {
+		for path, code := range expected {
+			if actual := status(path); actual != code {
+				t.Errorf("Expected GET %s to return %d, got %d", path, code, actual)
+			}
+		}
+	}
+
+	// The later source takes precedence for /both.
+	expectStatuses(map[string]int{"/first": 410, "/second": 410, "/both": 301})
+
+	first.routes = nil
+	second.routes = []Route{{IncomingPath: "/second-reloaded", RouteType: "exact", Handler: "gone"}}
+	if err := rt.ReloadSource("second"); err != nil {
+		t.Fatalf("Unexpected error reloading source: %v", err)
+	}
+	if first.loads != 1 || second.loads != 2 {
+		t.Errorf("Expected only the second source to be loaded again, got %d and %d loads", first.loads, second.loads)
+	}
+	expectStatuses(map[string]int{"/first": 410, "/both": 410, "/second": 404, "/second-reloaded": 410})
+
+	if err := rt.ReloadSource("third"); !errors.Is(err, ErrUnknownRouteSource) {
+		t.Errorf("Expected ErrUnknownRouteSource reloading an unknown source, got %v", err)
+	}
+
+	rt.ReloadRoutes()
+	expectStatuses(map[string]int{"/first": 404, "/both": 404, "/second-reloaded": 410})
+}
+
+func TestParseMongoSourceName(t *testing.T) {
+	examples := []struct {
+		name, db, backends, routes string
+		valid                      bool
+	}{
+		{"mongo:publishing", "publishing", "backends", "routes", true},
+		{"mongo:apps/app_backends/app_routes", "apps", "app_backends", "app_routes", true},
+		{"mongo:", "", "", "", false},
+		{"mongo:apps/app_backends", "", "", "", false},
+		{"mongo:apps//app_routes", "", "", "", false},
+		{"mongo", "", "", "", false},
+		{"file", "", "", "", false},
+	}
+	for _, ex := range examples {
+		db, backends, routes, err := parseMongoSourceName(ex.name)
+		if ex.valid && (err != nil || db != ex.db || backends != ex.backends || routes != ex.routes) {
+			t.Errorf("Expected %s to give %s, %s and %s, got %s, %s and %s (error: %v)",
+				ex.name, ex.db, ex.backends, ex.routes, db, backends, routes, err)
+		}
+		if !ex.valid && err == nil {
+			t.Errorf("Expected an error parsing %s", ex.name)
+		}
+	}
+}
+
+func TestReloadReportsSourceCounts(t *testing.T) {
+	publishing := &staticRouteSource{
+		backends: []Backend{{BackendId: "frontend", BackendURL: "http://frontend.example.com/"}},
+		routes: []Route{
+			{IncomingPath: "/guidance", RouteType: "prefix", Handler: "gone"},
+			{IncomingPath: "/shared", RouteType: "exact", Handler: "gone"},
+		},
+	}
+	apps := &staticRouteSource{
+		routes: []Route{
+			{IncomingPath: "/apply", RouteType: "prefix", Handler: "gone"},
+			{IncomingPath: "/shared", RouteType: "exact", Handler: "redirect", RedirectTo: "/apply"},
+			{IncomingPath: "/renew", RouteType: "exact", Handler: "gone"},
+		},
+	}
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	var buf bytes.Buffer
+	rt.logger, _ = logger.New(&buf)
+	rt.AddRouteSource("mongo:publishing", publishing)
+	rt.AddRouteSource("mongo:apps/app_backends/app_routes", apps)
+	var result ReloadResult
+	rt.OnReload(func(r ReloadResult) { result = r })
+	rt.ReloadRoutes()
+
+	expected := map[string]SourceCount{
+		"mongo:publishing":                   {Backends: 1, Routes: 2},
+		"mongo:apps/app_backends/app_routes": {Backends: 0, Routes: 3},
+	}
+	if !reflect.DeepEqual(result.Sources, expected) {
+		t.Errorf("Expected source counts %v, got %v", expected, result.Sources)
+	}
+	if result.RouteCount != 5 {
+		t.Errorf("Expected both registrations of /shared to be counted, giving 5 routes, got %d", result.RouteCount)
+	}
+
+	// The later source wins for the overlapping path.
+	w := httptest.NewRecorder()
+	rt.ServeHTTP(w, httptest.NewRequest("GET", "/shared", nil))
+	if w.Code != http.StatusMovedPermanently {
+		t.Errorf("Expected /shared to be served by the later source, got %d", w.Code)
+	}
+
+	rt.logger.Flush()
+	if !strings.Contains(buf.String(), `"sources":{"mongo:apps/app_backends/app_routes":{"backends":0,"routes":3},"mongo:publishing":{"backends":1,"routes":2}}`) {
+		t.Errorf("Expected the routes_loaded event to give each source's counts, got %q", buf.String())
+	}
+}
+
+func TestStaticFilesRouteSource(t *testing.T) {
+	dir := t.TempDir()
+	robots := filepath.Join(dir, "robots")
+	security := filepath.Join(dir, "security.html")
+	os.WriteFile(robots, []byte("User-agent: *\n"), 0644)
+	os.WriteFile(security, []byte("Contact: mailto:security@example.com\n"), 0644)
+
+	source, err := NewStaticFilesRouteSource("/robots.txt=" + robots + ", /.well-known/security.txt=" + security)
+	if err != nil {
+		t.Fatalf("Unexpected error creating source: %v", err)
+	}
+	backends, routes, err := source.Load()
+	if err != nil {
+		t.Fatalf("Unexpected error loading routes: %v", err)
+	}
+	expected := []Route{
+		{IncomingPath: "/.well-known/security.txt", RouteType: "exact", Handler: "static", StaticBody: "Contact: mailto:security@example.com\n", StaticContentType: "text/html; charset=utf-8"},
+		{IncomingPath: "/robots.txt", RouteType: "exact", Handler: "static", StaticBody: "User-agent: *\n", StaticContentType: "text/plain; charset=utf-8"},
+	}
+	if len(backends) != 0 || !reflect.DeepEqual(routes, expected) {
+		t.Errorf("Expected %+v, got %+v and backends %+v", expected, routes, backends)
+	}
+
+	for _, spec := range []string{"robots.txt=" + robots, "/robots.txt", "/robots.txt="} {
+		if _, err := NewStaticFilesRouteSource(spec); err == nil {
+			t.Errorf("Expected %q to be refused", spec)
+		}
+	}
+	source, _ = NewStaticFilesRouteSource("/missing=" + filepath.Join(dir, "missing"))
+	if _, _, err := source.Load(); err == nil {
+		t.Error("Expected loading a missing file to fail")
+	}
+}
@@ -1,46 +1,319 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/alphagov/router/handlers"
 	"github.com/alphagov/router/logger"
+	"github.com/alphagov/router/tracing"
+	"github.com/alphagov/router/trie"
 	"github.com/alphagov/router/triemux"
-	"labix.org/v2/mgo"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Router is a wrapper around an HTTP multiplexer (trie.Mux) which retrieves its
-// routes from a passed mongo database.
+// routes from one or more RouteSources.
 type Router struct {
-	mux                   *triemux.Mux
+	// mux is loaded by ServeHTTP without taking lock, so that requests don't
+	// contend with each other. It's only replaced while holding lock, along
+	// with the state describing it.
+	mux atomic.Pointer[triemux.Mux]
+
+	// ready is set once routes have first been loaded successfully. Until
+	// then requests are turned away with a 503 rather than being looked up
+	// in an empty table.
+	ready atomic.Bool
+
+	// inFlight counts the requests currently being served.
+	inFlight atomic.Int64
+
+	// generation counts the requests being served with the current mux. It's
+	// replaced just after the mux, so a request loading it before the mux
+	// is counted against the mux it uses, or an earlier one.
+	generation atomic.Pointer[generation]
+
+	// maintenance is the page served in place of every route while the
+	// router is in maintenance mode, or nil if it isn't.
+	maintenance atomic.Pointer[maintenancePage]
+
+	// integrityFailures counts the integrity checks which have found the
+	// route tries corrupted.
+	integrityFailures atomic.Int64
+
+	// reloads queues reloads triggered while another is running.
+	reloads reloadQueue
+
 	lock                  sync.RWMutex
-	mongoUrl              string
-	mongoDbName           string
+	reloadLock            sync.Mutex
+	sources               []*namedRouteSource
 	backendConnectTimeout time.Duration
 	backendHeaderTimeout  time.Duration
+	backendTLSTimeout     time.Duration
+	backendFlushInterval  time.Duration
+	dnsCache              *handlers.DNSCache
+	requestTimeout        time.Duration
+	allowedMethods        map[string]bool
+	allowHeader           string
+	trustedProxies        []*net.IPNet
+	enableBoom            bool
+	enableChaos           bool
+	requireHost           bool
+	strictPaths           bool
+	strictIncomingPaths   bool
+	httpsRedirect         bool
+	edge                  bool
+	skipRedirectLoops     bool
+	allowedHandlers       map[string]bool
+	allowedRedirectHosts  map[string]bool
+	reservedPrefix        string
+	pathPrefix            string
+	warmupConnections     int
+	warmupPath            string
+	maxRedirectLength     int
+	maxResponseBytes      int64
+	lazyBackends          bool
+	timeoutHeader         string
+	notFound              http.Handler
+	notFoundStatus        int
+	errorPages            *handlers.ErrorPages
+	errorTemplates        *handlers.ErrorTemplates
+	scanDetector          *handlers.ScanDetector
+	responseCache         *handlers.ResponseCache
 	logger                logger.Logger
+	skippedRoutes         int
+	skippedBackends       int
+	backends              map[string]http.Handler
+	backendPools          backendPools
+	circuitBreakers       map[string]*handlers.CircuitBreaker
+	reloadCallbacks       []func(ReloadResult)
+	fingerprint           string
+	routesLoadedAt        time.Time
+	startedAt             time.Time
+	lastReloadAt          time.Time
+	lastReloadErr         error
+	sourceErrors          map[string]error
+}
+
+// defaultMaxRedirectLength is the longest Location header redirect routes
+// send unless LimitRedirectLength is called. It's well beyond any sensible
+// redirect, but within what clients and proxies accept.
+const defaultMaxRedirectLength = 8192
+
+// notReadyRetryAfter is the Retry-After (in seconds) sent with the 503s
+// served before routes have first been loaded.
+const notReadyRetryAfter = "5"
+
+// defaultMaintenanceBody is the page served in maintenance mode if no other
+// is given.
+const defaultMaintenanceBody = "This service is down for maintenance. Please try again later.\n"
+
+// generation counts the requests being served with one routing table, so
+// that its backends' connections are only closed once they have finished.
+type generation struct {
+	inFlight atomic.Int64
+}
+
+// drainPollInterval is how often a replaced routing table is checked for
+// requests still being served, before its backends' connections are closed.
+const drainPollInterval = 100 * time.Millisecond
+
+// maintenancePage is the response served to requests in maintenance mode.
+type maintenancePage struct {
+	contentType string
+	body        string
+	retryAfter  int
+}
+
+// maxMirrorBodyBytes is the largest request body which is copied to a
+// route's mirror backend. Requests with larger bodies aren't mirrored.
+const maxMirrorBodyBytes = 1 << 20
+
+// knownHandlerKinds are the values of Route.Handler which the router can
+// serve.
+var knownHandlerKinds = []string{"backend", "redirect", "gone", "ping", "static", "filesystem", "boom"}
+
+// ErrUnknownRouteSource is returned when reloading a route source which
+// hasn't been added to the router.
+var ErrUnknownRouteSource = errors.New("unknown route source")
+
+// ErrUnknownBackend is returned when rechecking a backend which isn't in the
+// loaded routing table.
+var ErrUnknownBackend = errors.New("unknown backend")
+
+// The errors returned by failed reloads wrap one of these (or
+// ErrUnknownRouteSource or ErrInvalidRouteData), so that callers can tell
+// with errors.Is why the routes weren't reloaded.
+var (
+	// ErrRouteSourceUnavailable means a route source couldn't be reached.
+	ErrRouteSourceUnavailable = errors.New("route source unavailable")
+	// ErrRouteSourceTimeout means a route source took too long to respond.
+	ErrRouteSourceTimeout = errors.New("route source timed out")
+	// ErrTooManyRoutesDropped means drop protection refused the reload.
+	ErrTooManyRoutesDropped = errors.New("reload would drop too many routes")
+	// ErrReloadPanicked means building the new routing table panicked.
+	ErrReloadPanicked = errors.New("reload panicked")
+	// ErrReloadDropped means the reload was triggered while another was
+	// running and the queue of those waiting was full.
+	ErrReloadDropped = errors.New("too many reloads queued")
+	// ErrRoutesNeedReload means ReloadBackends couldn't apply the changes to
+	// the backends without reloading the routes as well.
+	ErrRoutesNeedReload = errors.New("routes need reloading")
+)
+
+// namedRouteSource is a route source added to a Router, along with the
+// backends and routes most recently loaded from it.
+type namedRouteSource struct {
+	name     string
+	source   RouteSource
+	backends []Backend
+	routes   []Route
 }
 
 type Backend struct {
-	BackendId  string `bson:"backend_id"`
-	BackendURL string `bson:"backend_url"`
+	BackendId                string   `bson:"backend_id" json:"backend_id"`
+	BackendURL               string   `bson:"backend_url" json:"backend_url"`
+	ConnectTimeoutMs         int      `bson:"connect_timeout_ms" json:"connect_timeout_ms"`
+	TLSHandshakeTimeoutMs    int      `bson:"tls_handshake_timeout_ms" json:"tls_handshake_timeout_ms"`
+	HeaderTimeoutMs          int      `bson:"header_timeout_ms" json:"header_timeout_ms"`
+	FlushIntervalMs          int      `bson:"flush_interval_ms" json:"flush_interval_ms"`
+	CircuitBreakerFailures   int      `bson:"circuit_breaker_failures" json:"circuit_breaker_failures"`
+	CircuitBreakerWindowMs   int      `bson:"circuit_breaker_window_ms" json:"circuit_breaker_window_ms"`
+	CircuitBreakerCooldownMs int      `bson:"circuit_breaker_cooldown_ms" json:"circuit_breaker_cooldown_ms"`
+	HopByHopHeaders          []string `bson:"hop_by_hop_headers" json:"hop_by_hop_headers"`
+	HTTP2                    bool     `bson:"http2" json:"http2"`
+	OverrideHost             string   `bson:"override_host" json:"override_host"`
+	PreserveHost             bool     `bson:"preserve_host" json:"preserve_host"`
+	UserAgent                string   `bson:"user_agent" json:"user_agent"`
+	UserAgentSuffix          string   `bson:"user_agent_suffix" json:"user_agent_suffix"`
+	InterceptErrors          bool     `bson:"intercept_errors" json:"intercept_errors"`
 }
 
+// The defaults for backends with a circuit breaker which don't set its
+// window or cool-down.
+const (
+	defaultCircuitBreakerWindow   = 10 * time.Second
+	defaultCircuitBreakerCooldown = 30 * time.Second
+)
+
 type Route struct {
-	IncomingPath string `bson:"incoming_path"`
-	RouteType    string `bson:"route_type"`
-	Handler      string `bson:"handler"`
-	BackendId    string `bson:"backend_id"`
-	RedirectTo   string `bson:"redirect_to"`
-	RedirectType string `bson:"redirect_type"`
+	IncomingPath        string            `bson:"incoming_path" json:"incoming_path"`
+	RouteType           string            `bson:"route_type" json:"route_type"`
+	Handler             string            `bson:"handler" json:"handler"`
+	BackendId           string            `bson:"backend_id" json:"backend_id"`
+	RedirectTo          string            `bson:"redirect_to" json:"redirect_to"`
+	RedirectType        string            `bson:"redirect_type" json:"redirect_type"`
+	Cache               bool              `bson:"cache_responses" json:"cache_responses"`
+	Decompress          bool              `bson:"decompress_requests" json:"decompress_requests"`
+	DocumentRoot        string            `bson:"document_root" json:"document_root"`
+	StripPrefix         string            `bson:"strip_prefix" json:"strip_prefix"`
+	StripSuffix         string            `bson:"strip_suffix" json:"strip_suffix"`
+	HeaderTimeoutMs     int               `bson:"header_timeout_ms" json:"header_timeout_ms"`
+	RewritePattern      string            `bson:"rewrite_pattern" json:"rewrite_pattern"`
+	RewriteReplacement  string            `bson:"rewrite_replacement" json:"rewrite_replacement"`
+	BufferResponseBytes int               `bson:"buffer_response_bytes" json:"buffer_response_bytes"`
+	PingBody            string            `bson:"ping_body" json:"ping_body"`
+	StaticBody          string            `bson:"static_body" json:"static_body"`
+	StaticContentType   string            `bson:"static_content_type" json:"static_content_type"`
+	BasicAuthRealm      string            `bson:"basic_auth_realm" json:"basic_auth_realm"`
+	BasicAuthUser       string            `bson:"basic_auth_user" json:"basic_auth_user"`
+	BasicAuthSHA256     string            `bson:"basic_auth_password_sha256" json:"basic_auth_password_sha256"`
+	ChaosDelayMs        int               `bson:"chaos_delay_ms" json:"chaos_delay_ms"`
+	ChaosDelayChance    float64           `bson:"chaos_delay_probability" json:"chaos_delay_probability"`
+	ChaosErrorChance    float64           `bson:"chaos_error_probability" json:"chaos_error_probability"`
+	BucketCookie        string            `bson:"bucket_cookie" json:"bucket_cookie"`
+	BucketHashCount     int               `bson:"bucket_hash_count" json:"bucket_hash_count"`
+	BucketBackends      map[string]string `bson:"bucket_backends" json:"bucket_backends"`
+	RegionHeader        string            `bson:"region_header" json:"region_header"`
+	RegionBackends      map[string]string `bson:"region_backends" json:"region_backends"`
+	HashBackends        []string          `bson:"hash_backends" json:"hash_backends"`
+	HashKey             string            `bson:"hash_key" json:"hash_key"`
+	ContentTypeBackends map[string]string `bson:"content_type_backends" json:"content_type_backends"`
+	AllowConnect        bool              `bson:"allow_connect" json:"allow_connect"`
+	Priority            int               `bson:"priority" json:"priority"`
+	MinExtraSegments    int               `bson:"min_extra_segments" json:"min_extra_segments"`
+	HTTPSRedirect       bool              `bson:"https_redirect" json:"https_redirect"`
+	ReadOnly            bool              `bson:"read_only" json:"read_only"`
+	ReadOnlyBody        string            `bson:"read_only_body" json:"read_only_body"`
+	Meta                map[string]string `bson:"meta" json:"meta"`
+	MirrorBackendId     string            `bson:"mirror_backend_id" json:"mirror_backend_id"`
+	MaxResponseBytes    int64             `bson:"max_response_bytes" json:"max_response_bytes"`
+}
+
+// RouterOptions configures a new Router. The values are given as they are in
+// the environment. RequestTimeout, AllowedMethods, ResponseCacheSize,
+// NotFoundStatus and AllowedHandlers must be set; the rest may be left empty
+// to turn the option off or use its default.
+type RouterOptions struct {
+	// BackendTLSHandshakeTimeout limits the TLS handshake with https
+	// backends, separately from the connect timeout. Empty or zero means no
+	// limit.
+	BackendTLSHandshakeTimeout string
+	// DNSCacheTTL is how long backends' DNS lookups are cached for. Empty or
+	// zero turns the cache off.
+	DNSCacheTTL string
+	// RequestTimeout is the longest the router will spend serving a request.
+	RequestTimeout string
+	// AllowedMethods lists the request methods which may be used, separated
+	// by commas. Requests with others get a 405.
+	AllowedMethods string
+	// TrustedProxies lists the addresses and CIDR ranges whose
+	// X-Forwarded-For headers are trusted, separated by commas.
+	TrustedProxies string
+	// ResponseCacheSize is the size of the response cache, in megabytes.
+	ResponseCacheSize string
+	// NotFoundStatus, NotFoundContentType and NotFoundBody describe the
+	// response to requests which no route matches.
+	NotFoundStatus      string
+	NotFoundContentType string
+	NotFoundBody        string
+	// AllowedHandlers lists the kinds of handler which routes may use,
+	// separated by commas. Routes using others are skipped.
+	AllowedHandlers string
+	// AllowedRedirectHosts lists the hosts which redirect routes may send
+	// clients to, separated by commas, besides the router's own.
+	AllowedRedirectHosts string
+	// BackendWarmupConnections is the number of connections to open to each
+	// backend after a reload, by requesting BackendWarmupPath ("/" by
+	// default). Empty or zero turns warmup off.
+	BackendWarmupConnections string
+	BackendWarmupPath        string
+	// ErrorPages maps statuses to the URLs of the pages served for them, as
+	// parsed by parseErrorPages.
+	ErrorPages string
+
+	EnableBoom        bool
+	EnableChaos       bool
+	RequireHost       bool
+	SkipRedirectLoops bool
 }
 
-// NewRouter returns a new empty router instance. You will still need to call
-// ReloadRoutes() to do the initial route load.
-func NewRouter(mongoUrl, mongoDbName, backendConnectTimeout, backendHeaderTimeout, logFileName string) (rt *Router, err error) {
+// parseOptionalDuration parses a duration, which is zero if s is empty.
+func parseOptionalDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// NewRouter returns a new empty router instance. You will still need to add
+// one or more route sources with AddRouteSource, and call ReloadRoutes() to
+// do the initial route load.
+func NewRouter(backendConnectTimeout, backendHeaderTimeout, logFileName string, options RouterOptions) (rt *Router, err error) {
 	beConnTimeout, err := time.ParseDuration(backendConnectTimeout)
 	if err != nil {
 		return nil, err
@@ -49,8 +322,110 @@ func NewRouter(mongoUrl, mongoDbName, backendConnectTimeout, backendHeaderTimeou
 	if err != nil {
 		return nil, err
 	}
+	beTLSTimeout, err := parseOptionalDuration(options.BackendTLSHandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	dnsTTL, err := parseOptionalDuration(options.DNSCacheTTL)
+	if err != nil {
+		return nil, err
+	}
+	reqTimeout, err := time.ParseDuration(options.RequestTimeout)
+	if err != nil {
+		return nil, err
+	}
 	logInfo("router: using backend connect timeout:", beConnTimeout)
 	logInfo("router: using backend header timeout:", beHeaderTimeout)
+	if beTLSTimeout > 0 {
+		logInfo("router: using backend TLS handshake timeout:", beTLSTimeout)
+	}
+	if dnsTTL > 0 {
+		logInfo("router: caching backend DNS lookups for:", dnsTTL)
+	}
+	logInfo("router: using request timeout:", reqTimeout)
+
+	methods := make(map[string]bool)
+	methodList := make([]string, 0)
+	for _, m := range strings.Split(options.AllowedMethods, ",") {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if m != "" && !methods[m] {
+			methods[m] = true
+			methodList = append(methodList, m)
+		}
+	}
+	if len(methodList) == 0 {
+		return nil, fmt.Errorf("no request methods allowed by %q", options.AllowedMethods)
+	}
+	logInfo("router: allowing request methods:", strings.Join(methodList, ", "))
+
+	handlerKinds := make(map[string]bool)
+	for _, kind := range knownHandlerKinds {
+		handlerKinds[kind] = false
+	}
+	for _, kind := range strings.Split(options.AllowedHandlers, ",") {
+		kind = strings.TrimSpace(kind)
+		if _, ok := handlerKinds[kind]; !ok && kind != "" {
+			return nil, fmt.Errorf("unknown handler kind %q in allowed handlers", kind)
+		}
+		handlerKinds[kind] = kind != ""
+	}
+	logInfo("router: allowing handlers:", options.AllowedHandlers)
+
+	var redirectHosts map[string]bool
+	for _, host := range strings.Split(options.AllowedRedirectHosts, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			if redirectHosts == nil {
+				redirectHosts = make(map[string]bool)
+			}
+			redirectHosts[host] = true
+		}
+	}
+	if redirectHosts != nil {
+		logInfo("router: allowing redirects to hosts:", options.AllowedRedirectHosts)
+	}
+
+	proxies, err := handlers.ParseTrustedProxies(options.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	if len(proxies) > 0 {
+		logInfo("router: trusting X-Forwarded-For from:", options.TrustedProxies)
+	}
+
+	cacheSizeMB, err := strconv.ParseInt(options.ResponseCacheSize, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	logInfo(fmt.Sprintf("router: using response cache size: %dMB", cacheSizeMB))
+
+	status, err := strconv.Atoi(options.NotFoundStatus)
+	if err != nil || status < 400 || status > 599 {
+		return nil, fmt.Errorf("invalid not-found status %q, must be between 400 and 599", options.NotFoundStatus)
+	}
+	var notFound http.Handler
+	notFoundBody := options.NotFoundBody
+	if status != http.StatusNotFound || notFoundBody != "" {
+		if notFoundBody == "" {
+			notFoundBody = http.StatusText(status) + "\n"
+		}
+		notFound = handlers.NewNotFoundHandler(status, options.NotFoundContentType, notFoundBody)
+		logInfo("router: answering unmatched requests with status:", status)
+	}
+
+	warmupConnections := 0
+	if options.BackendWarmupConnections != "" {
+		warmupConnections, err = strconv.Atoi(options.BackendWarmupConnections)
+		if err != nil {
+			return nil, err
+		}
+	}
+	warmupPath := options.BackendWarmupPath
+	if warmupPath == "" {
+		warmupPath = "/"
+	}
+	if warmupConnections > 0 {
+		logInfo(fmt.Sprintf("router: warming up %d connections to each backend with %s", warmupConnections, warmupPath))
+	}
 
 	l, err := logger.New(logFileName)
 	if err != nil {
@@ -58,152 +433,2206 @@ func NewRouter(mongoUrl, mongoDbName, backendConnectTimeout, backendHeaderTimeou
 	}
 	logInfo("router: logging errors as JSON to", logFileName)
 
+	pageURLs, err := parseErrorPages(options.ErrorPages)
+	if err != nil {
+		return nil, err
+	}
+	var pages *handlers.ErrorPages
+	if len(pageURLs) > 0 {
+		pages = handlers.NewErrorPages(pageURLs, beConnTimeout+beHeaderTimeout, l)
+		if _, ok := pageURLs[status]; ok {
+			if notFound == nil {
+				notFound = http.NotFoundHandler()
+			}
+			notFound = pages.PageHandler(status, notFound)
+		}
+		logInfo("router: serving error pages:", options.ErrorPages)
+	}
+
 	rt = &Router{
-		mux:                   triemux.NewMux(),
-		mongoUrl:              mongoUrl,
-		mongoDbName:           mongoDbName,
 		backendConnectTimeout: beConnTimeout,
 		backendHeaderTimeout:  beHeaderTimeout,
+		backendTLSTimeout:     beTLSTimeout,
+		requestTimeout:        reqTimeout,
+		allowedMethods:        methods,
+		allowHeader:           strings.Join(methodList, ", "),
+		trustedProxies:        proxies,
+		enableBoom:            options.EnableBoom,
+		enableChaos:           options.EnableChaos,
+		requireHost:           options.RequireHost,
+		skipRedirectLoops:     options.SkipRedirectLoops,
+		allowedHandlers:       handlerKinds,
+		allowedRedirectHosts:  redirectHosts,
+		warmupConnections:     warmupConnections,
+		warmupPath:            warmupPath,
+		maxRedirectLength:     defaultMaxRedirectLength,
+		reloads:               reloadQueue{maxQueued: defaultMaxQueuedReloads},
+		notFound:              notFound,
+		notFoundStatus:        status,
+		errorPages:            pages,
+		responseCache:         handlers.NewResponseCache(cacheSizeMB * 1024 * 1024),
 		logger:                l,
+		startedAt:             time.Now(),
+		sourceErrors:          make(map[string]error),
+	}
+	if dnsTTL > 0 {
+		rt.dnsCache = handlers.NewDNSCache(dnsTTL)
 	}
+	rt.mux.Store(rt.newMux())
+	rt.generation.Store(&generation{})
 	return rt, nil
 }
 
+// parseErrorPages parses a comma-separated list of error pages, each of the
+// form <status>=<url>, into a map of URLs by status.
+func parseErrorPages(errorPages string) (map[int]string, error) {
+	pages := make(map[int]string)
+	for _, page := range strings.Split(errorPages, ",") {
+		if page = strings.TrimSpace(page); page == "" {
+			continue
+		}
+		code, pageURL, _ := strings.Cut(page, "=")
+		status, err := strconv.Atoi(code)
+		if err != nil || status < 400 || status > 599 {
+			return nil, fmt.Errorf("invalid error page %q, status must be between 400 and 599", page)
+		}
+		if u, err := url.Parse(pageURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid error page %q, must have an http or https URL", page)
+		}
+		pages[status] = pageURL
+	}
+	return pages, nil
+}
+
+// parseErrorTemplates parses a comma-separated list of error templates, each
+// of the form <status>=<file>, into a map of files by status.
+func parseErrorTemplates(errorTemplates string) (map[int]string, error) {
+	files := make(map[int]string)
+	for _, tmpl := range strings.Split(errorTemplates, ",") {
+		if tmpl = strings.TrimSpace(tmpl); tmpl == "" {
+			continue
+		}
+		code, file, _ := strings.Cut(tmpl, "=")
+		status, err := strconv.Atoi(code)
+		if err != nil || status < 500 || status > 599 {
+			return nil, fmt.Errorf("invalid error template %q, status must be between 500 and 599", tmpl)
+		}
+		if file == "" {
+			return nil, fmt.Errorf("invalid error template %q, must have a file", tmpl)
+		}
+		files[status] = file
+	}
+	return files, nil
+}
+
+// newMux makes an empty proxy mux, which answers unmatched requests with the
+// router's not-found handler.
+func (rt *Router) newMux() *triemux.Mux {
+	return triemux.NewMuxWithOptions(triemux.MuxOptions{HandlerFor: routeHandlerFor, NotFoundHandler: rt.notFound})
+}
+
+// AddRouteSource adds a named source of backends and routes to the router.
+// Sources must be added before the routes are first loaded. Where sources
+// define the same backend, or route, the one added last takes precedence.
+func (rt *Router) AddRouteSource(name string, source RouteSource) {
+	rt.reloadLock.Lock()
+	defer rt.reloadLock.Unlock()
+
+	rt.sources = append(rt.sources, &namedRouteSource{name: name, source: source})
+}
+
 // ServeHTTP delegates responsibility for serving requests to the proxy mux
-// instance for this router.
+// instance for this router. Requests which take longer than the configured
+// request timeout (or the shorter one a client asks for with an
+// X-Request-Timeout header) to serve are abandoned and a 504 is returned
+// instead.
+// Requests using a method which isn't in the allowed list are rejected with a
+// 405 before being dispatched, as are those with malformed paths (with a 400)
+// if RejectMalformedPaths has been called. Until routes have first been
+// loaded, every request gets a 503 with a Retry-After.
 func (rt *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rt.inFlight.Add(1)
+	defer rt.inFlight.Add(-1)
+
+	timeout := clientRequestTimeout(req, rt.requestTimeout)
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	tw := newTimeoutWriter(w, ctx)
+	matched := &matchedRoute{}
+	ctx = context.WithValue(ctx, matchedRouteKey{}, matched)
+
 	defer func() {
-		if r := recover(); r != nil {
-			logWarn("router: recovered from panic in ServeHTTP:", r)
-			rt.logger.LogFromClientRequest(map[string]interface{}{"error": fmt.Sprintf("panic: %v", r), "status": 500}, req)
+		r := recover()
+		if ctx.Err() == context.DeadlineExceeded {
+			rt.handleTimeout(tw, req, timeout)
+		}
+		if r == http.ErrAbortHandler {
+			// Raised by the reverse proxy when it can't finish copying a
+			// response body, so that the server aborts the connection.
+			panic(r)
+		}
+		if r != nil {
+			fields := map[string]interface{}{"error": fmt.Sprintf("panic: %v", r), "status": 500}
+			if matched.path != "" {
+				logWarn(fmt.Sprintf("router: recovered from panic in ServeHTTP (route: %s, handler: %s):", matched.path, matched.handler), r)
+				fields["route"] = matched.path
+				fields["route_type"] = matched.routeType
+				fields["handler"] = matched.handler
+				if len(matched.meta) > 0 {
+					fields["route_meta"] = matched.meta
+				}
+				if matched.backendId != "" {
+					fields["backend_id"] = matched.backendId
+				}
+			} else {
+				logWarn("router: recovered from panic in ServeHTTP:", r)
+			}
+			rt.logger.LogFromClientRequest(fields, req)
 			w.WriteHeader(http.StatusInternalServerError)
 		}
 	}()
-	rt.lock.RLock()
-	mux := rt.mux
-	rt.lock.RUnlock()
 
-	mux.ServeHTTP(w, req)
-}
+	if !rt.allowedMethods[req.Method] {
+		w.Header().Set("Allow", rt.allowHeader)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
 
-// ReloadRoutes reloads the routes for this Router instance on the fly. It will
-// create a new proxy mux, load applications (backends) and routes into it, and
-// then flip the "mux" pointer in the Router.
-func (rt *Router) ReloadRoutes() {
-	defer func() {
-		if r := recover(); r != nil {
-			logWarn("router: recovered from panic in ReloadRoutes:", r)
-			logInfo("router: original routes have not been modified")
+	// HTTP/1.0 clients may leave out the Host header. Routing doesn't depend
+	// on it, so they're served unless a Host is required.
+	if rt.requireHost && req.Host == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if rt.strictPaths {
+		if err := triemux.ValidatePath(escapedRequestPath(req)); err != nil {
+			rt.logger.LogFromClientRequest(map[string]interface{}{"error": err.Error(), "status": 400}, req)
+			w.WriteHeader(http.StatusBadRequest)
+			return
 		}
-	}()
+	}
 
-	logDebug("mgo: connecting to", rt.mongoUrl)
-	sess, err := mgo.Dial(rt.mongoUrl)
-	if err != nil {
-		panic(fmt.Sprintln("mgo:", err))
+	if page := rt.maintenance.Load(); page != nil && !rt.isPingRoute(req) {
+		w.Header().Set("Content-Type", page.contentType)
+		if page.retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(page.retryAfter))
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, page.body)
+		return
 	}
-	defer sess.Close()
-	sess.SetMode(mgo.Strong, true)
 
-	db := sess.DB(rt.mongoDbName)
+	if !rt.ready.Load() {
+		w.Header().Set("Retry-After", notReadyRetryAfter)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
 
-	logInfo("router: reloading routes")
-	newmux := triemux.NewMux()
+	gen := rt.generation.Load()
+	gen.inFlight.Add(1)
+	defer gen.inFlight.Add(-1)
 
-	backends := rt.loadBackends(db.C("backends"))
-	loadRoutes(db.C("routes"), newmux, backends)
+	var handler http.Handler = rt.mux.Load()
+	if rt.httpsRedirect {
+		handler = handlers.NewHTTPSRedirectHandler(handler, rt.trustedProxies)
+	}
+	if rt.timeoutHeader != "" {
+		handler = handlers.WithTimeoutHeader(handler, rt.timeoutHeader)
+	}
+	if rt.errorPages != nil {
+		handler = rt.errorPages.Wrap(handler)
+	}
+	if rt.scanDetector != nil {
+		handler = rt.scanDetector.Wrap(handler)
+	}
 
-	rt.lock.Lock()
-	rt.mux = newmux
-	rt.lock.Unlock()
+	if tracing.Enabled() {
+		tracing.RecordClientAddress(req, handlers.ClientIP(req, rt.trustedProxies))
+	}
 
-	logInfo(fmt.Sprintf("router: reloaded %d routes (checksum: %x)", rt.mux.RouteCount(), rt.mux.RouteChecksum()))
+	serveUntilDeadline(handler, tw, req.WithContext(ctx))
 }
 
-// loadBackends is a helper function which loads backends from the
-// passed mongo collection, constructs a Handler for each one, and returns
-// them in map keyed on the backend_id
-func (rt *Router) loadBackends(c *mgo.Collection) (backends map[string]http.Handler) {
-	backend := &Backend{}
-	backends = make(map[string]http.Handler)
+// serveUntilDeadline serves a request with handler in its own goroutine, so
+// that the request is cut off at its deadline even if the handler doesn't
+// watch its context. The handler is left to finish in the background, and
+// anything it writes after that is discarded. A response which had already
+// started is aborted, rather than being finished as if it were complete. A
+// panic in the handler is raised again here.
+func serveUntilDeadline(handler http.Handler, tw *timeoutWriter, req *http.Request) {
+	finished := make(chan interface{}, 1)
+	go func() {
+		defer func() { finished <- recover() }()
+		handler.ServeHTTP(tw, req)
+	}()
 
-	iter := c.Find(nil).Iter()
+	deadline, _ := req.Context().Deadline()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case r := <-finished:
+		if r != nil {
+			panic(r)
+		}
+		return
+	case <-timer.C:
+	}
+	// The context is done by now, so that ServeHTTP sees the timeout (or
+	// the client having gone away).
+	<-req.Context().Done()
 
-	for iter.Next(&backend) {
-		backendUrl, err := url.Parse(backend.BackendURL)
-		if err != nil {
-			logWarn(fmt.Sprintf("router: couldn't parse URL %s for backend %s "+
-				"(error: %v), skipping!", backend.BackendURL, backend.BackendId, err))
-			continue
+	status, hijacked := tw.stop()
+	if hijacked {
+		// The connection belongs to the handler until it returns.
+		if r := <-finished; r != nil {
+			panic(r)
 		}
+		return
+	}
+	if status != 0 {
+		panic(http.ErrAbortHandler)
+	}
+}
 
-		backends[backend.BackendId] = handlers.NewBackendHandler(backendUrl, rt.backendConnectTimeout, rt.backendHeaderTimeout, rt.logger)
+// isPingRoute reports whether a request would be served by a ping route,
+// which load balancers' health probes use.
+func (rt *Router) isPingRoute(req *http.Request) bool {
+	match := rt.mux.Load().Match(req.URL.Path)
+	if match.Route == nil {
+		return false
 	}
+	route := routeDoc(match.Route.Value)
+	return route != nil && route.Handler == "ping"
+}
 
-	if err := iter.Err(); err != nil {
-		panic(err)
+// clientRequestTimeout returns how long the router should spend serving a
+// request: max, or less if the client asked for a shorter timeout, in
+// milliseconds, with an X-Request-Timeout header.
+func clientRequestTimeout(req *http.Request, max time.Duration) time.Duration {
+	ms, err := strconv.Atoi(req.Header.Get("X-Request-Timeout"))
+	if err != nil || ms <= 0 {
+		return max
+	}
+	if timeout := time.Duration(ms) * time.Millisecond; timeout < max {
+		return timeout
 	}
+	return max
+}
 
-	return
+// escapedRequestPath returns the path of the request as the client sent it,
+// before percent-decoding.
+func escapedRequestPath(req *http.Request) string {
+	if strings.HasPrefix(req.RequestURI, "/") {
+		path, _, _ := strings.Cut(req.RequestURI, "?")
+		return path
+	}
+	return req.URL.EscapedPath()
 }
 
-// loadRoutes is a helper function which loads routes from the passed mongo
-// collection and registers them with the passed proxy mux.
-func loadRoutes(c *mgo.Collection, mux *triemux.Mux, backends map[string]http.Handler) {
-	route := &Route{}
+// matchedRouteKey is the context key under which ServeHTTP stores the
+// matchedRoute for a request.
+type matchedRouteKey struct{}
 
-	iter := c.Find(nil).Sort("incoming_path", "route_type").Iter()
+// matchedRoute records which route a request was dispatched to, so that it
+// can be reported if the route's handler panics.
+type matchedRoute struct {
+	path, routeType, handler, backendId string
+	meta                                map[string]string
+}
 
-	for iter.Next(&route) {
-		prefix := (route.RouteType == "prefix")
-		switch route.Handler {
-		case "backend":
-			handler, ok := backends[route.BackendId]
-			if !ok {
-				logWarn(fmt.Sprintf("router: found route %+v which references unknown backend "+
-					"%s, skipping!", route, route.BackendId))
-				continue
-			}
-			mux.Handle(route.IncomingPath, prefix, handler)
-			logDebug(fmt.Sprintf("router: registered %s (prefix: %v) for %s",
-				route.IncomingPath, prefix, route.BackendId))
-		case "redirect":
-			redirectTemporarily := (route.RedirectType == "temporary")
-			handler := handlers.NewRedirectHandler(route.IncomingPath, route.RedirectTo, prefix, redirectTemporarily)
-			mux.Handle(route.IncomingPath, prefix, handler)
-			logDebug(fmt.Sprintf("router: registered %s (prefix: %v) -> %s",
-				route.IncomingPath, prefix, route.RedirectTo))
-		case "gone":
-			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				w.WriteHeader(http.StatusGone)
-			})
-			mux.Handle(route.IncomingPath, prefix, handler)
-			logDebug(fmt.Sprintf("router: registered %s (prefix: %v) -> Gone", route.IncomingPath, prefix))
-		case "boom":
-			// Special handler so that we can test failure behaviour.
-			mux.Handle(route.IncomingPath, prefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				panic("Boom!!!")
-			}))
-			logDebug(fmt.Sprintf("router: registered %s (prefix: %v) -> Boom!!!", route.IncomingPath, prefix))
-		default:
-			logWarn(fmt.Sprintf("router: found route %+v with unknown handler type "+
-				"%s, skipping!", route, route.Handler))
-			continue
+// withMatchedRoute wraps the handler registered for a route so that the
+// route is recorded in the request's matchedRoute before it is served, and
+// its metadata (if any) in the access log entry for the request.
+func withMatchedRoute(handler http.Handler, route *Route) http.Handler {
+	info := matchedRoute{path: route.IncomingPath, routeType: route.RouteType, handler: route.Handler, meta: route.Meta}
+	if route.Handler == "backend" {
+		info.backendId = route.BackendId
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m, ok := r.Context().Value(matchedRouteKey{}).(*matchedRoute); ok {
+			*m = info
+		}
+		if len(info.meta) > 0 {
+			handlers.AddAccessLogField(r, "route_meta", info.meta)
 		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// routeValue is the value registered in the mux for each loaded route, so
+// that the route it was loaded from can be found from a match.
+type routeValue struct {
+	handler http.Handler
+	route   *Route
+}
+
+// routeHandlerFor resolves the values registered in the router's muxes into
+// handlers. Handlers registered directly are used as they are.
+func routeHandlerFor(value interface{}) (http.Handler, bool) {
+	switch v := value.(type) {
+	case *routeValue:
+		return v.handler, true
+	case http.Handler:
+		return v, true
 	}
+	return nil, false
+}
 
-	if err := iter.Err(); err != nil {
-		panic(err)
+// routeDoc returns the route a value in the router's route table was loaded
+// from, or nil if it was registered directly.
+func routeDoc(value interface{}) *Route {
+	if v, ok := value.(*routeValue); ok {
+		return v.route
 	}
+	return nil
 }
 
-func (rt *Router) RouteStats() (stats map[string]interface{}) {
+// handleTimeout logs a request which has exceeded the overall request
+// timeout, and sends a 504 response if nothing has been sent yet. If the
+// response has already started there's nothing useful left to send, so it is
+// cut short.
+func (rt *Router) handleTimeout(tw *timeoutWriter, req *http.Request, timeout time.Duration) {
+	status, _ := tw.stop()
+	if status == 0 {
+		status = http.StatusGatewayTimeout
+		if rt.errorPages != nil {
+			rt.errorPages.Serve(tw.ResponseWriter, req, status, nil)
+		} else {
+			tw.ResponseWriter.WriteHeader(status)
+		}
+	}
+	rt.logger.LogFromClientRequest(map[string]interface{}{"error": fmt.Sprintf("request timed out after %v", timeout), "status": status}, req)
+}
+
+// timeoutWriter passes a response through to the client until the request's
+// deadline has passed or it is stopped. After that, anything the handler
+// writes is discarded, so that Router.ServeHTTP can send its own response in
+// place of one which hasn't yet started. The handler's headers are kept apart
+// from the client's until the response starts, as the handler may still be
+// setting them while the router sends its own.
+type timeoutWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	mu      sync.Mutex
+	header  http.Header
+	status  int
+	stopped bool
+}
+
+func newTimeoutWriter(w http.ResponseWriter, ctx context.Context) *timeoutWriter {
+	header := w.Header().Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &timeoutWriter{ResponseWriter: w, ctx: ctx, header: header}
+}
+
+// stop discards anything written from now on, and returns the status of the
+// response if it has started, and whether the connection has been hijacked.
+func (tw *timeoutWriter) stop() (status int, hijacked bool) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	tw.stopped = true
+	return tw.status, tw.status == http.StatusSwitchingProtocols
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.status != 0 && !tw.stopped {
+		// Trailers are set once the response has started.
+		return tw.ResponseWriter.Header()
+	}
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	tw.writeHeader(code)
+}
+
+// writeHeader sends the handler's headers and status. mu must be held.
+func (tw *timeoutWriter) writeHeader(code int) {
+	if tw.status != 0 || tw.stopped {
+		return
+	}
+	if tw.ctx.Err() == context.DeadlineExceeded {
+		tw.stopped = true
+		return
+	}
+	header := tw.ResponseWriter.Header()
+	for k := range header {
+		delete(header, k)
+	}
+	for k, v := range tw.header {
+		header[k] = v
+	}
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		// Informational responses come before the final one.
+		tw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	tw.status = code
+	tw.ResponseWriter.WriteHeader(code)
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.status == 0 {
+		tw.writeHeader(http.StatusOK)
+	}
+	if tw.stopped {
+		return len(b), nil
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.status == 0 {
+		tw.writeHeader(http.StatusOK)
+	}
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok && !tw.stopped {
+		f.Flush()
+	}
+}
+
+func (tw *timeoutWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.stopped {
+		return nil, nil, fmt.Errorf("router: the request has timed out")
+	}
+	h, ok := tw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("router: %T does not support hijacking", tw.ResponseWriter)
+	}
+	conn, buf, err := h.Hijack()
+	if err == nil {
+		// The connection is no longer ours to send a response on.
+		tw.status = http.StatusSwitchingProtocols
+	}
+	return conn, buf, err
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// ReloadRoutes reloads the routes for this Router instance on the fly. It will
+// create a new proxy mux, load applications (backends) and routes into it, and
+// then flip the "mux" pointer in the Router. If the reload fails, the current
+// routes are kept and the error says why.
+func (rt *Router) ReloadRoutes() error {
+	return rt.reload("", -1, false)
+}
+
+// ReloadRoutesWithDropProtection is like ReloadRoutes, but leaves the current
+// routes in place if the new routing table would drop more than
+// maxDropPercent of them. This guards automatic reloads against a route
+// source which has been emptied or only partially written.
+func (rt *Router) ReloadRoutesWithDropProtection(maxDropPercent int) error {
+	return rt.reload("", maxDropPercent, false)
+}
+
+// ReloadSource reloads the backends and routes from just the named route
+// source, and rebuilds the routing table using the last backends and routes
+// loaded from the others.
+func (rt *Router) ReloadSource(name string) error {
+	return rt.reload(name, -1, false)
+}
+
+// ReloadSourceWithDropProtection is like ReloadSource, with the same drop
+// protection as ReloadRoutesWithDropProtection.
+func (rt *Router) ReloadSourceWithDropProtection(name string, maxDropPercent int) error {
+	return rt.reload(name, maxDropPercent, false)
+}
+
+// routeSnapshot is the form in which Snapshot passes the loaded backends and
+// routes to another router process.
+type routeSnapshot struct {
+	Sources []snapshotSource `json:"sources"`
+}
+
+type snapshotSource struct {
+	Name     string    `json:"name"`
+	Backends []Backend `json:"backends"`
+	Routes   []Route   `json:"routes"`
+}
+
+// Snapshot returns the backends and routes last loaded from each route
+// source, so that a new router process can start serving them with
+// RestoreSnapshot instead of waiting to load them itself.
+func (rt *Router) Snapshot() ([]byte, error) {
 	rt.lock.RLock()
-	mux := rt.mux
+	var snapshot routeSnapshot
+	for _, s := range rt.sources {
+		if s.backends == nil && s.routes == nil {
+			// Never loaded, so leave the new process to load it.
+			continue
+		}
+		snapshot.Sources = append(snapshot.Sources, snapshotSource{s.name, s.backends, s.routes})
+	}
 	rt.lock.RUnlock()
 
-	stats = make(map[string]interface{})
-	stats["count"] = mux.RouteCount()
-	stats["checksum"] = fmt.Sprintf("%x", mux.RouteChecksum())
+	return json.Marshal(snapshot)
+}
+
+// RestoreSnapshot builds the routing table from a snapshot taken with
+// Snapshot, rather than loading from the route sources. Sources missing from
+// the snapshot are loaded as usual, and later reloads use the sources
+// themselves.
+func (rt *Router) RestoreSnapshot(data []byte) error {
+	var snapshot routeSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("couldn't parse route snapshot: %v", err)
+	}
+
+	rt.reloadLock.Lock()
+	for _, s := range rt.sources {
+		for _, ss := range snapshot.Sources {
+			if ss.Name == s.name {
+				s.source = &snapshotRouteSource{RouteSource: s.source, backends: ss.Backends, routes: ss.Routes}
+			}
+		}
+	}
+	rt.reloadLock.Unlock()
+
+	return rt.reload("", -1, false)
+}
+
+// ReloadResult describes the outcome of a reload, for the callbacks
+// registered with OnReload.
+type ReloadResult struct {
+	// Source is the name of the route source which was reloaded, or empty
+	// if all of them were.
+	Source string
+	// Err is nil if the reload succeeded. Otherwise the previous routes
+	// are still in place.
+	Err error
+	// RouteCount and Checksum describe the routing table in use after the
+	// reload.
+	RouteCount int
+	Checksum   string
+	// Added and Removed count the routes which the reload added to, and
+	// removed from, the routing table.
+	Added, Removed int
+	// Unchanged is true if the backends and routes loaded were identical to
+	// those already in use, so the routing table wasn't replaced.
+	Unchanged bool
+	Duration  time.Duration
+	// Sources gives the number of backends and routes which each source
+	// contributed (before they were merged), whether or not it was reloaded.
+	Sources map[string]SourceCount
+	// BackendsOnly is true for a reload of just the backends, by
+	// ReloadBackends. ChangedBackends lists the IDs of the backends it found
+	// had changed, and ReboundRoutes counts the routes which use them.
+	BackendsOnly    bool
+	ChangedBackends []string
+	ReboundRoutes   int
+}
+
+// SourceCount is the number of backends and routes loaded from one source.
+type SourceCount struct {
+	Backends int `json:"backends"`
+	Routes   int `json:"routes"`
+}
+
+// ReservePrefix sets aside a path prefix for the router's own use (such as
+// serving the API on the public listener). Routes at or beneath the prefix
+// are skipped when loading. It must be called before the routes are first
+// loaded.
+func (rt *Router) ReservePrefix(prefix string) {
+	rt.reloadLock.Lock()
+	defer rt.reloadLock.Unlock()
+
+	rt.reservedPrefix = prefix
+}
+
+// SetPathPrefix makes the router serve every route beneath prefix (such as
+// "/staging"), so that one set of routes can be served for several
+// environments. The prefix is removed from the path of each request before
+// it's passed to its route's handler. It must be called before the routes
+// are first loaded.
+func (rt *Router) SetPathPrefix(prefix string) error {
+	prefix = strings.TrimRight(prefix, "/")
+	if !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("path prefix %q must start with a / and not be the root", prefix)
+	}
+	rt.reloadLock.Lock()
+	defer rt.reloadLock.Unlock()
+
+	rt.pathPrefix = prefix
+	return nil
+}
+
+// SetErrorTemplates sets the templates, given as a comma-separated list of
+// <status>=<file> pairs, which replace the bodies of 5xx responses from
+// backends with intercept_errors set. It must be called before the routes
+// are first loaded.
+func (rt *Router) SetErrorTemplates(errorTemplates string) error {
+	files, err := parseErrorTemplates(errorTemplates)
+	if err != nil {
+		return err
+	}
+	templates, err := handlers.NewErrorTemplates(files, rt.logger)
+	if err != nil {
+		return err
+	}
+	rt.reloadLock.Lock()
+	defer rt.reloadLock.Unlock()
+
+	rt.errorTemplates = templates
+	return nil
+}
+
+// SetBackendFlushInterval makes the router flush responses from backends to
+// the client at least every interval as they're copied, or after every write
+// if interval is negative, rather than only flushing streaming responses
+// (server-sent events, and those without a Content-Length) as they arrive.
+// Backends may override it with flush_interval_ms. It must be called before
+// the routes are first loaded.
+func (rt *Router) SetBackendFlushInterval(interval time.Duration) {
+	rt.reloadLock.Lock()
+	defer rt.reloadLock.Unlock()
+
+	rt.backendFlushInterval = interval
+}
+
+// SendTimeoutHeader makes the router tell backends how long they have left to
+// respond, in milliseconds, in the named request header, so that they can
+// give up on work whose response won't be waited for. It must be called
+// before the router starts serving requests.
+func (rt *Router) SendTimeoutHeader(header string) {
+	rt.timeoutHeader = header
+}
+
+// LoadBackendsLazily makes the router build the handler for each backend,
+// with its connection pool, when a request is first sent to it rather than
+// when the routes are loaded, to save memory where there are many backends
+// which are rarely used. Backends aren't warmed up. It must be called before
+// the routes are first loaded.
+func (rt *Router) LoadBackendsLazily() {
+	rt.reloadLock.Lock()
+	defer rt.reloadLock.Unlock()
+
+	rt.lazyBackends = true
+}
+
+// LimitResponseSize sets the largest response body, in bytes, which is
+// proxied from a backend. Longer responses are answered with a 502 if their
+// Content-Length gives them away, and otherwise cut off at the limit. Routes
+// may set their own limit with max_response_bytes (or a negative one for no
+// limit). Zero, the default, removes the limit. It must be called before the
+// routes are first loaded.
+func (rt *Router) LimitResponseSize(maxBytes int64) {
+	rt.reloadLock.Lock()
+	defer rt.reloadLock.Unlock()
+
+	rt.maxResponseBytes = maxBytes
+}
+
+// LimitQueuedReloads sets the number of reloads which may wait for the
+// running one to finish; reloads triggered once that many are waiting fail
+// with ErrReloadDropped, unless they can share one of those waiting. Zero
+// drops every reload triggered while another is running.
+func (rt *Router) LimitQueuedReloads(maxQueued int) {
+	rt.reloads.mu.Lock()
+	defer rt.reloads.mu.Unlock()
+
+	rt.reloads.maxQueued = maxQueued
+}
+
+// ReloadStatus describes the reload running, those queued behind it, and the
+// number of reloads which have been coalesced with a queued one or dropped.
+func (rt *Router) ReloadStatus() map[string]interface{} {
+	return rt.reloads.status()
+}
+
+// LimitRedirectLength sets the longest Location header redirect routes may
+// send, in bytes. Redirects which would be longer are answered with a 500.
+// Zero removes the limit. It must be called before the routes are first
+// loaded.
+func (rt *Router) LimitRedirectLength(maxLength int) {
+	rt.reloadLock.Lock()
+	defer rt.reloadLock.Unlock()
+
+	rt.maxRedirectLength = maxLength
+}
+
+// RejectMalformedPaths makes the router answer requests whose paths have
+// malformed percent-encoding, or decode to control characters such as null
+// bytes, with a 400, rather than routing them by the bytes they decode to.
+// It must be called before the router starts serving requests.
+func (rt *Router) RejectMalformedPaths() {
+	rt.strictPaths = true
+}
+
+// FailReloadOnEmptyIncomingPaths makes reloads fail, keeping the current
+// routes, if a route source has a route with an empty (or whitespace-only)
+// incoming path, rather than skipping the route. It must be called before
+// the routes are first loaded.
+func (rt *Router) FailReloadOnEmptyIncomingPaths() {
+	rt.strictIncomingPaths = true
+}
+
+// RedirectToHTTPS makes the router redirect every request made over plain
+// HTTP to HTTPS, as routes with https_redirect set are. Requests forwarded
+// by a trusted proxy are taken to have been made over HTTPS if the proxy
+// says so with X-Forwarded-Proto. It must be called before the router starts
+// serving requests.
+func (rt *Router) RedirectToHTTPS() {
+	rt.httpsRedirect = true
+}
+
+// ServeAtEdge tells the router that clients connect to it directly, with no
+// proxy in front of it. Backends are then sent X-Forwarded-For,
+// X-Forwarded-Proto and X-Forwarded-Host describing the client's own
+// connection, in place of any the client sent, which could have been made
+// up. It must be called before the routes are first loaded, and can't be
+// used with trusted proxies, whose forwarding headers would be thrown away.
+func (rt *Router) ServeAtEdge() error {
+	if len(rt.trustedProxies) > 0 {
+		return fmt.Errorf("the router can't be at the edge if it trusts proxies in front of it")
+	}
+	rt.edge = true
+	return nil
+}
+
+// StartMaintenance puts the router into maintenance mode, in which every
+// request (other than those for ping routes, so that load balancers keep
+// sending traffic) is answered with a 503 and the passed page, rather than
+// being routed. A Retry-After header is sent with it if retryAfter (in
+// seconds) is positive. Maintenance mode lasts until EndMaintenance is
+// called, whatever reloads there are in the meantime.
+func (rt *Router) StartMaintenance(contentType, body string, retryAfter int) {
+	if body == "" {
+		contentType, body = "text/plain; charset=utf-8", defaultMaintenanceBody
+	}
+	rt.maintenance.Store(&maintenancePage{contentType, body, retryAfter})
+	rt.logEvent("maintenance_started", map[string]interface{}{"retry_after": retryAfter})
+}
+
+// EndMaintenance takes the router out of maintenance mode, so that requests
+// are routed again.
+func (rt *Router) EndMaintenance() {
+	if rt.maintenance.Swap(nil) != nil {
+		rt.logEvent("maintenance_ended", map[string]interface{}{})
+	}
+}
+
+// InMaintenance reports whether the router is in maintenance mode.
+func (rt *Router) InMaintenance() bool {
+	return rt.maintenance.Load() != nil
+}
+
+// DetectScanners makes the router watch for clients which request at least
+// threshold distinct paths which aren't found within window, logging each
+// one spotted and, if block is set, answering its requests with a 429 for
+// the next window. It must be called before the router starts serving
+// requests.
+func (rt *Router) DetectScanners(threshold int, window time.Duration, block bool) {
+	rt.scanDetector = handlers.NewScanDetector(threshold, window, block, rt.notFoundStatus, rt.trustedProxies, rt.logger)
+}
+
+// ScanStats returns the statistics for scanner detection, or nil if it isn't
+// enabled.
+func (rt *Router) ScanStats() map[string]interface{} {
+	if rt.scanDetector == nil {
+		return nil
+	}
+	return rt.scanDetector.Stats()
+}
+
+// OnReload registers a callback to be run after every reload, whether or not
+// it succeeds. Callbacks are run in the order they were registered, once the
+// reload has finished (so they may themselves trigger reloads), but may run
+// concurrently with the callbacks for other reloads.
+func (rt *Router) OnReload(callback func(result ReloadResult)) {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	rt.reloadCallbacks = append(rt.reloadCallbacks, callback)
+}
+
+// reload reloads the routes (or, if backendsOnly is set, just the backends)
+// and then runs the reload callbacks.
+//
+// Only one reload runs at a time. One triggered while another is running
+// waits its turn, unless LimitQueuedReloads reloads are already waiting, in
+// which case it fails with ErrReloadDropped. If one of those waiting has the
+// same drop protection, and reloads the same source or all of them (or can
+// be widened to, for a full reload), the trigger shares its outcome instead.
+func (rt *Router) reload(name string, maxDropPercent int, backendsOnly bool) error {
+	queued, owner, ok := rt.reloads.enter(name, maxDropPercent, backendsOnly)
+	if !ok {
+		logWarn(fmt.Sprintf("router: dropping reload of %q as too many are already queued", name))
+		return ErrReloadDropped
+	}
+	if !owner {
+		logInfo(fmt.Sprintf("router: coalescing reload of %q with one already queued", name))
+		<-queued.done
+		return queued.err
+	}
+	<-queued.start
+	return rt.runReload(queued)
+}
+
+// runReload runs a reload whose turn it is, letting the next one start
+// before the callbacks are run.
+func (rt *Router) runReload(queued *queuedReload) error {
+	name := queued.name
+	start := time.Now()
+	result := ReloadResult{Source: name, BackendsOnly: queued.backendsOnly}
+	var err error
+	if queued.backendsOnly {
+		err = rt.reloadBackends(&result)
+	} else {
+		err = rt.reloadRoutes(name, queued.maxDropPercent, &result)
+	}
+
+	rt.lock.Lock()
+	rt.lastReloadAt = time.Now()
+	rt.lastReloadErr = err
+	if err == nil && !queued.backendsOnly {
+		rt.routesLoadedAt = rt.lastReloadAt
+		rt.ready.Store(true)
+	}
+	mux := rt.mux.Load()
+	callbacks := rt.reloadCallbacks
+	rt.lock.Unlock()
+
+	result.Err = err
+	result.RouteCount = mux.RouteCount()
+	result.Checksum = fmt.Sprintf("%x", mux.RouteChecksum())
+	result.Duration = time.Since(start)
+	switch {
+	case err != nil:
+		rt.logEvent("routes_load_failed", map[string]interface{}{"source": name, "backends_only": queued.backendsOnly, "error": err.Error()})
+	case queued.backendsOnly:
+		rt.logEvent("backends_reloaded", map[string]interface{}{
+			"changed":  result.ChangedBackends,
+			"routes":   result.ReboundRoutes,
+			"count":    result.RouteCount,
+			"checksum": result.Checksum,
+		})
+	default:
+		rt.logEvent("routes_loaded", map[string]interface{}{
+			"source":    name,
+			"count":     result.RouteCount,
+			"checksum":  result.Checksum,
+			"added":     result.Added,
+			"removed":   result.Removed,
+			"unchanged": result.Unchanged,
+			"sources":   result.Sources,
+		})
+	}
+	rt.reloads.finish(queued, err)
+	for _, callback := range callbacks {
+		callback(result)
+	}
+	return err
+}
+
+// checkIncomingPaths returns an error wrapping ErrInvalidRouteData if any of
+// the routes has an empty incoming path.
+func checkIncomingPaths(routes []Route) error {
+	empty := 0
+	for i := range routes {
+		if isEmptyPath(routes[i].IncomingPath) {
+			empty++
+		}
+	}
+	if empty > 0 {
+		return fmt.Errorf("%w: %d routes have an empty incoming path", ErrInvalidRouteData, empty)
+	}
+	return nil
+}
+
+// isEmptyPath reports whether an incoming path is empty or only whitespace.
+// Such paths would otherwise be registered at the root.
+func isEmptyPath(path string) bool {
+	return strings.TrimSpace(path) == ""
+}
+
+// loadError wraps an error from loading the named route source, classifying
+// it as invalid data, a timeout or the source being unavailable.
+func loadError(name string, err error) error {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrInvalidRouteData):
+		return fmt.Errorf("loading routes from %s: %w", name, err)
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return fmt.Errorf("%w: loading routes from %s: %w", ErrRouteSourceTimeout, name, err)
+	}
+	return fmt.Errorf("%w: loading routes from %s: %w", ErrRouteSourceUnavailable, name, err)
+}
+
+// reloadRoutes does the work of ReloadRoutes and ReloadSource, recording the
+// changes it makes in result. All sources are reloaded if name is empty. Drop
+// protection is disabled if maxDropPercent is negative.
+func (rt *Router) reloadRoutes(name string, maxDropPercent int, result *ReloadResult) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logWarn("router: recovered from panic in ReloadRoutes:", r)
+			logInfo("router: original routes have not been modified")
+			err = fmt.Errorf("%w: %v", ErrReloadPanicked, r)
+		}
+	}()
+
+	// Reloads of different sources mustn't interleave, or one could throw
+	// away the routes loaded by the other.
+	rt.reloadLock.Lock()
+	defer rt.reloadLock.Unlock()
+
+	loaded := make(map[string]*namedRouteSource)
+	for _, s := range rt.sources {
+		if name != "" && s.name != name {
+			continue
+		}
+		backendDocs, routeDocs, err := s.source.Load()
+		if err == nil && rt.strictIncomingPaths {
+			err = checkIncomingPaths(routeDocs)
+		}
+		rt.lock.Lock()
+		rt.sourceErrors[s.name] = err
+		rt.lock.Unlock()
+		if err != nil {
+			logWarn(fmt.Sprintf("router: couldn't load routes from %s: %v", s.name, err))
+			logInfo("router: original routes have not been modified")
+			return loadError(s.name, err)
+		}
+		loaded[s.name] = &namedRouteSource{s.name, s.source, backendDocs, routeDocs}
+	}
+	if name != "" && len(loaded) == 0 {
+		return fmt.Errorf("%w %q", ErrUnknownRouteSource, name)
+	}
+
+	logInfo("router: reloading routes")
+	sources := make([]*namedRouteSource, len(rt.sources))
+	for i, s := range rt.sources {
+		if l, ok := loaded[s.name]; ok {
+			s = l
+		}
+		sources[i] = s
+	}
+	result.Sources = make(map[string]SourceCount, len(sources))
+	for _, s := range sources {
+		result.Sources[s.name] = SourceCount{len(s.backends), len(s.routes)}
+		logInfo(fmt.Sprintf("router: %s has %d backends and %d routes", s.name, len(s.backends), len(s.routes)))
+	}
+	backendDocs, routeDocs := mergeBackends(sources), mergeRoutes(sources)
+
+	// Replacing the routing table throws away the response cache and the
+	// backends' connection pools, so don't do it if nothing has changed.
+	fingerprint := routeTableFingerprint(backendDocs, routeDocs)
+	if fingerprint == rt.fingerprint {
+		rt.lock.Lock()
+		rt.sources = sources
+		rt.lock.Unlock()
+		result.Unchanged = true
+		logInfo("router: routes unchanged, keeping the current routing table")
+		return nil
+	}
+
+	newmux := rt.newMux()
+	backends, breakers, pools, skippedBackends := rt.loadBackends(backendDocs)
+	skippedRoutes := rt.loadRoutes(routeDocs, newmux, backends, breakers)
+
+	rt.lock.Lock()
+	if current := rt.mux.Load().RouteCount(); maxDropPercent >= 0 && current > 0 {
+		dropped := current - newmux.RouteCount()
+		if dropped*100 > current*maxDropPercent {
+			rt.lock.Unlock()
+			pools.closeIdleConnections()
+			logWarn(fmt.Sprintf("router: refusing to reload routes, as %d of %d routes would be dropped "+
+				"(more than %d%%)", dropped, current, maxDropPercent))
+			return fmt.Errorf("%w: %d of %d routes", ErrTooManyRoutesDropped, dropped, current)
+		}
+	}
+	oldmux := rt.mux.Swap(newmux)
+	oldgen := rt.generation.Swap(&generation{})
+	oldpools := rt.backendPools
+	rt.sources = sources
+	rt.skippedRoutes = skippedRoutes
+	rt.skippedBackends = skippedBackends
+	rt.backends = backends
+	rt.backendPools = pools
+	rt.circuitBreakers = breakers
+	rt.lock.Unlock()
+	go releaseBackends(oldgen, oldpools)
+	rt.fingerprint = fingerprint
+
+	// Cached responses may have come from routes which have since changed.
+	rt.responseCache.Purge()
+
+	if rt.warmupConnections > 0 && !rt.lazyBackends {
+		go rt.warmUpBackends(backends)
+	}
+
+	for _, r := range newmux.ShadowedRoutes() {
+		logWarn(fmt.Sprintf("router: route %s (prefix: %v) was registered more than once "+
+			"and the earlier registration can never be selected", r.Path, r.Prefix))
+	}
+	warnOfBroadPrefixes(newmux)
+	logInfo(fmt.Sprintf("router: reloaded %d routes, skipped %d routes and %d backends (checksum: %x)",
+		newmux.RouteCount(), skippedRoutes, skippedBackends, newmux.RouteChecksum()))
+
+	result.Added, result.Removed = diffRoutes(oldmux.Routes(), newmux.Routes())
+	return nil
+}
+
+// ReloadBackends reloads just the backends from the route sources, and
+// rebinds the routes using any backend which has changed (such as one which
+// has moved to another host) to a new handler for it, in place in a copy of
+// the current routing table. Routes aren't read again: sources which are
+// BackendSources (such as mongo) only read their backends, and the routes
+// last loaded are kept. Requests for routes whose backends are unchanged
+// carry on using the same handlers and connections.
+//
+// If the routes haven't been loaded yet, or a backend which routes use has
+// been removed or is now invalid, nothing is changed and an error wrapping
+// ErrRoutesNeedReload is returned, as only a full reload can skip routes.
+// Backend reloads are queued along with the others.
+func (rt *Router) ReloadBackends() error {
+	return rt.reload("", -1, true)
+}
+
+// reloadBackends does the work of ReloadBackends, recording the backends
+// which changed in result.
+func (rt *Router) reloadBackends(result *ReloadResult) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logWarn("router: recovered from panic in ReloadBackends:", r)
+			logInfo("router: original backends have not been modified")
+			err = fmt.Errorf("%w: %v", ErrReloadPanicked, r)
+		}
+	}()
+
+	rt.reloadLock.Lock()
+	defer rt.reloadLock.Unlock()
+
+	if !rt.ready.Load() {
+		return fmt.Errorf("%w: routes haven't been loaded yet", ErrRoutesNeedReload)
+	}
+
+	sources := make([]*namedRouteSource, len(rt.sources))
+	for i, s := range rt.sources {
+		backendDocs, err := loadBackends(s.source)
+		rt.lock.Lock()
+		rt.sourceErrors[s.name] = err
+		rt.lock.Unlock()
+		if err != nil {
+			logWarn(fmt.Sprintf("router: couldn't load backends from %s: %v", s.name, err))
+			logInfo("router: original backends have not been modified")
+			return loadError(s.name, err)
+		}
+		sources[i] = &namedRouteSource{s.name, s.source, backendDocs, s.routes}
+	}
+
+	// A backend has changed if it has been added or removed, or any of its
+	// fields differ.
+	oldDocs := make(map[string]Backend)
+	for _, b := range mergeBackends(rt.sources) {
+		oldDocs[b.BackendId] = b
+	}
+	newDocs := make(map[string]Backend)
+	backendDocs := mergeBackends(sources)
+	for _, b := range backendDocs {
+		newDocs[b.BackendId] = b
+	}
+	changed := make(map[string]bool)
+	changedDocs := make([]Backend, 0)
+	for id, b := range newDocs {
+		if old, ok := oldDocs[id]; !ok || !reflect.DeepEqual(old, b) {
+			changed[id] = true
+			changedDocs = append(changedDocs, b)
+		}
+	}
+	for id := range oldDocs {
+		if _, ok := newDocs[id]; !ok {
+			changed[id] = true
+		}
+	}
+	if len(changed) == 0 {
+		rt.lock.Lock()
+		rt.sources = sources
+		rt.lock.Unlock()
+		result.Unchanged = true
+		logInfo("router: backends unchanged, keeping the current routing table")
+		return nil
+	}
+
+	newBackends, newBreakers, newPools, _ := rt.loadBackends(changedDocs)
+	backends := make(map[string]http.Handler, len(newDocs))
+	breakers := make(map[string]*handlers.CircuitBreaker, len(newDocs))
+	for id, handler := range rt.backends {
+		if !changed[id] {
+			backends[id] = handler
+		}
+	}
+	for id, breaker := range rt.circuitBreakers {
+		if !changed[id] {
+			breakers[id] = breaker
+		}
+	}
+	for id, handler := range newBackends {
+		backends[id] = handler
+	}
+	for id, breaker := range newBreakers {
+		breakers[id] = breaker
+	}
+
+	// Rebuild the routes which use a changed backend, and swap their new
+	// handlers into a copy of the routing table.
+	newmux := rt.mux.Load().Clone()
+	rebound := make([]triemux.RouteInfo, 0)
+	routeDocs := make([]Route, 0)
+	for _, info := range newmux.Routes() {
+		route := routeDoc(info.Value)
+		if route == nil {
+			continue
+		}
+		uses := false
+		for _, id := range routeBackendIds(route) {
+			if _, ok := backends[id]; !ok {
+				newPools.closeIdleConnections()
+				return fmt.Errorf("%w: route %s (%s) uses backend %s, which has been removed or is invalid",
+					ErrRoutesNeedReload, route.IncomingPath, route.RouteType, id)
+			}
+			uses = uses || changed[id]
+		}
+		if uses {
+			rebound = append(rebound, info)
+			routeDocs = append(routeDocs, *route)
+		}
+	}
+	scratch := rt.newMux()
+	if skipped := rt.loadRoutes(routeDocs, scratch, backends, breakers); skipped > 0 {
+		newPools.closeIdleConnections()
+		return fmt.Errorf("%w: %d routes couldn't be rebuilt with the new backends", ErrRoutesNeedReload, skipped)
+	}
+	for _, info := range rebound {
+		if route, ok := scratch.Route(info.Path, info.Prefix); ok {
+			newmux.ReplaceValue(info.Path, info.Prefix, route.Value)
+		}
+	}
+
+	// The replaced backends' connections are closed once the requests
+	// which may be using them have finished, as for a full reload.
+	pools := make(backendPools, len(newDocs))
+	retired := make(backendPools)
+	rt.lock.Lock()
+	for id, pool := range rt.backendPools {
+		if changed[id] {
+			retired[id] = pool
+		} else {
+			pools[id] = pool
+		}
+	}
+	for id, pool := range newPools {
+		pools[id] = pool
+	}
+	rt.mux.Store(newmux)
+	oldgen := rt.generation.Swap(&generation{})
+	rt.sources = sources
+	rt.skippedBackends = len(newDocs) - len(backends)
+	rt.backends = backends
+	rt.backendPools = pools
+	rt.circuitBreakers = breakers
+	rt.lock.Unlock()
+	go releaseBackends(oldgen, retired)
+	rt.fingerprint = routeTableFingerprint(backendDocs, mergeRoutes(sources))
+
+	// Cached responses may have come from a backend which has since moved.
+	rt.responseCache.Purge()
+
+	if rt.warmupConnections > 0 && !rt.lazyBackends {
+		go rt.warmUpBackends(newBackends)
+	}
+
+	changedIds := make([]string, 0, len(changed))
+	for id := range changed {
+		changedIds = append(changedIds, id)
+	}
+	sort.Strings(changedIds)
+	result.ChangedBackends = changedIds
+	result.ReboundRoutes = len(rebound)
+	logInfo(fmt.Sprintf("router: reloaded backends %s, rebinding %d routes", strings.Join(changedIds, ", "), len(rebound)))
+	return nil
+}
+
+// backendPool keeps the proxies built for a backend, so that the connections
+// they hold open for reuse can be closed once it has been replaced. Otherwise
+// they would be kept for as long as the router runs.
+type backendPool struct {
+	mu      sync.Mutex
+	proxies []http.Handler
+}
+
+func (p *backendPool) add(proxy http.Handler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.proxies = append(p.proxies, proxy)
+}
+
+// closeIdleConnections closes the connections which aren't being used by a
+// request. A nil pool has none.
+func (p *backendPool) closeIdleConnections() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, proxy := range p.proxies {
+		handlers.CloseIdleConnections(proxy)
+	}
+}
+
+// backendPools holds the pool of each backend in a routing table, by ID.
+type backendPools map[string]*backendPool
+
+func (p backendPools) closeIdleConnections() {
+	for _, pool := range p {
+		pool.closeIdleConnections()
+	}
+}
+
+// releaseBackends waits for the requests being served with a replaced routing
+// table to finish, and then closes the connections the replaced backends are
+// keeping open. Requests are cut off after the request timeout, so it doesn't
+// wait for long.
+func releaseBackends(gen *generation, pools backendPools) {
+	for gen.inFlight.Load() > 0 {
+		time.Sleep(drainPollInterval)
+	}
+	pools.closeIdleConnections()
+}
+
+// routeTableFingerprint returns a hash of everything loaded from the route
+// sources, to tell whether a reload has changed anything.
+func routeTableFingerprint(backends []Backend, routes []Route) string {
+	h := sha1.New()
+	enc := json.NewEncoder(h)
+	enc.Encode(backends)
+	enc.Encode(routes)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// diffRoutes counts the routes (by path and route type) which are in new but
+// not old, and in old but not new.
+func diffRoutes(old, new []triemux.RouteInfo) (added, removed int) {
+	key := func(r triemux.RouteInfo) string {
+		return fmt.Sprintf("%s(%v)", r.Path, r.Prefix)
+	}
+	oldKeys := make(map[string]bool, len(old))
+	for _, r := range old {
+		oldKeys[key(r)] = true
+	}
+	for _, r := range new {
+		if oldKeys[key(r)] {
+			delete(oldKeys, key(r))
+		} else {
+			added++
+		}
+	}
+	return added, len(oldKeys)
+}
+
+// warmUpBackends opens idle connections to each of the backends, so that
+// the first requests to them after a reload don't have to. It's best-effort:
+// any errors are only logged.
+func (rt *Router) warmUpBackends(backends map[string]http.Handler) {
+	for _, backend := range backends {
+		handlers.WarmUp(backend, rt.warmupPath, rt.warmupConnections, rt.requestTimeout)
+	}
+	logDebug(fmt.Sprintf("router: warmed up connections to %d backends", len(backends)))
+}
+
+// Prefix routes this close to the root, with at least this many exact routes
+// beneath them, are likely to be accidental catch-alls.
+const (
+	broadPrefixMaxDepth    = 1
+	broadPrefixExactRoutes = 10
+)
+
+// warnOfBroadPrefixes logs the shallow prefix routes which have many exact
+// routes beneath them. Requests for paths beneath those exact routes go to
+// the prefix route, which is often a surprise.
+func warnOfBroadPrefixes(mux *triemux.Mux) {
+	for _, c := range mux.PrefixCoverage() {
+		depth := len(strings.FieldsFunc(c.Route.Path, func(r rune) bool { return r == '/' }))
+		if depth > broadPrefixMaxDepth || len(c.ExactPaths) < broadPrefixExactRoutes {
+			continue
+		}
+		examples := c.ExactPaths[:3]
+		logWarn(fmt.Sprintf("router: prefix route %s has %d exact routes beneath it (such as %s), "+
+			"and will serve any requests for paths beneath those routes", c.Route.Path, len(c.ExactPaths),
+			strings.Join(examples, ", ")))
+	}
+}
+
+// mergeBackends combines the backends from each source, logging any backend
+// IDs defined by more than one source. The definition from the latest source
+// wins.
+func mergeBackends(sources []*namedRouteSource) (backends []Backend) {
+	definedBy := make(map[string]string)
+	for _, s := range sources {
+		for _, b := range s.backends {
+			if other, ok := definedBy[b.BackendId]; ok && other != s.name {
+				logWarn(fmt.Sprintf("router: backend %s from %s overrides the one from %s", b.BackendId, s.name, other))
+			}
+			definedBy[b.BackendId] = s.name
+			backends = append(backends, b)
+		}
+	}
+	return
+}
+
+// mergeRoutes combines the routes from each source, logging any routes
+// defined by more than one source. The route from the latest source wins,
+// as it is registered last.
+func mergeRoutes(sources []*namedRouteSource) (routes []Route) {
+	definedBy := make(map[string]string)
+	for _, s := range sources {
+		for _, r := range s.routes {
+			key := path.Clean("/"+r.IncomingPath) + " " + r.RouteType
+			if other, ok := definedBy[key]; ok && other != s.name {
+				logWarn(fmt.Sprintf("router: route %s (%s) from %s overrides the one from %s", r.IncomingPath, r.RouteType, s.name, other))
+			}
+			definedBy[key] = s.name
+			routes = append(routes, r)
+		}
+	}
+	return
+}
+
+// loadBackends is a helper function which constructs a Handler for each of
+// the passed backends (or, if backends are loaded lazily, one which constructs
+// it on first use), and returns them in map keyed on the backend_id, along
+// with the circuit breakers of those backends which have them, the pools of
+// proxies built for them, and the number of backends which were skipped
+// because they were invalid.
+func (rt *Router) loadBackends(backendDocs []Backend) (backends map[string]http.Handler, breakers map[string]*handlers.CircuitBreaker, pools backendPools, skipped int) {
+	backends = make(map[string]http.Handler)
+	breakers = make(map[string]*handlers.CircuitBreaker)
+	pools = make(backendPools)
+
+	for i := range backendDocs {
+		backend := &backendDocs[i]
+		backendUrl, err := url.Parse(backend.BackendURL)
+		if err != nil {
+			rt.logSkippedBackend(backend, fmt.Sprintf("has unparseable URL %s (error: %v)", backend.BackendURL, err))
+			skipped++
+			continue
+		}
+
+		if backend.OverrideHost != "" && backend.PreserveHost {
+			rt.logSkippedBackend(backend, "sets both override_host and preserve_host")
+			skipped++
+			continue
+		}
+		if backend.UserAgent != "" && backend.UserAgentSuffix != "" {
+			rt.logSkippedBackend(backend, "sets both user_agent and user_agent_suffix")
+			skipped++
+			continue
+		}
+
+		connectTimeout := rt.backendConnectTimeout
+		if backend.ConnectTimeoutMs > 0 {
+			connectTimeout = time.Duration(backend.ConnectTimeoutMs) * time.Millisecond
+		}
+		tlsTimeout := rt.backendTLSTimeout
+		if backend.TLSHandshakeTimeoutMs > 0 {
+			tlsTimeout = time.Duration(backend.TLSHandshakeTimeoutMs) * time.Millisecond
+		}
+		headerTimeout := rt.backendHeaderTimeout
+		if backend.HeaderTimeoutMs > 0 {
+			headerTimeout = time.Duration(backend.HeaderTimeoutMs) * time.Millisecond
+		}
+		flushInterval := rt.backendFlushInterval
+		if backend.FlushIntervalMs != 0 {
+			flushInterval = time.Duration(backend.FlushIntervalMs) * time.Millisecond
+		}
+		var breaker *handlers.CircuitBreaker
+		if backend.CircuitBreakerFailures > 0 {
+			window, cooldown := defaultCircuitBreakerWindow, defaultCircuitBreakerCooldown
+			if backend.CircuitBreakerWindowMs > 0 {
+				window = time.Duration(backend.CircuitBreakerWindowMs) * time.Millisecond
+			}
+			if backend.CircuitBreakerCooldownMs > 0 {
+				cooldown = time.Duration(backend.CircuitBreakerCooldownMs) * time.Millisecond
+			}
+			breaker = handlers.NewCircuitBreaker(backend.CircuitBreakerFailures, window, cooldown)
+			breakers[backend.BackendId] = breaker
+		}
+		pool := &backendPool{}
+		pools[backend.BackendId] = pool
+		build := func() http.Handler {
+			handler := handlers.NewBackendHandler(backendUrl, connectTimeout, tlsTimeout, headerTimeout, flushInterval, rt.dnsCache, backend.HTTP2, rt.logger)
+			pool.add(handler)
+			if backend.OverrideHost != "" {
+				handler = handlers.WithHost(handler, backend.OverrideHost)
+			} else if backend.PreserveHost {
+				handler = handlers.WithClientHost(handler)
+			}
+			if backend.UserAgent != "" {
+				handler = handlers.WithUserAgent(handler, backend.UserAgent)
+			} else if backend.UserAgentSuffix != "" {
+				handler = handlers.WithUserAgentSuffix(handler, backend.UserAgentSuffix)
+			}
+			if len(backend.HopByHopHeaders) > 0 {
+				handler = handlers.WithHopByHopHeaders(handler, backend.HopByHopHeaders)
+			}
+			if rt.edge {
+				handler = handlers.AtEdge(handler)
+			}
+			if breaker != nil {
+				handler = handlers.NewCircuitBreakingHandler(handler, breaker)
+			}
+			if backend.InterceptErrors && rt.errorTemplates != nil {
+				handler = rt.errorTemplates.Wrap(handler)
+			}
+			return handler
+		}
+		if rt.lazyBackends {
+			backends[backend.BackendId] = handlers.NewLazyHandler(build)
+		} else {
+			backends[backend.BackendId] = build()
+		}
+	}
+
+	return
+}
+
+// loadRoutes is a helper function which registers the passed routes with the
+// passed proxy mux. It returns the number of routes which were skipped because
+// they were invalid.
+func (rt *Router) loadRoutes(routeDocs []Route, mux *triemux.Mux, backends map[string]http.Handler, breakers map[string]*handlers.CircuitBreaker) (skipped int) {
+	// scratch holds every route, so that redirects can be checked for loops
+	// against the table as a whole. It's only built once a redirect is seen.
+	var scratch *triemux.Mux
+	for i := range routeDocs {
+		route := &routeDocs[i]
+		if isEmptyPath(route.IncomingPath) {
+			rt.logSkippedRoute(route, "has an empty incoming path")
+			skipped++
+			continue
+		}
+		prefix, err := triemux.ParseRouteType(route.RouteType)
+		if err != nil {
+			rt.logSkippedRoute(route, fmt.Sprintf("has invalid route type (error: %v)", err))
+			skipped++
+			continue
+		}
+		if route.Priority != 0 && !prefix {
+			rt.logSkippedRoute(route, "has a priority, which only prefix routes can have")
+			skipped++
+			continue
+		}
+		if route.MinExtraSegments != 0 && (!prefix || route.MinExtraSegments < 0) {
+			rt.logSkippedRoute(route, "has an invalid min_extra_segments, which only prefix routes can have")
+			skipped++
+			continue
+		}
+		// incomingPath is where the route is registered, beneath the path
+		// prefix if there is one.
+		incomingPath := route.IncomingPath
+		if rt.pathPrefix != "" {
+			incomingPath = rt.pathPrefix + strings.TrimRight(incomingPath, "/")
+		}
+		if rt.reservedPrefix != "" && hasPathPrefix(incomingPath, rt.reservedPrefix) {
+			rt.logSkippedRoute(route, "is beneath the reserved prefix "+rt.reservedPrefix)
+			skipped++
+			continue
+		}
+		if allowed, known := rt.allowedHandlers[route.Handler]; known && !allowed {
+			rt.logSkippedRoute(route, "uses the "+route.Handler+" handler, which isn't allowed")
+			skipped++
+			continue
+		}
+		var handler http.Handler
+		var target string
+		switch route.Handler {
+		case "backend":
+			backend, ok := backends[route.BackendId]
+			if !ok {
+				rt.logSkippedRoute(route, "references unknown backend "+route.BackendId)
+				skipped++
+				continue
+			}
+			handler, target = backend, route.BackendId
+			if route.BucketCookie != "" {
+				handler, err = bucketHandler(route, backends, backend)
+				if err != nil {
+					rt.logSkippedRoute(route, err.Error())
+					skipped++
+					continue
+				}
+				target += " (bucketed by cookie " + route.BucketCookie + ")"
+			}
+			if route.RegionHeader != "" {
+				handler, err = regionHandler(route, backends, handler)
+				if err != nil {
+					rt.logSkippedRoute(route, err.Error())
+					skipped++
+					continue
+				}
+				target += " (by region header " + route.RegionHeader + ")"
+			}
+			if len(route.HashBackends) > 0 {
+				handler, err = hashHandler(route, backends, breakers, handler)
+				if err != nil {
+					rt.logSkippedRoute(route, err.Error())
+					skipped++
+					continue
+				}
+				target += " (hashed over " + strings.Join(route.HashBackends, ", ") + ")"
+			}
+			if len(route.ContentTypeBackends) > 0 {
+				handler, err = contentTypeHandler(route, backends, handler)
+				if err != nil {
+					rt.logSkippedRoute(route, err.Error())
+					skipped++
+					continue
+				}
+				target += " (by content type)"
+			}
+			if route.MirrorBackendId != "" {
+				shadow, ok := backends[route.MirrorBackendId]
+				if !ok {
+					rt.logSkippedRoute(route, "references unknown mirror backend "+route.MirrorBackendId)
+					skipped++
+					continue
+				}
+				handler = handlers.NewMirroringHandler(handler, shadow, maxMirrorBodyBytes, rt.requestTimeout)
+				target += " (mirrored to " + route.MirrorBackendId + ")"
+			}
+			if route.AllowConnect {
+				handler = handlers.WithConnect(handler)
+				target += " (CONNECT allowed)"
+			}
+			if route.HeaderTimeoutMs > 0 {
+				handler = handlers.WithHeaderTimeout(handler, time.Duration(route.HeaderTimeoutMs)*time.Millisecond)
+			}
+			maxResponseBytes := rt.maxResponseBytes
+			if route.MaxResponseBytes != 0 {
+				maxResponseBytes = route.MaxResponseBytes
+			}
+			if maxResponseBytes > 0 {
+				handler = handlers.WithMaxResponseBytes(handler, maxResponseBytes)
+			}
+			if route.RewritePattern != "" {
+				handler, err = handlers.NewRewritingHandler(handler, route.RewritePattern, route.RewriteReplacement)
+				if err != nil {
+					rt.logSkippedRoute(route, fmt.Sprintf("has invalid rewrite pattern %s (error: %v)", route.RewritePattern, err))
+					skipped++
+					continue
+				}
+			}
+			if route.StripSuffix != "" {
+				handler = handlers.NewSuffixStrippingHandler(handler, route.StripSuffix)
+				target += " (without suffix " + route.StripSuffix + ")"
+			}
+			if route.Cache {
+				handler = handlers.NewCachingHandler(handler, rt.responseCache)
+				target += " (cached)"
+			}
+			if route.BufferResponseBytes > 0 {
+				handler = handlers.NewBufferingHandler(handler, route.BufferResponseBytes)
+			}
+			if route.Decompress {
+				handler = handlers.NewDecompressingHandler(handler)
+			}
+		case "redirect":
+			redirectTemporarily := (route.RedirectType == "temporary")
+			redirect, err := handlers.NewRedirectHandler(route.IncomingPath, route.RedirectTo, prefix, redirectTemporarily, rt.maxRedirectLength, rt.logger)
+			if err != nil {
+				rt.logSkippedRoute(route, fmt.Sprintf("has invalid redirect target %s (error: %v)", route.RedirectTo, err))
+				skipped++
+				continue
+			}
+			if host := redirectHost(route.RedirectTo); host != "" && rt.allowedRedirectHosts != nil && !rt.allowedRedirectHosts[host] {
+				rt.logSkippedRoute(route, "redirects to host "+host+", which isn't allowed")
+				skipped++
+				continue
+			}
+			if scratch == nil {
+				scratch = redirectLoopMux(routeDocs)
+			}
+			if redirectsToItself(scratch, route, prefix) {
+				if rt.skipRedirectLoops {
+					rt.logSkippedRoute(route, "redirects back to itself")
+					skipped++
+					continue
+				}
+				logWarn(fmt.Sprintf("router: redirect route %s (%s) redirects back to itself (target: %s)",
+					route.IncomingPath, route.RouteType, route.RedirectTo))
+			}
+			handler, target = handlers.NewHeadHandler(redirect), route.RedirectTo
+		case "gone":
+			handler = handlers.NewHeadHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusGone)
+			}))
+			target = "Gone"
+		case "ping":
+			body := route.PingBody
+			if body == "" {
+				body = "OK"
+			}
+			handler = handlers.NewHeadHandler(handlers.NewPingHandler(body))
+			target = "Ping"
+		case "static":
+			contentType := route.StaticContentType
+			if contentType == "" {
+				contentType = "text/plain; charset=utf-8"
+			}
+			handler = handlers.NewHeadHandler(handlers.NewStaticHandler(contentType, route.StaticBody))
+			target = "Static"
+		case "filesystem":
+			if route.DocumentRoot == "" {
+				rt.logSkippedRoute(route, "has no document root")
+				skipped++
+				continue
+			}
+			handler = handlers.NewFileSystemHandler(route.DocumentRoot, route.StripPrefix)
+			target = route.DocumentRoot
+		case "boom":
+			// Special handler so that we can test failure behaviour.
+			if !rt.enableBoom {
+				rt.logSkippedRoute(route, "uses the boom handler, which is disabled")
+				skipped++
+				continue
+			}
+			handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				panic("Boom!!!")
+			})
+			target = "Boom!!!"
+		default:
+			rt.logSkippedRoute(route, "has unknown handler type "+route.Handler)
+			skipped++
+			continue
+		}
+
+		if route.ReadOnly {
+			handler = handlers.NewReadOnlyHandler(handler, route.ReadOnlyBody)
+			target += " (read only)"
+		}
+
+		if route.BasicAuthUser != "" {
+			realm := route.BasicAuthRealm
+			if realm == "" {
+				realm = "Restricted"
+			}
+			handler = handlers.NewBasicAuthHandler(realm, route.BasicAuthUser, route.BasicAuthSHA256, handler)
+			target += " (basic auth)"
+		}
+
+		if route.ChaosDelayChance > 0 || route.ChaosErrorChance > 0 {
+			if route.ChaosDelayChance > 1 || route.ChaosErrorChance > 1 || route.ChaosDelayMs < 0 {
+				rt.logSkippedRoute(route, "has invalid chaos settings")
+				skipped++
+				continue
+			}
+			if rt.enableChaos {
+				handler = handlers.NewChaosHandler(handler, time.Duration(route.ChaosDelayMs)*time.Millisecond, route.ChaosDelayChance, route.ChaosErrorChance)
+				target += " (chaos)"
+			} else {
+				logWarn(fmt.Sprintf("router: route %s (%s) has chaos settings, which are ignored as chaos is disabled", route.IncomingPath, route.RouteType))
+			}
+		}
+
+		backendId := ""
+		if route.Handler == "backend" {
+			backendId = route.BackendId
+		}
+		if rt.pathPrefix != "" {
+			handler = handlers.NewPrefixStrippingHandler(handler, rt.pathPrefix)
+		}
+		if route.HTTPSRedirect && !rt.httpsRedirect {
+			handler = handlers.NewHTTPSRedirectHandler(handler, rt.trustedProxies)
+			target += " (https only)"
+		}
+		handler = tracing.RouteHandler(handler, route.IncomingPath, route.RouteType, route.Handler, backendId)
+		handler = withMatchedRoute(handler, route)
+
+		value := &routeValue{handler, route}
+		if route.Priority != 0 || route.MinExtraSegments != 0 {
+			mux.HandlePrefix(incomingPath, prefixOptions(route), value)
+		} else {
+			mux.HandleValue(incomingPath, prefix, value)
+		}
+		logDebug(fmt.Sprintf("router: registered %s (%s) -> %s", incomingPath, route.RouteType, target))
+	}
+
+	return
+}
+
+// prefixOptions returns the options with which a prefix route is registered.
+func prefixOptions(route *Route) triemux.PrefixOptions {
+	return triemux.PrefixOptions{Priority: route.Priority, MinExtraSegments: route.MinExtraSegments}
+}
+
+// bucketHandler returns the handler for a backend route which chooses its
+// backend by the route's bucket cookie, falling back to the route's own
+// backend.
+func bucketHandler(route *Route, backends map[string]http.Handler, fallback http.Handler) (http.Handler, error) {
+	if len(route.BucketBackends) == 0 {
+		return nil, errors.New("has a bucket cookie but no bucket backends")
+	}
+	buckets := make(map[string]http.Handler, len(route.BucketBackends))
+	for bucket, backendId := range route.BucketBackends {
+		backend, ok := backends[backendId]
+		if !ok {
+			return nil, fmt.Errorf("references unknown backend %s for bucket %s", backendId, bucket)
+		}
+		buckets[bucket] = backend
+	}
+	return handlers.NewCookieBucketHandler(route.BucketCookie, buckets, route.BucketHashCount, fallback), nil
+}
+
+// regionHandler returns the handler for a backend route which chooses its
+// backend by the value of the route's region header, falling back to the
+// route's own backend (or bucketed backends).
+func regionHandler(route *Route, backends map[string]http.Handler, fallback http.Handler) (http.Handler, error) {
+	if len(route.RegionBackends) == 0 {
+		return nil, errors.New("has a region header but no region backends")
+	}
+	regions := make(map[string]http.Handler, len(route.RegionBackends))
+	for region, backendId := range route.RegionBackends {
+		backend, ok := backends[backendId]
+		if !ok {
+			return nil, fmt.Errorf("references unknown backend %s for region %s", backendId, region)
+		}
+		regions[region] = backend
+	}
+	return handlers.NewRegionHandler(route.RegionHeader, regions, fallback), nil
+}
+
+// hashHandler returns the handler for a backend route which spreads requests
+// over its hash backends by consistent hashing of its hash key, passing over
+// backends whose circuit is open. Requests without the key, or arriving when
+// every hash backend is unhealthy, fall back to the route's own backend (or
+// bucketed or regional backends).
+func hashHandler(route *Route, backends map[string]http.Handler, breakers map[string]*handlers.CircuitBreaker, fallback http.Handler) (http.Handler, error) {
+	key, err := handlers.ParseHashKey(route.HashKey)
+	if err != nil {
+		return nil, fmt.Errorf("has an %v", err)
+	}
+	nodes := make(map[string]http.Handler, len(route.HashBackends))
+	for _, backendId := range route.HashBackends {
+		backend, ok := backends[backendId]
+		if !ok {
+			return nil, fmt.Errorf("references unknown hash backend %s", backendId)
+		}
+		nodes[backendId] = backend
+	}
+	return handlers.NewConsistentHashHandler(key, nodes, breakers, fallback), nil
+}
+
+// contentTypeHandler returns the handler for a backend route which chooses
+// its backend by the media type of the request's Content-Type, falling back
+// to the route's own backend (or bucketed, regional or hashed backends).
+func contentTypeHandler(route *Route, backends map[string]http.Handler, fallback http.Handler) (http.Handler, error) {
+	byType := make(map[string]http.Handler, len(route.ContentTypeBackends))
+	for mediaType, backendId := range route.ContentTypeBackends {
+		backend, ok := backends[backendId]
+		if !ok {
+			return nil, fmt.Errorf("references unknown backend %s for content type %s", backendId, mediaType)
+		}
+		byType[mediaType] = backend
+	}
+	return handlers.NewContentTypeHandler(byType, fallback), nil
+}
+
+// hasPathPrefix reports whether path is prefix, or a path beneath it.
+func hasPathPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// redirectLoopMux builds a mux holding every route with a valid route type,
+// for use by redirectsToItself.
+func redirectLoopMux(routeDocs []Route) *triemux.Mux {
+	mux := triemux.NewMux()
+	for i := range routeDocs {
+		prefix, err := triemux.ParseRouteType(routeDocs[i].RouteType)
+		switch {
+		case err != nil:
+		case prefix && (routeDocs[i].Priority != 0 || routeDocs[i].MinExtraSegments > 0):
+			mux.HandlePrefix(routeDocs[i].IncomingPath, prefixOptions(&routeDocs[i]), http.NotFoundHandler())
+		default:
+			mux.Handle(routeDocs[i].IncomingPath, prefix, http.NotFoundHandler())
+		}
+	}
+	return mux
+}
+
+// redirectsToItself reports whether the target of a redirect route would be
+// served by the route itself. Only targets on the same host are considered,
+// since the router can't know which host an absolute target will reach.
+func redirectsToItself(mux *triemux.Mux, route *Route, prefix bool) bool {
+	u, err := url.Parse(route.RedirectTo)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return false
+	}
+	match := mux.Match(u.Path)
+	return match.Route != nil && match.Route.Path == route.IncomingPath && match.Route.Prefix == prefix
+}
+
+// redirectHost returns the lower-cased host name of an absolute (or
+// protocol-relative) redirect target, or an empty string for a path.
+func redirectHost(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// logSkippedRoute records a route which was skipped while loading, both as a
+// warning and as a structured entry in the error log.
+func (rt *Router) logSkippedRoute(route *Route, reason string) {
+	logWarn(fmt.Sprintf("router: found route %+v which %s, skipping!", route, reason))
+	rt.logger.Log(map[string]interface{}{"error": "skipped route which " + reason, "route": route})
+}
+
+// logEvent records a lifecycle event, such as the routes being loaded, as a
+// structured entry in the error log.
+func (rt *Router) logEvent(event string, fields map[string]interface{}) {
+	fields["event"] = event
+	rt.logger.Log(fields)
+}
+
+// logSkippedBackend records a backend which was skipped while loading, both
+// as a warning and as a structured entry in the error log.
+func (rt *Router) logSkippedBackend(backend *Backend, reason string) {
+	logWarn(fmt.Sprintf("router: found backend %+v which %s, skipping!", backend, reason))
+	rt.logger.Log(map[string]interface{}{"error": "skipped backend which " + reason, "backend": backend})
+}
+
+func (rt *Router) RouteStats() (stats map[string]interface{}) {
+	rt.lock.RLock()
+	mux := rt.mux.Load()
+	skipped := rt.skippedRoutes
+	loadedAt := rt.routesLoadedAt
+	rt.lock.RUnlock()
+
+	stats = make(map[string]interface{})
+	stats["count"] = mux.RouteCount()
+	stats["exact_count"], stats["prefix_count"] = mux.RouteCounts()
+	exactTrie, prefixTrie := mux.TrieStats()
+	stats["tries"] = map[string]trie.TrieStats{"exact": exactTrie, "prefix": prefixTrie}
+	stats["checksum"] = fmt.Sprintf("%x", mux.RouteChecksum())
+	stats["skipped"] = skipped
+	stats["integrity_failures"] = rt.integrityFailures.Load()
+	// Until a reload has succeeded there's no meaningful age, so report null
+	// rather than one measured from the zero time.
+	stats["routes_loaded_at"] = nil
+	stats["routes_age_seconds"] = nil
+	if !loadedAt.IsZero() {
+		stats["routes_loaded_at"] = loadedAt.UTC().Format(time.RFC3339Nano)
+		stats["routes_age_seconds"] = time.Since(loadedAt).Seconds()
+	}
+	return
+}
+
+// Health describes the state of the router for the verbose healthcheck:
+// whether it's ready to serve and whether it's in maintenance mode, the
+// number of routes, the outcome of the last reload and of the last load from
+// each route source, the number of requests being served and how long the
+// router has been running.
+func (rt *Router) Health() map[string]interface{} {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+
+	lastReload := map[string]interface{}(nil)
+	if !rt.lastReloadAt.IsZero() {
+		lastReload = map[string]interface{}{
+			"at": rt.lastReloadAt.UTC().Format(time.RFC3339Nano),
+			"ok": rt.lastReloadErr == nil,
+		}
+		if rt.lastReloadErr != nil {
+			lastReload["error"] = rt.lastReloadErr.Error()
+		}
+	}
+
+	// A source is only known to be reachable once it has been loaded from,
+	// so one which hasn't been tried yet isn't reported as ok.
+	sources := make(map[string]interface{}, len(rt.sources))
+	for _, s := range rt.sources {
+		status := map[string]interface{}{"ok": false}
+		if err, tried := rt.sourceErrors[s.name]; !tried {
+			status["error"] = "not loaded yet"
+		} else if err != nil {
+			status["error"] = err.Error()
+		} else {
+			status["ok"] = true
+		}
+		sources[s.name] = status
+	}
+
+	return map[string]interface{}{
+		"ready":              rt.ready.Load(),
+		"maintenance":        rt.InMaintenance(),
+		"route_count":        rt.mux.Load().RouteCount(),
+		"last_reload":        lastReload,
+		"sources":            sources,
+		"in_flight_requests": rt.inFlight.Load(),
+		"uptime_seconds":     time.Since(rt.startedAt).Seconds(),
+	}
+}
+
+// RouteChecksum returns the checksum of the currently loaded route table as
+// a hex string.
+func (rt *Router) RouteChecksum() string {
+	rt.lock.RLock()
+	mux := rt.mux.Load()
+	rt.lock.RUnlock()
+
+	return fmt.Sprintf("%x", mux.RouteChecksum())
+}
+
+// MatchRoute reports how the currently loaded route table would resolve the
+// passed path, without serving a request.
+func (rt *Router) MatchRoute(path string) triemux.Match {
+	rt.lock.RLock()
+	mux := rt.mux.Load()
+	rt.lock.RUnlock()
+
+	return mux.Match(path)
+}
+
+// CandidateRoutes returns every route in the currently loaded route table
+// which matches the passed path, in order of precedence.
+func (rt *Router) CandidateRoutes(path string) []triemux.RouteInfo {
+	return rt.mux.Load().Candidates(path)
+}
+
+// LookupRoute returns the route in the currently loaded route table with the
+// passed incoming path and route type, if there is one. The path is the
+// route's own, before any path prefix is added.
+func (rt *Router) LookupRoute(incomingPath string, prefix bool) (triemux.RouteInfo, bool) {
+	if rt.pathPrefix != "" {
+		incomingPath = rt.pathPrefix + strings.TrimRight(incomingPath, "/")
+	}
+	return rt.mux.Load().Route(incomingPath, prefix)
+}
+
+// Routes returns the routes in the currently loaded route table which can be
+// selected by a lookup, sorted by path.
+func (rt *Router) Routes() []triemux.RouteInfo {
+	return rt.mux.Load().Routes()
+}
+
+// CheckRouteIntegrity verifies that the routes in the loaded routing table's
+// tries are those which were registered in it, as a check for bugs which
+// corrupt them. A mismatch is logged and counted under integrity_failures
+// in the route stats.
+func (rt *Router) CheckRouteIntegrity() error {
+	mux := rt.mux.Load()
+	err := mux.VerifyTables()
+	if err != nil {
+		rt.integrityFailures.Add(1)
+		logWarn("router: route table integrity check failed:", err)
+		rt.logger.Log(map[string]interface{}{
+			"error":    "route table integrity check failed: " + err.Error(),
+			"checksum": fmt.Sprintf("%x", mux.RouteChecksum()),
+		})
+	}
+	return err
+}
+
+// CheckRouteIntegrityEvery calls CheckRouteIntegrity every interval until
+// the context is cancelled.
+func (rt *Router) CheckRouteIntegrityEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rt.CheckRouteIntegrity()
+		}
+	}
+}
+
+// RouteTable is the currently loaded routing table in the form the file
+// route source reads, so that it can be exported and loaded by another
+// router.
+type RouteTable struct {
+	Backends []Backend `json:"backends"`
+	Routes   []Route   `json:"routes"`
+}
+
+// ExportRoutes returns the routes in the currently loaded routing table,
+// with the backends which were loaded with them. Routes and backends which
+// were skipped aren't included, nor are routes which were replaced by a
+// later route for the same path.
+func (rt *Router) ExportRoutes() RouteTable {
+	rt.lock.RLock()
+	defined := make(map[string]Backend)
+	for _, s := range rt.sources {
+		for _, b := range s.backends {
+			defined[b.BackendId] = b
+		}
+	}
+	loaded := rt.backends
+	mux := rt.mux.Load()
+	rt.lock.RUnlock()
+
+	table := RouteTable{Backends: []Backend{}, Routes: []Route{}}
+	for backendId, backend := range defined {
+		if _, ok := loaded[backendId]; ok {
+			table.Backends = append(table.Backends, backend)
+		}
+	}
+	sort.Slice(table.Backends, func(i, j int) bool {
+		return table.Backends[i].BackendId < table.Backends[j].BackendId
+	})
+	for _, info := range mux.Routes() {
+		if route := routeDoc(info.Value); route != nil {
+			table.Routes = append(table.Routes, *route)
+		}
+	}
+	sort.Sort(routesByPathAndType(table.Routes))
+	return table
+}
+
+// ActiveBackends returns the IDs of the backends which the routes in the
+// currently loaded route table send requests to, sorted. As well as each
+// backend route's own backend, these include those its requests may be sent
+// to by bucket, region, hashing or content type, and its mirror backend.
+// Backends which are loaded but not used by any route aren't included.
+func (rt *Router) ActiveBackends() []string {
+	seen := make(map[string]bool)
+	for _, info := range rt.Routes() {
+		if route := routeDoc(info.Value); route != nil {
+			for _, backendId := range routeBackendIds(route) {
+				seen[backendId] = true
+			}
+		}
+	}
+
+	backends := make([]string, 0, len(seen))
+	for backendId := range seen {
+		backends = append(backends, backendId)
+	}
+	sort.Strings(backends)
+	return backends
+}
+
+// routeBackendIds returns the IDs of every backend a route may send
+// requests to, including those for buckets, regions, hashing, content types
+// and mirroring. Routes with other handlers use none.
+func routeBackendIds(route *Route) []string {
+	if route.Handler != "backend" {
+		return nil
+	}
+	ids := []string{route.BackendId}
+	for _, backendId := range route.BucketBackends {
+		ids = append(ids, backendId)
+	}
+	for _, backendId := range route.RegionBackends {
+		ids = append(ids, backendId)
+	}
+	ids = append(ids, route.HashBackends...)
+	for _, backendId := range route.ContentTypeBackends {
+		ids = append(ids, backendId)
+	}
+	if route.MirrorBackendId != "" {
+		ids = append(ids, route.MirrorBackendId)
+	}
+	return ids
+}
+
+func (rt *Router) CacheStats() map[string]interface{} {
+	return rt.responseCache.Stats()
+}
+
+// DNSCacheStats returns the statistics for the backend DNS cache, or nil if
+// DNS lookups aren't being cached.
+func (rt *Router) DNSCacheStats() map[string]interface{} {
+	if rt.dnsCache == nil {
+		return nil
+	}
+	return rt.dnsCache.Stats()
+}
+
+// ResetStats sets the counters reported by the stats methods back to zero:
+// the response and DNS cache hits and misses, the circuit breaker trips and
+// refused requests, and the scanners detected and blocked. Figures
+// describing the routing table, the contents of the caches or the state of
+// the circuits are left alone.
+func (rt *Router) ResetStats() {
+	rt.lock.RLock()
+	breakers := rt.circuitBreakers
+	rt.lock.RUnlock()
+
+	rt.responseCache.ResetStats()
+	if rt.dnsCache != nil {
+		rt.dnsCache.ResetStats()
+	}
+	if rt.scanDetector != nil {
+		rt.scanDetector.ResetStats()
+	}
+	for _, breaker := range breakers {
+		breaker.ResetStats()
+	}
+}
+
+// RecheckBackend probes the backend with the passed ID straight away, with a
+// GET request for the warm-up path, rather than waiting for client requests
+// to show whether it has failed or recovered. It's healthy if it responds
+// without a 5xx status. If the backend has a circuit breaker, its circuit is
+// closed or opened to match. The outcome is returned, along with the state
+// of the circuit.
+func (rt *Router) RecheckBackend(id string) (map[string]interface{}, error) {
+	rt.lock.RLock()
+	backend, ok := rt.backends[id]
+	breaker := rt.circuitBreakers[id]
+	rt.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownBackend, id)
+	}
+
+	status := handlers.Probe(backend, rt.warmupPath, rt.requestTimeout)
+	healthy := status != 0 && status < 500
+	result := map[string]interface{}{"backend_id": id, "healthy": healthy, "status": status}
+	if breaker != nil {
+		breaker.RecordHealthCheck(healthy)
+		result["circuit"] = breaker.Stats()
+	}
+	rt.logEvent("backend_rechecked", map[string]interface{}{"backend_id": id, "healthy": healthy, "status": status})
+	return result, nil
+}
+
+func (rt *Router) BackendStats() (stats map[string]interface{}) {
+	rt.lock.RLock()
+	skipped := rt.skippedBackends
+	breakers := rt.circuitBreakers
+	rt.lock.RUnlock()
+
+	circuits := make(map[string]interface{})
+	for id, breaker := range breakers {
+		circuits[id] = breaker.Stats()
+	}
+
+	stats = make(map[string]interface{})
+	stats["skipped"] = skipped
+	stats["circuits"] = circuits
 	return
 }
@@ -2,9 +2,20 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/alphagov/router/handlers"
+	"github.com/alphagov/router/triemux"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
+// maxMaintenanceBodyBytes is the largest maintenance page which can be set
+// through the API.
+const maxMaintenanceBodyBytes = 1 << 20
+
 func newApiHandler(rout *Router) http.Handler {
 	mux := http.NewServeMux()
 
@@ -15,7 +26,39 @@ func newApiHandler(rout *Router) http.Handler {
 			return
 		}
 
-		rout.ReloadRoutes()
+		var err error
+		if source := r.URL.Query().Get("source"); source != "" {
+			err = rout.ReloadSource(source)
+		} else {
+			err = rout.ReloadRoutes()
+		}
+		writeReloadError(w, err)
+	})
+	mux.HandleFunc("/reload/backends", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeReloadError(w, rout.ReloadBackends())
+	})
+	mux.HandleFunc("/reload/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		json_data, err := json.MarshalIndent(rout.ReloadStatus(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json_data)
+		w.Write([]byte("\n"))
 	})
 	mux.HandleFunc("/healthcheck", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
@@ -24,7 +67,58 @@ func newApiHandler(rout *Router) http.Handler {
 			return
 		}
 
-		w.Write([]byte("OK"))
+		if verbose, _ := strconv.ParseBool(r.URL.Query().Get("verbose")); !verbose {
+			w.Write([]byte("OK"))
+			return
+		}
+
+		json_data, err := json.MarshalIndent(rout.Health(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json_data)
+		w.Write([]byte("\n"))
+	})
+	mux.HandleFunc("/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch r.URL.Query().Get("state") {
+		case "on":
+			retryAfter := 0
+			if value := r.URL.Query().Get("retry_after"); value != "" {
+				var err error
+				if retryAfter, err = strconv.Atoi(value); err != nil || retryAfter < 0 {
+					http.Error(w, "retry_after must be a number of seconds", http.StatusBadRequest)
+					return
+				}
+			}
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMaintenanceBodyBytes))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			contentType := r.Header.Get("Content-Type")
+			if contentType == "" {
+				contentType = "text/html; charset=utf-8"
+			}
+			rout.StartMaintenance(contentType, string(body), retryAfter)
+		case "off":
+			rout.EndMaintenance()
+		default:
+			http.Error(w, "state must be on or off", http.StatusBadRequest)
+			return
+		}
+
+		json_data, _ := json.Marshal(map[string]bool{"maintenance": rout.InMaintenance()})
+		w.Write(json_data)
+		w.Write([]byte("\n"))
 	})
 	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
@@ -35,6 +129,14 @@ func newApiHandler(rout *Router) http.Handler {
 
 		stats := make(map[string]map[string]interface{})
 		stats["routes"] = rout.RouteStats()
+		stats["backends"] = rout.BackendStats()
+		stats["cache"] = rout.CacheStats()
+		if dnsStats := rout.DNSCacheStats(); dnsStats != nil {
+			stats["dns"] = dnsStats
+		}
+		if scanStats := rout.ScanStats(); scanStats != nil {
+			stats["scanners"] = scanStats
+		}
 
 		json_data, err := json.MarshalIndent(stats, "", "  ")
 		if err != nil {
@@ -45,6 +147,276 @@ func newApiHandler(rout *Router) http.Handler {
 		w.Write(json_data)
 		w.Write([]byte("\n"))
 	})
+	mux.HandleFunc("/stats/reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		rout.ResetStats()
+	})
+	mux.HandleFunc("/stats/checksum", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(rout.RouteChecksum()))
+		w.Write([]byte("\n"))
+	})
+	mux.HandleFunc("/routes", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		routes := make([]map[string]interface{}, 0)
+		for _, route := range rout.Routes() {
+			routes = append(routes, routeSummary(route))
+		}
+
+		json_data, err := json.MarshalIndent(routes, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		w.Write(json_data)
+		w.Write([]byte("\n"))
+	})
+	mux.HandleFunc("/routes/export", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		json_data, err := json.MarshalIndent(rout.ExportRoutes(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		w.Write(json_data)
+		w.Write([]byte("\n"))
+	})
+	mux.HandleFunc("/routes/lookup", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			http.Error(w, "missing path parameter", http.StatusBadRequest)
+			return
+		}
+		prefix, err := triemux.ParseRouteType(r.URL.Query().Get("type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		route, ok := rout.LookupRoute(path, prefix)
+		if !ok {
+			http.Error(w, "no route registered for "+path, http.StatusNotFound)
+			return
+		}
+		var result interface{} = routeSummary(route)
+		if doc := routeDoc(route.Value); doc != nil {
+			result = doc
+		}
+
+		json_data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(json_data)
+		w.Write([]byte("\n"))
+	})
+	mux.HandleFunc("/backends", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		json_data, err := json.MarshalIndent(rout.ActiveBackends(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		w.Write(json_data)
+		w.Write([]byte("\n"))
+	})
+	mux.HandleFunc("/backends/{id}/recheck", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		result, err := rout.RecheckBackend(r.PathValue("id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		json_data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		w.Write(json_data)
+		w.Write([]byte("\n"))
+	})
+	mux.HandleFunc("/debug/match", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			http.Error(w, "missing path parameter", http.StatusBadRequest)
+			return
+		}
+
+		match := rout.MatchRoute(path)
+		trace := map[string]interface{}{
+			"path":            match.Path,
+			"segments":        match.Segments,
+			"normalized_path": match.NormalizedPath,
+			"matched":         match.Route != nil,
+		}
+		if match.Route != nil {
+			trace["trie"] = match.Trie
+			trace["route"] = routeSummary(*match.Route)
+		}
+		candidates := make([]map[string]interface{}, 0)
+		for _, route := range rout.CandidateRoutes(path) {
+			candidates = append(candidates, routeSummary(route))
+		}
+		trace["candidates"] = candidates
+
+		json_data, err := json.MarshalIndent(trace, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		w.Write(json_data)
+		w.Write([]byte("\n"))
+	})
+
+	mux.HandleFunc("/debug/would-serve", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		path := r.URL.Query().Get("path")
+		if path == "" {
+			http.Error(w, "missing path parameter", http.StatusBadRequest)
+			return
+		}
+
+		// Only the route table is consulted: nothing is sent to the route's
+		// handler.
+		result := map[string]interface{}{"matched": false}
+		if route := rout.MatchRoute(path).Route; route != nil {
+			result["matched"] = true
+			result["route_type"] = "exact"
+			if route.Prefix {
+				result["route_type"] = "prefix"
+			}
+			if doc := routeDoc(route.Value); doc != nil {
+				result["handler"] = doc.Handler
+				if doc.Handler == "backend" {
+					result["backend_id"] = doc.BackendId
+				}
+			}
+		}
+
+		json_data, err := json.Marshal(result)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		w.Write(json_data)
+		w.Write([]byte("\n"))
+	})
 
 	return mux
 }
+
+// writeReloadError sends the response for a reload which failed with err,
+// or nothing if it succeeded.
+func writeReloadError(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrUnknownRouteSource):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrRouteSourceUnavailable):
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	case errors.Is(err, ErrRouteSourceTimeout):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	case errors.Is(err, ErrReloadDropped):
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, ErrRoutesNeedReload):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// routeSummary describes a route from the route table for the API, giving
+// its path, route type and any metadata.
+func routeSummary(route triemux.RouteInfo) map[string]interface{} {
+	routeType := "exact"
+	if route.Prefix {
+		routeType = "prefix"
+	}
+	summary := map[string]interface{}{"incoming_path": route.Path, "route_type": routeType}
+	if doc := routeDoc(route.Value); doc != nil && len(doc.Meta) > 0 {
+		summary["meta"] = doc.Meta
+	}
+	return summary
+}
+
+// withApiPrefix serves the API handler beneath prefix on the public listener,
+// for environments where a second port is inconvenient. Requests for the
+// prefix are dispatched before the route table is consulted, so no route can
+// shadow them, and they must carry the API's basic auth credentials.
+func withApiPrefix(public, api http.Handler, prefix, user, passHash string) (http.Handler, error) {
+	prefix = strings.TrimRight(prefix, "/")
+	if !strings.HasPrefix(prefix, "/") {
+		return nil, fmt.Errorf("API prefix %q must start with a / and not be the root", prefix)
+	}
+	if user == "" || passHash == "" {
+		return nil, errors.New("a user and password hash are required to serve the API on the public listener")
+	}
+
+	api = handlers.NewBasicAuthHandler("Router API", user, passHash, http.StripPrefix(prefix, api))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hasPathPrefix(r.URL.Path, prefix) {
+			api.ServeHTTP(w, r)
+			return
+		}
+		public.ServeHTTP(w, r)
+	}), nil
+}
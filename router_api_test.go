@@ -0,0 +1,663 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/alphagov/router/handlers"
+	"github.com/alphagov/router/logger"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestApiPrefixOnPublicListener(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET,POST", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "gone"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.ReservePrefix("/__router__")
+	rt.AddRouteSource("static", &staticRouteSource{routes: []Route{
+		{IncomingPath: "/", RouteType: "prefix", Handler: "gone"},
+		{IncomingPath: "/__router__/healthcheck", RouteType: "exact", Handler: "gone"},
+		{IncomingPath: "/__router__elsewhere", RouteType: "exact", Handler: "gone"},
+	}})
+	rt.ReloadRoutes()
+	if skipped := rt.RouteStats()["skipped"]; skipped != 1 {
+		t.Errorf("Expected the route beneath the reserved prefix to be skipped, got %v skipped", skipped)
+	}
+
+	sum := sha256.Sum256([]byte("s3cret"))
+	handler, err := withApiPrefix(publicHandler(rt, nil, nil), newApiHandler(rt), "/__router__/", "admin", hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatalf("Unexpected error adding the API prefix: %v", err)
+	}
+
+	examples := []struct {
+		method, path string
+		withAuth     bool
+		status       int
+	}{
+		{"GET", "/__router__/healthcheck", true, http.StatusOK},
+		{"GET", "/__router__/healthcheck", false, http.StatusUnauthorized},
+		{"POST", "/__router__/reload", true, http.StatusOK},
+		{"GET", "/__router__/stats", true, http.StatusOK},
+		{"GET", "/__router__elsewhere", false, http.StatusGone},
+		{"GET", "/healthcheck", false, http.StatusGone},
+		{"GET", "/some/page", false, http.StatusGone},
+	}
+	for _, ex := range examples {
+		r := httptest.NewRequest(ex.method, ex.path, nil)
+		if ex.withAuth {
+			r.SetBasicAuth("admin", "s3cret")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != ex.status {
+			t.Errorf("Expected %s %s (with credentials: %v) to get %d, got %d", ex.method, ex.path, ex.withAuth, ex.status, w.Code)
+		}
+	}
+}
+
+func TestApiPrefixRequiresCredentials(t *testing.T) {
+	examples := []struct {
+		prefix, user, hash string
+	}{
+		{"/__router__", "", ""},
+		{"/__router__", "admin", ""},
+		{"/", "admin", "abc"},
+		{"__router__", "admin", "abc"},
+	}
+	for _, ex := range examples {
+		if _, err := withApiPrefix(http.NotFoundHandler(), http.NotFoundHandler(), ex.prefix, ex.user, ex.hash); err == nil {
+			t.Errorf("Expected an error serving the API under %q with user %q and hash %q", ex.prefix, ex.user, ex.hash)
+		}
+	}
+}
+
+func TestApiReloadErrors(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "gone"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{err: errors.New("connection refused")})
+	api := newApiHandler(rt)
+
+	examples := []struct {
+		path   string
+		status int
+	}{
+		{"/reload", http.StatusBadGateway},
+		{"/reload?source=static", http.StatusBadGateway},
+		{"/reload?source=missing", http.StatusNotFound},
+	}
+	for _, ex := range examples {
+		rw := httptest.NewRecorder()
+		api.ServeHTTP(rw, httptest.NewRequest("POST", ex.path, nil))
+		if rw.Code != ex.status {
+			t.Errorf("POST %s: expected status %d, got %d", ex.path, ex.status, rw.Code)
+		}
+		if ex.status == http.StatusBadGateway && !strings.Contains(rw.Body.String(), "connection refused") {
+			t.Errorf("POST %s: expected the error in the response, got %q", ex.path, rw.Body.String())
+		}
+	}
+}
+
+func TestApiReloadStatus(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "gone"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{routes: goneRoutes(1)})
+	rt.ReloadRoutes()
+
+	rw := httptest.NewRecorder()
+	newApiHandler(rt).ServeHTTP(rw, httptest.NewRequest("GET", "/reload/status", nil))
+	var status map[string]interface{}
+	if err := json.Unmarshal(rw.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Couldn't parse /reload/status: %v", err)
+	}
+	if status["running"] != nil || status["max_queued"] != 1.0 || status["dropped"] != 0.0 {
+		t.Errorf("Unexpected reload status %v", status)
+	}
+}
+
+func TestApiReloadBackends(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	source := &staticRouteSource{
+		backends: []Backend{{BackendId: "app", BackendURL: "http://app.internal"}},
+		routes:   []Route{{IncomingPath: "/app", RouteType: "prefix", Handler: "backend", BackendId: "app"}},
+	}
+	rt.AddRouteSource("static", source)
+	rt.ReloadRoutes()
+	api := newApiHandler(rt)
+
+	examples := []struct {
+		method   string
+		backends []Backend
+		status   int
+	}{
+		{"GET", source.backends, http.StatusMethodNotAllowed},
+		{"POST", []Backend{{BackendId: "app", BackendURL: "http://moved.internal"}}, http.StatusOK},
+		{"POST", nil, http.StatusConflict},
+	}
+	for _, ex := range examples {
+		source.backends = ex.backends
+		rw := httptest.NewRecorder()
+		api.ServeHTTP(rw, httptest.NewRequest(ex.method, "/reload/backends", nil))
+		if rw.Code != ex.status {
+			t.Errorf("%s /reload/backends: expected %d, got %d %q", ex.method, ex.status, rw.Code, rw.Body.String())
+		}
+	}
+}
+
+func TestApiLookupRoute(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{{BackendId: "frontend", BackendURL: "http://frontend.internal"}},
+		routes: []Route{
+			{IncomingPath: "/foo", RouteType: "exact", Handler: "backend", BackendId: "frontend", Meta: map[string]string{"team": "publishing"}},
+			{IncomingPath: "/foo", RouteType: "prefix", Handler: "redirect", RedirectTo: "/bar", RedirectType: "permanent"},
+			{IncomingPath: "/gone", RouteType: "prefix", Handler: "gone"},
+		},
+	})
+	rt.ReloadRoutes()
+	api := newApiHandler(rt)
+
+	lookup := func(query string) (*httptest.ResponseRecorder, Route) {
+		rw := httptest.NewRecorder()
+		api.ServeHTTP(rw, httptest.NewRequest("GET", "/routes/lookup?"+query, nil))
+		var route Route
+		if rw.Code == http.StatusOK {
+			if err := json.Unmarshal(rw.Body.Bytes(), &route); err != nil {
+				t.Fatalf("Couldn't parse /routes/lookup?%s: %v", query, err)
+			}
+		}
+		return rw, route
+	}
+
+	rw, route := lookup("path=/foo&type=exact")
+	if rw.Code != http.StatusOK || route.Handler != "backend" || route.BackendId != "frontend" || route.Meta["team"] != "publishing" {
+		t.Errorf("Expected the exact /foo route, got %d %q", rw.Code, rw.Body.String())
+	}
+	rw, route = lookup("path=/foo&type=prefix")
+	if rw.Code != http.StatusOK || route.Handler != "redirect" || route.RedirectTo != "/bar" || route.RouteType != "prefix" {
+		t.Errorf("Expected the prefix /foo route, got %d %q", rw.Code, rw.Body.String())
+	}
+	if rw, _ = lookup("path=/foo"); rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), `"backend_id": "frontend"`) {
+		t.Errorf("Expected the type to default to exact, got %d %q", rw.Code, rw.Body.String())
+	}
+
+	// Only registered routes are found, not routes which would match.
+	examples := []struct {
+		query  string
+		status int
+	}{
+		{"path=/gone/foo&type=prefix", http.StatusNotFound},
+		{"path=/gone&type=exact", http.StatusNotFound},
+		{"path=/missing", http.StatusNotFound},
+		{"path=/foo&type=suffix", http.StatusBadRequest},
+		{"type=exact", http.StatusBadRequest},
+	}
+	for _, ex := range examples {
+		if rw, _ := lookup(ex.query); rw.Code != ex.status {
+			t.Errorf("Expected /routes/lookup?%s to get %d, got %d", ex.query, ex.status, rw.Code)
+		}
+	}
+}
+
+func TestRouteMeta(t *testing.T) {
+	routesJSON := `{"routes": [
+		{"incoming_path": "/tagged", "route_type": "prefix", "handler": "gone", "meta": {"team": "publishing", "ticket": "OPS-123"}},
+		{"incoming_path": "/untagged", "route_type": "exact", "handler": "gone"}
+	]}`
+	path := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(path, []byte(routesJSON), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "gone"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("file", NewFileRouteSource(path))
+	if err := rt.ReloadRoutes(); err != nil {
+		t.Fatalf("Unexpected error loading routes: %v", err)
+	}
+	api := newApiHandler(rt)
+
+	get := func(path string) string {
+		rw := httptest.NewRecorder()
+		api.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("GET %s: expected a 200, got %d", path, rw.Code)
+		}
+		return rw.Body.String()
+	}
+	var match struct {
+		Route struct {
+			Meta map[string]string `json:"meta"`
+		} `json:"route"`
+	}
+	if err := json.Unmarshal([]byte(get("/debug/match?path=/tagged/page")), &match); err != nil {
+		t.Fatal(err)
+	}
+	if match.Route.Meta["team"] != "publishing" || match.Route.Meta["ticket"] != "OPS-123" {
+		t.Errorf("Expected the match trace to include the route's metadata, got %v", match.Route.Meta)
+	}
+
+	var routes []struct {
+		IncomingPath string            `json:"incoming_path"`
+		Meta         map[string]string `json:"meta"`
+	}
+	if err := json.Unmarshal([]byte(get("/routes")), &routes); err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 || routes[0].IncomingPath != "/tagged" || routes[0].Meta["team"] != "publishing" || routes[1].Meta != nil {
+		t.Errorf("Expected the route listing to include the metadata of tagged routes only, got %+v", routes)
+	}
+
+	var buf bytes.Buffer
+	l, _ := logger.New(&buf)
+	handlers.NewAccessLogHandler(rt, l, handlers.AccessLogSample{}, 0, nil).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/tagged/page", nil))
+	l.Flush()
+	if !strings.Contains(buf.String(), `"route_meta":{"team":"publishing","ticket":"OPS-123"}`) {
+		t.Errorf("Expected the access log entry to include the route's metadata, got %q", buf.String())
+	}
+}
+
+func TestApiWouldServe(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Expected nothing to be sent to the backend, got a request for %s", r.URL.Path)
+	}))
+	defer backend.Close()
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,gone"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{{BackendId: "frontend", BackendURL: backend.URL}},
+		routes: []Route{
+			{IncomingPath: "/government", RouteType: "prefix", Handler: "backend", BackendId: "frontend"},
+			{IncomingPath: "/old", RouteType: "exact", Handler: "gone"},
+		},
+	})
+	rt.ReloadRoutes()
+	api := newApiHandler(rt)
+
+	examples := []struct {
+		path, expected string
+	}{
+		{"/government/publications", `{"backend_id":"frontend","handler":"backend","matched":true,"route_type":"prefix"}`},
+		{"/old", `{"handler":"gone","matched":true,"route_type":"exact"}`},
+		{"/old/page", `{"matched":false}`},
+	}
+	for _, ex := range examples {
+		rw := httptest.NewRecorder()
+		api.ServeHTTP(rw, httptest.NewRequest("GET", "/debug/would-serve?path="+ex.path, nil))
+		if rw.Code != http.StatusOK || strings.TrimSpace(rw.Body.String()) != ex.expected {
+			t.Errorf("%s: expected 200 %s, got %d %s", ex.path, ex.expected, rw.Code, rw.Body.String())
+		}
+	}
+
+	rw := httptest.NewRecorder()
+	api.ServeHTTP(rw, httptest.NewRequest("GET", "/debug/would-serve", nil))
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected a request without a path to get a 400, got %d", rw.Code)
+	}
+}
+
+func TestApiVerboseHealthcheck(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "gone"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	source := &staticRouteSource{routes: goneRoutes(3)}
+	rt.AddRouteSource("mongo", source)
+	api := newApiHandler(rt)
+
+	type health struct {
+		Ready      bool `json:"ready"`
+		RouteCount int  `json:"route_count"`
+		LastReload *struct {
+			At    string `json:"at"`
+			OK    bool   `json:"ok"`
+			Error string `json:"error"`
+		} `json:"last_reload"`
+		Sources map[string]struct {
+			OK    bool   `json:"ok"`
+			Error string `json:"error"`
+		} `json:"sources"`
+		InFlightRequests *int     `json:"in_flight_requests"`
+		UptimeSeconds    *float64 `json:"uptime_seconds"`
+	}
+	check := func() health {
+		rw := httptest.NewRecorder()
+		api.ServeHTTP(rw, httptest.NewRequest("GET", "/healthcheck?verbose=true", nil))
+		if rw.Code != http.StatusOK || rw.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("Expected a 200 with JSON, got %d (%q)", rw.Code, rw.Header().Get("Content-Type"))
+		}
+		var h health
+		if err := json.Unmarshal(rw.Body.Bytes(), &h); err != nil {
+			t.Fatalf("Expected valid JSON, got %q: %v", rw.Body.String(), err)
+		}
+		if h.InFlightRequests == nil || h.UptimeSeconds == nil {
+			t.Errorf("Expected the in-flight request count and uptime, got %q", rw.Body.String())
+		}
+		return h
+	}
+
+	h := check()
+	if h.Ready || h.RouteCount != 0 || h.LastReload != nil || h.Sources["mongo"].OK || h.Sources["mongo"].Error != "not loaded yet" {
+		t.Errorf("Expected nothing to have been loaded yet, got %+v", h)
+	}
+
+	rt.ReloadRoutes()
+	h = check()
+	if !h.Ready || h.RouteCount != 3 || h.LastReload == nil || !h.LastReload.OK || h.LastReload.At == "" || !h.Sources["mongo"].OK {
+		t.Errorf("Expected the successful reload to be reported, got %+v", h)
+	}
+
+	source.err = errors.New("connection refused")
+	rt.ReloadRoutes()
+	h = check()
+	if !h.Ready || h.RouteCount != 3 || h.LastReload.OK || !strings.Contains(h.LastReload.Error, "connection refused") ||
+		h.Sources["mongo"].OK || !strings.Contains(h.Sources["mongo"].Error, "connection refused") {
+		t.Errorf("Expected the failed reload to be reported, with the old routes still in use, got %+v", h)
+	}
+
+	for _, path := range []string{"/healthcheck", "/healthcheck?verbose=false"} {
+		rw := httptest.NewRecorder()
+		api.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		if rw.Code != http.StatusOK || rw.Body.String() != "OK" {
+			t.Errorf("GET %s: expected a plain OK, got %d %q", path, rw.Code, rw.Body.String())
+		}
+	}
+}
+
+func TestApiRecheckBackend(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusInternalServerError)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer backend.Close()
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{{BackendId: "frontend", BackendURL: backend.URL, CircuitBreakerFailures: 1, CircuitBreakerCooldownMs: 60000}},
+		routes:   []Route{{IncomingPath: "/", RouteType: "prefix", Handler: "backend", BackendId: "frontend"}},
+	})
+	if err := rt.ReloadRoutes(); err != nil {
+		t.Fatalf("Unexpected error loading routes: %v", err)
+	}
+	api := newApiHandler(rt)
+
+	serve := func() int {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest("GET", "/foo", nil))
+		return rw.Code
+	}
+	type recheck struct {
+		BackendId string `json:"backend_id"`
+		Healthy   bool   `json:"healthy"`
+		Status    int    `json:"status"`
+		Circuit   struct {
+			State string `json:"state"`
+		} `json:"circuit"`
+	}
+	recheckBackend := func(id string) (int, recheck) {
+		rw := httptest.NewRecorder()
+		api.ServeHTTP(rw, httptest.NewRequest("POST", "/backends/"+id+"/recheck", nil))
+		var r recheck
+		if rw.Code == http.StatusOK {
+			if err := json.Unmarshal(rw.Body.Bytes(), &r); err != nil {
+				t.Fatalf("Expected valid JSON, got %q: %v", rw.Body.String(), err)
+			}
+		}
+		return rw.Code, r
+	}
+
+	if code := serve(); code != http.StatusInternalServerError {
+		t.Fatalf("Expected the backend's failure to be passed on, got %d", code)
+	}
+	if code := serve(); code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected the circuit to have opened, got %d", code)
+	}
+
+	code, r := recheckBackend("frontend")
+	if code != http.StatusOK || r.BackendId != "frontend" || r.Healthy || r.Status != 500 || r.Circuit.State != "open" {
+		t.Errorf("Expected an unhealthy recheck to leave the circuit open, got %d %+v", code, r)
+	}
+	if code := serve(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the circuit to stay open after an unhealthy recheck, got %d", code)
+	}
+
+	status.Store(http.StatusOK)
+	code, r = recheckBackend("frontend")
+	if code != http.StatusOK || !r.Healthy || r.Status != 200 || r.Circuit.State != "closed" {
+		t.Errorf("Expected a healthy recheck to close the circuit, got %d %+v", code, r)
+	}
+	if code := serve(); code != http.StatusOK {
+		t.Errorf("Expected requests to reach the backend after a healthy recheck, got %d", code)
+	}
+
+	if code, _ := recheckBackend("unknown"); code != http.StatusNotFound {
+		t.Errorf("Expected a 404 for an unknown backend, got %d", code)
+	}
+}
+
+func TestApiActiveBackends(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,gone"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	backends := []Backend{
+		{BackendId: "frontend", BackendURL: "http://frontend.example.com"},
+		{BackendId: "search", BackendURL: "http://search.example.com"},
+		{BackendId: "search-b", BackendURL: "http://search-b.example.com"},
+		{BackendId: "shadow", BackendURL: "http://shadow.example.com"},
+		{BackendId: "unused", BackendURL: "http://unused.example.com"},
+	}
+	source := &staticRouteSource{backends: backends, routes: []Route{
+		{IncomingPath: "/", RouteType: "prefix", Handler: "backend", BackendId: "frontend", MirrorBackendId: "shadow"},
+		{IncomingPath: "/search", RouteType: "prefix", Handler: "backend", BackendId: "search",
+			BucketCookie: "ab", BucketBackends: map[string]string{"B": "search-b"}},
+		{IncomingPath: "/gone", RouteType: "exact", Handler: "gone"},
+	}}
+	rt.AddRouteSource("static", source)
+	rt.ReloadRoutes()
+	api := newApiHandler(rt)
+
+	get := func() string {
+		rw := httptest.NewRecorder()
+		api.ServeHTTP(rw, httptest.NewRequest("GET", "/backends", nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("Expected a 200, got %d", rw.Code)
+		}
+		var active []string
+		if err := json.Unmarshal(rw.Body.Bytes(), &active); err != nil {
+			t.Fatalf("Expected a JSON list, got %q: %v", rw.Body.String(), err)
+		}
+		return strings.Join(active, ",")
+	}
+	if active := get(); active != "frontend,search,search-b,shadow" {
+		t.Errorf("Expected the backends used by the loaded routes, got %s", active)
+	}
+
+	source.routes = source.routes[:1]
+	rt.ReloadRoutes()
+	if active := get(); active != "frontend,shadow" {
+		t.Errorf("Expected the search backends to be dropped once no route uses them, got %s", active)
+	}
+}
+
+func TestApiExportRoutes(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,gone,redirect"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{
+			{BackendId: "frontend", BackendURL: "http://frontend.example.com", HeaderTimeoutMs: 500},
+			{BackendId: "broken", BackendURL: "http://broken.example.com", OverrideHost: "a", PreserveHost: true},
+		},
+		routes: []Route{
+			{IncomingPath: "/", RouteType: "prefix", Handler: "backend", BackendId: "frontend", Meta: map[string]string{"team": "web"}},
+			{IncomingPath: "/broken", RouteType: "prefix", Handler: "backend", BackendId: "broken"},
+			{IncomingPath: "/gone", RouteType: "exact", Handler: "gone"},
+			{IncomingPath: "/old", RouteType: "exact", Handler: "redirect", RedirectTo: "/new", RedirectType: "permanent"},
+		},
+	})
+	rt.ReloadRoutes()
+
+	rw := httptest.NewRecorder()
+	newApiHandler(rt).ServeHTTP(rw, httptest.NewRequest("GET", "/routes/export", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected a 200, got %d", rw.Code)
+	}
+	backends, routes, err := parseRoutesJSON(rw.Body.Bytes())
+	if err != nil {
+		t.Fatalf("Expected the export to be readable by the file route source, got %q: %v", rw.Body.String(), err)
+	}
+
+	expectedBackends := []Backend{{BackendId: "frontend", BackendURL: "http://frontend.example.com", HeaderTimeoutMs: 500}}
+	if !reflect.DeepEqual(backends, expectedBackends) {
+		t.Errorf("Expected only the loaded backends to be exported, got %+v", backends)
+	}
+	var paths []string
+	for _, route := range routes {
+		paths = append(paths, route.IncomingPath)
+	}
+	if strings.Join(paths, ",") != "/,/gone,/old" {
+		t.Errorf("Expected only the loaded routes to be exported, got %v", paths)
+	}
+
+	// A router loading the export serves the same routes.
+	copied, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,gone,redirect"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	copied.AddRouteSource("export", &staticRouteSource{backends: backends, routes: routes})
+	copied.ReloadRoutes()
+	if copied.RouteChecksum() != rt.RouteChecksum() {
+		t.Errorf("Expected the exported routes to give the same checksum, got %s and %s", copied.RouteChecksum(), rt.RouteChecksum())
+	}
+	if exported := copied.ExportRoutes(); !reflect.DeepEqual(exported, RouteTable{backends, routes}) {
+		t.Errorf("Expected exporting the copy to give the same routes, got %+v", exported)
+	}
+}
+
+func TestApiMaintenance(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "gone,ping"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{routes: []Route{
+		{IncomingPath: "/foo", RouteType: "prefix", Handler: "gone"},
+		{IncomingPath: "/ping", RouteType: "exact", Handler: "ping"},
+	}})
+	rt.ReloadRoutes()
+	api := newApiHandler(rt)
+
+	serve := func(handler http.Handler, method, path string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "text/html")
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	if rw := serve(api, "POST", "/maintenance?state=on&retry_after=120", "<h1>Back soon</h1>"); rw.Code != http.StatusOK || strings.TrimSpace(rw.Body.String()) != `{"maintenance":true}` {
+		t.Fatalf("Expected maintenance mode to start, got %d %q", rw.Code, rw.Body.String())
+	}
+	rt.ReloadRoutes()
+	for _, path := range []string{"/foo", "/missing"} {
+		rw := serve(rt, "GET", path, "")
+		if rw.Code != http.StatusServiceUnavailable || rw.Body.String() != "<h1>Back soon</h1>" ||
+			rw.Header().Get("Content-Type") != "text/html" || rw.Header().Get("Retry-After") != "120" {
+			t.Errorf("Expected %s to get the maintenance page, got %d %q %v", path, rw.Code, rw.Body.String(), rw.Header())
+		}
+	}
+	if rw := serve(rt, "GET", "/ping", ""); rw.Code != http.StatusOK {
+		t.Errorf("Expected ping routes to be served during maintenance, got %d", rw.Code)
+	}
+	if rw := serve(api, "GET", "/healthcheck", ""); rw.Code != http.StatusOK || rw.Body.String() != "OK" {
+		t.Errorf("Expected the healthcheck to be unaffected by maintenance, got %d %q", rw.Code, rw.Body.String())
+	}
+	if rw := serve(api, "GET", "/healthcheck?verbose=true", ""); !strings.Contains(rw.Body.String(), `"maintenance": true`) {
+		t.Errorf("Expected the verbose healthcheck to report maintenance, got %q", rw.Body.String())
+	}
+
+	if rw := serve(api, "POST", "/maintenance?state=off", ""); rw.Code != http.StatusOK || strings.TrimSpace(rw.Body.String()) != `{"maintenance":false}` {
+		t.Fatalf("Expected maintenance mode to end, got %d %q", rw.Code, rw.Body.String())
+	}
+	if rw := serve(rt, "GET", "/foo", ""); rw.Code != http.StatusGone {
+		t.Errorf("Expected routes to be served again after maintenance, got %d", rw.Code)
+	}
+
+	serve(api, "POST", "/maintenance?state=on", "")
+	if rw := serve(rt, "GET", "/foo", ""); rw.Code != http.StatusServiceUnavailable || rw.Body.String() != defaultMaintenanceBody || rw.Header().Get("Retry-After") != "" {
+		t.Errorf("Expected the default maintenance page without a Retry-After, got %d %q %v", rw.Code, rw.Body.String(), rw.Header())
+	}
+
+	for _, path := range []string{"/maintenance", "/maintenance?state=maybe", "/maintenance?state=on&retry_after=soon"} {
+		if rw := serve(api, "POST", path, ""); rw.Code != http.StatusBadRequest {
+			t.Errorf("POST %s: expected a 400, got %d", path, rw.Code)
+		}
+	}
+	if rw := serve(api, "GET", "/maintenance", ""); rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected GET to be refused, got %d", rw.Code)
+	}
+}
+
+func TestApiMatchCandidates(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "gone"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{routes: []Route{
+		{IncomingPath: "/", RouteType: "prefix", Handler: "gone"},
+		{IncomingPath: "/government", RouteType: "prefix", Handler: "gone"},
+		{IncomingPath: "/government/publications", RouteType: "exact", Handler: "gone"},
+		{IncomingPath: "/government/other", RouteType: "exact", Handler: "gone"},
+	}})
+	rt.ReloadRoutes()
+
+	rw := httptest.NewRecorder()
+	newApiHandler(rt).ServeHTTP(rw, httptest.NewRequest("GET", "/debug/match?path=/government/publications", nil))
+	var match struct {
+		Candidates []struct {
+			IncomingPath string `json:"incoming_path"`
+			RouteType    string `json:"route_type"`
+		} `json:"candidates"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &match); err != nil {
+		t.Fatalf("Expected valid JSON, got %q: %v", rw.Body.String(), err)
+	}
+	candidates := make([]string, 0)
+	for _, c := range match.Candidates {
+		candidates = append(candidates, c.IncomingPath+" "+c.RouteType)
+	}
+	if got := strings.Join(candidates, ", "); got != "/government/publications exact, /government prefix, / prefix" {
+		t.Errorf("Expected every matching route in order of precedence, got %s", got)
+	}
+}
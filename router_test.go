@@ -0,0 +1,2379 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/alphagov/router/handlers"
+	"github.com/alphagov/router/logger"
+	"github.com/alphagov/router/triemux"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestRouter returns a Router with a 100ms request timeout, which serves
+// every request with the passed handler.
+func newTestRouter(t *testing.T, handler http.Handler) *Router {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "100ms", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone,filesystem,boom"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	mux := triemux.NewMux()
+	mux.Handle("/", true, handler)
+	rt.mux.Store(mux)
+	rt.ready.Store(true)
+	return rt
+}
+
+func TestRequestTimeoutBeforeResponse(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	examples := map[string]http.HandlerFunc{
+		"watching the context": func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+			w.WriteHeader(http.StatusBadGateway)
+		},
+		"ignoring the context": func(w http.ResponseWriter, r *http.Request) {
+			<-release
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	for name, handler := range examples {
+		rt := newTestRouter(t, handler)
+
+		w := httptest.NewRecorder()
+		start := time.Now()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		if w.Code != http.StatusGatewayTimeout {
+			t.Errorf("With a handler %s, expected status %d, got %d", name, http.StatusGatewayTimeout, w.Code)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("With a handler %s, expected the request to be cut off after 100ms, took %v", name, elapsed)
+		}
+	}
+}
+
+func TestRequestTimeoutDuringResponse(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	rt := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("x"))
+		w.(http.Flusher).Flush()
+		// Sleeps without watching the request's context.
+		<-release
+	}))
+	var buf bytes.Buffer
+	rt.logger, _ = logger.New(&buf)
+	server := httptest.NewServer(rt)
+	defer server.Close()
+
+	start := time.Now()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error making request: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the status already sent (%d) to be kept, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if string(body) != "x" {
+		t.Errorf("Expected the body already flushed to be kept, got %q", body)
+	}
+	if err == nil {
+		t.Error("Expected the response to be cut short")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the request to be cut off after 100ms, took %v", elapsed)
+	}
+	rt.logger.Flush()
+	if !strings.Contains(buf.String(), "request timed out after 100ms") {
+		t.Errorf("Expected the timeout to be logged, got %q", buf.String())
+	}
+}
+
+func TestBoomRoutesAreGated(t *testing.T) {
+	source := &staticRouteSource{routes: []Route{{IncomingPath: "/boom", RouteType: "exact", Handler: "boom"}}}
+
+	for _, enabled := range []bool{false, true} {
+		rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone,filesystem,boom", EnableBoom: enabled})
+		if err != nil {
+			t.Fatalf("Unexpected error creating router: %v", err)
+		}
+		rt.AddRouteSource("static", source)
+		rt.ReloadRoutes()
+
+		expectedCount, expectedSkipped := 0, 1
+		if enabled {
+			expectedCount, expectedSkipped = 1, 0
+		}
+		if count := rt.mux.Load().RouteCount(); count != expectedCount {
+			t.Errorf("With boom enabled=%v, expected %d routes loaded, got %d", enabled, expectedCount, count)
+		}
+		if skipped := rt.RouteStats()["skipped"]; skipped != expectedSkipped {
+			t.Errorf("With boom enabled=%v, expected %d routes skipped, got %v", enabled, expectedSkipped, skipped)
+		}
+	}
+}
+
+func TestCheckRouteIntegrity(t *testing.T) {
+	rt := newTestRouter(t, http.NotFoundHandler())
+	if err := rt.CheckRouteIntegrity(); err != nil {
+		t.Errorf("Expected the loaded routes to pass the integrity check, got %v", err)
+	}
+
+	mux := rt.mux.Load().Clone()
+	mux.Handle("/foo", false, http.NotFoundHandler())
+	rt.mux.Store(mux)
+	if err := rt.CheckRouteIntegrity(); err != nil {
+		t.Errorf("Expected routes added through the mux to pass the integrity check, got %v", err)
+	}
+	if failures := rt.RouteStats()["integrity_failures"]; failures != int64(0) {
+		t.Errorf("Expected no integrity failures, got %v", failures)
+	}
+}
+
+func TestEmptyIncomingPaths(t *testing.T) {
+	source := &staticRouteSource{routes: []Route{
+		{IncomingPath: "", RouteType: "prefix", Handler: "gone"},
+		{IncomingPath: "  \t", RouteType: "prefix", Handler: "gone"},
+		{IncomingPath: "/valid", RouteType: "exact", Handler: "gone"},
+	}}
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "gone"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", source)
+	if err := rt.ReloadRoutes(); err != nil {
+		t.Fatalf("Unexpected error reloading routes: %v", err)
+	}
+
+	if skipped := rt.RouteStats()["skipped"]; skipped != 2 {
+		t.Errorf("Expected the routes with empty incoming paths to be skipped, got %v skipped", skipped)
+	}
+	for path, expected := range map[string]int{"/": http.StatusNotFound, "/foo": http.StatusNotFound, "/valid": http.StatusGone} {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != expected {
+			t.Errorf("Expected %s to get %d, got %d", path, expected, w.Code)
+		}
+	}
+}
+
+func TestEmptyIncomingPathsFailStrictReloads(t *testing.T) {
+	source := &staticRouteSource{routes: []Route{{IncomingPath: "/valid", RouteType: "exact", Handler: "gone"}}}
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "gone"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.FailReloadOnEmptyIncomingPaths()
+	rt.AddRouteSource("static", source)
+	if err := rt.ReloadRoutes(); err != nil {
+		t.Fatalf("Unexpected error reloading routes: %v", err)
+	}
+
+	for _, path := range []string{"", " "} {
+		source.routes = []Route{
+			{IncomingPath: "/other", RouteType: "exact", Handler: "gone"},
+			{IncomingPath: path, RouteType: "prefix", Handler: "gone"},
+		}
+		if err := rt.ReloadRoutes(); !errors.Is(err, ErrInvalidRouteData) {
+			t.Errorf("Expected an incoming path of %q to fail the reload as invalid, got %v", path, err)
+		}
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", "/valid", nil))
+		if w.Code != http.StatusGone {
+			t.Errorf("Expected the original routes to be kept after an incoming path of %q, got %d for /valid", path, w.Code)
+		}
+	}
+}
+
+func TestChaosRoutesAreGated(t *testing.T) {
+	source := &staticRouteSource{routes: []Route{
+		{IncomingPath: "/chaos", RouteType: "exact", Handler: "gone", ChaosErrorChance: 1},
+		{IncomingPath: "/calm", RouteType: "exact", Handler: "gone"},
+		{IncomingPath: "/invalid", RouteType: "exact", Handler: "gone", ChaosErrorChance: 1.5},
+	}}
+
+	for _, enabled := range []bool{false, true} {
+		rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "gone", EnableChaos: enabled})
+		if err != nil {
+			t.Fatalf("Unexpected error creating router: %v", err)
+		}
+		rt.AddRouteSource("static", source)
+		rt.ReloadRoutes()
+
+		chaosStatus := http.StatusGone
+		if enabled {
+			chaosStatus = http.StatusInternalServerError
+		}
+		examples := []struct {
+			path   string
+			status int
+		}{
+			{"/chaos", chaosStatus},
+			{"/calm", http.StatusGone},
+			{"/invalid", http.StatusNotFound},
+		}
+		for _, ex := range examples {
+			w := httptest.NewRecorder()
+			rt.ServeHTTP(w, httptest.NewRequest("GET", ex.path, nil))
+			if w.Code != ex.status {
+				t.Errorf("With chaos enabled=%v, expected %s to get %d, got %d", enabled, ex.path, ex.status, w.Code)
+			}
+		}
+	}
+}
+
+func TestPanicsLogMatchedRoute(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone,filesystem,boom", EnableBoom: true})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{routes: []Route{{IncomingPath: "/boom", RouteType: "exact", Handler: "boom"}}})
+	rt.ReloadRoutes()
+
+	// No backend handler panics on its own, so register one which does
+	// alongside the loaded boom route.
+	rt.mux.Load().Handle("/app", true, withMatchedRoute(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("backend handler failed")
+	}), &Route{IncomingPath: "/app", RouteType: "prefix", Handler: "backend", BackendId: "app"}))
+
+	examples := []struct {
+		path     string
+		expected []string
+	}{
+		{"/boom", []string{`"route":"/boom"`, `"route_type":"exact"`, `"handler":"boom"`, `"error":"panic: Boom!!!"`}},
+		{"/app/page", []string{`"route":"/app"`, `"route_type":"prefix"`, `"handler":"backend"`, `"backend_id":"app"`}},
+	}
+	for _, ex := range examples {
+		var buf bytes.Buffer
+		rt.logger, _ = logger.New(&buf)
+
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", ex.path, nil))
+		rt.logger.Flush()
+
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("Expected %s to get a 500, got %d", ex.path, w.Code)
+		}
+		for _, field := range ex.expected {
+			if !strings.Contains(buf.String(), field) {
+				t.Errorf("Expected the log entry for %s to contain %s, got %q", ex.path, field, buf.String())
+			}
+		}
+	}
+}
+
+func TestNewRouterRequiresAllowedMethods(t *testing.T) {
+	for _, methods := range []string{"", " , ,"} {
+		if _, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: methods, ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone,filesystem,boom"}); err == nil {
+			t.Errorf("Expected an error creating a router allowing methods %q", methods)
+		}
+	}
+}
+
+func TestNotFoundResponse(t *testing.T) {
+	examples := []struct {
+		status, contentType, body string
+		expectedStatus            int
+		expectedContentType       string
+		expectedBody              string
+	}{
+		{"404", "text/plain; charset=utf-8", "", 404, "text/plain; charset=utf-8", "404 page not found\n"},
+		{"404", "application/json", `{"error":"not_found"}`, 404, "application/json", `{"error":"not_found"}`},
+		{"410", "text/plain; charset=utf-8", "", 410, "text/plain; charset=utf-8", "Gone\n"},
+	}
+
+	for _, ex := range examples {
+		rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: ex.status, NotFoundContentType: ex.contentType, NotFoundBody: ex.body, AllowedHandlers: "backend,redirect,gone,filesystem,boom"})
+		if err != nil {
+			t.Fatalf("Unexpected error creating router: %v", err)
+		}
+		rt.AddRouteSource("static", &staticRouteSource{routes: goneRoutes(1)})
+		rt.ReloadRoutes()
+
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", "/unmatched", nil))
+
+		if w.Code != ex.expectedStatus {
+			t.Errorf("Expected status %d, got %d", ex.expectedStatus, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != ex.expectedContentType {
+			t.Errorf("Expected Content-Type %q, got %q", ex.expectedContentType, ct)
+		}
+		if body := w.Body.String(); body != ex.expectedBody {
+			t.Errorf("Expected body %q, got %q", ex.expectedBody, body)
+		}
+	}
+}
+
+func TestNewRouterValidatesNotFoundStatus(t *testing.T) {
+	for _, status := range []string{"", "abc", "200", "302", "600"} {
+		if _, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: status, AllowedHandlers: "backend,redirect,gone,filesystem,boom"}); err == nil {
+			t.Errorf("Expected an error creating a router with not-found status %q", status)
+		}
+	}
+}
+
+func TestHeaderTimeoutPrecedence(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer backend.Close()
+
+	rt, err := NewRouter("1s", "100ms", "/dev/null", RouterOptions{RequestTimeout: "5s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone,filesystem,boom"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{
+			{BackendId: "default", BackendURL: backend.URL},
+			{BackendId: "patient", BackendURL: backend.URL, HeaderTimeoutMs: 1000},
+		},
+		routes: []Route{
+			{IncomingPath: "/global", Handler: "backend", BackendId: "default"},
+			{IncomingPath: "/backend", Handler: "backend", BackendId: "patient"},
+			{IncomingPath: "/route", Handler: "backend", BackendId: "default", HeaderTimeoutMs: 1000},
+			{IncomingPath: "/route-over-backend", Handler: "backend", BackendId: "patient", HeaderTimeoutMs: 100},
+		},
+	})
+	rt.ReloadRoutes()
+
+	examples := []struct {
+		path   string
+		status int
+	}{
+		{"/global", http.StatusGatewayTimeout},             // the global 100ms timeout applies
+		{"/backend", http.StatusOK},                        // the backend's 1s timeout overrides it
+		{"/route", http.StatusOK},                          // the route's 1s timeout overrides it
+		{"/route-over-backend", http.StatusGatewayTimeout}, // the route's 100ms beats the backend's 1s
+	}
+	for _, ex := range examples {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", ex.path, nil))
+		if w.Code != ex.status {
+			t.Errorf("Expected %s to return status %d, got %d", ex.path, ex.status, w.Code)
+		}
+	}
+}
+
+func TestOnReloadCallbacks(t *testing.T) {
+	source := &staticRouteSource{routes: goneRoutes(3)}
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone,filesystem,boom"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", source)
+
+	var results []ReloadResult
+	var order []int
+	rt.OnReload(func(result ReloadResult) {
+		if result.Checksum != rt.RouteChecksum() {
+			t.Errorf("Expected the checksum of the loaded routes (%s), got %s", rt.RouteChecksum(), result.Checksum)
+		}
+		results = append(results, result)
+		order = append(order, 1)
+	})
+	rt.OnReload(func(result ReloadResult) {
+		order = append(order, 2)
+	})
+
+	rt.ReloadRoutes()
+	source.routes = goneRoutes(2)[1:]
+	rt.ReloadRoutes()
+	rt.ReloadSource("missing")
+
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 reload results, got %d", len(results))
+	}
+	expected := []struct {
+		ok                    bool
+		count, added, removed int
+	}{
+		{true, 3, 3, 0},
+		{true, 1, 0, 2},
+		{false, 1, 0, 0},
+	}
+	for i, ex := range expected {
+		r := results[i]
+		if (r.Err == nil) != ex.ok || r.RouteCount != ex.count || r.Added != ex.added || r.Removed != ex.removed {
+			t.Errorf("Reload %d: expected ok=%v count=%d added=%d removed=%d, got %+v",
+				i, ex.ok, ex.count, ex.added, ex.removed, r)
+		}
+	}
+	if results[2].Source != "missing" || !errors.Is(results[2].Err, ErrUnknownRouteSource) {
+		t.Errorf("Expected the failed reload to report the unknown source, got %+v", results[2])
+	}
+	if fmt.Sprint(order) != "[1 2 1 2 1 2]" {
+		t.Errorf("Expected callbacks to run in registration order, got %v", order)
+	}
+}
+
+func TestOnReloadCallbackCanReload(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone,filesystem,boom"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{routes: goneRoutes(1)})
+
+	reloads := 0
+	rt.OnReload(func(result ReloadResult) {
+		reloads++
+		if reloads == 1 {
+			rt.ReloadRoutes()
+		}
+	})
+
+	done := make(chan bool)
+	go func() {
+		rt.ReloadRoutes()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reloading from a reload callback deadlocked")
+	}
+	if reloads != 2 {
+		t.Errorf("Expected 2 reloads, got %d", reloads)
+	}
+}
+
+// blockingRouteSource holds up each load until release is closed, sending
+// on started as it begins.
+type blockingRouteSource struct {
+	started chan struct{}
+	release chan struct{}
+	loads   atomic.Int64
+}
+
+func (s *blockingRouteSource) Load() ([]Backend, []Route, error) {
+	s.loads.Add(1)
+	s.started <- struct{}{}
+	<-s.release
+	return nil, goneRoutes(1), nil
+}
+
+func TestReloadQueue(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "gone"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	blocking := &blockingRouteSource{started: make(chan struct{}, 10), release: make(chan struct{})}
+	static := &staticRouteSource{routes: goneRoutes(2)}
+	rt.AddRouteSource("blocking", blocking)
+	rt.AddRouteSource("static", static)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	trigger := func(source string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if source == "" {
+				errs <- rt.ReloadRoutes()
+			} else {
+				errs <- rt.ReloadSource(source)
+			}
+		}()
+	}
+
+	trigger("")
+	<-blocking.started
+	for i := 0; i < 50; i++ {
+		trigger("blocking")
+	}
+	for deadline := time.Now().Add(5 * time.Second); rt.ReloadStatus()["coalesced"].(int64) < 49; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the reloads to be coalesced, got %v", rt.ReloadStatus())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queued reload of one source doesn't cover another, so with the
+	// queue full this is dropped.
+	if err := rt.ReloadSource("static"); !errors.Is(err, ErrReloadDropped) {
+		t.Errorf("Expected the reload to be dropped, got %v", err)
+	}
+	status := rt.ReloadStatus()
+	running := status["running"].(map[string]interface{})
+	queued := status["queued"].([]map[string]interface{})
+	if running["source"] != "" || len(queued) != 1 || queued[0]["source"] != "blocking" || queued[0]["triggers"] != 50 || status["dropped"] != int64(1) {
+		t.Errorf("Unexpected reload status %v", status)
+	}
+	// Reloads of just the backends are queued in the same way.
+	if err := rt.ReloadBackends(); !errors.Is(err, ErrReloadDropped) {
+		t.Errorf("Expected the backends reload to be dropped, got %v", err)
+	}
+
+	close(blocking.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Unexpected reload error: %v", err)
+		}
+	}
+	if loads := blocking.loads.Load(); loads != 2 {
+		t.Errorf("Expected 51 reload triggers to load the source twice, got %d", loads)
+	}
+	if static.loads != 1 {
+		t.Errorf("Expected the dropped reload not to load its source, got %d loads", static.loads)
+	}
+	status = rt.ReloadStatus()
+	if status["running"].(map[string]interface{}) != nil || len(status["queued"].([]map[string]interface{})) != 0 {
+		t.Errorf("Expected no reloads running or queued, got %v", status)
+	}
+}
+
+func TestReloadQueueMerging(t *testing.T) {
+	examples := []struct {
+		description   string
+		waitingSource string
+		waitingDrop   int
+		source        string
+		drop          int
+		merged        bool
+		mergedSource  string
+	}{
+		{"same source", "static", -1, "static", -1, true, "static"},
+		{"same source and drop protection", "static", 50, "static", 50, true, "static"},
+		{"manual reload behind an automatic one", "static", 50, "static", -1, false, "static"},
+		{"automatic reload behind a manual one", "static", -1, "static", 50, false, "static"},
+		{"full reload behind one source", "static", -1, "", -1, true, ""},
+		{"one source behind a full reload", "", -1, "static", -1, true, ""},
+		{"full reload behind an automatic one", "static", 50, "", -1, false, "static"},
+		{"another source", "static", -1, "other", -1, false, "static"},
+	}
+	for _, ex := range examples {
+		q := reloadQueue{maxQueued: 1}
+		q.enter("", -1, false)
+		waiting, _, _ := q.enter(ex.waitingSource, ex.waitingDrop, false)
+		r, owner, ok := q.enter(ex.source, ex.drop, false)
+		if ex.merged && (!ok || owner || r != waiting) {
+			t.Errorf("%s: expected the reload to be merged with the waiting one", ex.description)
+		}
+		if !ex.merged && ok {
+			t.Errorf("%s: expected the reload not to be merged, and dropped as the queue is full", ex.description)
+		}
+		if waiting.name != ex.mergedSource || waiting.maxDropPercent != ex.waitingDrop {
+			t.Errorf("%s: expected the waiting reload to be of %q with drop protection %d, got %q and %d",
+				ex.description, ex.mergedSource, ex.waitingDrop, waiting.name, waiting.maxDropPercent)
+		}
+	}
+
+	// A reload of just the backends is covered by another, or by a full
+	// reload without drop protection.
+	backendsExamples := []struct {
+		description   string
+		waitingSource string
+		waitingDrop   int
+		waitingOnly   bool
+		merged        bool
+	}{
+		{"behind a backends reload", "", -1, true, true},
+		{"behind a full reload", "", -1, false, true},
+		{"behind an automatic full reload", "", 50, false, false},
+		{"behind a reload of one source", "static", -1, false, false},
+	}
+	for _, ex := range backendsExamples {
+		q := reloadQueue{maxQueued: 1}
+		q.enter("", -1, false)
+		waiting, _, _ := q.enter(ex.waitingSource, ex.waitingDrop, ex.waitingOnly)
+		r, owner, ok := q.enter("", -1, true)
+		if ex.merged && (!ok || owner || r != waiting) {
+			t.Errorf("%s: expected the backends reload to be merged with the waiting one", ex.description)
+		}
+		if !ex.merged && ok {
+			t.Errorf("%s: expected the backends reload not to be merged", ex.description)
+		}
+		if waiting.backendsOnly != ex.waitingOnly {
+			t.Errorf("%s: expected the waiting reload to be unchanged", ex.description)
+		}
+	}
+}
+
+func TestReloadBackends(t *testing.T) {
+	server := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+	}
+	old, moved, other := server("old"), server("moved"), server("other")
+	defer old.Close()
+	defer moved.Close()
+	defer other.Close()
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	if err := rt.ReloadBackends(); !errors.Is(err, ErrRoutesNeedReload) {
+		t.Errorf("Expected reloading backends before routes to fail, got %v", err)
+	}
+	source := &staticRouteSource{
+		backends: []Backend{{BackendId: "app", BackendURL: old.URL}, {BackendId: "other", BackendURL: other.URL}},
+		routes: []Route{
+			{IncomingPath: "/app", RouteType: "prefix", Handler: "backend", BackendId: "app"},
+			{IncomingPath: "/other", RouteType: "prefix", Handler: "backend", BackendId: "other"},
+		},
+	}
+	rt.AddRouteSource("static", source)
+	rt.ReloadRoutes()
+	checksum := rt.RouteChecksum()
+	var result ReloadResult
+	rt.OnReload(func(r ReloadResult) { result = r })
+
+	expect := func(path, body string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != body {
+			t.Errorf("%s: expected %q, got %d %q", path, body, w.Code, w.Body.String())
+		}
+	}
+	expect("/app", "old")
+
+	source.backends = []Backend{{BackendId: "app", BackendURL: moved.URL}, {BackendId: "other", BackendURL: other.URL}}
+	if err := rt.ReloadBackends(); err != nil {
+		t.Fatalf("Unexpected error reloading backends: %v", err)
+	}
+	expect("/app", "moved")
+	expect("/other", "other")
+	if rt.RouteChecksum() != checksum {
+		t.Errorf("Expected the routes to be unchanged")
+	}
+	if !result.BackendsOnly || !reflect.DeepEqual(result.ChangedBackends, []string{"app"}) || result.ReboundRoutes != 1 {
+		t.Errorf("Expected the reload callbacks to be told which backends changed, got %+v", result)
+	}
+	if _, ok := rt.LookupRoute("/app", true); !ok {
+		t.Errorf("Expected /app to still be routed")
+	}
+
+	// Only a full reload can drop the routes using a removed backend.
+	source.backends = []Backend{{BackendId: "other", BackendURL: other.URL}}
+	if err := rt.ReloadBackends(); !errors.Is(err, ErrRoutesNeedReload) {
+		t.Errorf("Expected removing a backend in use to fail, got %v", err)
+	}
+	expect("/app", "moved")
+	if !errors.Is(result.Err, ErrRoutesNeedReload) {
+		t.Errorf("Expected the reload callbacks to be told of the failure, got %v", result.Err)
+	}
+}
+
+func TestChunkedResponsesAreStreamed(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.Write([]byte("second\n"))
+	}))
+	defer backend.Close()
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "5s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone,filesystem,boom"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{{BackendId: "streaming", BackendURL: backend.URL}},
+		routes: []Route{
+			{IncomingPath: "/stream", Handler: "backend", BackendId: "streaming"},
+			{IncomingPath: "/stream-cached", Handler: "backend", BackendId: "streaming", Cache: true},
+		},
+	})
+	rt.ReloadRoutes()
+	server := httptest.NewServer(rt)
+	defer server.Close()
+
+	for _, path := range []string{"/stream", "/stream-cached"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Unexpected error requesting %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		if len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked" {
+			t.Errorf("Expected %s to be sent chunked, got %v", path, resp.TransferEncoding)
+		}
+
+		lines := make(chan string)
+		go func() {
+			r := bufio.NewReader(resp.Body)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					close(lines)
+					return
+				}
+				lines <- line
+			}
+		}()
+
+		select {
+		case line := <-lines:
+			if line != "first\n" {
+				t.Errorf("Expected the first chunk from %s, got %q", path, line)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected the first chunk from %s before the backend finished", path)
+		}
+		release <- struct{}{}
+		if line := <-lines; line != "second\n" {
+			t.Errorf("Expected the second chunk from %s, got %q", path, line)
+		}
+	}
+}
+
+func TestAllowedHandlers(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend, redirect,gone", AllowedRedirectHosts: "WWW.gov.uk"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{{BackendId: "backend", BackendURL: "http://localhost:1/"}},
+		routes: []Route{
+			{IncomingPath: "/backend", Handler: "backend", BackendId: "backend"},
+			{IncomingPath: "/gone", Handler: "gone"},
+			{IncomingPath: "/relative", Handler: "redirect", RedirectTo: "/target"},
+			{IncomingPath: "/allowed-host", Handler: "redirect", RedirectTo: "https://www.gov.uk/target"},
+			{IncomingPath: "/mixed-case-host", Handler: "redirect", RedirectTo: "https://WWW.Gov.UK:443/target"},
+			{IncomingPath: "/other-host", Handler: "redirect", RedirectTo: "https://example.com/target"},
+			{IncomingPath: "/protocol-relative", Handler: "redirect", RedirectTo: "//example.com/target"},
+			{IncomingPath: "/files", Handler: "filesystem", DocumentRoot: "/tmp"},
+		},
+	})
+	rt.ReloadRoutes()
+
+	loaded := []string{"/backend", "/gone", "/relative", "/allowed-host", "/mixed-case-host"}
+	for _, path := range loaded {
+		if match := rt.MatchRoute(path); match.Route == nil {
+			t.Errorf("Expected the route for %s to be loaded", path)
+		}
+	}
+	for _, path := range []string{"/other-host", "/protocol-relative", "/files"} {
+		if match := rt.MatchRoute(path); match.Route != nil {
+			t.Errorf("Expected the route for %s to be skipped", path)
+		}
+	}
+	if skipped := rt.RouteStats()["skipped"]; skipped != 3 {
+		t.Errorf("Expected 3 routes to be skipped, got %v", skipped)
+	}
+}
+
+func TestNewRouterRejectsUnknownHandlerKinds(t *testing.T) {
+	if _, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,teleport"}); err == nil {
+		t.Error("Expected an error creating a router allowing an unknown handler kind")
+	}
+}
+
+func TestBackendWarmupAfterReload(t *testing.T) {
+	requests := make(chan string, 10)
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests <- name + " " + r.URL.Path
+		}))
+	}
+	one, two := newBackend("one"), newBackend("two")
+	defer one.Close()
+	defer two.Close()
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend", BackendWarmupConnections: "2", BackendWarmupPath: "/healthcheck"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{{BackendId: "one", BackendURL: one.URL}, {BackendId: "two", BackendURL: two.URL}},
+	})
+	rt.ReloadRoutes()
+
+	seen := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		select {
+		case r := <-requests:
+			seen[r]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected 4 warmup requests, got %v", seen)
+		}
+	}
+	if seen["one /healthcheck"] != 2 || seen["two /healthcheck"] != 2 {
+		t.Errorf("Expected 2 warmup requests to each backend's /healthcheck, got %v", seen)
+	}
+}
+
+func TestRequestsWithoutHost(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		rt := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("served"))
+		}))
+		rt.requireHost = strict
+		server := httptest.NewServer(rt)
+
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Unexpected error connecting to router: %v", err)
+		}
+		conn.Write([]byte("GET /foo HTTP/1.0\r\n\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("Unexpected error reading response: %v", err)
+		}
+		resp.Body.Close()
+		conn.Close()
+		server.Close()
+
+		expected := http.StatusOK
+		if strict {
+			expected = http.StatusBadRequest
+		}
+		if resp.StatusCode != expected {
+			t.Errorf("With a Host required=%v, expected a hostless request to get %d, got %d", strict, expected, resp.StatusCode)
+		}
+	}
+}
+
+func TestBasicAuthRoutes(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone,filesystem,boom"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	sum := sha256.Sum256([]byte("s3cret"))
+	rt.AddRouteSource("static", &staticRouteSource{
+		routes: []Route{
+			{IncomingPath: "/tools", RouteType: "prefix", Handler: "gone",
+				BasicAuthRealm: "Tools", BasicAuthUser: "admin", BasicAuthSHA256: hex.EncodeToString(sum[:])},
+			{IncomingPath: "/public", RouteType: "prefix", Handler: "gone"},
+		},
+	})
+	rt.ReloadRoutes()
+
+	examples := []struct {
+		path     string
+		withAuth bool
+		status   int
+	}{
+		{"/tools/foo", false, http.StatusUnauthorized},
+		{"/tools/foo", true, http.StatusGone},
+		{"/public/foo", false, http.StatusGone},
+	}
+	for _, ex := range examples {
+		r := httptest.NewRequest("GET", ex.path, nil)
+		if ex.withAuth {
+			r.SetBasicAuth("admin", "s3cret")
+		}
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, r)
+		if w.Code != ex.status {
+			t.Errorf("Expected %s (with credentials: %v) to get %d, got %d", ex.path, ex.withAuth, ex.status, w.Code)
+		}
+	}
+}
+
+func TestReadOnlyRoutes(t *testing.T) {
+	var writes int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			writes++
+		}
+		io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET,POST", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{{BackendId: "app", BackendURL: backend.URL}},
+		routes: []Route{
+			{IncomingPath: "/migrating", RouteType: "prefix", Handler: "backend", BackendId: "app",
+				ReadOnly: true, ReadOnlyBody: "Back soon\n"},
+			{IncomingPath: "/writable", RouteType: "prefix", Handler: "backend", BackendId: "app"},
+		},
+	})
+	rt.ReloadRoutes()
+
+	examples := []struct {
+		method, path string
+		status       int
+		body         string
+	}{
+		{"GET", "/migrating/foo", http.StatusOK, "backend"},
+		{"POST", "/migrating/foo", http.StatusServiceUnavailable, "Back soon\n"},
+		{"POST", "/writable/foo", http.StatusOK, "backend"},
+	}
+	for _, ex := range examples {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest(ex.method, ex.path, strings.NewReader("data")))
+		if w.Code != ex.status || w.Body.String() != ex.body {
+			t.Errorf("Expected %s %s to get %d %q, got %d %q", ex.method, ex.path, ex.status, ex.body, w.Code, w.Body.String())
+		}
+	}
+	if writes != 1 {
+		t.Errorf("Expected only the write to the writable route to reach the backend, got %d", writes)
+	}
+}
+
+func TestPingRoutes(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET,HEAD", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,ping"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{{BackendId: "down", BackendURL: "http://localhost:1/"}},
+		routes: []Route{
+			{IncomingPath: "/app", RouteType: "prefix", Handler: "backend", BackendId: "down"},
+			{IncomingPath: "/app/healthcheck", Handler: "ping"},
+			{IncomingPath: "/other/healthcheck", Handler: "ping", PingBody: "other app OK"},
+		},
+	})
+	rt.ReloadRoutes()
+
+	examples := []struct {
+		method, path, body string
+	}{
+		{"GET", "/app/healthcheck", "OK"},
+		{"GET", "/other/healthcheck", "other app OK"},
+		{"HEAD", "/app/healthcheck", ""},
+	}
+	for _, ex := range examples {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest(ex.method, ex.path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != ex.body {
+			t.Errorf("Expected %s %s to get 200 %q, got %d %q", ex.method, ex.path, ex.body, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRedirectLoopRoutes(t *testing.T) {
+	routes := []Route{
+		{IncomingPath: "/self", RouteType: "exact", Handler: "redirect", RedirectTo: "/self"},
+		{IncomingPath: "/section", RouteType: "prefix", Handler: "redirect", RedirectTo: "/section"},
+		{IncomingPath: "/growing", RouteType: "prefix", Handler: "redirect", RedirectTo: "/growing/more"},
+		{IncomingPath: "/moved", RouteType: "prefix", Handler: "redirect", RedirectTo: "/moved/new"},
+		{IncomingPath: "/moved/new", RouteType: "prefix", Handler: "gone"},
+	}
+
+	for _, skip := range []bool{false, true} {
+		var out bytes.Buffer
+		log.SetOutput(&out)
+		rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "redirect,gone", SkipRedirectLoops: skip})
+		if err != nil {
+			t.Fatalf("Unexpected error creating router: %v", err)
+		}
+		rt.AddRouteSource("static", &staticRouteSource{routes: routes})
+		rt.ReloadRoutes()
+		log.SetOutput(os.Stderr)
+
+		for _, path := range []string{"/self", "/section", "/growing"} {
+			if !strings.Contains(out.String(), path+" ") || !strings.Contains(out.String(), "back to itself") {
+				t.Errorf("Expected a redirect loop warning for %s (skipping: %v), got %q", path, skip, out.String())
+			}
+		}
+		if strings.Contains(out.String(), "/moved ") {
+			t.Errorf("Expected no redirect loop warning for /moved (skipping: %v), got %q", skip, out.String())
+		}
+
+		// Only direct loops can be caught when serving; /growing redirects
+		// to ever longer paths beneath itself.
+		loopStatus, growingStatus := http.StatusLoopDetected, http.StatusMovedPermanently
+		if skip {
+			loopStatus, growingStatus = http.StatusNotFound, http.StatusNotFound
+		}
+		examples := []struct {
+			path   string
+			status int
+		}{
+			{"/self", loopStatus},
+			{"/section/page", loopStatus},
+			{"/growing/page", growingStatus},
+			{"/moved/old", http.StatusMovedPermanently},
+			{"/moved/new", http.StatusGone},
+		}
+		for _, ex := range examples {
+			w := httptest.NewRecorder()
+			rt.ServeHTTP(w, httptest.NewRequest("GET", ex.path, nil))
+			if w.Code != ex.status {
+				t.Errorf("Expected %s (skipping loops: %v) to get %d, got %d", ex.path, skip, ex.status, w.Code)
+			}
+		}
+	}
+}
+
+func TestBroadPrefixWarning(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	routes := []Route{{IncomingPath: "/", RouteType: "prefix", Handler: "gone"}}
+	for i := 0; i < broadPrefixExactRoutes; i++ {
+		routes = append(routes, Route{IncomingPath: fmt.Sprintf("/section/page-%d", i), Handler: "gone"})
+	}
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "gone"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	source := &staticRouteSource{routes: routes}
+	rt.AddRouteSource("static", source)
+	rt.ReloadRoutes()
+
+	expected := fmt.Sprintf("router: prefix route / has %d exact routes beneath it (such as /section/page-0, /section/page-1, /section/page-2)", broadPrefixExactRoutes)
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("Expected a warning about the / prefix route, got %q", out.String())
+	}
+
+	out.Reset()
+	source.routes = routes[:broadPrefixExactRoutes]
+	rt.ReloadRoutes()
+	if strings.Contains(out.String(), "exact routes beneath it") {
+		t.Errorf("Expected no warning with fewer exact routes, got %q", out.String())
+	}
+}
+
+func TestReloadSkipsUnchangedRoutes(t *testing.T) {
+	source := &staticRouteSource{routes: []Route{{IncomingPath: "/foo", Handler: "redirect", RedirectTo: "/bar"}}}
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "redirect"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", source)
+	var results []ReloadResult
+	rt.OnReload(func(result ReloadResult) {
+		results = append(results, result)
+	})
+
+	rt.ReloadRoutes()
+	first := rt.mux.Load()
+	rt.ReloadRoutes()
+	if rt.mux.Load() != first {
+		t.Error("Expected reloading identical routes not to replace the routing table")
+	}
+	if source.loads != 2 {
+		t.Errorf("Expected the routes to be loaded twice, got %d", source.loads)
+	}
+
+	// A change which leaves the paths (and so the checksum) alone still counts.
+	source.routes = []Route{{IncomingPath: "/foo", Handler: "redirect", RedirectTo: "/baz"}}
+	rt.ReloadRoutes()
+	if rt.mux.Load() == first {
+		t.Error("Expected reloading changed routes to replace the routing table")
+	}
+
+	expected := []bool{false, true, false}
+	for i, unchanged := range expected {
+		if results[i].Unchanged != unchanged || results[i].Err != nil {
+			t.Errorf("Reload %d: expected unchanged=%v, got %+v", i, unchanged, results[i])
+		}
+	}
+}
+
+func TestRouteTableAge(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone,filesystem,boom"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	if stats := rt.RouteStats(); stats["routes_loaded_at"] != nil || stats["routes_age_seconds"] != nil {
+		t.Fatalf("Expected no age before the routes are loaded, got %v", stats)
+	}
+
+	rt.AddRouteSource("static", &staticRouteSource{routes: goneRoutes(1)})
+	rt.ReloadRoutes()
+	loadedAt := rt.RouteStats()["routes_loaded_at"]
+	first := rt.RouteStats()["routes_age_seconds"].(float64)
+	time.Sleep(20 * time.Millisecond)
+	second := rt.RouteStats()["routes_age_seconds"].(float64)
+	if second <= first {
+		t.Errorf("Expected the age to increase over time, got %v then %v", first, second)
+	}
+
+	rt.ReloadRoutes()
+	if third := rt.RouteStats()["routes_age_seconds"].(float64); third >= second {
+		t.Errorf("Expected the age to reset on reload, got %v after %v", third, second)
+	}
+	if rt.RouteStats()["routes_loaded_at"] == loadedAt {
+		t.Errorf("Expected the load time to change on reload, still %v", loadedAt)
+	}
+}
+
+func TestRouteCountsByType(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "redirect,gone"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{routes: []Route{
+		{IncomingPath: "/one", RouteType: "exact", Handler: "gone"},
+		{IncomingPath: "/two", RouteType: "exact", Handler: "gone"},
+		{IncomingPath: "/three", Handler: "gone"},
+		{IncomingPath: "/section", RouteType: "prefix", Handler: "gone"},
+		{IncomingPath: "/moved", RouteType: "prefix", Handler: "redirect", RedirectTo: "/elsewhere"},
+		{IncomingPath: "/bad", RouteType: "suffix", Handler: "gone"},
+	}})
+	rt.ReloadRoutes()
+
+	stats := rt.RouteStats()
+	if stats["exact_count"] != 3 || stats["prefix_count"] != 2 || stats["count"] != 5 {
+		t.Errorf("Expected 3 exact and 2 prefix routes, 5 in all, got %v, %v and %v",
+			stats["exact_count"], stats["prefix_count"], stats["count"])
+	}
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	old, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone,filesystem,boom"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	old.AddRouteSource("static", &staticRouteSource{routes: goneRoutes(3)})
+	old.ReloadRoutes()
+	snapshot, err := old.Snapshot()
+	if err != nil {
+		t.Fatalf("Unexpected error taking snapshot: %v", err)
+	}
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone,filesystem,boom"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	source := &staticRouteSource{routes: goneRoutes(1)}
+	rt.AddRouteSource("static", source)
+	if err := rt.RestoreSnapshot(snapshot); err != nil {
+		t.Fatalf("Unexpected error restoring snapshot: %v", err)
+	}
+	if source.loads != 0 {
+		t.Errorf("Expected the route source not to be loaded, got %d loads", source.loads)
+	}
+	if rt.RouteChecksum() != old.RouteChecksum() {
+		t.Errorf("Expected the restored routes to match the snapshot, got %v", rt.RouteStats())
+	}
+
+	rt.ReloadRoutes()
+	if source.loads != 1 || rt.RouteStats()["count"] != 1 {
+		t.Errorf("Expected later reloads to use the route source, got %d loads and %v", source.loads, rt.RouteStats())
+	}
+}
+
+func TestCookieBucketRoutes(t *testing.T) {
+	var backends []Backend
+	for _, name := range []string{"control", "variant-a", "variant-b"} {
+		name := name
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		defer server.Close()
+		backends = append(backends, Backend{BackendId: name, BackendURL: server.URL})
+	}
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: backends,
+		routes: []Route{
+			{IncomingPath: "/experiment", RouteType: "prefix", Handler: "backend", BackendId: "control",
+				BucketCookie: "ab_bucket", BucketBackends: map[string]string{"A": "variant-a", "B": "variant-b"}},
+			{IncomingPath: "/broken", RouteType: "prefix", Handler: "backend", BackendId: "control",
+				BucketCookie: "ab_bucket", BucketBackends: map[string]string{"A": "missing"}},
+		},
+	})
+	rt.ReloadRoutes()
+
+	examples := []struct {
+		path, cookie, expected string
+		status                 int
+	}{
+		{"/experiment/page", "A", "variant-a", http.StatusOK},
+		{"/experiment/page", "B", "variant-b", http.StatusOK},
+		{"/experiment/page", "Z", "control", http.StatusOK},
+		{"/experiment/page", "", "control", http.StatusOK},
+		{"/broken/page", "A", "", http.StatusNotFound},
+	}
+	for _, ex := range examples {
+		r := httptest.NewRequest("GET", ex.path, nil)
+		if ex.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "ab_bucket", Value: ex.cookie})
+		}
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, r)
+		if w.Code != ex.status || (ex.expected != "" && w.Body.String() != ex.expected) {
+			t.Errorf("Expected %s with bucket %q to get %d from %q, got %d %q", ex.path, ex.cookie, ex.status, ex.expected, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRegionRoutes(t *testing.T) {
+	var backends []Backend
+	for _, name := range []string{"default", "backend-eu", "backend-us"} {
+		name := name
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		defer server.Close()
+		backends = append(backends, Backend{BackendId: name, BackendURL: server.URL})
+	}
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: backends,
+		routes: []Route{
+			{IncomingPath: "/regional", RouteType: "prefix", Handler: "backend", BackendId: "default",
+				RegionHeader: "CloudFront-Viewer-Country", RegionBackends: map[string]string{"GB": "backend-eu", "US": "backend-us"}},
+			{IncomingPath: "/broken", RouteType: "prefix", Handler: "backend", BackendId: "default",
+				RegionHeader: "CloudFront-Viewer-Country", RegionBackends: map[string]string{"GB": "missing"}},
+		},
+	})
+	rt.ReloadRoutes()
+
+	examples := []struct {
+		path, region, expected string
+		status                 int
+	}{
+		{"/regional/page", "GB", "backend-eu", http.StatusOK},
+		{"/regional/page", "US", "backend-us", http.StatusOK},
+		{"/regional/page", "JP", "default", http.StatusOK},
+		{"/regional/page", "", "default", http.StatusOK},
+		{"/broken/page", "GB", "", http.StatusNotFound},
+	}
+	for _, ex := range examples {
+		r := httptest.NewRequest("GET", ex.path, nil)
+		if ex.region != "" {
+			r.Header.Set("CloudFront-Viewer-Country", ex.region)
+		}
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, r)
+		if w.Code != ex.status || (ex.expected != "" && w.Body.String() != ex.expected) {
+			t.Errorf("Expected %s from region %q to get %d from %q, got %d %q", ex.path, ex.region, ex.status, ex.expected, w.Code, w.Body.String())
+		}
+	}
+	if backends := rt.ActiveBackends(); !reflect.DeepEqual(backends, []string{"backend-eu", "backend-us", "default"}) {
+		t.Errorf("Expected the region backends to be active, got %v", backends)
+	}
+}
+
+func TestConsistentHashRoutes(t *testing.T) {
+	var backends []Backend
+	for _, name := range []string{"default", "cache-1", "cache-2", "cache-3"} {
+		name := name
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		defer server.Close()
+		backends = append(backends, Backend{BackendId: name, BackendURL: server.URL})
+	}
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: backends,
+		routes: []Route{
+			{IncomingPath: "/by-path", RouteType: "prefix", Handler: "backend", BackendId: "default",
+				HashBackends: []string{"cache-1", "cache-2", "cache-3"}},
+			{IncomingPath: "/by-header", RouteType: "prefix", Handler: "backend", BackendId: "default",
+				HashBackends: []string{"cache-1", "cache-2", "cache-3"}, HashKey: "header:X-Cache-Key"},
+			{IncomingPath: "/unknown-backend", RouteType: "prefix", Handler: "backend", BackendId: "default",
+				HashBackends: []string{"cache-1", "missing"}},
+			{IncomingPath: "/invalid-key", RouteType: "prefix", Handler: "backend", BackendId: "default",
+				HashBackends: []string{"cache-1"}, HashKey: "body"},
+		},
+	})
+	rt.ReloadRoutes()
+	if skipped := rt.RouteStats()["skipped"]; skipped != 2 {
+		t.Errorf("Expected the routes with an unknown backend or invalid key to be skipped, got %v skipped", skipped)
+	}
+
+	serve := func(path string) string {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Body.String()
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 30; i++ {
+		path := "/by-path/" + strconv.Itoa(i)
+		first := serve(path)
+		if again := serve(path); again != first {
+			t.Errorf("Expected %s to be served by %s again, got %s", path, first, again)
+		}
+		seen[first] = true
+	}
+	if len(seen) != 3 || seen["default"] {
+		t.Errorf("Expected paths to be spread over the hash backends, got %v", seen)
+	}
+	if got := serve("/by-header/foo"); got != "default" {
+		t.Errorf("Expected a request without the hash key to go to the route's backend, got %s", got)
+	}
+}
+
+func TestStripSuffixRoutes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer backend.Close()
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{{BackendId: "app", BackendURL: backend.URL}},
+		routes: []Route{
+			{IncomingPath: "/stripped", RouteType: "prefix", Handler: "backend", BackendId: "app", StripSuffix: ".json"},
+			{IncomingPath: "/kept", RouteType: "prefix", Handler: "backend", BackendId: "app"},
+		},
+	})
+	rt.ReloadRoutes()
+
+	examples := []struct {
+		path, expected string
+	}{
+		{"/stripped/foo.json", "/stripped/foo"},
+		{"/stripped/foo", "/stripped/foo"},
+		{"/kept/foo.json", "/kept/foo.json"},
+	}
+	for _, ex := range examples {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", ex.path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != ex.expected {
+			t.Errorf("Expected %s to be proxied as %s, got %d %q", ex.path, ex.expected, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestErrorTemplateBackends(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+		w.WriteHeader(status)
+		io.WriteString(w, "backend error detail")
+	}))
+	defer backend.Close()
+	file := filepath.Join(t.TempDir(), "500.html")
+	os.WriteFile(file, []byte("<h1>Sorry, something went wrong ({{.Status}})</h1>"), 0644)
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	if err := rt.SetErrorTemplates("500=" + file); err != nil {
+		t.Fatalf("Unexpected error setting error templates: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{
+			{BackendId: "intercepted", BackendURL: backend.URL, InterceptErrors: true},
+			{BackendId: "detailed", BackendURL: backend.URL},
+		},
+		routes: []Route{
+			{IncomingPath: "/500", RouteType: "exact", Handler: "backend", BackendId: "intercepted"},
+			{IncomingPath: "/404", RouteType: "exact", Handler: "backend", BackendId: "intercepted"},
+			{IncomingPath: "/detailed/500", RouteType: "exact", Handler: "backend", BackendId: "detailed"},
+		},
+	})
+	rt.ReloadRoutes()
+
+	examples := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/500", 500, "<h1>Sorry, something went wrong (500)</h1>"},
+		{"/404", 404, "backend error detail"},
+		{"/detailed/500", 500, "backend error detail"},
+	}
+	for _, ex := range examples {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", ex.path, nil))
+		if w.Code != ex.status || w.Body.String() != ex.body {
+			t.Errorf("%s: expected %d %q, got %d %q", ex.path, ex.status, ex.body, w.Code, w.Body.String())
+		}
+	}
+
+	if err := rt.SetErrorTemplates("404=" + file); err == nil {
+		t.Error("Expected a template for a 4xx to be refused")
+	}
+}
+
+func TestMaxResponseBytesRoutes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat("x", 100))
+	}))
+	defer backend.Close()
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.LimitResponseSize(50)
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{{BackendId: "app", BackendURL: backend.URL}},
+		routes: []Route{
+			{IncomingPath: "/limited", RouteType: "prefix", Handler: "backend", BackendId: "app"},
+			{IncomingPath: "/raised", RouteType: "prefix", Handler: "backend", BackendId: "app", MaxResponseBytes: 200},
+			{IncomingPath: "/unlimited", RouteType: "prefix", Handler: "backend", BackendId: "app", MaxResponseBytes: -1},
+		},
+	})
+	rt.ReloadRoutes()
+
+	examples := []struct {
+		path   string
+		status int
+	}{
+		{"/limited", http.StatusBadGateway},
+		{"/raised", http.StatusOK},
+		{"/unlimited", http.StatusOK},
+	}
+	for _, ex := range examples {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", ex.path, nil))
+		if w.Code != ex.status {
+			t.Errorf("%s: expected %d, got %d", ex.path, ex.status, w.Code)
+		}
+	}
+}
+
+func TestConnectTunnels(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "5s", AllowedMethods: "GET,CONNECT", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{{BackendId: "echo", BackendURL: "http://" + echo.Addr().String()}},
+		routes: []Route{
+			{IncomingPath: "/tunnel", Handler: "backend", BackendId: "echo", AllowConnect: true},
+			{IncomingPath: "/plain", Handler: "backend", BackendId: "echo"},
+		},
+	})
+	rt.ReloadRoutes()
+	server := httptest.NewServer(rt)
+	defer server.Close()
+
+	connect := func(path string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: router.example.com\r\n\r\n", path)
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+		if err != nil {
+			t.Fatalf("Reading the response to CONNECT %s: %v", path, err)
+		}
+		return conn, reader, resp
+	}
+
+	conn, reader, resp := connect("/tunnel")
+	defer conn.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected CONNECT /tunnel to get a 200, got %d", resp.StatusCode)
+	}
+	for _, message := range []string{"hello\n", "binary \x00\xff\n"} {
+		io.WriteString(conn, message)
+		if line, err := reader.ReadString('\n'); err != nil || line != message {
+			t.Errorf("Expected %q echoed through the tunnel, got %q (error: %v)", message, line, err)
+		}
+	}
+
+	plain, _, resp := connect("/plain")
+	defer plain.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected CONNECT to a route without allow_connect to get a 405, got %d", resp.StatusCode)
+	}
+}
+
+func TestBackendHostSettings(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer backend.Close()
+	backendHost := strings.TrimPrefix(backend.URL, "http://")
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{
+			{BackendId: "default", BackendURL: backend.URL},
+			{BackendId: "override", BackendURL: backend.URL, OverrideHost: "app.internal"},
+			{BackendId: "preserve", BackendURL: backend.URL, PreserveHost: true},
+			{BackendId: "both", BackendURL: backend.URL, OverrideHost: "app.internal", PreserveHost: true},
+		},
+		routes: []Route{
+			{IncomingPath: "/default", Handler: "backend", BackendId: "default"},
+			{IncomingPath: "/override", Handler: "backend", BackendId: "override"},
+			{IncomingPath: "/preserve", Handler: "backend", BackendId: "preserve"},
+		},
+	})
+	rt.ReloadRoutes()
+
+	if skipped := rt.BackendStats()["skipped"]; skipped != 1 {
+		t.Errorf("Expected the backend setting both options to be skipped, got %v skipped", skipped)
+	}
+	for path, expected := range map[string]string{"/default": backendHost, "/override": "app.internal", "/preserve": "www.example.com"} {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", "http://www.example.com"+path, nil))
+		if w.Body.String() != expected {
+			t.Errorf("Expected the backend for %s to see Host %q, got %q", path, expected, w.Body.String())
+		}
+	}
+}
+
+func TestBackendCircuitBreakers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone,filesystem,boom"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{
+			{BackendId: "failing", BackendURL: backend.URL, CircuitBreakerFailures: 2},
+			{BackendId: "unprotected", BackendURL: backend.URL},
+		},
+		routes: []Route{{IncomingPath: "/failing", Handler: "backend", BackendId: "failing"}},
+	})
+	rt.ReloadRoutes()
+
+	for _, status := range []int{500, 500, 503} {
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, httptest.NewRequest("GET", "/failing", nil))
+		if w.Code != status {
+			t.Errorf("Expected status %d, got %d", status, w.Code)
+		}
+	}
+
+	circuits := rt.BackendStats()["circuits"].(map[string]interface{})
+	if len(circuits) != 1 {
+		t.Fatalf("Expected only the backend with a circuit breaker to be listed, got %v", circuits)
+	}
+	if state := circuits["failing"].(map[string]interface{})["state"]; state != "open" {
+		t.Errorf("Expected the circuit to be open, got %v", state)
+	}
+}
+
+func TestResetStats(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/failing" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("cacheable"))
+	}))
+	defer backend.Close()
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone,filesystem,boom"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{
+			{BackendId: "cached", BackendURL: backend.URL},
+			{BackendId: "failing", BackendURL: backend.URL, CircuitBreakerFailures: 1},
+		},
+		routes: []Route{
+			{IncomingPath: "/cached", Handler: "backend", BackendId: "cached", Cache: true},
+			{IncomingPath: "/failing", Handler: "backend", BackendId: "failing"},
+		},
+	})
+	rt.ReloadRoutes()
+	for _, path := range []string{"/cached", "/cached", "/failing", "/failing"} {
+		rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	circuit := func() map[string]interface{} {
+		return rt.BackendStats()["circuits"].(map[string]interface{})["failing"].(map[string]interface{})
+	}
+	if cache := rt.CacheStats(); cache["hits"] != int64(1) || cache["misses"] != int64(1) {
+		t.Fatalf("Expected a cache hit and miss before resetting, got %v", cache)
+	}
+	if c := circuit(); c["trips"] != int64(1) || c["rejected"] != int64(1) {
+		t.Fatalf("Expected a trip and a refused request before resetting, got %v", c)
+	}
+
+	rt.ResetStats()
+
+	if cache := rt.CacheStats(); cache["hits"] != int64(0) || cache["misses"] != int64(0) || cache["entries"] != 1 {
+		t.Errorf("Expected the cache counters to be reset but its entries kept, got %v", cache)
+	}
+	if c := circuit(); c["trips"] != int64(0) || c["rejected"] != int64(0) || c["state"] != "open" {
+		t.Errorf("Expected the circuit counters to be reset but its state kept, got %v", c)
+	}
+	if count := rt.RouteStats()["count"]; count != 2 {
+		t.Errorf("Expected the route count to be unchanged, got %v", count)
+	}
+}
+
+func TestErrorPageRoutes(t *testing.T) {
+	pages := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "error page "+r.URL.Path)
+	}))
+	defer pages.Close()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, "backend's not found page")
+	}))
+	defer backend.Close()
+
+	errorPages := fmt.Sprintf("404=%s/404,500=%s/500", pages.URL, pages.URL)
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend", ErrorPages: errorPages})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{
+			{BackendId: "backend", BackendURL: backend.URL},
+			{BackendId: "down", BackendURL: "http://localhost:1/"},
+		},
+		routes: []Route{
+			{IncomingPath: "/backend", RouteType: "prefix", Handler: "backend", BackendId: "backend"},
+			{IncomingPath: "/down", RouteType: "prefix", Handler: "backend", BackendId: "down"},
+		},
+	})
+	rt.ReloadRoutes()
+
+	examples := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/unmatched", http.StatusNotFound, "error page /404"},
+		{"/down", http.StatusInternalServerError, "error page /500"},
+		{"/backend/missing", http.StatusNotFound, "backend's not found page"},
+	}
+	for _, ex := range examples {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest("GET", ex.path, nil))
+		if rw.Code != ex.status || rw.Body.String() != ex.body {
+			t.Errorf("%s: expected %d %q, got %d %q", ex.path, ex.status, ex.body, rw.Code, rw.Body.String())
+		}
+	}
+
+	for _, invalid := range []string{"404", "200=http://example.com/", "404=/404", "404=ftp://example.com/"} {
+		if _, err := parseErrorPages(invalid); err == nil {
+			t.Errorf("Expected error pages %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestScanDetection(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "gone"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{routes: goneRoutes(1)})
+	rt.ReloadRoutes()
+	rt.DetectScanners(5, time.Minute, true)
+
+	var statuses []int
+	for i := 0; i < 7; i++ {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest("GET", fmt.Sprintf("/probe-%d", i), nil))
+		statuses = append(statuses, rw.Code)
+	}
+	if fmt.Sprint(statuses) != "[404 404 404 404 404 429 429]" {
+		t.Errorf("Expected the scanning client to be blocked after 5 unmatched paths, got %v", statuses)
+	}
+	if stats := rt.ScanStats(); stats["detected"] != int64(1) {
+		t.Errorf("Expected one scanner to be detected, got %v", stats)
+	}
+}
+
+func TestRoutePriorities(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "gone,redirect"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{routes: []Route{
+		{IncomingPath: "/government", RouteType: "prefix", Handler: "gone", Priority: 1},
+		{IncomingPath: "/government/publications", RouteType: "prefix", Handler: "redirect", RedirectTo: "/elsewhere"},
+		{IncomingPath: "/government/exact", RouteType: "exact", Handler: "gone", Priority: 1},
+	}})
+	rt.ReloadRoutes()
+
+	rw := httptest.NewRecorder()
+	rt.ServeHTTP(rw, httptest.NewRequest("GET", "/government/publications/foo", nil))
+	if rw.Code != http.StatusGone {
+		t.Errorf("Expected the higher-priority prefix route to serve the request, got %d", rw.Code)
+	}
+	if skipped := rt.RouteStats()["skipped"]; skipped != 1 {
+		t.Errorf("Expected the exact route with a priority to be skipped, got %v skipped", skipped)
+	}
+}
+
+func TestRouteMinExtraSegments(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "gone,redirect"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{routes: []Route{
+		{IncomingPath: "/foo", RouteType: "prefix", Handler: "gone", MinExtraSegments: 1},
+		{IncomingPath: "/bar", RouteType: "prefix", Handler: "gone", MinExtraSegments: 1},
+		{IncomingPath: "/bar", RouteType: "exact", Handler: "redirect", RedirectTo: "/elsewhere"},
+		{IncomingPath: "/exact", RouteType: "exact", Handler: "gone", MinExtraSegments: 1},
+		{IncomingPath: "/negative", RouteType: "prefix", Handler: "gone", MinExtraSegments: -1},
+	}})
+	rt.ReloadRoutes()
+
+	examples := []struct {
+		path   string
+		status int
+	}{
+		{"/foo", http.StatusNotFound},
+		{"/foo/bar", http.StatusGone},
+		{"/bar", http.StatusMovedPermanently},
+		{"/bar/baz", http.StatusGone},
+	}
+	for _, ex := range examples {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest("GET", ex.path, nil))
+		if rw.Code != ex.status {
+			t.Errorf("Expected %s to get a %d, got %d", ex.path, ex.status, rw.Code)
+		}
+	}
+	if skipped := rt.RouteStats()["skipped"]; skipped != 2 {
+		t.Errorf("Expected the exact route and negative min_extra_segments to be skipped, got %v skipped", skipped)
+	}
+}
+
+func TestServeAtEdge(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", TrustedProxies: "10.0.0.0/8", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	if err := rt.ServeAtEdge(); err == nil {
+		t.Error("Expected a router with trusted proxies not to be allowed at the edge")
+	}
+
+	var forwardedFor string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwardedFor = r.Header.Get("X-Forwarded-For")
+	}))
+	defer backend.Close()
+
+	rt, err = NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	if err := rt.ServeAtEdge(); err != nil {
+		t.Fatalf("Unexpected error serving at the edge: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{{BackendId: "app", BackendURL: backend.URL}},
+		routes:   []Route{{IncomingPath: "/", RouteType: "prefix", Handler: "backend", BackendId: "app"}},
+	})
+	rt.ReloadRoutes()
+
+	req := httptest.NewRequest("GET", "/foo", nil)
+	req.RemoteAddr = "203.0.113.7:1234"
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	rt.ServeHTTP(httptest.NewRecorder(), req)
+	if forwardedFor != "203.0.113.7" {
+		t.Errorf("Expected the client's X-Forwarded-For to be replaced, got %q", forwardedFor)
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", TrustedProxies: "10.0.0.0/8", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "gone"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{routes: []Route{
+		{IncomingPath: "/secure", RouteType: "prefix", Handler: "gone", HTTPSRedirect: true},
+		{IncomingPath: "/open", RouteType: "prefix", Handler: "gone"},
+	}})
+	rt.ReloadRoutes()
+
+	serve := func(path, proto string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://www.example.com"+path, nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set("X-Forwarded-Proto", proto)
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, req)
+		return rw
+	}
+	if rw := serve("/secure/page?q=1", "http"); rw.Code != http.StatusMovedPermanently || rw.Header().Get("Location") != "https://www.example.com/secure/page?q=1" {
+		t.Errorf("Expected the https_redirect route to redirect plain HTTP, got %d to %q", rw.Code, rw.Header().Get("Location"))
+	}
+	if rw := serve("/secure/page", "https"); rw.Code != http.StatusGone {
+		t.Errorf("Expected the https_redirect route to serve HTTPS, got %d", rw.Code)
+	}
+	if rw := serve("/open", "http"); rw.Code != http.StatusGone {
+		t.Errorf("Expected other routes to serve plain HTTP, got %d", rw.Code)
+	}
+
+	rt.RedirectToHTTPS()
+	if rw := serve("/open", "http"); rw.Code != http.StatusMovedPermanently || rw.Header().Get("Location") != "https://www.example.com/open" {
+		t.Errorf("Expected every route to redirect plain HTTP, got %d to %q", rw.Code, rw.Header().Get("Location"))
+	}
+	if rw := serve("/missing", "https"); rw.Code != http.StatusNotFound {
+		t.Errorf("Expected HTTPS requests not to be redirected, got %d", rw.Code)
+	}
+}
+
+func TestNotReadyUntilRoutesLoaded(t *testing.T) {
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "gone"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	source := &staticRouteSource{routes: goneRoutes(1), err: errors.New("connection refused")}
+	rt.AddRouteSource("static", source)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		return rw
+	}
+	for _, path := range []string{"/gone-0", "/missing"} {
+		if rw := serve(path); rw.Code != http.StatusServiceUnavailable || rw.Header().Get("Retry-After") == "" {
+			t.Errorf("Expected %s to get a 503 with a Retry-After before loading, got %d", path, rw.Code)
+		}
+	}
+
+	if err := rt.ReloadRoutes(); err == nil {
+		t.Fatal("Expected the first load to fail")
+	}
+	if rw := serve("/gone-0"); rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a 503 after a failed first load, got %d", rw.Code)
+	}
+
+	source.err = nil
+	if err := rt.ReloadRoutes(); err != nil {
+		t.Fatalf("Unexpected error loading routes: %v", err)
+	}
+	if rw := serve("/gone-0"); rw.Code != http.StatusGone {
+		t.Errorf("Expected a loaded route to be served, got %d", rw.Code)
+	}
+	if rw := serve("/missing"); rw.Code != http.StatusNotFound || rw.Header().Get("Retry-After") != "" {
+		t.Errorf("Expected an unknown path to get a 404 once loaded, got %d", rw.Code)
+	}
+}
+
+func TestMirroredRoutes(t *testing.T) {
+	mirrored := make(chan string, 1)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "primary")
+	}))
+	defer primary.Close()
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r.URL.Path
+		io.WriteString(w, "shadow")
+	}))
+	defer shadow.Close()
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{{BackendId: "primary", BackendURL: primary.URL}, {BackendId: "shadow", BackendURL: shadow.URL}},
+		routes: []Route{
+			{IncomingPath: "/mirrored", RouteType: "prefix", Handler: "backend", BackendId: "primary", MirrorBackendId: "shadow"},
+			{IncomingPath: "/unknown", RouteType: "prefix", Handler: "backend", BackendId: "primary", MirrorBackendId: "missing"},
+		},
+	})
+	rt.ReloadRoutes()
+
+	rw := httptest.NewRecorder()
+	rt.ServeHTTP(rw, httptest.NewRequest("GET", "/mirrored/foo", nil))
+	if rw.Code != http.StatusOK || rw.Body.String() != "primary" {
+		t.Errorf("Expected the primary backend's response, got %d %q", rw.Code, rw.Body.String())
+	}
+	select {
+	case path := <-mirrored:
+		if path != "/mirrored/foo" {
+			t.Errorf("Expected the shadow backend to get /mirrored/foo, got %s", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the request to be mirrored to the shadow backend")
+	}
+	if skipped := rt.RouteStats()["skipped"]; skipped != 1 {
+		t.Errorf("Expected the route with an unknown mirror backend to be skipped, got %v skipped", skipped)
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer backend.Close()
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,redirect,gone"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	if err := rt.SetPathPrefix("staging"); err == nil {
+		t.Error("Expected a path prefix without a leading slash to be refused")
+	}
+	if err := rt.SetPathPrefix("/staging/"); err != nil {
+		t.Fatalf("Unexpected error setting the path prefix: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{{BackendId: "backend", BackendURL: backend.URL}},
+		routes: []Route{
+			{IncomingPath: "/", RouteType: "exact", Handler: "backend", BackendId: "backend"},
+			{IncomingPath: "/foo", RouteType: "prefix", Handler: "backend", BackendId: "backend"},
+			{IncomingPath: "/gone", RouteType: "exact", Handler: "gone"},
+			{IncomingPath: "/old", RouteType: "prefix", Handler: "redirect", RedirectTo: "/new"},
+		},
+	})
+	if err := rt.ReloadRoutes(); err != nil {
+		t.Fatalf("Unexpected error loading routes: %v", err)
+	}
+
+	examples := []struct {
+		path     string
+		status   int
+		expected string
+	}{
+		{"/staging", 200, "/"},
+		{"/staging/foo/bar", 200, "/foo/bar"},
+		{"/staging/gone", 410, ""},
+		{"/staging/old/bar", 301, "/new/bar"},
+		{"/foo/bar", 404, ""},
+		{"/gone", 404, ""},
+		{"/", 404, ""},
+	}
+	for _, ex := range examples {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest("GET", ex.path, nil))
+		got := rw.Body.String()
+		if rw.Code == http.StatusMovedPermanently {
+			got = rw.Header().Get("Location")
+		}
+		if rw.Code != ex.status || (ex.expected != "" && got != ex.expected) {
+			t.Errorf("%s: expected %d %q, got %d %q", ex.path, ex.status, ex.expected, rw.Code, got)
+		}
+	}
+}
+
+func TestRejectMalformedPaths(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		rt := newTestRouter(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("served"))
+		}))
+		var buf bytes.Buffer
+		rt.logger, _ = logger.New(&buf)
+		if strict {
+			rt.RejectMalformedPaths()
+		}
+
+		examples := []struct {
+			requestURI string
+			malformed  bool
+		}{
+			{"/foo/bar?baz=%zz", false},
+			{"/foo%20bar", false},
+			{"/caf%C3%A9/a%2Fb", false},
+			{"/foo%2", true},
+			{"/%zz/bar", true},
+			{"/foo%00", true},
+			{"/foo%0d%0aSet-Cookie:%20x", true},
+		}
+		for _, ex := range examples {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RequestURI = ex.requestURI
+			// Mimic what the server would have decoded, as far as possible.
+			if u, err := url.ParseRequestURI(ex.requestURI); err == nil {
+				req.URL = u
+			}
+			rw := httptest.NewRecorder()
+			rt.ServeHTTP(rw, req)
+
+			expected := http.StatusOK
+			if strict && ex.malformed {
+				expected = http.StatusBadRequest
+			}
+			if rw.Code != expected {
+				t.Errorf("With strict paths %v, expected %s to get %d, got %d", strict, ex.requestURI, expected, rw.Code)
+			}
+		}
+
+		rt.logger.Flush()
+		if logged := strings.Count(buf.String(), "malformed path"); strict && logged != 4 || !strict && logged != 0 {
+			t.Errorf("With strict paths %v, expected each rejected request to be logged, got %q", strict, buf.String())
+		}
+	}
+}
+
+func TestReloadDuringInFlightRequest(t *testing.T) {
+	testReloadDuringInFlightRequest(t, "ReloadRoutes", (*Router).ReloadRoutes)
+	// Replacing just the changed backend must release its connection in
+	// the same way.
+	testReloadDuringInFlightRequest(t, "ReloadBackends", (*Router).ReloadBackends)
+}
+
+func testReloadDuringInFlightRequest(t *testing.T, name string, reload func(*Router) error) {
+	started, release := make(chan struct{}), make(chan struct{})
+	closed := make(chan struct{}, 10)
+	oldBackend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "old")
+	}))
+	oldBackend.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	oldBackend.Start()
+	defer oldBackend.Close()
+	newBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "new")
+	}))
+	defer newBackend.Close()
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "5s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	source := &staticRouteSource{
+		backends: []Backend{{BackendId: "frontend", BackendURL: oldBackend.URL}},
+		routes:   []Route{{IncomingPath: "/", RouteType: "prefix", Handler: "backend", BackendId: "frontend"}},
+	}
+	rt.AddRouteSource("static", source)
+	rt.ReloadRoutes()
+
+	serve := func() string {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest("GET", "/foo", nil))
+		return fmt.Sprintf("%d %s", rw.Code, rw.Body.String())
+	}
+	slow := make(chan string)
+	go func() { slow <- serve() }()
+	<-started
+
+	source.backends = []Backend{{BackendId: "frontend", BackendURL: newBackend.URL}}
+	if err := reload(rt); err != nil {
+		t.Fatalf("%s: unexpected error: %v", name, err)
+	}
+	if got := serve(); got != "200 new" {
+		t.Errorf("%s: expected requests after the reload to use the new backend, got %q", name, got)
+	}
+	select {
+	case <-closed:
+		t.Errorf("%s: expected the old backend's connection to be kept while a request is using it", name)
+	case <-time.After(3 * drainPollInterval):
+	}
+
+	close(release)
+	if got := <-slow; got != "200 old" {
+		t.Errorf("%s: expected the in-flight request to complete with the old backend, got %q", name, got)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Errorf("%s: expected the old backend's connection to be closed once its request had finished", name)
+	}
+}
+
+func TestLazyBackends(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "served")
+	}))
+	defer backend.Close()
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.LoadBackendsLazily()
+	backends, _, _, _ := rt.loadBackends([]Backend{
+		{BackendId: "used", BackendURL: backend.URL},
+		{BackendId: "unused", BackendURL: backend.URL},
+	})
+	mux := rt.newMux()
+	rt.loadRoutes([]Route{
+		{IncomingPath: "/used", RouteType: "prefix", Handler: "backend", BackendId: "used"},
+		{IncomingPath: "/unused", RouteType: "prefix", Handler: "backend", BackendId: "unused"},
+	}, mux, backends, nil)
+	rt.mux.Store(mux)
+	rt.ready.Store(true)
+
+	for _, id := range []string{"used", "unused"} {
+		if backends[id].(*handlers.LazyHandler).Built() {
+			t.Errorf("Expected backend %s not to be built when loaded", id)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest("GET", "/used/foo", nil))
+		if rw.Code != http.StatusOK || rw.Body.String() != "served" {
+			t.Errorf("Expected the lazily built backend to serve the request, got %d %q", rw.Code, rw.Body.String())
+		}
+	}
+	if !backends["used"].(*handlers.LazyHandler).Built() || backends["unused"].(*handlers.LazyHandler).Built() {
+		t.Error("Expected only the backend which was sent a request to be built")
+	}
+}
+
+func TestRequestTimeoutBudget(t *testing.T) {
+	remaining := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		remaining <- r.Header.Get("X-Timeout-Ms")
+	}))
+	defer backend.Close()
+
+	rt, err := NewRouter("1s", "5s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.SendTimeoutHeader("X-Timeout-Ms")
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{{BackendId: "backend", BackendURL: backend.URL}},
+		routes:   []Route{{IncomingPath: "/", RouteType: "prefix", Handler: "backend", BackendId: "backend"}},
+	})
+	rt.ReloadRoutes()
+
+	examples := []struct {
+		clientTimeout string
+		min, max      int
+	}{
+		{"", 800, 1000},
+		{"200", 100, 200},
+		{"5000", 800, 1000}, // clients can't extend the router's timeout
+		{"nonsense", 800, 1000},
+	}
+	for _, ex := range examples {
+		req := httptest.NewRequest("GET", "/foo", nil)
+		if ex.clientTimeout != "" {
+			req.Header.Set("X-Request-Timeout", ex.clientTimeout)
+		}
+		rt.ServeHTTP(httptest.NewRecorder(), req)
+		ms, _ := strconv.Atoi(<-remaining)
+		if ms < ex.min || ms > ex.max {
+			t.Errorf("With X-Request-Timeout %q, expected the backend to be told %d-%dms are left, got %d", ex.clientTimeout, ex.min, ex.max, ms)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/slow", nil)
+	req.Header.Set("X-Request-Timeout", "100")
+	rw := httptest.NewRecorder()
+	start := time.Now()
+	rt.ServeHTTP(rw, req)
+	if elapsed := time.Since(start); rw.Code != http.StatusGatewayTimeout || elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the request to be cut off with a 504 after 100ms, got %d after %v", rw.Code, elapsed)
+	}
+}
+
+func TestStaticRoutesWinOverPrefixes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+	robots := filepath.Join(t.TempDir(), "robots.txt")
+	os.WriteFile(robots, []byte("User-agent: *\nDisallow: /search\n"), 0644)
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET,HEAD", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend,static"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{{BackendId: "backend", BackendURL: backend.URL}},
+		routes: []Route{
+			{IncomingPath: "/", RouteType: "prefix", Handler: "backend", BackendId: "backend", Priority: 10},
+			{IncomingPath: "/robots.txt", RouteType: "prefix", Handler: "backend", BackendId: "backend"},
+			{IncomingPath: "/.well-known/security.txt", RouteType: "exact", Handler: "static", StaticBody: "Contact: mailto:security@example.com\n"},
+		},
+	})
+	files, err := NewStaticFilesRouteSource("/robots.txt=" + robots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.AddRouteSource("static-files", files)
+	if err := rt.ReloadRoutes(); err != nil {
+		t.Fatalf("Unexpected error loading routes: %v", err)
+	}
+
+	examples := []struct {
+		method, path, body string
+	}{
+		{"GET", "/robots.txt", "User-agent: *\nDisallow: /search\n"},
+		{"HEAD", "/robots.txt", ""},
+		{"GET", "/.well-known/security.txt", "Contact: mailto:security@example.com\n"},
+		{"GET", "/robots.txt/foo", "backend"},
+		{"GET", "/foo", "backend"},
+	}
+	for _, ex := range examples {
+		rw := httptest.NewRecorder()
+		rt.ServeHTTP(rw, httptest.NewRequest(ex.method, ex.path, nil))
+		if rw.Code != http.StatusOK || rw.Body.String() != ex.body {
+			t.Errorf("%s %s: expected 200 %q, got %d %q", ex.method, ex.path, ex.body, rw.Code, rw.Body.String())
+		}
+	}
+}
+
+func TestBackendFlushInterval(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/events" {
+			w.Header().Set("Content-Type", "text/event-stream")
+		} else {
+			w.Header().Set("Content-Length", "100")
+		}
+		w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer backend.Close()
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "5s", AllowedMethods: "GET", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: []Backend{
+			{BackendId: "default", BackendURL: backend.URL},
+			{BackendId: "flushed", BackendURL: backend.URL, FlushIntervalMs: 10},
+		},
+		routes: []Route{
+			{IncomingPath: "/events", RouteType: "exact", Handler: "backend", BackendId: "default"},
+			{IncomingPath: "/fixed", RouteType: "exact", Handler: "backend", BackendId: "default"},
+			{IncomingPath: "/fixed-flushed", RouteType: "exact", Handler: "backend", BackendId: "flushed"},
+		},
+	})
+	rt.ReloadRoutes()
+	server := httptest.NewServer(rt)
+	defer server.Close()
+
+	examples := []struct {
+		path    string
+		flushed bool
+	}{
+		{"/events", true}, // server-sent events are always flushed as they arrive
+		{"/fixed", false},
+		{"/fixed-flushed", true},
+	}
+	for _, ex := range examples {
+		// Until something is flushed, even the response headers are held
+		// back, so the request is made in the background.
+		event := make(chan string, 1)
+		go func() {
+			resp, err := http.Get(server.URL + ex.path)
+			if err != nil {
+				event <- err.Error()
+				return
+			}
+			defer resp.Body.Close()
+			line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+			event <- line
+		}()
+		select {
+		case line := <-event:
+			if !ex.flushed {
+				t.Errorf("%s: expected the response to be held back until it was complete, got %q", ex.path, line)
+			} else if line != "data: first\n" {
+				t.Errorf("%s: expected the first event, got %q", ex.path, line)
+			}
+		case <-time.After(500 * time.Millisecond):
+			if ex.flushed {
+				t.Errorf("%s: expected the first event to arrive before the backend finished", ex.path)
+			}
+		}
+	}
+}
+
+func TestContentTypeRoutes(t *testing.T) {
+	var backends []Backend
+	for _, name := range []string{"frontend", "api", "uploads"} {
+		name := name
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		defer server.Close()
+		backends = append(backends, Backend{BackendId: name, BackendURL: server.URL})
+	}
+
+	rt, err := NewRouter("1s", "1s", "/dev/null", RouterOptions{RequestTimeout: "1s", AllowedMethods: "GET,POST", ResponseCacheSize: "1", NotFoundStatus: "404", AllowedHandlers: "backend"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating router: %v", err)
+	}
+	rt.AddRouteSource("static", &staticRouteSource{
+		backends: backends,
+		routes: []Route{
+			{IncomingPath: "/submit", RouteType: "prefix", Handler: "backend", BackendId: "frontend",
+				ContentTypeBackends: map[string]string{"application/json": "api", "multipart/form-data": "uploads"}},
+			{IncomingPath: "/broken", RouteType: "prefix", Handler: "backend", BackendId: "frontend",
+				ContentTypeBackends: map[string]string{"application/json": "missing"}},
+		},
+	})
+	rt.ReloadRoutes()
+
+	examples := []struct {
+		path, contentType, expected string
+		status                      int
+	}{
+		{"/submit/form", "application/json; charset=utf-8", "api", http.StatusOK},
+		{"/submit/form", "multipart/form-data; boundary=xyz", "uploads", http.StatusOK},
+		{"/submit/form", "application/x-www-form-urlencoded", "frontend", http.StatusOK},
+		{"/submit/form", "", "frontend", http.StatusOK},
+		{"/broken/form", "application/json", "", http.StatusNotFound},
+	}
+	for _, ex := range examples {
+		r := httptest.NewRequest("POST", ex.path, strings.NewReader("{}"))
+		if ex.contentType != "" {
+			r.Header.Set("Content-Type", ex.contentType)
+		}
+		w := httptest.NewRecorder()
+		rt.ServeHTTP(w, r)
+		if w.Code != ex.status || (ex.expected != "" && w.Body.String() != ex.expected) {
+			t.Errorf("Expected %s with Content-Type %q to get %d from %q, got %d %q", ex.path, ex.contentType, ex.status, ex.expected, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,31 @@
+require 'spec_helper'
+
+describe "restricting the handlers routes may use" do
+  start_router_around_all :port => 3167, :api_port => 3166, :extra_env => {
+    "ROUTER_ALLOWED_HANDLERS" => "redirect,gone",
+    "ROUTER_ALLOWED_REDIRECT_HOSTS" => "www.gov.uk",
+  }
+
+  before :each do
+    add_gone_route "/gone"
+    add_redirect_route "/relative", "/target"
+    add_redirect_route "/allowed", "https://www.gov.uk/target"
+    add_redirect_route "/disallowed", "https://example.com/target"
+    add_filesystem_route "/files", File.expand_path("../fixtures/filesystem", __FILE__), :prefix => true, :strip_prefix => "/files"
+    reload_routes(3166)
+  end
+
+  it "should load routes using allowed handlers" do
+    expect(router_request("/gone", :port => 3167).code).to eq(410)
+    expect(router_request("/relative", :port => 3167).code).to eq(301)
+    expect(router_request("/allowed", :port => 3167).code).to eq(301)
+  end
+
+  it "should skip routes using disallowed handlers or redirect hosts" do
+    expect(router_request("/files/hello.txt", :port => 3167).code).to eq(404)
+    expect(router_request("/disallowed", :port => 3167).code).to eq(404)
+
+    stats = JSON.parse(HTTPClient.get(api_url("/stats", 3166)).body)
+    expect(stats["routes"]["skipped"]).to eq(2)
+  end
+end
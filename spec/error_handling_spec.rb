@@ -27,4 +27,25 @@ describe "error handling" do
       expect(Time.parse(log_details["@timestamp"]).to_i).to be_within(5).of(Time.now.to_i)
     end
   end
+
+  describe "with the boom handler disabled" do
+    start_router_around_all :port => 3167, :api_port => 3166, :extra_env => {"ROUTER_ENABLE_BOOM" => ""}
+
+    before :each do
+      add_route "/boom", :handler => "boom"
+      reload_routes(3166)
+    end
+
+    it "should skip boom routes, and count and log them" do
+      response = router_request("/boom", :port => 3167)
+      expect(response.code).to eq(404)
+
+      stats = JSON.parse(HTTPClient.get(api_url("/stats", 3166)).body)
+      expect(stats["routes"]["skipped"]).to eq(1)
+
+      log_details = last_router_error_log_entry
+      expect(log_details["@fields"]["error"]).to eq("skipped route which uses the boom handler, which is disabled")
+      expect(log_details["@fields"]["route"]["handler"]).to eq("boom")
+    end
+  end
 end
@@ -0,0 +1,40 @@
+require 'spec_helper'
+
+describe "Filesystem routes" do
+  let(:document_root) { File.expand_path("../fixtures/filesystem", __FILE__) }
+
+  before :each do
+    add_filesystem_route("/assets", document_root, :prefix => true, :strip_prefix => "/assets")
+    add_filesystem_route("/no-root", "", :prefix => true)
+    reload_routes
+  end
+
+  it "should serve a file from the document root" do
+    response = router_request("/assets/hello.txt")
+    expect(response.code).to eq(200)
+    expect(response.body).to eq("Hello, world\n")
+    expect(response.headers["Content-Type"]).to start_with("text/plain")
+  end
+
+  it "should return a 404 for a missing file" do
+    response = router_request("/assets/missing.txt")
+    expect(response.code).to eq(404)
+  end
+
+  it "should not list the contents of a directory" do
+    response = router_request("/assets/listed/")
+    expect(response.code).to eq(404)
+    expect(response.body).not_to include("file.txt")
+  end
+
+  it "should serve a directory's index.html" do
+    response = router_request("/assets/indexed/")
+    expect(response.code).to eq(200)
+    expect(response.body).to eq("<p>Index</p>\n")
+  end
+
+  it "should skip routes without a document root" do
+    response = router_request("/no-root/hello.txt")
+    expect(response.code).to eq(404)
+  end
+end
@@ -0,0 +1,36 @@
+require 'spec_helper'
+
+describe "HEAD requests" do
+  start_backend_around_all :port => 3163, :type => :echo
+
+  before :each do
+    add_backend "backend", "http://localhost:3163/"
+    add_backend_route "/backend", "backend"
+    add_redirect_route "/redirect", "/target"
+    add_gone_route "/gone"
+    add_filesystem_route "/assets", File.expand_path("../fixtures/filesystem", __FILE__), :prefix => true, :strip_prefix => "/assets"
+    reload_routes
+  end
+
+  %w(/redirect /gone /assets/hello.txt).each do |path|
+    it "should return the same status and headers as a GET for #{path}, without a body" do
+      get = HTTPClient.get(router_url(path))
+      head = HTTPClient.head(router_url(path))
+
+      expect(head.code).to eq(get.code)
+      %w(Content-Length Content-Type Location Cache-Control).each do |name|
+        expect(head.headers[name]).to eq(get.headers[name])
+      end
+      expect(head.body).to eq("")
+    end
+  end
+
+  it "should pass HEAD requests through to backends, without a body" do
+    get = HTTPClient.get(router_url("/backend"))
+    head = HTTPClient.head(router_url("/backend"))
+
+    expect(head.code).to eq(200)
+    expect(head.headers["Content-Type"]).to eq(get.headers["Content-Type"])
+    expect(head.body).to eq("")
+  end
+end
@@ -0,0 +1,35 @@
+require 'spec_helper'
+
+describe "requests which match no route" do
+  it "should return the standard 404 by default" do
+    reload_routes
+    response = router_request("/not-here")
+    expect(response.code).to eq(404)
+    expect(response.body).to eq("404 page not found\n")
+  end
+
+  describe "with a custom not-found response" do
+    start_router_around_all :port => 3167, :api_port => 3166, :extra_env => {
+      "ROUTER_NOTFOUND_STATUS" => "404",
+      "ROUTER_NOTFOUND_CONTENT_TYPE" => "application/json",
+      "ROUTER_NOTFOUND_BODY" => '{"error":"not_found"}',
+    }
+
+    before :each do
+      add_gone_route("/gone")
+      reload_routes(3166)
+    end
+
+    it "should return the configured status, content type and body" do
+      response = router_request("/not-here", :port => 3167)
+      expect(response.code).to eq(404)
+      expect(response.headers["Content-Type"]).to eq("application/json")
+      expect(response.body).to eq('{"error":"not_found"}')
+    end
+
+    it "should still serve matching routes" do
+      response = router_request("/gone", :port => 3167)
+      expect(response.code).to eq(410)
+    end
+  end
+end
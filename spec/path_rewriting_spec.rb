@@ -0,0 +1,33 @@
+require 'spec_helper'
+
+describe "rewriting request paths" do
+  start_backend_around_all :port => 3163, :type => :echo
+
+  before :each do
+    add_backend "backend", "http://localhost:3163/"
+    add_backend_route "/old", "backend", :prefix => true,
+      :rewrite_pattern => "^/old/(.*)$", :rewrite_replacement => "/v2/$1"
+    reload_routes
+  end
+
+  it "should substitute capture groups into the path sent to the backend" do
+    response = router_request("/old/foo/bar?baz=qux")
+    expect(response.code).to eq(200)
+    expect(JSON.parse(response.body)["Request"]["RequestURI"]).to eq("/v2/foo/bar?baz=qux")
+  end
+
+  it "should pass paths which don't match through unchanged" do
+    response = router_request("/old")
+    expect(response.code).to eq(200)
+    expect(JSON.parse(response.body)["Request"]["RequestURI"]).to eq("/old")
+  end
+
+  it "should skip routes with invalid patterns" do
+    add_backend_route "/broken", "backend", :rewrite_pattern => "^/broken/(", :rewrite_replacement => "/$1"
+    reload_routes
+
+    response = router_request("/broken")
+    expect(response.code).to eq(404)
+    expect(last_router_error_log_entry["@fields"]["error"]).to start_with("skipped route which has invalid rewrite pattern")
+  end
+end
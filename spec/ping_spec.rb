@@ -0,0 +1,32 @@
+require 'spec_helper'
+
+describe "Ping endpoints" do
+
+  before :each do
+    add_backend("down", "http://localhost:3164/")
+    add_backend_route("/app", "down", :prefix => true)
+    add_ping_route("/app/healthcheck")
+    add_ping_route("/other/healthcheck", :ping_body => "other app OK")
+    reload_routes
+  end
+
+  it "should return a 200 without contacting the backend" do
+    response = router_request("/app/healthcheck")
+    expect(response.code).to eq(200)
+    expect(response.body).to eq("OK")
+
+    response = router_request("/app/foo")
+    expect(response.code).to eq(502)
+  end
+
+  it "should return the configured body" do
+    response = router_request("/other/healthcheck")
+    expect(response.code).to eq(200)
+    expect(response.body).to eq("other app OK")
+  end
+
+  it "should not be cacheable" do
+    response = router_request("/app/healthcheck")
+    expect(response["Cache-Control"]).to eq("no-cache")
+  end
+end
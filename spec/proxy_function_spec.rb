@@ -110,6 +110,87 @@ describe "functioning as a reverse proxy" do
         expect(response.code).to eq(200)
         expect(response).to have_response_body("Tarpit")
       end
+
+      describe "overridden for a backend or route" do
+        before :each do
+          add_backend "patient-tarpit1", "http://localhost:3160/", "header_timeout_ms" => 2000
+          add_backend_route "/patient-backend", "patient-tarpit1"
+          add_backend_route "/patient-route", "tarpit1", "header_timeout_ms" => 2000
+          add_backend_route "/impatient-route", "patient-tarpit1", "header_timeout_ms" => 300
+          reload_routes(3166)
+        end
+
+        it "should use the backend's timeout in place of the default" do
+          response = router_request("/patient-backend", :port => 3167)
+          expect(response.code).to eq(200)
+        end
+
+        it "should use the route's timeout in place of the default" do
+          response = router_request("/patient-route", :port => 3167)
+          expect(response.code).to eq(200)
+        end
+
+        it "should use the route's timeout in place of the backend's" do
+          response = router_request("/impatient-route", :port => 3167)
+          expect(response.code).to eq(504)
+        end
+      end
+    end
+
+    describe "overall request timeout" do
+      start_router_around_all :port => 3167, :api_port => 3166, :extra_env => {"ROUTER_REQUEST_TIMEOUT" => "0.5s"}
+      start_backend_around_all :port => 3160, :type => :tarpit, "response-delay" => "1h"
+      start_backend_around_all :port => 3161, :type => :tarpit, "response-delay" => "0s", "body-delay" => "1h"
+
+      before :each do
+        add_backend "tarpit-headers", "http://localhost:3160/"
+        add_backend "tarpit-body", "http://localhost:3161/"
+        add_backend_route "/tarpit-headers", "tarpit-headers"
+        add_backend_route "/tarpit-body", "tarpit-body"
+        reload_routes(3166)
+      end
+
+      it "should log and return a 504 if no response has started within the configured request timeout" do
+        start = Time.now
+        response = HTTPClient.get(router_url("/tarpit-headers", 3167), :header => {
+          "X-Varnish" => "12341113",
+        })
+        duration = Time.now - start
+
+        expect(response.code).to eq(504)
+        expect(duration).to be_within(0.2).of(0.5)
+
+        log_details = last_router_error_log_entry
+        expect(log_details["@fields"]).to eq({
+          "error" => "request timed out after 500ms",
+          "request" => "GET /tarpit-headers HTTP/1.1",
+          "request_method" => "GET",
+          "status" => 504,
+          "varnish_id" => "12341113",
+        })
+        expect(Time.parse(log_details["@timestamp"]).to_i).to be_within(5).of(Time.now.to_i)
+      end
+
+      it "should log and cut the response short if the body is still being sent after the request timeout" do
+        start = Time.now
+        expect {
+          HTTPClient.get(router_url("/tarpit-body", 3167), :header => {
+            "X-Varnish" => "12341114",
+          })
+        }.to raise_error
+        duration = Time.now - start
+
+        expect(duration).to be_within(0.2).of(0.5)
+
+        log_details = last_router_error_log_entry
+        expect(log_details["@fields"]).to eq({
+          "error" => "request timed out after 500ms",
+          "request" => "GET /tarpit-body HTTP/1.1",
+          "request_method" => "GET",
+          "status" => 200,
+          "varnish_id" => "12341114",
+        })
+      end
     end
   end
 
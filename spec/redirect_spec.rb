@@ -112,5 +112,97 @@ describe "Redirection" do
         expect(response.headers['Location']).to eq("http://bar.example.com/bar?baz=qux")
       end
     end
+
+    describe "https redirect" do
+      before :each do
+        add_redirect_route("/secure", "https://other.example.org/path")
+        reload_routes
+      end
+
+      it "should redirect to the external URL verbatim" do
+        response = router_request("/secure")
+        expect(response.code).to eq(301)
+        expect(response.headers['Location']).to eq("https://other.example.org/path")
+      end
+    end
+
+    describe "protocol-relative redirects" do
+      before :each do
+        add_redirect_route("/proto", "//other.example.org/path")
+        add_redirect_route("/proto-prefix", "//other.example.org/prefix", :prefix => true)
+        reload_routes
+      end
+
+      it "should redirect to the protocol-relative URL verbatim" do
+        response = router_request("/proto")
+        expect(response.code).to eq(301)
+        expect(response.headers['Location']).to eq("//other.example.org/path")
+      end
+
+      it "should preserve the path and query string" do
+        response = router_request("/proto-prefix/baz?qux=quux")
+        expect(response.headers['Location']).to eq("//other.example.org/prefix/baz?qux=quux")
+      end
+    end
+  end
+
+  describe "invalid redirect targets" do
+    before :each do
+      add_redirect_route("/no-host", "http:///path")
+      add_redirect_route("/bad-scheme", "javascript://alert(1)")
+      add_redirect_route("/javascript", "javascript:alert(1)")
+      add_redirect_route("/data", "data:text/html,hi")
+      add_redirect_route("/mailto", "mailto:x@y")
+      add_redirect_route("/missing-slash", "http:/foo")
+      add_redirect_route("/valid", "/bar")
+      reload_routes
+    end
+
+    it "should skip routes with a malformed target" do
+      response = router_request("/no-host")
+      expect(response.code).to eq(404)
+    end
+
+    it "should skip routes with an unsupported scheme" do
+      response = router_request("/bad-scheme")
+      expect(response.code).to eq(404)
+    end
+
+    it "should skip routes with an unsupported scheme and no slashes" do
+      %w(/javascript /data /mailto).each do |path|
+        response = router_request(path)
+        expect(response.code).to eq(404)
+      end
+    end
+
+    it "should skip routes with a scheme but no host" do
+      response = router_request("/missing-slash")
+      expect(response.code).to eq(404)
+    end
+
+    it "should still load routes with valid targets" do
+      response = router_request("/valid")
+      expect(response.code).to eq(301)
+      expect(response.headers['Location']).to eq("/bar")
+    end
+  end
+
+  describe "redirect loops" do
+    before :each do
+      add_redirect_route("/loop", "/loop")
+      add_redirect_route("/loop-prefix", "/loop-prefix", :prefix => true)
+      reload_routes
+    end
+
+    it "should return a 508 for a redirect to the same URL" do
+      response = router_request("/loop")
+      expect(response.code).to eq(508)
+      expect(response.headers['Location']).to be_nil
+    end
+
+    it "should return a 508 for a prefix redirect to its own prefix" do
+      response = router_request("/loop-prefix/foo?bar=baz")
+      expect(response.code).to eq(508)
+    end
   end
 end
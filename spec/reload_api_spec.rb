@@ -59,6 +59,11 @@ describe "reload API endpoint" do
         expect(@data["routes"]["count"]).to eq(3)
       end
 
+      it "should return the number of routes and backends skipped" do
+        expect(@data["routes"]["skipped"]).to eq(0)
+        expect(@data["backends"]["skipped"]).to eq(0)
+      end
+
       it "should return a checksum calculated from the sorted paths and route_types" do
         s = Digest::SHA1.new
         s << "/baz(true)"
@@ -87,6 +92,60 @@ describe "reload API endpoint" do
       end
     end
 
+    describe "checksum only" do
+      before :each do
+        add_redirect_route("/foo", "/bar", :prefix => true)
+        reload_routes
+      end
+
+      it "should return the same checksum as the full stats as plain text" do
+        stats = JSON.parse(HTTPClient.get(api_url("/stats")).body)
+
+        response = HTTPClient.get(api_url("/stats/checksum"))
+        expect(response.status).to eq(200)
+        expect(response.headers["Content-Type"]).to eq("text/plain")
+        expect(response.body.strip).to eq(stats["routes"]["checksum"])
+      end
+
+      it "should respond with 405 for other verbs" do
+        response = HTTPClient.post(api_url("/stats/checksum"))
+        expect(response.status).to eq(405)
+        expect(response.headers["Allow"]).to eq("GET")
+      end
+    end
+
+    describe "resetting counters" do
+      start_backend_around_all :port => 3160, :type => :counter, "cache-control" => "max-age=60"
+
+      before :each do
+        add_backend "counter", "http://localhost:3160/"
+        add_backend_route "/cached", "counter", :cache_responses => true
+        reload_routes
+      end
+
+      it "should zero the counters, leaving the routes in place" do
+        router_request("/cached")
+        router_request("/cached")
+        stats = JSON.parse(HTTPClient.get(api_url("/stats")).body)
+        expect(stats["cache"]["hits"]).to be > 0
+
+        response = HTTPClient.post(api_url("/stats/reset"))
+        expect(response.status).to eq(200)
+
+        after = JSON.parse(HTTPClient.get(api_url("/stats")).body)
+        expect(after["cache"]["hits"]).to eq(0)
+        expect(after["cache"]["misses"]).to eq(0)
+        expect(after["routes"]["count"]).to eq(stats["routes"]["count"])
+        expect(after["routes"]["checksum"]).to eq(stats["routes"]["checksum"])
+      end
+
+      it "should respond with 405 for other verbs" do
+        response = HTTPClient.get(api_url("/stats/reset"))
+        expect(response.status).to eq(405)
+        expect(response.headers["Allow"]).to eq("POST")
+      end
+    end
+
     it "should respond with 405 for other verbs" do
       response = HTTPClient.post(api_url("/stats"))
       expect(response.status).to eq(405)
@@ -94,4 +153,52 @@ describe "reload API endpoint" do
       expect(response.headers["Allow"]).to eq("GET")
     end
   end
+
+  describe "route matching" do
+    before :each do
+      add_redirect_route("/foo", "/bar", :prefix => true)
+      add_redirect_route("/foo/bar", "/baz", :prefix => false)
+      reload_routes
+    end
+
+    def match(path)
+      response = HTTPClient.get(api_url("/debug/match"), :query => {"path" => path})
+      expect(response.status).to eq(200)
+      JSON.parse(response.body)
+    end
+
+    it "should report an exact match" do
+      data = match("/foo//bar/")
+      expect(data["matched"]).to eq(true)
+      expect(data["trie"]).to eq("exact")
+      expect(data["route"]).to eq("incoming_path" => "/foo/bar", "route_type" => "exact")
+      expect(data["segments"]).to eq(["foo", "bar"])
+      expect(data["normalized_path"]).to eq("/foo/bar")
+    end
+
+    it "should report a prefix match" do
+      data = match("/foo/baz")
+      expect(data["matched"]).to eq(true)
+      expect(data["trie"]).to eq("prefix")
+      expect(data["route"]).to eq("incoming_path" => "/foo", "route_type" => "prefix")
+    end
+
+    it "should report a miss" do
+      data = match("/qux")
+      expect(data["matched"]).to eq(false)
+      expect(data).not_to have_key("route")
+      expect(data["segments"]).to eq(["qux"])
+    end
+
+    it "should respond with 400 without a path" do
+      response = HTTPClient.get(api_url("/debug/match"))
+      expect(response.status).to eq(400)
+    end
+
+    it "should respond with 405 for other verbs" do
+      response = HTTPClient.post(api_url("/debug/match"))
+      expect(response.status).to eq(405)
+      expect(response.headers["Allow"]).to eq("GET")
+    end
+  end
 end
@@ -0,0 +1,40 @@
+require 'spec_helper'
+require 'zlib'
+require 'stringio'
+
+describe "decompressing request bodies" do
+  start_backend_around_all :port => 3163, :type => :echo
+
+  def gzip(data)
+    io = StringIO.new
+    gz = Zlib::GzipWriter.new(io)
+    gz.write(data)
+    gz.close
+    io.string
+  end
+
+  before :each do
+    add_backend "backend", "http://localhost:3163/"
+    add_backend_route "/decompressed", "backend", :decompress_requests => true
+    add_backend_route "/untouched", "backend"
+    reload_routes
+  end
+
+  it "should pass the decoded body to the backend" do
+    response = HTTPClient.post(router_url("/decompressed"), gzip("Hello, backend"), "Content-Encoding" => "gzip")
+    expect(response.code).to eq(200)
+
+    data = JSON.parse(response.body)
+    expect(data["Body"]).to eq("Hello, backend")
+    expect(data["Request"]["Header"]["Content-Encoding"]).to be_nil
+  end
+
+  it "should leave bodies for other routes untouched" do
+    response = HTTPClient.post(router_url("/untouched"), gzip("Hello, backend"), "Content-Encoding" => "gzip")
+    expect(response.code).to eq(200)
+
+    data = JSON.parse(response.body)
+    expect(data["Body"]).not_to eq("Hello, backend")
+    expect(data["Request"]["Header"]["Content-Encoding"]).to eq(["gzip"])
+  end
+end
@@ -0,0 +1,50 @@
+require 'spec_helper'
+
+describe "filtering requests by method" do
+  start_backend_around_all :port => 3163, :type => :echo
+
+  before :each do
+    add_backend "backend", "http://localhost:3163/"
+    add_backend_route "/foo", "backend", :prefix => true
+    reload_routes
+  end
+
+  it "should pass standard methods through to the backend" do
+    %w(GET POST PUT PATCH DELETE OPTIONS).each do |method|
+      response = HTTPClient.new.request(method, router_url("/foo"))
+      expect(response.code).to eq(200)
+      expect(JSON.parse(response.body)["Request"]["Method"]).to eq(method)
+    end
+  end
+
+  it "should reject TRACE requests by default" do
+    response = HTTPClient.new.request("TRACE", router_url("/foo"))
+    expect(response.code).to eq(405)
+    expect(response.headers["Allow"]).to eq("GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+  end
+
+  it "should reject requests with an unknown method" do
+    response = HTTPClient.new.request("FOO", router_url("/foo"))
+    expect(response.code).to eq(405)
+  end
+
+  describe "with a configured list of methods" do
+    start_router_around_all :port => 3167, :api_port => 3166, :extra_env => {"ROUTER_ALLOWED_METHODS" => "GET,TRACE"}
+
+    before :each do
+      reload_routes(3166)
+    end
+
+    it "should allow TRACE requests when configured" do
+      response = HTTPClient.new.request("TRACE", router_url("/foo", 3167))
+      expect(response.code).to eq(200)
+      expect(JSON.parse(response.body)["Request"]["Method"]).to eq("TRACE")
+    end
+
+    it "should reject methods which aren't in the list" do
+      response = HTTPClient.new.request("POST", router_url("/foo", 3167))
+      expect(response.code).to eq(405)
+      expect(response.headers["Allow"]).to eq("GET, TRACE")
+    end
+  end
+end
@@ -0,0 +1,85 @@
+require 'spec_helper'
+
+describe "caching backend responses" do
+  start_backend_around_all :port => 3160, :type => :counter, "cache-control" => "max-age=1"
+
+  def cache_stats
+    response = HTTPClient.get(api_url("/stats"))
+    JSON.parse(response.body)["cache"]
+  end
+
+  before :each do
+    add_backend "counter", "http://localhost:3160/"
+    add_backend_route "/cached", "counter", :prefix => true, :cache_responses => true
+    add_backend_route "/uncached", "counter", :prefix => true
+    reload_routes
+  end
+
+  it "should serve repeated requests from the cache" do
+    stats_before = cache_stats
+    first = router_request("/cached/foo")
+    second = router_request("/cached/foo")
+
+    expect(first.code).to eq(200)
+    expect(second.body).to eq(first.body)
+    expect(second.headers["Age"]).not_to be_nil
+
+    stats = cache_stats
+    expect(stats["hits"] - stats_before["hits"]).to eq(1)
+    expect(stats["misses"] - stats_before["misses"]).to eq(1)
+  end
+
+  it "should key the cache on the path and query string" do
+    first = router_request("/cached/foo")
+    expect(router_request("/cached/bar").body).not_to eq(first.body)
+    expect(router_request("/cached/foo?bar=baz").body).not_to eq(first.body)
+  end
+
+  it "should expire entries after max-age" do
+    first = router_request("/cached/foo")
+    sleep 1.1
+    second = router_request("/cached/foo")
+    expect(second.body).not_to eq(first.body)
+  end
+
+  it "should bypass the cache for requests with Cache-Control: no-cache" do
+    first = router_request("/cached/foo")
+    second = HTTPClient.get(router_url("/cached/foo"), :header => {"Cache-Control" => "no-cache"})
+    expect(second.body).not_to eq(first.body)
+  end
+
+  it "should not cache responses with no-store or private" do
+    first = router_request("/cached/foo?cache_control=no-store")
+    expect(router_request("/cached/foo?cache_control=no-store").body).not_to eq(first.body)
+
+    first = router_request("/cached/foo?cache_control=private,max-age=60")
+    expect(router_request("/cached/foo?cache_control=private,max-age=60").body).not_to eq(first.body)
+  end
+
+  it "should not cache responses to unsafe methods" do
+    first = HTTPClient.post(router_url("/cached/foo"))
+    second = HTTPClient.post(router_url("/cached/foo"))
+    expect(second.body).not_to eq(first.body)
+  end
+
+  it "should not cache responses for routes without caching enabled" do
+    first = router_request("/uncached/foo")
+    second = router_request("/uncached/foo")
+    expect(second.body).not_to eq(first.body)
+  end
+
+  it "should discard cached responses when the routes are changed" do
+    first = router_request("/cached/foo")
+    add_backend_route "/other", "counter"
+    reload_routes
+    second = router_request("/cached/foo")
+    expect(second.body).not_to eq(first.body)
+  end
+
+  it "should keep cached responses when reloading unchanged routes" do
+    first = router_request("/cached/foo")
+    reload_routes
+    second = router_request("/cached/foo")
+    expect(second.body).to eq(first.body)
+  end
+end
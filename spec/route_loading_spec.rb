@@ -31,6 +31,28 @@ describe "loading routes from the db" do
     end
   end
 
+  context "a route with an unrecognised route type" do
+    before :each do
+      add_backend_route("/foo", "backend-1")
+      add_backend_route("/bar", "backend-2", :route_type => "fooey")
+      add_backend_route("/baz", "backend-2", :prefix => true)
+      reload_routes
+    end
+
+    it "should skip the invalid route" do
+      response = router_request("/bar")
+      expect(response.code).to eq(404)
+    end
+
+    it "should continue to load other routes" do
+      response = router_request("/foo")
+      expect(response).to have_response_body("backend 1")
+
+      response = router_request("/baz/qux")
+      expect(response).to have_response_body("backend 2")
+    end
+  end
+
   context "a route with a non-existent backend" do
     before :each do
       add_backend_route("/foo", "backend-1")
@@ -57,3 +79,77 @@ describe "loading routes from the db" do
     end
   end
 end
+
+describe "reporting routes skipped while loading" do
+  def route_stats
+    response = HTTPClient.get(api_url("/stats"))
+    JSON.parse(response.body)
+  end
+
+  before :each do
+    add_backend("backend-1", "http://localhost:3160/")
+    add_backend_route("/foo", "backend-1")
+  end
+
+  it "should report no skipped routes when all routes are valid" do
+    reload_routes
+    expect(route_stats["routes"]["skipped"]).to eq(0)
+    expect(route_stats["backends"]["skipped"]).to eq(0)
+  end
+
+  it "should count and log routes with an unknown backend" do
+    add_backend_route("/bar", "backend-bar")
+    reload_routes
+
+    expect(route_stats["routes"]["skipped"]).to eq(1)
+    log_details = last_router_error_log_entry
+    expect(log_details["@fields"]["error"]).to eq("skipped route which references unknown backend backend-bar")
+    expect(log_details["@fields"]["route"]["incoming_path"]).to eq("/bar")
+    expect(log_details["@fields"]["route"]["backend_id"]).to eq("backend-bar")
+  end
+
+  it "should count and log routes with an unknown handler type" do
+    add_route("/bar", :handler => "fooey")
+    reload_routes
+
+    expect(route_stats["routes"]["skipped"]).to eq(1)
+    log_details = last_router_error_log_entry
+    expect(log_details["@fields"]["error"]).to eq("skipped route which has unknown handler type fooey")
+    expect(log_details["@fields"]["route"]["handler"]).to eq("fooey")
+  end
+
+  it "should count and log routes with an unknown route type" do
+    add_backend_route("/bar", "backend-1", :route_type => "fooey")
+    reload_routes
+
+    expect(route_stats["routes"]["skipped"]).to eq(1)
+    log_details = last_router_error_log_entry
+    expect(log_details["@fields"]["error"]).to eq('skipped route which has invalid route type (error: unknown route type "fooey")')
+    expect(log_details["@fields"]["route"]["route_type"]).to eq("fooey")
+  end
+
+  it "should count and log routes with an invalid redirect target" do
+    add_redirect_route("/bar", "http:///bar")
+    reload_routes
+
+    expect(route_stats["routes"]["skipped"]).to eq(1)
+    log_details = last_router_error_log_entry
+    expect(log_details["@fields"]["error"]).to start_with("skipped route which has invalid redirect target http:///bar")
+    expect(log_details["@fields"]["route"]["redirect_to"]).to eq("http:///bar")
+  end
+
+  it "should count and log backends with an unparseable URL, and the routes referencing them" do
+    add_backend("backend-bad", "http://%zz/")
+    add_backend_route("/bar", "backend-bad")
+    reload_routes
+
+    stats = route_stats
+    expect(stats["backends"]["skipped"]).to eq(1)
+    expect(stats["routes"]["skipped"]).to eq(1)
+
+    entries = LOGFILE.readlines.map { |line| JSON.parse(line) }
+    backend_entry = entries.find { |e| e["@fields"]["backend"] }
+    expect(backend_entry["@fields"]["error"]).to start_with("skipped backend which has unparseable URL http://%zz/")
+    expect(backend_entry["@fields"]["backend"]["backend_id"]).to eq("backend-bad")
+  end
+end
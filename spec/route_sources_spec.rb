@@ -0,0 +1,53 @@
+require 'spec_helper'
+require 'tempfile'
+
+describe "loading routes from several sources" do
+  route_file = Tempfile.new(["routes", ".json"])
+
+  def write_route_file(file, routes)
+    File.write(file.path, JSON.generate({"backends" => [], "routes" => routes}))
+  end
+
+  def gone(path)
+    {"incoming_path" => path, "route_type" => "exact", "handler" => "gone"}
+  end
+
+  start_router_around_all :port => 3167, :api_port => 3166, :extra_env => {
+    "ROUTER_ROUTE_SOURCE" => "mongo,file",
+    "ROUTER_ROUTE_FILE" => route_file.path,
+  }
+
+  before :each do
+    write_route_file(route_file, [gone("/from-file"), gone("/both")])
+    add_route "/from-mongo", :handler => "redirect", :redirect_to => "/elsewhere"
+    add_route "/both", :handler => "redirect", :redirect_to => "/elsewhere"
+    reload_routes(3166)
+  end
+
+  it "should serve the routes from all of the sources" do
+    expect(router_request("/from-file", :port => 3167).code).to eq(410)
+    expect(router_request("/from-mongo", :port => 3167).code).to eq(301)
+  end
+
+  it "should give the last source precedence" do
+    expect(router_request("/both", :port => 3167).code).to eq(410)
+  end
+
+  it "should reload just the named source" do
+    write_route_file(route_file, [gone("/from-file-reloaded")])
+    add_route "/from-mongo-later", :handler => "gone"
+
+    response = HTTPClient.post(api_url("/reload?source=file", 3166))
+    expect(response.code).to eq(200)
+
+    expect(router_request("/from-file", :port => 3167).code).to eq(404)
+    expect(router_request("/from-file-reloaded", :port => 3167).code).to eq(410)
+    expect(router_request("/from-mongo", :port => 3167).code).to eq(301)
+    expect(router_request("/from-mongo-later", :port => 3167).code).to eq(404)
+  end
+
+  it "should 404 when asked to reload an unknown source" do
+    response = HTTPClient.post(api_url("/reload?source=consul", 3166))
+    expect(response.code).to eq(404)
+  end
+end
@@ -24,12 +24,17 @@ module RouterHelpers
 
   LOGFILE = Tempfile.new("router_error_log")
 
-  def last_router_error_log_line
-    LOGFILE.readlines.last
+  def router_error_log_entries
+    LOGFILE.readlines.map { |line| JSON.parse(line) }
   end
 
+  # The last entry which isn't a lifecycle event (such as "routes_loaded").
   def last_router_error_log_entry
-    JSON.parse(last_router_error_log_line)
+    router_error_log_entries.reject { |entry| entry["@fields"].has_key?("event") }.last
+  end
+
+  def router_lifecycle_events
+    router_error_log_entries.map { |entry| entry["@fields"]["event"] }.compact
   end
 
   def reset_router_error_log
@@ -61,6 +66,7 @@ module RouterHelpers
         "ROUTER_APIADDR"  => ":#{api_port}",
         "ROUTER_MONGO_DB" => "router_test",
         "ROUTER_ERROR_LOG" => LOGFILE.path,
+        "ROUTER_ENABLE_BOOM" => "1",
       }.merge(extra_env)
 
       if ENV['USE_COMPILED_ROUTER']
@@ -1,8 +1,8 @@
 require 'mongo'
 
 module RoutesHelpers
-  def add_backend(id, url)
-    RoutesHelpers.db["backends"].insert({"backend_id" => id, "backend_url" => url})
+  def add_backend(id, url, attrs = {})
+    RoutesHelpers.db["backends"].insert(attrs.merge({"backend_id" => id, "backend_url" => url}))
   end
 
   def add_backend_route(path, backend_id, options = {})
@@ -17,8 +17,16 @@ module RoutesHelpers
     add_route path, options.merge(:handler => "gone")
   end
 
+  def add_ping_route(path, options = {})
+    add_route path, options.merge(:handler => "ping")
+  end
+
+  def add_filesystem_route(path, document_root, options = {})
+    add_route path, options.merge(:handler => "filesystem", :document_root => document_root)
+  end
+
   def add_route(path, attrs = {})
-    route_type = attrs.delete(:prefix) ? 'prefix' : 'exact'
+    route_type = attrs.delete(:route_type) || (attrs.delete(:prefix) ? 'prefix' : 'exact')
     RoutesHelpers.db["routes"].insert(attrs.merge({
       "incoming_path" => path,
       "route_type" => route_type,
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+var port = flag.Int("port", 3160, "The port to listen on")
+var cacheControl = flag.String("cache-control", "", "Cache-Control header to be returned with each response")
+
+var (
+	mu      sync.Mutex
+	counter int
+)
+
+// counterResponse returns a body which changes with every request, so that
+// tests can tell whether a response was served from a cache.
+func counterResponse(w http.ResponseWriter, r *http.Request) {
+	mu.Lock()
+	counter++
+	count := counter
+	mu.Unlock()
+
+	if cc := r.URL.Query().Get("cache_control"); cc != "" {
+		w.Header().Set("Cache-Control", cc)
+	} else if *cacheControl != "" {
+		w.Header().Set("Cache-Control", *cacheControl)
+	}
+	fmt.Fprintf(w, "response %d\n", count)
+}
+
+func main() {
+	flag.Parse()
+
+	addr := fmt.Sprintf(":%d", *port)
+
+	err := http.ListenAndServe(addr, http.HandlerFunc(counterResponse))
+	if err != nil {
+		log.Fatal("ListenAndServe: ", err)
+	}
+}
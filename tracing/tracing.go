@@ -0,0 +1,119 @@
+// Package tracing provides optional OpenTelemetry instrumentation for the
+// router. Until Enable is called, all of its functions are no-ops and the
+// handlers it is asked to wrap are returned untouched.
+package tracing
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+const instrumentationName = "github.com/alphagov/router"
+
+var (
+	enabled    bool
+	tracer     trace.Tracer
+	propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+)
+
+// Enable turns on tracing, recording spans with the passed provider. It must
+// be called before any handlers are wrapped.
+func Enable(provider trace.TracerProvider) {
+	tracer = provider.Tracer(instrumentationName)
+	enabled = true
+}
+
+// Enabled reports whether tracing has been turned on.
+func Enabled() bool {
+	return enabled
+}
+
+// Handler wraps a handler so that each request is served within a server
+// span. The span's parent is taken from any trace context headers
+// (traceparent/tracestate) on the incoming request.
+func Handler(handler http.Handler) http.Handler {
+	if !enabled {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, "router "+r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+			))
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(sw, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", sw.status))
+		if sw.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	})
+}
+
+// RouteHandler wraps the handler registered for a route so that the matched
+// route (and the backend, if any) are recorded on the request's span.
+func RouteHandler(handler http.Handler, path, routeType, handlerType, backendId string) http.Handler {
+	if !enabled {
+		return handler
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("http.route", path),
+		attribute.String("router.route_type", routeType),
+		attribute.String("router.handler", handlerType),
+	}
+	if backendId != "" {
+		attrs = append(attrs, attribute.String("router.backend_id", backendId))
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace.SpanFromContext(r.Context()).SetAttributes(attrs...)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// RecordClientAddress records the address of the client which made the
+// request on the request's span.
+func RecordClientAddress(r *http.Request, addr string) {
+	if !enabled {
+		return
+	}
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("client.address", addr))
+}
+
+// Inject adds the trace context headers for the request's span to an
+// outgoing request to a backend.
+func Inject(req *http.Request) {
+	if !enabled {
+		return
+	}
+	propagator.Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+}
+
+// statusWriter records the status code of the response passing through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	sw.status = code
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
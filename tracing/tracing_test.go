@@ -0,0 +1,121 @@
+package tracing
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// teapotHandler is a pointer type, so that handlers can be compared.
+type teapotHandler struct{}
+
+func (h *teapotHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusTeapot)
+}
+
+var teapot = &teapotHandler{}
+
+// disableAfter returns tracing to its initial, disabled state at the end of
+// the test.
+func disableAfter(t *testing.T) {
+	t.Cleanup(func() {
+		enabled = false
+		tracer = nil
+	})
+}
+
+func TestDisabledIsNoop(t *testing.T) {
+	if Enabled() {
+		t.Fatal("Expected tracing to be disabled by default")
+	}
+	if h := Handler(teapot); h != http.Handler(teapot) {
+		t.Errorf("Expected Handler to return the handler it was passed, got %v", h)
+	}
+	if h := RouteHandler(teapot, "/foo", "exact", "backend", "foo"); h != http.Handler(teapot) {
+		t.Errorf("Expected RouteHandler to return the handler it was passed, got %v", h)
+	}
+
+	req, _ := http.NewRequest("GET", "http://backend/foo", nil)
+	Inject(req)
+	if len(req.Header) != 0 {
+		t.Errorf("Expected Inject not to add any headers, got %v", req.Header)
+	}
+}
+
+func TestSpanAttributesAndPropagation(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	Enable(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	disableAfter(t)
+
+	var outgoing *http.Request
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		RecordClientAddress(r, "203.0.113.7")
+		outgoing, _ = http.NewRequest("GET", "http://backend/foo/bar", nil)
+		outgoing = outgoing.WithContext(r.Context())
+		Inject(outgoing)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	handler := Handler(RouteHandler(backend, "/foo", "prefix", "backend", "foo-app"))
+
+	req := httptest.NewRequest("GET", "/foo/bar", nil)
+	req.Header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+
+	if got := span.Parent.TraceID().String(); got != "0af7651916cd43dd8448eb211c80319c" {
+		t.Errorf("Expected span to continue the incoming trace, got trace ID %s", got)
+	}
+
+	expected := map[attribute.Key]attribute.Value{
+		"http.request.method":       attribute.StringValue("GET"),
+		"url.path":                  attribute.StringValue("/foo/bar"),
+		"http.route":                attribute.StringValue("/foo"),
+		"router.route_type":         attribute.StringValue("prefix"),
+		"router.handler":            attribute.StringValue("backend"),
+		"router.backend_id":         attribute.StringValue("foo-app"),
+		"http.response.status_code": attribute.IntValue(502),
+		"client.address":            attribute.StringValue("203.0.113.7"),
+	}
+	actual := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes {
+		actual[kv.Key] = kv.Value
+	}
+	for k, v := range expected {
+		if actual[k] != v {
+			t.Errorf("Expected span attribute %s to be %v, was %v", k, v.Emit(), actual[k].Emit())
+		}
+	}
+	if span.Status.Code.String() != "Error" {
+		t.Errorf("Expected span status to be Error for a 502, was %v", span.Status.Code)
+	}
+
+	traceparent := outgoing.Header.Get("Traceparent")
+	expectedParent := "00-0af7651916cd43dd8448eb211c80319c-" + span.SpanContext.SpanID().String() + "-01"
+	if traceparent != expectedParent {
+		t.Errorf("Expected outgoing traceparent to be %s, was %s", expectedParent, traceparent)
+	}
+}
+
+func TestHandlerPassesFlushesThrough(t *testing.T) {
+	Enable(sdktrace.NewTracerProvider())
+	disableAfter(t)
+
+	handler := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/stream", nil))
+	if !w.Flushed {
+		t.Error("Expected Flush to be passed through to the client")
+	}
+}
@@ -75,6 +75,30 @@ func (t *Trie) GetLongestPrefix(path []string) (entry interface{}, ok bool) {
 	return t.getentry()
 }
 
+// GetAllPrefixes retrieves every element from the Trie whose path is a
+// prefix of (or equal to) the passed path, ordered from the shortest path to
+// the longest. Example:
+//
+//     for _, res := range trie.GetAllPrefixes([]string{"foo", "bar"}) {
+//       fmt.Println("Value at /foo/bar or above was", res)
+//     }
+func (t *Trie) GetAllPrefixes(path []string) (entries []interface{}) {
+	node := t
+	for i := 0; ; i++ {
+		if entry, ok := node.getentry(); ok {
+			entries = append(entries, entry)
+		}
+		if i == len(path) {
+			return
+		}
+		child, ok := node.Children[path[i]]
+		if !ok {
+			return
+		}
+		node = child
+	}
+}
+
 // Set creates an element in the Trie
 //
 // Takes a path (which can be empty, to denote the root element of the Trie),
@@ -116,6 +140,81 @@ func (t *Trie) Del(path []string) bool {
 	return res.Del(newpath)
 }
 
+// Clone returns a copy of the Trie, which can be modified without affecting
+// the original. The entries themselves are shared, not copied.
+func (t *Trie) Clone() *Trie {
+	clone := &Trie{
+		Leaf:     t.Leaf,
+		Entry:    t.Entry,
+		Children: make(trieChildren, len(t.Children)),
+	}
+	for key, child := range t.Children {
+		clone.Children[key] = child.Clone()
+	}
+	return clone
+}
+
+// Walk calls fn with the path and value of every element in the Trie, in no
+// particular order.
+func (t *Trie) Walk(fn func(path []string, entry interface{})) {
+	t.walk(nil, fn)
+}
+
+// Count returns the number of elements in the Trie.
+func (t *Trie) Count() (count int) {
+	t.Walk(func([]string, interface{}) {
+		count++
+	})
+	return
+}
+
+// TrieStats describes the shape of a Trie.
+type TrieStats struct {
+	// Nodes is the number of nodes in the Trie, including the root and
+	// nodes left without an element by Del.
+	Nodes int `json:"nodes"`
+	// MaxDepth is the length of the longest path from the root to a node.
+	MaxDepth int `json:"max_depth"`
+	// AverageBranching is the mean number of children of the nodes which
+	// have any.
+	AverageBranching float64 `json:"average_branching"`
+}
+
+// Stats walks the Trie to count its nodes and measure its depth and
+// branching factor.
+func (t *Trie) Stats() TrieStats {
+	var stats TrieStats
+	var parents, children int
+	var walk func(node *Trie, depth int)
+	walk = func(node *Trie, depth int) {
+		stats.Nodes++
+		if depth > stats.MaxDepth {
+			stats.MaxDepth = depth
+		}
+		if len(node.Children) > 0 {
+			parents++
+			children += len(node.Children)
+		}
+		for _, child := range node.Children {
+			walk(child, depth+1)
+		}
+	}
+	walk(t, 0)
+	if parents > 0 {
+		stats.AverageBranching = float64(children) / float64(parents)
+	}
+	return stats
+}
+
+func (t *Trie) walk(path []string, fn func(path []string, entry interface{})) {
+	if t.Leaf {
+		fn(path, t.Entry)
+	}
+	for key, child := range t.Children {
+		child.walk(append(path[:len(path):len(path)], key), fn)
+	}
+}
+
 func (t *Trie) setentry(value interface{}) {
 	t.Leaf = true
 	t.Entry = value
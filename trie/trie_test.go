@@ -1,6 +1,8 @@
 package trie
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -201,6 +203,117 @@ func TestDelReturnsStatus(t *testing.T) {
 	}
 }
 
+func TestCloneIsIndependent(t *testing.T) {
+	trie := NewTrie()
+	trie.Set([]string{"foo"}, "foo")
+	trie.Set([]string{"foo", "bar"}, "bar")
+
+	clone := trie.Clone()
+	clone.Set([]string{"foo", "baz"}, "baz")
+	clone.Set([]string{"foo"}, "changed")
+	clone.Del([]string{"foo", "bar"})
+
+	if val, ok := trie.Get([]string{"foo"}); !ok || val != "foo" {
+		t.Errorf("Expected the original to still map foo to foo, got %v (%v)", val, ok)
+	}
+	if val, ok := trie.Get([]string{"foo", "bar"}); !ok || val != "bar" {
+		t.Errorf("Expected the original to still contain foo/bar, got %v (%v)", val, ok)
+	}
+	if _, ok := trie.Get([]string{"foo", "baz"}); ok {
+		t.Error("Expected the original not to contain foo/baz")
+	}
+	if val, ok := clone.Get([]string{"foo"}); !ok || val != "changed" {
+		t.Errorf("Expected the clone to map foo to changed, got %v (%v)", val, ok)
+	}
+	if _, ok := clone.Get([]string{"foo", "bar"}); ok {
+		t.Error("Expected foo/bar to be deleted from the clone")
+	}
+}
+
+func TestWalk(t *testing.T) {
+	trie := NewTrie()
+	trie.Set([]string{}, "root")
+	trie.Set([]string{"foo", "bar"}, "bar")
+	trie.Set([]string{"foo", "baz"}, "baz")
+	trie.Set([]string{"qux"}, "qux")
+	trie.Del([]string{"qux"})
+
+	seen := make(map[string]interface{})
+	trie.Walk(func(path []string, entry interface{}) {
+		seen[strings.Join(path, "/")] = entry
+	})
+
+	expected := map[string]interface{}{"": "root", "foo/bar": "bar", "foo/baz": "baz"}
+	if len(seen) != len(expected) {
+		t.Errorf("Expected Walk to visit %v, visited %v", expected, seen)
+	}
+	for path, entry := range expected {
+		if seen[path] != entry {
+			t.Errorf("Expected Walk to visit %q with %v, got %v", path, entry, seen[path])
+		}
+	}
+}
+
+func TestCount(t *testing.T) {
+	trie := NewTrie()
+	if count := trie.Count(); count != 0 {
+		t.Errorf("Expected an empty trie to have a count of 0, got %d", count)
+	}
+	trie.Set([]string{}, "root")
+	trie.Set([]string{"foo", "bar"}, "bar")
+	trie.Set([]string{"foo", "bar"}, "replaced")
+	trie.Set([]string{"qux"}, "qux")
+	trie.Del([]string{"qux"})
+	if count := trie.Count(); count != 2 {
+		t.Errorf("Expected a count of 2, got %d", count)
+	}
+}
+
+func TestStats(t *testing.T) {
+	trie := NewTrie()
+	if stats := trie.Stats(); stats != (TrieStats{Nodes: 1}) {
+		t.Errorf("Expected an empty trie to have just its root, got %+v", stats)
+	}
+
+	trie.Set([]string{"foo"}, "foo")
+	trie.Set([]string{"foo", "bar"}, "bar")
+	trie.Set([]string{"foo", "baz", "qux"}, "qux")
+	trie.Set([]string{"quux"}, "quux")
+	// The nodes are still there after the element is deleted.
+	trie.Set([]string{"corge", "grault"}, "grault")
+	trie.Del([]string{"corge", "grault"})
+
+	// root -> foo, quux, corge; foo -> bar, baz; baz -> qux; corge -> grault
+	expected := TrieStats{Nodes: 8, MaxDepth: 3, AverageBranching: 7.0 / 4}
+	if stats := trie.Stats(); stats != expected {
+		t.Errorf("Expected stats %+v, got %+v", expected, stats)
+	}
+}
+
+func TestGetAllPrefixes(t *testing.T) {
+	trie := NewTrie()
+	trie.Set([]string{}, "root")
+	trie.Set([]string{"foo"}, "foo")
+	trie.Set([]string{"foo", "bar", "baz"}, "baz")
+	trie.Set([]string{"qux"}, "qux")
+
+	examples := []struct {
+		path     []string
+		expected string
+	}{
+		{[]string{}, "[root]"},
+		{[]string{"foo"}, "[root foo]"},
+		{[]string{"foo", "bar"}, "[root foo]"},
+		{[]string{"foo", "bar", "baz", "quux"}, "[root foo baz]"},
+		{[]string{"other"}, "[root]"},
+	}
+	for _, ex := range examples {
+		if got := fmt.Sprint(trie.GetAllPrefixes(ex.path)); got != ex.expected {
+			t.Errorf("Expected the prefixes of %v to be %s, got %s", ex.path, ex.expected, got)
+		}
+	}
+}
+
 func buildExampleTrie(t *testing.T, pairs []Pair) *Trie {
 	trie := NewTrie()
 	for _, p := range pairs {
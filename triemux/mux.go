@@ -5,38 +5,158 @@ package triemux
 
 import (
 	"crypto/sha1"
+	"encoding"
+	"errors"
+	"fmt"
 	"github.com/alphagov/router/trie"
 	"hash"
 	"log"
 	"net/http"
+	"net/url"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type Mux struct {
-	mu         sync.RWMutex
-	exactTrie  *trie.Trie
-	prefixTrie *trie.Trie
+	mu         sync.Mutex
+	handlerFor func(interface{}) (http.Handler, bool)
+	notFound   http.Handler
 	count      int
 	checksum   hash.Hash
+	shadowed   []RouteInfo
+	// strictTrailingSlash is the StrictTrailingSlash option.
+	strictTrailingSlash bool
+	// sum caches the value of checksum, which is costly to compute, until
+	// another route is registered.
+	sum atomic.Pointer[[]byte]
+	// tableSum is a checksum of the routes in the tries, kept up to date as
+	// they're registered, for VerifyTables. Unlike checksum it doesn't
+	// depend on the order of registration or cover replaced routes, so it
+	// can be recomputed from the tries.
+	tableSum [sha1.Size]byte
+
+	// tries is the snapshot of the routes which lookups read without
+	// locking, so it must never be modified once stored. Routes are
+	// registered in a copy, pending, which is stored in its place (and
+	// dirty cleared) before the next read.
+	tries   atomic.Pointer[muxTries]
+	pending *muxTries
+	dirty   atomic.Bool
+}
+
+// muxTries holds a mux's exact and prefix routes. prioritized is set once
+// any prefix route has a priority or a minimum number of extra segments, as
+// lookups then have to consider every matching prefix route rather than just
+// the longest.
+type muxTries struct {
+	exact       *trie.Trie
+	prefix      *trie.Trie
+	prioritized bool
 }
 
 type muxEntry struct {
-	prefix  bool
-	handler http.Handler
+	path             string
+	prefix           bool
+	value            interface{}
+	priority         int
+	depth            int
+	minExtraSegments int
+}
+
+// RouteInfo describes a route registered with a Mux. Value is the handler
+// (or, for routes registered with HandleValue, other value) for the route.
+type RouteInfo struct {
+	Path   string
+	Prefix bool
+	Value  interface{}
+}
+
+// MuxOptions customises the behaviour of a Mux.
+type MuxOptions struct {
+	// HandlerFor resolves the value registered for a route into the handler
+	// for a request matching it, returning false if it can't. It allows
+	// embedders to register richer values (such as route descriptions) with
+	// HandleValue, and construct their handlers lazily. By default the value
+	// must itself be an http.Handler.
+	HandlerFor func(value interface{}) (http.Handler, bool)
+
+	// NotFoundHandler serves requests which don't match any route. By
+	// default they receive http.NotFound.
+	NotFoundHandler http.Handler
+
+	// StrictTrailingSlash makes a trailing slash significant for exact
+	// routes, so that /foo/ is a different route from /foo and each matches
+	// only its own path. By default trailing slashes are ignored, and an
+	// exact route for either matches both. Prefix routes ignore trailing
+	// slashes either way.
+	StrictTrailingSlash bool
 }
 
 // NewMux makes a new empty Mux.
 func NewMux() *Mux {
-	return &Mux{exactTrie: trie.NewTrie(), prefixTrie: trie.NewTrie(), checksum: sha1.New()}
+	return NewMuxWithOptions(MuxOptions{})
+}
+
+// NewMuxWithOptions makes a new empty Mux with the passed options.
+func NewMuxWithOptions(options MuxOptions) *Mux {
+	handlerFor := options.HandlerFor
+	if handlerFor == nil {
+		handlerFor = defaultHandlerFor
+	}
+	notFound := options.NotFoundHandler
+	if notFound == nil {
+		notFound = http.NotFoundHandler()
+	}
+	mux := &Mux{handlerFor: handlerFor, notFound: notFound, checksum: sha1.New(), strictTrailingSlash: options.StrictTrailingSlash}
+	mux.tries.Store(&muxTries{exact: trie.NewTrie(), prefix: trie.NewTrie()})
+	return mux
+}
+
+// snapshot returns the current routes, first publishing any which have been
+// registered since they were last read. Once routes have been published, as
+// they normally are before a mux starts serving requests, this takes no
+// locks.
+func (mux *Mux) snapshot() *muxTries {
+	if mux.dirty.Load() {
+		mux.mu.Lock()
+		mux.publish()
+		mux.mu.Unlock()
+	}
+	return mux.tries.Load()
+}
+
+// publish replaces the snapshot with the pending routes. mu must be held.
+func (mux *Mux) publish() {
+	if mux.pending != nil {
+		mux.tries.Store(mux.pending)
+		mux.pending = nil
+	}
+	mux.dirty.Store(false)
+}
+
+// writable returns the tries routes should be registered in, copying the
+// snapshot if there are no pending changes yet. mu must be held.
+func (mux *Mux) writable() *muxTries {
+	if mux.pending == nil {
+		current := mux.tries.Load()
+		mux.pending = &muxTries{current.exact.Clone(), current.prefix.Clone(), current.prioritized}
+	}
+	return mux.pending
+}
+
+func defaultHandlerFor(value interface{}) (http.Handler, bool) {
+	handler, ok := value.(http.Handler)
+	return handler, ok
 }
 
 // ServeHTTP dispatches the request to a backend with a registered route
-// matching the request path, or 404s.
+// matching the request path, or passes it to the not-found handler.
 func (mux *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	handler, ok := mux.lookup(r.URL.Path)
 	if !ok {
-		http.NotFound(w, r)
+		mux.notFound.ServeHTTP(w, r)
 		return
 	}
 
@@ -46,43 +166,438 @@ func (mux *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // lookup takes a path and looks up its registered entry in the mux trie,
 // returning the handler for that path, if any matches.
 func (mux *Mux) lookup(path string) (handler http.Handler, ok bool) {
-	mux.mu.RLock()
-	defer mux.mu.RUnlock()
-
 	pathSegments := splitpath(path)
-	val, ok := mux.exactTrie.Get(pathSegments)
+	entry, _, ok := mux.snapshot().find(mux.exactSegments(path, pathSegments), pathSegments)
 	if !ok {
-		val, ok = mux.prefixTrie.GetLongestPrefix(pathSegments)
+		return nil, false
 	}
+
+	handler, ok = mux.handlerFor(entry.value)
 	if !ok {
+		log.Printf("lookup: couldn't get a handler for the value (%v) registered for %s", entry.value, entry.path)
 		return nil, false
 	}
+	return handler, true
+}
+
+// find looks up the entry for a path, trying the exact trie (with the path's
+// exact segments) before the prefix trie. It returns the name of the trie
+// which matched.
+func (tries *muxTries) find(exactSegments, pathSegments []string) (entry muxEntry, trieName string, ok bool) {
+	val, ok := tries.exact.Get(exactSegments)
+	trieName = "exact"
+	if !ok {
+		if tries.prioritized {
+			val, ok = highestPriority(tries.prefix.GetAllPrefixes(pathSegments), len(pathSegments))
+		} else {
+			val, ok = tries.prefix.GetLongestPrefix(pathSegments)
+		}
+		trieName = "prefix"
+	}
+	if !ok {
+		return muxEntry{}, "", false
+	}
 
-	entry, ok := val.(muxEntry)
+	entry, ok = val.(muxEntry)
 	if !ok {
 		log.Printf("lookup: got value (%v) from trie that wasn't a muxEntry!", val)
-		return nil, false
+		return muxEntry{}, "", false
+	}
+	return entry, trieName, true
+}
+
+// highestPriority picks the entry with the highest priority from the
+// matching prefix routes, which are ordered from the shortest path to the
+// longest, so that the longest wins ties. Routes requiring more segments
+// than the path's length (segments) has beyond their own are passed over.
+func highestPriority(candidates []interface{}, segments int) (best interface{}, ok bool) {
+	bestPriority := 0
+	for _, val := range candidates {
+		priority := 0
+		if entry, isEntry := val.(muxEntry); isEntry {
+			if entry.depth+entry.minExtraSegments > segments {
+				continue
+			}
+			priority = entry.priority
+		}
+		if !ok || priority >= bestPriority {
+			best, bestPriority, ok = val, priority, true
+		}
 	}
+	return best, ok
+}
 
-	return entry.handler, ok
+// Match describes how a Mux resolves a path.
+type Match struct {
+	// Path is the path as passed to Match.
+	Path string
+	// Segments are the lookup segments the path was split into. With
+	// StrictTrailingSlash, a path with a trailing slash ends with an empty
+	// segment, which only exact routes take into account.
+	Segments []string
+	// NormalizedPath is the path rebuilt from its segments, with any empty
+	// segments (from leading, trailing or repeated slashes) removed, other
+	// than a trailing slash which is significant.
+	NormalizedPath string
+	// Trie is "exact" or "prefix", naming the trie which held the matching
+	// route, or empty if no route matched.
+	Trie string
+	// Route is the matching route, or nil if no route matched.
+	Route *RouteInfo
+}
+
+// Match reports how the mux would resolve the passed path, without serving
+// a request. It's intended for debugging the route table.
+func (mux *Mux) Match(path string) Match {
+	pathSegments := splitpath(path)
+	exactSegments := mux.exactSegments(path, pathSegments)
+	match := Match{
+		Path:           path,
+		Segments:       exactSegments,
+		NormalizedPath: "/" + strings.Join(exactSegments, "/"),
+	}
+	if entry, trieName, ok := mux.snapshot().find(exactSegments, pathSegments); ok {
+		match.Trie = trieName
+		match.Route = &RouteInfo{entry.path, entry.prefix, entry.value}
+	}
+	return match
+}
+
+// Candidates returns every route which matches the passed path, in the order
+// of precedence lookups use, so the first (if any) is the route Match finds.
+// An exact route for the path comes first, followed by the prefix routes
+// above it: those with higher priorities first, and then the longest first.
+// Prefix routes which need more segments than the path has beyond their own
+// aren't included. It's intended for debugging surprising matches.
+func (mux *Mux) Candidates(path string) []RouteInfo {
+	pathSegments := splitpath(path)
+	tries := mux.snapshot()
+
+	candidates := make([]RouteInfo, 0)
+	if val, ok := tries.exact.Get(mux.exactSegments(path, pathSegments)); ok {
+		if entry, ok := val.(muxEntry); ok {
+			candidates = append(candidates, RouteInfo{entry.path, entry.prefix, entry.value})
+		}
+	}
+	prefixes := make([]muxEntry, 0)
+	for _, val := range tries.prefix.GetAllPrefixes(pathSegments) {
+		if entry, ok := val.(muxEntry); ok && entry.depth+entry.minExtraSegments <= len(pathSegments) {
+			prefixes = append(prefixes, entry)
+		}
+	}
+	sort.SliceStable(prefixes, func(i, j int) bool {
+		if prefixes[i].priority != prefixes[j].priority {
+			return prefixes[i].priority > prefixes[j].priority
+		}
+		return prefixes[i].depth > prefixes[j].depth
+	})
+	for _, entry := range prefixes {
+		candidates = append(candidates, RouteInfo{entry.path, entry.prefix, entry.value})
+	}
+	return candidates
+}
+
+// Route returns the route registered for exactly the passed path and route
+// type, if there is one. Unlike Match, it doesn't consider which other routes
+// would serve the path.
+func (mux *Mux) Route(path string, prefix bool) (RouteInfo, bool) {
+	tries := mux.snapshot()
+	t := tries.exact
+	if prefix {
+		t = tries.prefix
+	}
+	val, ok := t.Get(mux.routeSegments(path, prefix))
+	entry, isEntry := val.(muxEntry)
+	if !ok || !isEntry {
+		return RouteInfo{}, false
+	}
+	return RouteInfo{entry.path, entry.prefix, entry.value}, true
 }
 
 // Handle registers the specified route (either an exact or a prefix route)
 // and associates it with the specified handler. Requests through the mux for
 // paths matching the route will be passed to that handler.
 func (mux *Mux) Handle(path string, prefix bool, handler http.Handler) {
+	mux.HandleValue(path, prefix, handler)
+}
+
+// HandleValue registers the specified route in the same way as Handle, but
+// associates it with an arbitrary value. The handler for requests matching
+// the route is found by passing the value to the mux's HandlerFor option (see
+// MuxOptions) when they're served.
+func (mux *Mux) HandleValue(path string, prefix bool, value interface{}) {
+	mux.handle(path, prefix, PrefixOptions{}, value)
+}
+
+// HandlePrefixWithPriority registers a prefix route in the same way as
+// HandleValue, but with a priority. Where more than one prefix route matches
+// a path, the one with the highest priority is chosen, and only where they
+// have the same priority does the longest win. Routes registered without a
+// priority have a priority of 0, so a broader prefix route with a positive
+// priority takes over the paths of the routes beneath it. Exact routes
+// still take precedence over all prefix routes for their own paths.
+func (mux *Mux) HandlePrefixWithPriority(path string, priority int, value interface{}) {
+	mux.handle(path, true, PrefixOptions{Priority: priority}, value)
+}
+
+// Replace swaps the handler of an already-registered route, keeping its
+// priority and other options, and reports whether there was such a route.
+// Unlike registering the route again, it isn't counted as another route or
+// reported as shadowing the original. The route checksum only covers the
+// routes' paths, types and options, so it's unchanged.
+func (mux *Mux) Replace(path string, prefix bool, handler http.Handler) bool {
+	return mux.ReplaceValue(path, prefix, handler)
+}
+
+// ReplaceValue swaps the value of an already-registered route, in the same
+// way as Replace.
+func (mux *Mux) ReplaceValue(path string, prefix bool, value interface{}) bool {
 	mux.mu.Lock()
 	defer mux.mu.Unlock()
 
-	mux.addToStats(path, prefix)
+	pathSegments := mux.routeSegments(path, prefix)
+	current := mux.pending
+	if current == nil {
+		current = mux.tries.Load()
+	}
+	t := current.exact
 	if prefix {
-		mux.prefixTrie.Set(splitpath(path), muxEntry{prefix, handler})
-	} else {
-		mux.exactTrie.Set(splitpath(path), muxEntry{prefix, handler})
+		t = current.prefix
+	}
+	val, ok := t.Get(pathSegments)
+	entry, isEntry := val.(muxEntry)
+	if !ok || !isEntry {
+		return false
+	}
+
+	tries := mux.writable()
+	t = tries.exact
+	if prefix {
+		t = tries.prefix
+	}
+	entry.value = value
+	t.Set(pathSegments, entry)
+	mux.dirty.Store(true)
+	return true
+}
+
+// PrefixOptions changes how a prefix route registered with HandlePrefix
+// matches.
+type PrefixOptions struct {
+	// Priority is the route's priority, as for HandlePrefixWithPriority.
+	Priority int
+	// MinExtraSegments is the number of path segments beyond the route's
+	// own which a path needs for the route to match it. A /foo route with
+	// a MinExtraSegments of 1 matches /foo/bar but not /foo, which is left
+	// to an exact route, a shorter prefix route or the not-found handler.
+	// It stops a prefix route such as / from serving its own path.
+	MinExtraSegments int
+}
+
+// HandlePrefix registers a prefix route in the same way as HandleValue, but
+// with the passed options.
+func (mux *Mux) HandlePrefix(path string, options PrefixOptions, value interface{}) {
+	mux.handle(path, true, options, value)
+}
+
+func (mux *Mux) handle(path string, prefix bool, options PrefixOptions, value interface{}) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	mux.addToStats(path, prefix, options)
+	tries := mux.writable()
+	t := tries.exact
+	if prefix {
+		t = tries.prefix
+	}
+	pathSegments := mux.routeSegments(path, prefix)
+	if val, ok := t.Get(pathSegments); ok {
+		if entry, ok := val.(muxEntry); ok {
+			mux.shadowed = append(mux.shadowed, RouteInfo{entry.path, entry.prefix, entry.value})
+			xorSum(&mux.tableSum, entrySum(pathSegments, entry))
+		}
+	}
+	entry := muxEntry{path, prefix, value, options.Priority, len(pathSegments), options.MinExtraSegments}
+	t.Set(pathSegments, entry)
+	xorSum(&mux.tableSum, entrySum(pathSegments, entry))
+	if options.Priority != 0 || options.MinExtraSegments != 0 {
+		tries.prioritized = true
+	}
+	mux.dirty.Store(true)
+}
+
+// ShadowedRoutes returns the routes which can never be selected by a lookup.
+//
+// An exact route always wins for its own path, and a prefix route always wins
+// for at least its own path's unregistered children unless a prefix route
+// above it has a higher priority, so the only routes which can be
+// unreachable are those replaced by a later registration of the same path
+// and route type, and prefix routes beneath a higher-priority prefix route.
+func (mux *Mux) ShadowedRoutes() []RouteInfo {
+	mux.mu.Lock()
+	shadowed := make([]RouteInfo, len(mux.shadowed))
+	copy(shadowed, mux.shadowed)
+	mux.mu.Unlock()
+
+	tries := mux.snapshot()
+	if !tries.prioritized {
+		return shadowed
+	}
+	outranked := make([]RouteInfo, 0)
+	tries.prefix.Walk(func(path []string, val interface{}) {
+		entry, ok := val.(muxEntry)
+		if !ok || len(path) == 0 {
+			return
+		}
+		for _, val := range tries.prefix.GetAllPrefixes(path[:len(path)-1]) {
+			// A higher-priority route only takes every path from the route
+			// beneath it if it doesn't need more segments than that does.
+			if above, ok := val.(muxEntry); ok && above.priority > entry.priority &&
+				above.depth+above.minExtraSegments <= entry.depth+entry.minExtraSegments {
+				outranked = append(outranked, RouteInfo{entry.path, entry.prefix, entry.value})
+				return
+			}
+		}
+	})
+	sort.Slice(outranked, func(i, j int) bool {
+		return outranked[i].Path < outranked[j].Path
+	})
+	return append(shadowed, outranked...)
+}
+
+// PrefixCoverage describes the exact routes registered beneath a prefix
+// route's path. Requests for paths beneath those exact routes (but not the
+// exact routes' own paths) are served by the prefix route.
+type PrefixCoverage struct {
+	Route RouteInfo
+	// ExactPaths are the paths of the exact routes below the prefix route's
+	// path, sorted.
+	ExactPaths []string
+}
+
+// PrefixCoverage returns the prefix routes which have exact routes
+// registered beneath them, sorted by path.
+func (mux *Mux) PrefixCoverage() []PrefixCoverage {
+	tries := mux.snapshot()
+	coverage := make([]PrefixCoverage, 0)
+	tries.prefix.Walk(func(path []string, val interface{}) {
+		entry, ok := val.(muxEntry)
+		if !ok {
+			return
+		}
+		node := tries.exact
+		for _, segment := range path {
+			if node = node.Children[segment]; node == nil {
+				return
+			}
+		}
+		exactPaths := make([]string, 0)
+		node.Walk(func(subpath []string, val interface{}) {
+			if exact, ok := val.(muxEntry); ok && len(subpath) > 0 {
+				exactPaths = append(exactPaths, exact.path)
+			}
+		})
+		if len(exactPaths) > 0 {
+			sort.Strings(exactPaths)
+			coverage = append(coverage, PrefixCoverage{RouteInfo{entry.path, entry.prefix, entry.value}, exactPaths})
+		}
+	})
+
+	sort.Slice(coverage, func(i, j int) bool {
+		return coverage[i].Route.Path < coverage[j].Route.Path
+	})
+	return coverage
+}
+
+// Routes returns the routes which can currently be selected by a lookup,
+// sorted by path, with exact routes before prefix routes at the same path.
+func (mux *Mux) Routes() []RouteInfo {
+	tries := mux.snapshot()
+	routes := make([]RouteInfo, 0)
+	collect := func(path []string, val interface{}) {
+		if entry, ok := val.(muxEntry); ok {
+			routes = append(routes, RouteInfo{entry.path, entry.prefix, entry.value})
+		}
+	}
+	tries.exact.Walk(collect)
+	tries.prefix.Walk(collect)
+
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return !routes[i].Prefix && routes[j].Prefix
+	})
+	return routes
+}
+
+// ParseRouteType maps a route type string onto the prefix flag taken by
+// Handle. "prefix" routes match the path and everything beneath it, and
+// "exact" routes (the default if routeType is empty) match only the path
+// itself. Any other route type is an error.
+func ParseRouteType(routeType string) (prefix bool, err error) {
+	switch routeType {
+	case "exact", "":
+		return false, nil
+	case "prefix":
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown route type %q", routeType)
+}
+
+// HandleByType registers the specified route in the same way as Handle, but
+// takes the route type as a string (see ParseRouteType). An error is returned
+// if the route type is not recognised, and no route is registered.
+func (mux *Mux) HandleByType(path, routeType string, handler http.Handler) error {
+	prefix, err := ParseRouteType(routeType)
+	if err != nil {
+		return err
+	}
+	mux.Handle(path, prefix, handler)
+	return nil
+}
+
+// Clone returns a copy of the mux, which can have further routes registered
+// without affecting the original. The registered handlers (or values) are
+// shared by the copy, as is the snapshot of the routes until either mux
+// registers another, while the stats are copied.
+func (mux *Mux) Clone() *Mux {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	mux.publish()
+	shadowed := make([]RouteInfo, len(mux.shadowed))
+	copy(shadowed, mux.shadowed)
+	clone := &Mux{
+		handlerFor:          mux.handlerFor,
+		notFound:            mux.notFound,
+		strictTrailingSlash: mux.strictTrailingSlash,
+		count:               mux.count,
+		checksum:            cloneHash(mux.checksum),
+		shadowed:            shadowed,
+		tableSum:            mux.tableSum,
 	}
+	clone.tries.Store(mux.tries.Load())
+	clone.sum.Store(mux.sum.Load())
+	return clone
 }
 
-func (mux *Mux) addToStats(path string, prefix bool) {
+// cloneHash copies the state of a hash (such as SHA-1) which supports binary
+// marshalling, as the standard library's hashes do.
+func cloneHash(h hash.Hash) hash.Hash {
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	clone := sha1.New()
+	if err := clone.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		panic(err)
+	}
+	return clone
+}
+
+func (mux *Mux) addToStats(path string, prefix bool, options PrefixOptions) {
+	mux.sum.Store(nil)
 	mux.count++
 	mux.checksum.Write([]byte(path))
 	if prefix {
@@ -90,14 +605,87 @@ func (mux *Mux) addToStats(path string, prefix bool) {
 	} else {
 		mux.checksum.Write([]byte("(false)"))
 	}
+	// Options are only written where they're set, so that the checksums of
+	// route tables without any are unchanged.
+	if options.Priority != 0 {
+		fmt.Fprintf(mux.checksum, "(priority %d)", options.Priority)
+	}
+	if options.MinExtraSegments != 0 {
+		fmt.Fprintf(mux.checksum, "(min extra segments %d)", options.MinExtraSegments)
+	}
 }
 
 func (mux *Mux) RouteCount() int {
 	return mux.count
 }
 
+// RouteCounts returns the number of distinct exact and prefix routes in the
+// mux. Unlike RouteCount, routes which were registered more than once are
+// only counted once.
+func (mux *Mux) RouteCounts() (exact, prefix int) {
+	tries := mux.snapshot()
+	return tries.exact.Count(), tries.prefix.Count()
+}
+
+// TrieStats returns the shape of the mux's exact and prefix tries.
+func (mux *Mux) TrieStats() (exact, prefix trie.TrieStats) {
+	tries := mux.snapshot()
+	return tries.exact.Stats(), tries.prefix.Stats()
+}
+
+// RouteChecksum returns a checksum of the routes registered with the mux, in
+// the order they were registered. It's computed once after each route is
+// registered, so reading it again is cheap. The result mustn't be modified.
 func (mux *Mux) RouteChecksum() []byte {
-	return mux.checksum.Sum(nil)
+	if sum := mux.sum.Load(); sum != nil {
+		return *sum
+	}
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	sum := mux.checksum.Sum(nil)
+	mux.sum.Store(&sum)
+	return sum
+}
+
+// VerifyTables checks that the routes in the mux's tries are those which
+// were registered, by recomputing their checksum from the tries and
+// comparing it with the one kept as they were registered. It returns an
+// error if they differ, which means the tries have been corrupted.
+func (mux *Mux) VerifyTables() error {
+	mux.mu.Lock()
+	mux.publish()
+	tries := mux.tries.Load()
+	expected := mux.tableSum
+	mux.mu.Unlock()
+
+	var actual [sha1.Size]byte
+	sum := func(path []string, val interface{}) {
+		if entry, ok := val.(muxEntry); ok {
+			xorSum(&actual, entrySum(path, entry))
+		}
+	}
+	tries.exact.Walk(sum)
+	tries.prefix.Walk(sum)
+	if actual != expected {
+		return fmt.Errorf("route tries have checksum %x, but %x was registered", actual, expected)
+	}
+	return nil
+}
+
+// entrySum returns the checksum of a route stored at path in a trie. It
+// covers where the route is stored as well as its own path, type and
+// options, so a route stored in the wrong place changes the checksum.
+func entrySum(path []string, entry muxEntry) [sha1.Size]byte {
+	return sha1.Sum([]byte(fmt.Sprintf("%q %q %v %d %d", path, entry.path, entry.prefix, entry.priority, entry.minExtraSegments)))
+}
+
+// xorSum adds (or, as it's its own inverse, removes) a route's checksum to a
+// checksum of a set of routes.
+func xorSum(sum *[sha1.Size]byte, entry [sha1.Size]byte) {
+	for i := range sum {
+		sum[i] ^= entry[i]
+	}
 }
 
 // splitpath turns a slash-delimited string into a lookup path (a slice
@@ -115,3 +703,47 @@ func splitpath(path string) []string {
 
 	return parts
 }
+
+// exactSegments returns the segments (from splitpath) of a path as they're
+// looked up in the exact trie. With StrictTrailingSlash, a trailing slash
+// (other than on the root) is kept as an empty last segment, which splitpath
+// never otherwise produces.
+func (mux *Mux) exactSegments(path string, pathSegments []string) []string {
+	if !mux.strictTrailingSlash || len(pathSegments) == 0 || !strings.HasSuffix(path, "/") {
+		return pathSegments
+	}
+	return append(pathSegments[:len(pathSegments):len(pathSegments)], "")
+}
+
+// routeSegments returns the segments a route is stored under in its trie.
+func (mux *Mux) routeSegments(path string, prefix bool) []string {
+	pathSegments := splitpath(path)
+	if prefix {
+		return pathSegments
+	}
+	return mux.exactSegments(path, pathSegments)
+}
+
+// ErrMalformedPath is returned by ValidatePath for paths whose
+// percent-encoding is malformed, or which decode to control characters.
+var ErrMalformedPath = errors.New("malformed path")
+
+// ValidatePath checks a path as the client sent it, before percent-decoding,
+// for a % which isn't followed by two hex digits, and for segments which
+// decode to control characters such as null bytes. Lookups always use the
+// decoded path, leniently, so this is for callers which would rather reject
+// such requests than route them on whatever bytes they decode to.
+func ValidatePath(escapedPath string) error {
+	for _, segment := range strings.Split(escapedPath, "/") {
+		decoded, err := url.PathUnescape(segment)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrMalformedPath, err)
+		}
+		for i := 0; i < len(decoded); i++ {
+			if c := decoded[i]; c < 0x20 || c == 0x7f {
+				return fmt.Errorf("%w: segment %q contains control character %#02x", ErrMalformedPath, segment, c)
+			}
+		}
+	}
+	return nil
+}
@@ -1,12 +1,17 @@
 package triemux
 
 import (
+	"bytes"
 	"crypto/sha1"
+	"errors"
 	"fmt"
+	"github.com/alphagov/router/trie"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -164,6 +169,48 @@ var lookupExamples = []LookupExample{
 			{"/bar", false, nil},
 		},
 	},
+	{ // paths are case-sensitive
+		registrations: []Registration{
+			{"/Foo", false, a},
+			{"/foo", true, b},
+		},
+		checks: []Check{
+			{"/Foo", true, a},
+			{"/foo", true, b},
+			{"/FOO", false, nil},
+			{"/Foo/bar", false, nil},
+			{"/foo/Bar", true, b},
+		},
+	},
+}
+
+func TestValidatePath(t *testing.T) {
+	examples := []struct {
+		path  string
+		valid bool
+	}{
+		{"/foo/bar", true},
+		{"/foo%20bar/baz", true},
+		{"/caf%C3%A9", true},
+		{"/a%2Fb", true},
+		{"/100%25", true},
+		{"/foo%2", false},
+		{"/foo%", false},
+		{"/%zz/bar", false},
+		{"/foo%00", false},
+		{"/foo%0Abar", false},
+		{"/foo%7f", false},
+		{"/foo\x00", false},
+	}
+	for _, ex := range examples {
+		err := ValidatePath(ex.path)
+		if ex.valid && err != nil {
+			t.Errorf("Expected %q to be valid, got %v", ex.path, err)
+		}
+		if !ex.valid && !errors.Is(err, ErrMalformedPath) {
+			t.Errorf("Expected %q to be malformed, got %v", ex.path, err)
+		}
+	}
 }
 
 func TestLookup(t *testing.T) {
@@ -189,6 +236,103 @@ func testLookup(t *testing.T, ex LookupExample) {
 	}
 }
 
+var handleByTypeExamples = []struct {
+	routeType string
+	ok        bool
+	checks    []Check
+}{
+	{"exact", true, []Check{{"/foo", true, a}, {"/foo/bar", false, nil}}},
+	{"prefix", true, []Check{{"/foo", true, a}, {"/foo/bar", true, a}}},
+	{"suffix", false, []Check{{"/foo", false, nil}}},
+	{"", true, []Check{{"/foo", true, a}, {"/foo/bar", false, nil}}},
+	{"Prefix", false, []Check{{"/foo", false, nil}}},
+}
+
+func TestHandleByType(t *testing.T) {
+	for _, ex := range handleByTypeExamples {
+		mux := NewMux()
+		err := mux.HandleByType("/foo", ex.routeType, a)
+		if ex.ok && err != nil {
+			t.Errorf("Expected HandleByType(%q) to succeed, got error %v", ex.routeType, err)
+		}
+		if !ex.ok && err == nil {
+			t.Errorf("Expected HandleByType(%q) to return an error", ex.routeType)
+		}
+		for _, c := range ex.checks {
+			handler, ok := mux.lookup(c.path)
+			if ok != c.ok || handler != c.handler {
+				t.Errorf("Expected lookup(%v) after HandleByType(%q) to be (%v, %v), was (%v, %v)",
+					c.path, ex.routeType, c.handler, c.ok, handler, ok)
+			}
+		}
+	}
+}
+
+var shadowedExamples = []struct {
+	registrations []Registration
+	shadowed      []RouteInfo
+}{
+	{ // no overlapping routes
+		[]Registration{{"/foo", false, a}, {"/foo/bar", true, b}},
+		[]RouteInfo{},
+	},
+	{ // an exact and a prefix route at the same path don't shadow each other
+		[]Registration{{"/foo", false, a}, {"/foo", true, b}},
+		[]RouteInfo{},
+	},
+	{ // a prefix route with an exact child doesn't shadow it
+		[]Registration{{"/foo", true, a}, {"/foo/bar", false, b}},
+		[]RouteInfo{},
+	},
+	{ // re-registering an exact route shadows the original
+		[]Registration{{"/foo", false, a}, {"/foo", false, b}},
+		[]RouteInfo{{"/foo", false, a}},
+	},
+	{ // re-registering a prefix route (with a different spelling) shadows the original
+		[]Registration{{"/foo", true, a}, {"/bar", true, b}, {"/foo/", true, c}},
+		[]RouteInfo{{"/foo", true, a}},
+	},
+}
+
+func TestShadowedRoutes(t *testing.T) {
+	for i, ex := range shadowedExamples {
+		mux := NewMux()
+		for _, r := range ex.registrations {
+			mux.Handle(r.path, r.prefix, r.handler)
+		}
+		shadowed := mux.ShadowedRoutes()
+		if len(shadowed) != len(ex.shadowed) {
+			t.Errorf("Example %d: expected %d shadowed routes, got %v", i, len(ex.shadowed), shadowed)
+			continue
+		}
+		for j := range ex.shadowed {
+			if shadowed[j] != ex.shadowed[j] {
+				t.Errorf("Example %d: expected shadowed route %v, got %v", i, ex.shadowed[j], shadowed[j])
+			}
+		}
+	}
+}
+
+// Shadowed routes must be exactly those which lookup can never return.
+func TestShadowedRoutesAreUnreachable(t *testing.T) {
+	for _, ex := range lookupExamples {
+		mux := NewMux()
+		for _, r := range ex.registrations {
+			mux.Handle(r.path, r.prefix, r.handler)
+		}
+		if len(mux.ShadowedRoutes()) != 0 {
+			t.Errorf("Expected no shadowed routes for %v, got %v", ex.registrations, mux.ShadowedRoutes())
+		}
+	}
+
+	mux := NewMux()
+	mux.Handle("/foo", false, a)
+	mux.Handle("/foo", false, b)
+	if handler, _ := mux.lookup("/foo"); handler != b {
+		t.Errorf("Expected lookup(/foo) to map to the most recent registration, was %v", handler)
+	}
+}
+
 var statsExample = []Registration{
 	{"/", false, a},
 	{"/foo", true, a},
@@ -206,6 +350,112 @@ func TestRouteCount(t *testing.T) {
 	}
 }
 
+func TestRouteCounts(t *testing.T) {
+	mux := NewMux()
+	for _, reg := range statsExample {
+		mux.Handle(reg.path, reg.prefix, reg.handler)
+	}
+	mux.Handle("/bar", false, a)
+	mux.Handle("/baz", true, a)
+	mux.Handle("/qux", true, a)
+
+	exact, prefix := mux.RouteCounts()
+	if exact != 2 || prefix != 3 {
+		t.Errorf("Expected 2 exact and 3 prefix routes, got %d and %d", exact, prefix)
+	}
+	if count := mux.RouteCount(); count != 6 {
+		t.Errorf("Expected RouteCount to include the repeated route, giving 6, got %d", count)
+	}
+}
+
+func TestTrieStats(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/", true, a)
+	mux.Handle("/foo", false, a)
+	mux.Handle("/foo/bar/baz", false, a)
+	mux.Handle("/qux", false, a)
+	mux.Handle("/government", true, a)
+	mux.Handle("/government/news", true, a)
+
+	exact, prefix := mux.TrieStats()
+	// root -> foo, qux; foo -> bar; bar -> baz
+	if exact != (trie.TrieStats{Nodes: 5, MaxDepth: 3, AverageBranching: 4.0 / 3}) {
+		t.Errorf("Unexpected exact trie stats %+v", exact)
+	}
+	// root -> government; government -> news
+	if prefix != (trie.TrieStats{Nodes: 3, MaxDepth: 2, AverageBranching: 1}) {
+		t.Errorf("Unexpected prefix trie stats %+v", prefix)
+	}
+}
+
+func TestChecksumIsCached(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/foo", false, a)
+	first := mux.RouteChecksum()
+	if again := mux.RouteChecksum(); !bytes.Equal(again, first) {
+		t.Errorf("Expected the checksum to be unchanged, got %x then %x", first, again)
+	}
+
+	// Replacing a handler leaves the checksum alone, but registering a
+	// route changes it, in the mux and not in a clone taken before.
+	mux.Replace("/foo", false, b)
+	if again := mux.RouteChecksum(); !bytes.Equal(again, first) {
+		t.Errorf("Expected replacing a handler not to change the checksum, got %x then %x", first, again)
+	}
+	clone := mux.Clone()
+	mux.Handle("/bar", true, b)
+	second := mux.RouteChecksum()
+	if bytes.Equal(second, first) {
+		t.Error("Expected registering a route to change the checksum")
+	}
+	if !bytes.Equal(clone.RouteChecksum(), first) {
+		t.Errorf("Expected the clone's checksum to be unchanged, got %x", clone.RouteChecksum())
+	}
+
+	// The cached checksum is the one which would be computed afresh.
+	if expected := mux.checksum.Sum(nil); !bytes.Equal(second, expected) {
+		t.Errorf("Expected the cached checksum %x to match the computed %x", second, expected)
+	}
+	clone.Handle("/bar", true, c)
+	if !bytes.Equal(clone.RouteChecksum(), second) {
+		t.Errorf("Expected the clone to get the same checksum for the same routes, got %x and %x", clone.RouteChecksum(), second)
+	}
+}
+
+func TestVerifyTables(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/foo", false, a)
+	mux.Handle("/foo", true, a)
+	mux.HandlePrefix("/bar", PrefixOptions{Priority: 1, MinExtraSegments: 1}, b)
+	mux.Handle("/foo/", false, b) // replaces /foo
+	mux.Replace("/foo", true, c)
+	clone := mux.Clone()
+	clone.Handle("/baz", false, c)
+	for name, m := range map[string]*Mux{"original": mux, "clone": clone} {
+		if err := m.VerifyTables(); err != nil {
+			t.Errorf("Expected the %s mux's tables to verify, got %v", name, err)
+		}
+	}
+
+	corrupted := mux.Clone()
+	corrupted.tableSum[0] ^= 1
+	if err := corrupted.VerifyTables(); err == nil {
+		t.Error("Expected a corrupted stored checksum to be detected")
+	}
+
+	// A route moved to the wrong place in a trie is detected too.
+	corrupted = mux.Clone()
+	tries := corrupted.tries.Load()
+	moved := &muxTries{tries.exact.Clone(), tries.prefix.Clone(), tries.prioritized}
+	entry, _ := moved.exact.Get([]string{"foo"})
+	moved.exact.Del([]string{"foo"})
+	moved.exact.Set([]string{"qux"}, entry)
+	corrupted.tries.Store(moved)
+	if err := corrupted.VerifyTables(); err == nil {
+		t.Error("Expected a route stored at the wrong path to be detected")
+	}
+}
+
 func TestChecksum(t *testing.T) {
 	mux := NewMux()
 	hash := sha1.New()
@@ -253,6 +503,20 @@ func BenchmarkLookup(b *testing.B) {
 	}
 }
 
+func BenchmarkRouteChecksum(b *testing.B) {
+	tm := benchSetup()
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tm.RouteChecksum()
+		}
+	})
+	b.Run("computed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tm.checksum.Sum(nil)
+		}
+	})
+}
+
 // Test behaviour when looking up nonexistent urls
 func BenchmarkLookupBogus(b *testing.B) {
 	b.StopTimer()
@@ -277,3 +541,594 @@ func BenchmarkLookupMalicious(b *testing.B) {
 		tm.lookup("/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/x/")
 	}
 }
+
+// Test behaviour looking up extant urls from many goroutines at once, as a
+// busy router does
+func BenchmarkLookupParallel(b *testing.B) {
+	b.StopTimer()
+	tm := benchSetup()
+	urls := loadStrings("testdata/urls")
+	b.StartTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		perm := rand.Perm(len(urls))
+		for i := 0; pb.Next(); i++ {
+			tm.lookup(urls[perm[i%len(urls)]])
+		}
+	})
+}
+
+// routeDescriptor stands in for the richer values an embedder might register.
+type routeDescriptor struct {
+	name    string
+	handler http.Handler
+}
+
+func TestHandlerForOption(t *testing.T) {
+	resolved := make([]string, 0)
+	mux := NewMuxWithOptions(MuxOptions{
+		HandlerFor: func(value interface{}) (http.Handler, bool) {
+			route, ok := value.(*routeDescriptor)
+			if !ok || route.handler == nil {
+				return nil, false
+			}
+			resolved = append(resolved, route.name)
+			return route.handler, true
+		},
+	})
+	mux.HandleValue("/foo", true, &routeDescriptor{"foo", a})
+	mux.HandleValue("/bar", false, &routeDescriptor{"bar", nil})
+	mux.Handle("/baz", false, b)
+
+	checks := []Check{
+		{"/foo", true, a},
+		{"/foo/bar", true, a},
+		{"/bar", false, nil}, // the adapter can't resolve a handler
+		{"/baz", false, nil}, // a plain handler isn't a routeDescriptor
+		{"/qux", false, nil},
+	}
+	for _, c := range checks {
+		handler, ok := mux.lookup(c.path)
+		if ok != c.ok || handler != c.handler {
+			t.Errorf("Expected lookup(%v) to be (%v, %v), was (%v, %v)", c.path, c.handler, c.ok, handler, ok)
+		}
+	}
+	if len(resolved) != 2 || resolved[0] != "foo" || resolved[1] != "foo" {
+		t.Errorf("Expected handlers to be resolved lazily on each lookup, got %v", resolved)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/bar", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected a route without a handler to 404, got %d", w.Code)
+	}
+}
+
+func TestDefaultHandlerForRejectsOtherValues(t *testing.T) {
+	mux := NewMux()
+	mux.HandleValue("/foo", false, "not a handler")
+	if _, ok := mux.lookup("/foo"); ok {
+		t.Error("Expected a value which isn't an http.Handler not to match")
+	}
+}
+
+var matchExamples = []struct {
+	path  string
+	match Match
+}{
+	{ // exact hit, normalizing the path
+		"//foo/bar/",
+		Match{"//foo/bar/", []string{"foo", "bar"}, "/foo/bar", "exact", &RouteInfo{"/foo/bar", false, b}},
+	},
+	{ // prefix hit
+		"/foo/baz",
+		Match{"/foo/baz", []string{"foo", "baz"}, "/foo/baz", "prefix", &RouteInfo{"/foo", true, a}},
+	},
+	{ // miss
+		"/qux",
+		Match{"/qux", []string{"qux"}, "/qux", "", nil},
+	},
+}
+
+func TestMatch(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/foo", true, a)
+	mux.Handle("/foo/bar", false, b)
+
+	for _, ex := range matchExamples {
+		match := mux.Match(ex.path)
+		if match.Path != ex.match.Path || match.NormalizedPath != ex.match.NormalizedPath || match.Trie != ex.match.Trie {
+			t.Errorf("Expected Match(%v) to be %+v, was %+v", ex.path, ex.match, match)
+		}
+		if fmt.Sprint(match.Segments) != fmt.Sprint(ex.match.Segments) {
+			t.Errorf("Expected Match(%v) segments to be %v, was %v", ex.path, ex.match.Segments, match.Segments)
+		}
+		if (match.Route == nil) != (ex.match.Route == nil) || (match.Route != nil && *match.Route != *ex.match.Route) {
+			t.Errorf("Expected Match(%v) route to be %v, was %v", ex.path, ex.match.Route, match.Route)
+		}
+	}
+}
+
+func TestNotFoundHandlerOption(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewMux().ServeHTTP(w, httptest.NewRequest("GET", "/foo", nil))
+	if w.Code != http.StatusNotFound || w.Body.String() != "404 page not found\n" {
+		t.Errorf("Expected the default not-found response, got %d %q", w.Code, w.Body.String())
+	}
+
+	mux := NewMuxWithOptions(MuxOptions{
+		NotFoundHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusGone)
+		}),
+	})
+	mux.Handle("/bar", false, a)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/foo", nil))
+	if w.Code != http.StatusGone {
+		t.Errorf("Expected the not-found handler to be used, got %d", w.Code)
+	}
+}
+
+func TestTrailingSlashIsIgnored(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/foo", false, a)
+	mux.Handle("/bar/", false, b)
+
+	examples := []Check{
+		{"/foo", true, a},
+		{"/foo/", true, a},
+		{"/bar", true, b},
+		{"/bar/", true, b},
+	}
+	for _, c := range examples {
+		if handler, ok := mux.lookup(c.path); ok != c.ok || handler != c.handler {
+			t.Errorf("Expected lookup(%v) to map to handler %v, was %v", c.path, c.handler, handler)
+		}
+	}
+
+	// Registering the other form replaces the route, rather than adding one.
+	mux.Handle("/foo/", false, c)
+	if exact, _ := mux.RouteCounts(); exact != 2 {
+		t.Errorf("Expected /foo and /foo/ to be the same route, got %d exact routes", exact)
+	}
+}
+
+func TestStrictTrailingSlash(t *testing.T) {
+	mux := NewMuxWithOptions(MuxOptions{StrictTrailingSlash: true})
+	mux.Handle("/foo", false, a)
+	mux.Handle("/foo/", false, b)
+	mux.Handle("/bar/", false, c)
+	mux.Handle("/", false, a)
+	mux.Handle("/prefix/", true, b)
+
+	examples := []Check{
+		{"/foo", true, a},
+		{"/foo/", true, b},
+		{"/foo//", true, b},
+		{"/bar", false, nil},
+		{"/bar/", true, c},
+		{"/", true, a},
+		{"/prefix", true, b},
+		{"/prefix/", true, b},
+		{"/prefix/baz", true, b},
+	}
+	for _, c := range examples {
+		if handler, ok := mux.lookup(c.path); ok != c.ok || handler != c.handler {
+			t.Errorf("Expected lookup(%v) to map to handler %v, was %v", c.path, c.handler, handler)
+		}
+	}
+	if exact, _ := mux.RouteCounts(); exact != 4 {
+		t.Errorf("Expected /foo and /foo/ to be different routes, got %d exact routes", exact)
+	}
+	if match := mux.Match("/foo/"); match.NormalizedPath != "/foo/" || match.Route == nil || match.Route.Path != "/foo/" {
+		t.Errorf("Expected /foo/ to match its own route, got %+v", match)
+	}
+	if !mux.ReplaceValue("/foo/", false, c) {
+		t.Error("Expected the /foo/ route to be replaceable")
+	}
+	if handler, _ := mux.Clone().lookup("/foo/"); handler != c {
+		t.Errorf("Expected a clone to keep the option, got %v", handler)
+	}
+	if err := mux.VerifyTables(); err != nil {
+		t.Errorf("Unexpected integrity error: %v", err)
+	}
+}
+
+func TestConcurrentLookupAndHandle(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/", true, a)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, ok := mux.lookup("/foo/bar"); !ok {
+					t.Error("Expected every lookup to match a route")
+					return
+				}
+				mux.Routes()
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		path := fmt.Sprintf("/route-%d", i)
+		mux.Handle(path, false, b)
+		if handler, ok := mux.lookup(path); !ok || handler != b {
+			t.Errorf("Expected %s to be found as soon as it was registered", path)
+		}
+		if i%50 == 0 {
+			mux.Clone().Handle("/clone-only", false, b)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if handler, _ := mux.lookup("/clone-only"); handler != a {
+		t.Error("Expected routes registered in a clone not to affect the original")
+	}
+}
+
+func TestPrefixPriorities(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/foo", true, a)
+	mux.Handle("/foo/bar", true, b)
+	mux.Handle("/foo/bar/exact", false, c)
+	unprioritized := mux.RouteChecksum()
+
+	if handler, _ := mux.lookup("/foo/bar/baz"); handler != b {
+		t.Errorf("Expected the longest prefix to win without priorities, got %v", handler)
+	}
+
+	mux = NewMux()
+	mux.HandlePrefixWithPriority("/foo", 10, a)
+	mux.Handle("/foo/bar", true, b)
+	mux.Handle("/foo/bar/exact", false, c)
+	mux.HandlePrefixWithPriority("/qux", 5, a)
+	mux.HandlePrefixWithPriority("/qux/quux", 5, b)
+	if bytes.Equal(mux.RouteChecksum(), unprioritized) {
+		t.Error("Expected priorities to change the route checksum")
+	}
+
+	examples := []struct {
+		path     string
+		expected http.Handler
+	}{
+		{"/foo/bar/baz", a},    // the broader prefix has the higher priority
+		{"/foo/bar", a},        // including for the narrower prefix's own path
+		{"/foo/bar/exact", c},  // exact routes still win
+		{"/qux/quux/corge", b}, // the longest wins a tie
+		{"/qux/other", a},
+	}
+	for _, ex := range examples {
+		if handler, _ := mux.lookup(ex.path); handler != ex.expected {
+			t.Errorf("Expected %s to be handled by %v, got %v", ex.path, ex.expected, handler)
+		}
+	}
+
+	shadowed := mux.ShadowedRoutes()
+	if len(shadowed) != 1 || shadowed[0].Path != "/foo/bar" {
+		t.Errorf("Expected the outranked /foo/bar route to be shadowed, got %v", shadowed)
+	}
+}
+
+func TestPrefixMinExtraSegments(t *testing.T) {
+	mux := NewMux()
+	mux.HandlePrefix("/", PrefixOptions{MinExtraSegments: 1}, a)
+	mux.HandlePrefix("/foo", PrefixOptions{MinExtraSegments: 1}, b)
+	mux.HandlePrefix("/qux", PrefixOptions{MinExtraSegments: 2}, c)
+
+	examples := []struct {
+		path     string
+		ok       bool
+		expected http.Handler
+	}{
+		{"/", false, nil},         // the root prefix doesn't serve its own path
+		{"/foo", true, a},         // so /foo's own path goes to the root route
+		{"/foo/", true, a},        // trailing slashes don't add a segment
+		{"/foo/bar", true, b},     // one extra segment is enough
+		{"/foo/bar/baz", true, b}, // as are more
+		{"/qux/quux", true, a},    // /qux needs two
+		{"/qux/quux/corge", true, c},
+	}
+	for _, ex := range examples {
+		if handler, ok := mux.lookup(ex.path); ok != ex.ok || handler != ex.expected {
+			t.Errorf("Expected %s to be handled by %v (%v), got %v (%v)", ex.path, ex.expected, ex.ok, handler, ok)
+		}
+	}
+
+	mux.Handle("/foo", false, c)
+	if handler, _ := mux.lookup("/foo"); handler != c {
+		t.Errorf("Expected an exact route to serve the bare prefix path, got %v", handler)
+	}
+
+	unguarded := NewMux()
+	unguarded.Handle("/foo", true, a)
+	guarded := NewMux()
+	guarded.HandlePrefix("/foo", PrefixOptions{MinExtraSegments: 1}, a)
+	if bytes.Equal(guarded.RouteChecksum(), unguarded.RouteChecksum()) {
+		t.Error("Expected a minimum number of extra segments to change the route checksum")
+	}
+}
+
+func TestReplace(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/foo", true, a)
+	mux.Handle("/foo", false, b)
+	mux.HandlePrefixWithPriority("/bar", 5, a)
+	mux.Handle("/bar/baz", true, b)
+	checksum := mux.RouteChecksum()
+
+	if !mux.Replace("/foo/", true, c) {
+		t.Error("Expected the /foo prefix route to be replaced")
+	}
+	if !mux.Replace("/bar", true, c) {
+		t.Error("Expected the /bar prefix route to be replaced")
+	}
+	checks := []Check{
+		{"/foo", true, b},
+		{"/foo/qux", true, c},
+		{"/bar/baz/qux", true, c}, // the replaced route keeps its priority
+	}
+	for _, ch := range checks {
+		if handler, ok := mux.lookup(ch.path); ok != ch.ok || handler != ch.handler {
+			t.Errorf("Expected lookup(%v) to be (%v, %v), was (%v, %v)", ch.path, ch.handler, ch.ok, handler, ok)
+		}
+	}
+	if mux.RouteCount() != 4 || !bytes.Equal(mux.RouteChecksum(), checksum) || len(mux.ShadowedRoutes()) != 1 {
+		t.Errorf("Expected replacing handlers to leave the route count, checksum and shadowed routes unchanged")
+	}
+
+	for _, missing := range []struct {
+		path   string
+		prefix bool
+	}{{"/qux", true}, {"/bar", false}, {"/foo/bar", true}, {"/", true}} {
+		if mux.Replace(missing.path, missing.prefix, c) {
+			t.Errorf("Expected no route to replace at %s (prefix: %v)", missing.path, missing.prefix)
+		}
+	}
+	if _, ok := mux.lookup("/qux"); ok {
+		t.Error("Expected a failed replacement not to register a route")
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/", true, a)
+	mux.Handle("/foo", true, b)
+	mux.Handle("/foo/bar", true, c)
+	mux.Handle("/foo/bar", false, a)
+	mux.Handle("/foo/bar/baz", true, b)
+	mux.HandlePrefix("/foo/bar", PrefixOptions{MinExtraSegments: 1}, b)
+
+	describe := func(candidates []RouteInfo) string {
+		descriptions := make([]string, 0)
+		for _, c := range candidates {
+			descriptions = append(descriptions, fmt.Sprintf("%s(%v)", c.Path, c.Prefix))
+		}
+		return strings.Join(descriptions, " ")
+	}
+	examples := []struct {
+		path, expected string
+	}{
+		{"/foo/bar", "/foo/bar(false) /foo(true) /(true)"},
+		{"/foo/bar/qux", "/foo/bar(true) /foo(true) /(true)"},
+		{"/foo/bar/baz", "/foo/bar/baz(true) /foo/bar(true) /foo(true) /(true)"},
+		{"/other", "/(true)"},
+	}
+	for _, ex := range examples {
+		candidates := mux.Candidates(ex.path)
+		if got := describe(candidates); got != ex.expected {
+			t.Errorf("Expected the candidates for %s to be %s, got %s", ex.path, ex.expected, got)
+		}
+		if match := mux.Match(ex.path); match.Route == nil || match.Route.Path != candidates[0].Path || match.Route.Prefix != candidates[0].Prefix {
+			t.Errorf("Expected the first candidate for %s to be the match, got %+v", ex.path, match.Route)
+		}
+	}
+
+	mux.HandlePrefixWithPriority("/foo", 1, a)
+	if got := describe(mux.Candidates("/foo/bar/baz/qux")); got != "/foo(true) /foo/bar/baz(true) /foo/bar(true) /(true)" {
+		t.Errorf("Expected higher-priority prefix routes to come first, got %s", got)
+	}
+	if got := mux.Candidates("/nothing"); len(got) != 1 {
+		t.Errorf("Expected only the root route to be a candidate, got %v", got)
+	}
+}
+
+func TestRoute(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/foo", false, a)
+	mux.Handle("/foo", true, b)
+	mux.Handle("/bar", true, c)
+
+	examples := []struct {
+		path    string
+		prefix  bool
+		ok      bool
+		handler http.Handler
+	}{
+		{"/foo", false, true, a},
+		{"/foo/", false, true, a},
+		{"/foo", true, true, b},
+		{"/bar", true, true, c},
+		{"/bar", false, false, nil},
+		{"/bar/baz", true, false, nil},
+	}
+	for _, ex := range examples {
+		route, ok := mux.Route(ex.path, ex.prefix)
+		if ok != ex.ok || (ok && (route.Value != ex.handler || route.Prefix != ex.prefix)) {
+			t.Errorf("Expected Route(%v, %v) to be %v, got %+v (%v)", ex.path, ex.prefix, ex.handler, route, ok)
+		}
+	}
+}
+
+func TestCloneIsIndependent(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/foo", true, a)
+	mux.Handle("/bar", false, b)
+
+	clone := mux.Clone()
+	if fmt.Sprintf("%x", clone.RouteChecksum()) != fmt.Sprintf("%x", mux.RouteChecksum()) || clone.RouteCount() != 2 {
+		t.Errorf("Expected the clone to have the same stats as the original")
+	}
+	if handler, _ := clone.lookup("/foo/bar"); handler != a {
+		t.Errorf("Expected the clone to share the original's handlers, got %v", handler)
+	}
+
+	clone.Handle("/foo/bar", false, c)
+	clone.Handle("/bar", false, c)
+
+	checks := []Check{
+		{"/foo/bar", true, a},
+		{"/bar", true, b},
+	}
+	for _, ch := range checks {
+		if handler, ok := mux.lookup(ch.path); ok != ch.ok || handler != ch.handler {
+			t.Errorf("Expected lookup(%v) on the original to be (%v, %v), was (%v, %v)", ch.path, ch.handler, ch.ok, handler, ok)
+		}
+		if handler, _ := clone.lookup(ch.path); handler != c {
+			t.Errorf("Expected lookup(%v) on the clone to be %v, was %v", ch.path, c, handler)
+		}
+	}
+	if mux.RouteCount() != 2 || clone.RouteCount() != 4 {
+		t.Errorf("Expected route counts of 2 and 4, got %d and %d", mux.RouteCount(), clone.RouteCount())
+	}
+	if fmt.Sprintf("%x", clone.RouteChecksum()) == fmt.Sprintf("%x", mux.RouteChecksum()) {
+		t.Error("Expected the clone's checksum to change independently of the original's")
+	}
+	if len(mux.ShadowedRoutes()) != 0 || len(clone.ShadowedRoutes()) != 1 {
+		t.Errorf("Expected only the clone to have a shadowed route, got %v and %v", mux.ShadowedRoutes(), clone.ShadowedRoutes())
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/foo", true, a)
+	mux.Handle("/bar", false, a)
+	mux.Handle("/foo", false, b)
+	mux.Handle("/bar", false, c)
+
+	expected := []RouteInfo{{"/bar", false, c}, {"/foo", false, b}, {"/foo", true, a}}
+	routes := mux.Routes()
+	if len(routes) != len(expected) {
+		t.Fatalf("Expected routes %v, got %v", expected, routes)
+	}
+	for i := range expected {
+		if routes[i] != expected[i] {
+			t.Errorf("Expected route %d to be %v, got %v", i, expected[i], routes[i])
+		}
+	}
+}
+
+func TestPrefixCoverage(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/", true, a)
+	mux.Handle("/foo", true, b)
+	mux.Handle("/bar", true, c)
+	mux.Handle("/", false, a)
+	mux.Handle("/foo", false, a)
+	mux.Handle("/foo/bar", false, a)
+	mux.Handle("/foo/bar/baz", false, a)
+	mux.Handle("/qux", false, a)
+
+	coverage := mux.PrefixCoverage()
+	expected := []struct {
+		path       string
+		exactPaths string
+	}{
+		{"/", "[/foo /foo/bar /foo/bar/baz /qux]"},
+		{"/foo", "[/foo/bar /foo/bar/baz]"},
+	}
+	if len(coverage) != len(expected) {
+		t.Fatalf("Expected coverage for %d prefix routes, got %v", len(expected), coverage)
+	}
+	for i, ex := range expected {
+		if coverage[i].Route.Path != ex.path || fmt.Sprint(coverage[i].ExactPaths) != ex.exactPaths {
+			t.Errorf("Expected %s to cover %s, got %s covering %v", ex.path, ex.exactPaths, coverage[i].Route.Path, coverage[i].ExactPaths)
+		}
+	}
+}
+
+// adversarialPaths are awkward inputs for path parsing and lookup, added to
+// the fuzz corpora alongside splitExamples.
+var adversarialPaths = []string{
+	"/foo\x00bar",
+	"\x00",
+	"/%2F/%2e%2e/",
+	"/../..//./",
+	"/\xff\xfe/\xc3",
+	"/ü/𝄞/‮",
+	strings.Repeat("/a", 1000),
+	strings.Repeat("/", 1000),
+	"?query=/with/slashes#/fragment",
+}
+
+func FuzzSplitpath(f *testing.F) {
+	for _, ex := range splitExamples {
+		f.Add(ex.in)
+	}
+	for _, path := range adversarialPaths {
+		f.Add(path)
+	}
+
+	f.Fuzz(func(t *testing.T, path string) {
+		parts := splitpath(path)
+		for _, part := range parts {
+			if part == "" || strings.Contains(part, "/") {
+				t.Fatalf("splitpath(%q) returned an invalid segment %q in %q", path, part, parts)
+			}
+		}
+
+		// Joining the segments back up gives a normalized path, which must
+		// split into the same segments again.
+		normalized := "/" + strings.Join(parts, "/")
+		if again := splitpath(normalized); strings.Join(again, "/") != strings.Join(parts, "/") || len(again) != len(parts) {
+			t.Fatalf("splitpath(%q) gave %q, but its normalized form %q gave %q", path, parts, normalized, again)
+		}
+	})
+}
+
+func FuzzLookup(f *testing.F) {
+	for _, ex := range splitExamples {
+		f.Add(ex.in, false, ex.in)
+		f.Add(ex.in, true, ex.in+"/child")
+	}
+	for _, path := range adversarialPaths {
+		f.Add(path, false, path+"/")
+		f.Add("/foo", true, path)
+	}
+
+	f.Fuzz(func(t *testing.T, registered string, prefix bool, requested string) {
+		mux := NewMux()
+		mux.Handle(registered, prefix, a)
+
+		// Any path may be looked up without panicking, and Match agrees
+		// with lookup about whether it was found.
+		_, found := mux.lookup(requested)
+		if match := mux.Match(requested); (match.Route != nil) != found {
+			t.Fatalf("lookup(%q) found=%v, but Match gave %+v", requested, found, match)
+		}
+
+		// The registered path always finds its own route, as do paths
+		// which normalize to it.
+		for _, path := range []string{registered, "/" + strings.Join(splitpath(registered), "/") + "/"} {
+			if handler, ok := mux.lookup(path); !ok || handler != a {
+				t.Fatalf("Registered %q (prefix: %v), but lookup(%q) gave %v, %v", registered, prefix, path, handler, ok)
+			}
+		}
+		if prefix {
+			child := registered + "/" + requested
+			if handler, ok := mux.lookup(child); !ok || handler != a {
+				t.Fatalf("Registered prefix %q, but lookup(%q) gave %v, %v", registered, child, handler, ok)
+			}
+		}
+	})
+}